@@ -0,0 +1,100 @@
+package crawler
+
+import (
+	"hash/fnv"
+	"math"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BloomVisitedStore is an approximate VisitedStore using a Bloom filter,
+// whose memory usage is bounded regardless of the number of pages. Pages
+// are never crawled twice but, with the configured false positive rate,
+// a page may be wrongly reported as visited and so not crawled. The rate
+// is only met up to the expected number of URLs and grows beyond it.
+type BloomVisitedStore struct {
+	bits     []uint64
+	m        uint64 // number of bits
+	k        uint64 // number of hash functions
+	expected int
+	added    int    // keys added, including false positives
+	set      uint64 // bits set
+}
+
+// NewBloomVisitedStore returns a Bloom filter sized for the expected
+// number of URLs with the given false positive rate, e.g. 0.001.
+func NewBloomVisitedStore(expected int, fpRate float64) (*BloomVisitedStore, error) {
+	if expected < 1 {
+		return nil, ErrInvalidExpectedURLs
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		return nil, ErrInvalidFPRate
+	}
+	// optimal size and number of hash functions for n keys and rate p:
+	// m = -n ln(p) / ln(2)^2 and k = m/n ln(2)
+	n := float64(expected)
+	m := uint64(math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/n*math.Ln2)))
+	return &BloomVisitedStore{
+		bits:     make([]uint64, (m+63)/64),
+		m:        m,
+		k:        k,
+		expected: expected,
+	}, nil
+}
+
+// positions returns the k bit positions of the key, derived from two
+// hashes (Kirsch-Mitzenmacher).
+func (b *BloomVisitedStore) positions(key string) []uint64 {
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	var h1, h2 uint64
+	for i := 0; i < 8; i++ {
+		h1 = h1<<8 | uint64(sum[i])
+		h2 = h2<<8 | uint64(sum[8+i])
+	}
+	positions := make([]uint64, b.k)
+	for i := uint64(0); i < b.k; i++ {
+		positions[i] = (h1 + i*h2) % b.m
+	}
+	return positions
+}
+
+// Seen reports whether the key was added, or a false positive.
+func (b *BloomVisitedStore) Seen(key string) bool {
+	for _, p := range b.positions(key) {
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Add adds the key to the filter. A warning is logged once the expected
+// number of URLs is exceeded.
+func (b *BloomVisitedStore) Add(key string) error {
+	for _, p := range b.positions(key) {
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			b.bits[p/64] |= 1 << (p % 64)
+			b.set++
+		}
+	}
+	b.added++
+	if b.added == b.expected+1 {
+		log.Warnf("Visited set holds more than the %d expected URLs: pages are increasingly likely to be wrongly skipped", b.expected)
+	}
+	return nil
+}
+
+// FillRatio returns the fraction of the filter bits set. The false
+// positive rate is about FillRatio^k, k being the number of hash
+// functions, and it's about 0.5 at the design capacity.
+func (b *BloomVisitedStore) FillRatio() float64 {
+	return float64(b.set) / float64(b.m)
+}
+
+// Close is a no-op.
+func (b *BloomVisitedStore) Close() error {
+	return nil
+}
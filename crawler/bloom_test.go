@@ -0,0 +1,53 @@
+package crawler
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBloomVisitedStore(t *testing.T) {
+	_, err := NewBloomVisitedStore(0, 0.01)
+	assert.Equal(t, ErrInvalidExpectedURLs, err)
+	_, err = NewBloomVisitedStore(100, 0)
+	assert.Equal(t, ErrInvalidFPRate, err)
+	_, err = NewBloomVisitedStore(100, 1)
+	assert.Equal(t, ErrInvalidFPRate, err)
+
+	b, err := NewBloomVisitedStore(1000, 0.01)
+	assert.NoError(t, err)
+	// about 9.6 bits and 7 hash functions per key for a 1% rate
+	assert.Equal(t, uint64(9586), b.m)
+	assert.Equal(t, uint64(7), b.k)
+}
+
+func TestBloomVisitedStore(t *testing.T) {
+	const expected = 10000
+	const fpRate = 0.01
+	b, err := NewBloomVisitedStore(expected, fpRate)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, b.FillRatio())
+
+	for i := 0; i < expected; i++ {
+		assert.NoError(t, b.Add(fmt.Sprintf("example.com/page/%d", i)))
+	}
+	// no false negatives
+	for i := 0; i < expected; i++ {
+		if !b.Seen(fmt.Sprintf("example.com/page/%d", i)) {
+			t.Fatalf("example.com/page/%d not seen", i)
+		}
+	}
+	// about half the bits are set at the design capacity
+	assert.InDelta(t, 0.5, b.FillRatio(), 0.05)
+
+	falsePositives := 0
+	const tries = 100000
+	for i := 0; i < tries; i++ {
+		if b.Seen(fmt.Sprintf("example.com/other/%d", i)) {
+			falsePositives++
+		}
+	}
+	rate := float64(falsePositives) / tries
+	assert.True(t, rate > fpRate/2 && rate < fpRate*2, "false positive rate %v", rate)
+}
@@ -0,0 +1,163 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MaxBrokenLinkSources is the max number of sources stored per broken URL.
+const MaxBrokenLinkSources = 100
+
+// BrokenLink is a URL that could not be fetched, with a 4xx or 5xx status
+// or a network error, and the pages linking to it.
+type BrokenLink struct {
+	URL      string
+	Status   int      // status code of the response. Zero if none was received.
+	Error    string   // why the fetch failed, e.g. "404 Not Found"
+	External bool     // the URL is external, only checked with CheckExternal
+	Sources  []string // pages linking to the URL or sitemaps listing it, sorted, up to MaxBrokenLinkSources
+}
+
+// brokenLinks holds the failed fetches and the sources of every link, since
+// a URL can fail before or after the pages linking to it are written.
+type brokenLinks struct {
+	mu       sync.Mutex
+	failures map[string]*BrokenLink // by URL
+	sources  map[string][]string    // by URL linked
+}
+
+func newBrokenLinks() *brokenLinks {
+	return &brokenLinks{failures: make(map[string]*BrokenLink), sources: make(map[string][]string)}
+}
+
+// addFailure records the site that failed. A nil *brokenLinks records
+// nothing.
+func (b *brokenLinks) addFailure(s webSite, err error) {
+	b.add(s, err, false)
+}
+
+// addExternalFailure records the external site whose check failed (see
+// CheckExternal).
+func (b *brokenLinks) addExternalFailure(s webSite, err error) {
+	b.add(s, err, true)
+}
+
+func (b *brokenLinks) add(s webSite, err error, external bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	failure := &BrokenLink{URL: s.URL.String(), Error: err.Error(), External: external}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		failure.Status = statusErr.code
+	}
+	b.failures[failure.URL] = failure
+	if s.sitemap != nil {
+		b.addSource(failure.URL, s.sitemap.String())
+	}
+}
+
+// addLinks records the page of the result as the source of its links.
+func (b *brokenLinks) addLinks(r PageResult) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	source := r.URL
+	for _, s := range r.children {
+		b.addSource(s.URL.String(), source)
+	}
+}
+
+func (b *brokenLinks) addSource(u, source string) {
+	if len(b.sources[u]) < MaxBrokenLinkSources {
+		b.sources[u] = append(b.sources[u], source)
+	}
+}
+
+// counts returns the number of internal and external URLs that failed and
+// are linked from a page or sitemap. A nil *brokenLinks counts nothing.
+func (b *brokenLinks) counts() (internal, external int) {
+	if b == nil {
+		return 0, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for u, failure := range b.failures {
+		switch {
+		case len(b.sources[u]) == 0:
+			// e.g. the seeds
+		case failure.External:
+			external++
+		default:
+			internal++
+		}
+	}
+	return internal, external
+}
+
+// BrokenLinks returns the URLs that could not be fetched, sorted by URL,
+// with the pages linking to them. They are only recorded if
+// RecordBrokenLinks is set.
+func (c *Crawler) BrokenLinks() []BrokenLink {
+	b := c.brokenLinks
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	broken := make([]BrokenLink, 0, len(b.failures))
+	for u, failure := range b.failures {
+		link := *failure
+		link.Sources = append([]string(nil), b.sources[u]...)
+		sort.Strings(link.Sources)
+		broken = append(broken, link)
+	}
+	sort.Slice(broken, func(i, j int) bool {
+		return broken[i].URL < broken[j].URL
+	})
+	return broken
+}
+
+// WriteBrokenLinksReport writes the broken links (see BrokenLinks) as tab
+// separated lines of two kinds:
+//   - "broken" lines for the pages that could not be fetched, or
+//     "broken-external" ones for the external URLs (see CheckExternal): URL,
+//     status code, error and the comma separated sources linking to it
+//   - "links-to-broken" lines for the pages linking to them, sorted: URL and
+//     the comma separated broken URLs it links to
+func (c *Crawler) WriteBrokenLinksReport(w io.Writer) error {
+	broken := c.BrokenLinks()
+	targets := map[string][]string{} // by source
+	for _, link := range broken {
+		kind := "broken"
+		if link.External {
+			kind = "broken-external"
+		}
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", kind, link.URL, formatStatus(link.Status), link.Error, strings.Join(link.Sources, ","))
+		if err != nil {
+			return err
+		}
+		for _, source := range link.Sources {
+			targets[source] = append(targets[source], link.URL)
+		}
+	}
+	sources := make([]string, 0, len(targets))
+	for source := range targets {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		if _, err := fmt.Fprintf(w, "links-to-broken\t%s\t%s\n", source, strings.Join(targets[source], ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
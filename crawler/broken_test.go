@@ -0,0 +1,232 @@
+package crawler_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scanterog/crawler/crawler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunRecordBrokenLinks(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	c := crawler.Crawler{
+		SeedURL:           serverURL,
+		IgnoreRobots:      true,
+		NumWorkers:        crawler.DefaultNumWorkers,
+		SiteMapWriter:     &bytes.Buffer{},
+		RecordBrokenLinks: true,
+	}
+	assert.NoError(t, c.Run())
+	assert.Equal(t, []crawler.BrokenLink{{
+		URL:     serverURL + "/help",
+		Status:  http.StatusNotFound,
+		Error:   "404 Not Found",
+		Sources: []string{serverURL, serverURL + "/about", serverURL + "/careers"},
+	}}, c.BrokenLinks())
+	stats := c.Stats()
+	assert.Equal(t, 1, stats.BrokenInternal)
+	assert.Zero(t, stats.BrokenExternal)
+	assert.Zero(t, stats.SeedsFailed)
+
+	report := &bytes.Buffer{}
+	assert.NoError(t, c.WriteBrokenLinksReport(report))
+	assert.Equal(t, fmt.Sprintf(`broken	%[1]s/help	404	404 Not Found	%[1]s,%[1]s/about,%[1]s/careers
+links-to-broken	%[1]s	%[1]s/help
+links-to-broken	%[1]s/about	%[1]s/help
+links-to-broken	%[1]s/careers	%[1]s/help
+`, serverURL), report.String())
+}
+
+func TestRunRecordBrokenLinksNetworkError(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reset" {
+			// the connection is closed without a response
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		fmt.Fprint(w, `<a href="/reset">reset</a>`)
+	}))
+	defer httpTestServer.Close()
+
+	c := crawler.Crawler{
+		SeedURL:           httpTestServer.URL,
+		IgnoreRobots:      true,
+		NumWorkers:        crawler.DefaultNumWorkers,
+		SiteMapWriter:     &bytes.Buffer{},
+		RecordBrokenLinks: true,
+	}
+	assert.NoError(t, c.Run())
+	broken := c.BrokenLinks()
+	if assert.Len(t, broken, 1) {
+		assert.Equal(t, httpTestServer.URL+"/reset", broken[0].URL)
+		assert.Zero(t, broken[0].Status)
+		assert.Contains(t, broken[0].Error, "EOF")
+		assert.Equal(t, []string{httpTestServer.URL}, broken[0].Sources)
+	}
+}
+
+func TestRunCheckExternal(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	externalServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/no-head":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		}
+	}))
+	defer externalServer.Close()
+	externalURL := externalServer.URL
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<a href="%[1]s/ok">ok</a><a href="%[1]s/missing">missing</a><a href="%[1]s/no-head">no head</a><a href="/other">other</a>`, externalURL)
+	}))
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	c := crawler.Crawler{
+		SeedURL:           serverURL,
+		IgnoreRobots:      true,
+		NumWorkers:        crawler.DefaultNumWorkers,
+		SiteMapWriter:     &bytes.Buffer{},
+		RecordBrokenLinks: true,
+		CheckExternal:     true,
+		ExternalDelay:     time.Millisecond,
+	}
+	assert.NoError(t, c.Run())
+	assert.Equal(t, []crawler.BrokenLink{{
+		URL:      externalURL + "/missing",
+		Status:   http.StatusNotFound,
+		Error:    "404 Not Found",
+		External: true,
+		Sources:  []string{serverURL, serverURL + "/other"},
+	}}, c.BrokenLinks())
+	stats := c.Stats()
+	assert.Zero(t, stats.BrokenInternal)
+	assert.Equal(t, 1, stats.BrokenExternal)
+	// each URL is checked once, however many pages link to it
+	assert.Equal(t, map[string]int{
+		"HEAD /ok":      1,
+		"HEAD /missing": 1,
+		"GET /missing":  1,
+		"HEAD /no-head": 1,
+		"GET /no-head":  1,
+	}, requests)
+
+	report := &bytes.Buffer{}
+	assert.NoError(t, c.WriteBrokenLinksReport(report))
+	assert.Contains(t, report.String(), fmt.Sprintf("broken-external\t%s/missing\t404\t404 Not Found\t%s,%s/other\n", externalURL, serverURL, serverURL))
+}
+
+func TestRunCheckExternalSlowHost(t *testing.T) {
+	var mu sync.Mutex
+	var slowChecks int
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		slowChecks++
+		mu.Unlock()
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer slowServer.Close()
+	var otherChecked time.Time
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		otherChecked = time.Now()
+		mu.Unlock()
+	}))
+	defer otherServer.Close()
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 8; i++ {
+			fmt.Fprintf(w, `<a href="%s/%d">slow</a>`, slowServer.URL, i)
+		}
+		fmt.Fprintf(w, `<a href="%s/">other</a>`, otherServer.URL)
+	}))
+	defer httpTestServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := crawler.Crawler{
+		SeedURL:         httpTestServer.URL,
+		IgnoreRobots:    true,
+		NumWorkers:      crawler.DefaultNumWorkers,
+		SiteMapWriter:   &bytes.Buffer{},
+		CheckExternal:   true,
+		ExternalWorkers: 2,
+		ExternalDelay:   time.Millisecond,
+	}
+	start := time.Now()
+	go func() {
+		// the slow host is checked once at a time, so its checks would
+		// take 2.4s: the crawl is cancelled once the other host is checked
+		time.Sleep(time.Second)
+		cancel()
+	}()
+	c.RunContext(ctx)
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.False(t, otherChecked.IsZero()) {
+		// checked by the second worker while the first waits for the slow host
+		assert.True(t, otherChecked.Sub(start) < 250*time.Millisecond, otherChecked.Sub(start))
+	}
+	// only one check at a time on the slow host
+	assert.True(t, slowChecks <= 4, slowChecks)
+}
+
+func TestRunSeedsFailed(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" || r.URL.Path == "/gone" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `<a href="/missing">missing</a>`)
+	}))
+	defer httpTestServer.Close()
+
+	t.Run("Some seeds", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURLs:          []string{httpTestServer.URL, httpTestServer.URL + "/gone"},
+			IgnoreRobots:      true,
+			NumWorkers:        crawler.DefaultNumWorkers,
+			SiteMapWriter:     &bytes.Buffer{},
+			RecordBrokenLinks: true,
+		}
+		assert.NoError(t, c.Run())
+		stats := c.Stats()
+		assert.Equal(t, 1, stats.SeedsFailed)
+		assert.Equal(t, 2, stats.PagesFailed)
+		// the seed failed is linked from no page
+		assert.Equal(t, 1, stats.BrokenInternal)
+		assert.Contains(t, stats.String(), "seeds failed: 1\nbroken internal links: 1\n")
+	})
+
+	t.Run("Every seed", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:           httpTestServer.URL + "/missing",
+			IgnoreRobots:      true,
+			NumWorkers:        crawler.DefaultNumWorkers,
+			SiteMapWriter:     &bytes.Buffer{},
+			RecordBrokenLinks: true,
+		}
+		assert.True(t, errors.Is(c.Run(), crawler.ErrSeedFetchFailed))
+		stats := c.Stats()
+		assert.Equal(t, 1, stats.SeedsFailed)
+		assert.Zero(t, stats.BrokenInternal)
+	})
+}
@@ -0,0 +1,193 @@
+package crawler
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// PatternBudget limits the number of crawled URLs matching a pattern.
+// This is useful to bound effectively infinite URL spaces like calendars
+// (/events?month=2031-05) or faceted navigation (?page=9999).
+type PatternBudget struct {
+	Pattern string `json:"pattern"` // regular expression matched against the full URL
+	Max     int    `json:"max"`     // max number of matching pages fetched successfully
+}
+
+type patternBudget struct {
+	PatternBudget
+	re   *regexp.Regexp
+	used int
+}
+
+func compilePatternBudgets(budgets []PatternBudget) ([]*patternBudget, error) {
+	compiled := make([]*patternBudget, 0, len(budgets))
+	for _, b := range budgets {
+		re, err := regexp.Compile(b.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern budget %q: %s", b.Pattern, err.Error())
+		}
+		if b.Max < 0 {
+			return nil, fmt.Errorf("invalid pattern budget %q: max must be at least 0", b.Pattern)
+		}
+		compiled = append(compiled, &patternBudget{PatternBudget: b, re: re})
+	}
+	return compiled, nil
+}
+
+// spendPatternBudget charges the given URL against every matching budget
+// when it's admitted. It returns the pattern of the first exhausted
+// budget, if any, in which case nothing is charged.
+func (c *Crawler) spendPatternBudget(u string) (string, bool) {
+	c.patternBudgetsMu.Lock()
+	defer c.patternBudgetsMu.Unlock()
+	var matched []*patternBudget
+	for _, b := range c.patternBudgets {
+		if !b.re.MatchString(u) {
+			continue
+		}
+		if b.used >= b.Max {
+			return b.Pattern, true
+		}
+		matched = append(matched, b)
+	}
+	for _, b := range matched {
+		b.used++
+	}
+	return "", false
+}
+
+// refundPatternBudget gives back the URL charged by spendPatternBudget to
+// every matching budget, when its fetch failed or didn't happen, so only
+// the pages fetched successfully count.
+func (c *Crawler) refundPatternBudget(u *url.URL) {
+	if len(c.patternBudgets) == 0 {
+		return
+	}
+	c.patternBudgetsMu.Lock()
+	defer c.patternBudgetsMu.Unlock()
+	s := u.String()
+	for _, b := range c.patternBudgets {
+		if b.re.MatchString(s) {
+			b.used--
+		}
+	}
+}
+
+// DirBudgetUsage holds the pages fetched under a DirBudgets path prefix.
+type DirBudgetUsage struct {
+	Max     int // max number of pages fetched under the prefix
+	Fetched int // pages fetched successfully or being fetched
+	Skipped int // URLs under the prefix skipped once the budget was exhausted
+}
+
+// dirBudgets enforces DirBudgets. Pages are charged to the longest prefix
+// matching their path, if any, when they are fetched, so URLs skipped for
+// other reasons or already visited don't count. Every method is safe for
+// concurrent use and a nil *dirBudgets allows every URL.
+type dirBudgets struct {
+	mu       sync.Mutex
+	prefixes []string // longest first
+	usage    map[string]*DirBudgetUsage
+}
+
+func newDirBudgets(budgets map[string]int) (*dirBudgets, error) {
+	if len(budgets) == 0 {
+		return nil, nil
+	}
+	d := &dirBudgets{usage: make(map[string]*DirBudgetUsage, len(budgets))}
+	for prefix, max := range budgets {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid dir budget %q: prefix must start with /", prefix)
+		}
+		if max < 0 {
+			return nil, fmt.Errorf("invalid dir budget %q: max must be at least 0", prefix)
+		}
+		d.prefixes = append(d.prefixes, prefix)
+		d.usage[prefix] = &DirBudgetUsage{Max: max}
+	}
+	sort.Slice(d.prefixes, func(i, j int) bool {
+		return len(d.prefixes[i]) > len(d.prefixes[j])
+	})
+	return d, nil
+}
+
+// budget returns the usage of the longest prefix matching the URL path.
+// d.mu must be held.
+func (d *dirBudgets) budget(u *url.URL) *DirBudgetUsage {
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	for _, prefix := range d.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return d.usage[prefix]
+		}
+	}
+	return nil
+}
+
+// exhausted reports whether the budget of the URL is used up, in which
+// case the skipped URL is counted.
+func (d *dirBudgets) exhausted(u *url.URL) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b := d.budget(u)
+	if b == nil || b.Fetched < b.Max {
+		return false
+	}
+	b.Skipped++
+	return true
+}
+
+// reserve charges the URL against its budget before fetching it. It
+// returns false, counting the skipped URL, if the budget is used up.
+func (d *dirBudgets) reserve(u *url.URL) bool {
+	if d == nil {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b := d.budget(u)
+	if b == nil {
+		return true
+	}
+	if b.Fetched >= b.Max {
+		b.Skipped++
+		return false
+	}
+	b.Fetched++
+	return true
+}
+
+// release gives back the page reserved for a failed fetch.
+func (d *dirBudgets) release(u *url.URL) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if b := d.budget(u); b != nil {
+		b.Fetched--
+	}
+}
+
+// snapshot returns a copy of the usage of every budget.
+func (d *dirBudgets) snapshot() map[string]DirBudgetUsage {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	usage := make(map[string]DirBudgetUsage, len(d.usage))
+	for prefix, b := range d.usage {
+		usage[prefix] = *b
+	}
+	return usage
+}
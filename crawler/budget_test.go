@@ -0,0 +1,93 @@
+package crawler
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompilePatternBudgets(t *testing.T) {
+	t.Run("Valid budgets", func(t *testing.T) {
+		budgets, err := compilePatternBudgets([]PatternBudget{{Pattern: `\?page=\d+`, Max: 50}})
+		assert.NoError(t, err)
+		assert.Len(t, budgets, 1)
+	})
+	t.Run("Invalid pattern", func(t *testing.T) {
+		_, err := compilePatternBudgets([]PatternBudget{{Pattern: `(`, Max: 50}})
+		assert.Error(t, err)
+	})
+	t.Run("Invalid max", func(t *testing.T) {
+		_, err := compilePatternBudgets([]PatternBudget{{Pattern: `page`, Max: -1}})
+		assert.Error(t, err)
+	})
+}
+
+func TestSpendPatternBudget(t *testing.T) {
+	budgets, _ := compilePatternBudgets([]PatternBudget{
+		{Pattern: `\?page=\d+`, Max: 2},
+		{Pattern: `/events`, Max: 1},
+	})
+	c := Crawler{patternBudgets: budgets}
+
+	_, exhausted := c.spendPatternBudget("https://example.com/about")
+	assert.False(t, exhausted)
+	_, exhausted = c.spendPatternBudget("https://example.com/list?page=1")
+	assert.False(t, exhausted)
+	_, exhausted = c.spendPatternBudget("https://example.com/events?page=2")
+	assert.False(t, exhausted)
+	pattern, exhausted := c.spendPatternBudget("https://example.com/list?page=3")
+	assert.True(t, exhausted)
+	assert.Equal(t, `\?page=\d+`, pattern)
+	pattern, exhausted = c.spendPatternBudget("https://example.com/events")
+	assert.True(t, exhausted)
+	assert.Equal(t, `/events`, pattern)
+
+	c.refundPatternBudget(&url.URL{Scheme: "https", Host: "example.com", Path: "/events", RawQuery: "page=2"})
+	_, exhausted = c.spendPatternBudget("https://example.com/events")
+	assert.False(t, exhausted)
+	_, exhausted = c.spendPatternBudget("https://example.com/list?page=3")
+	assert.False(t, exhausted)
+}
+
+func TestNewDirBudgets(t *testing.T) {
+	d, err := newDirBudgets(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+	_, err = newDirBudgets(map[string]int{"forum/": 10})
+	assert.Error(t, err)
+	_, err = newDirBudgets(map[string]int{"/forum/": -1})
+	assert.Error(t, err)
+}
+
+func TestDirBudgets(t *testing.T) {
+	d, err := newDirBudgets(map[string]int{"/forum/": 2, "/forum/archive/": 1, "/blog/": 0})
+	assert.NoError(t, err)
+	mustParse := func(s string) *url.URL {
+		u, _ := url.Parse(s)
+		return u
+	}
+
+	assert.True(t, d.reserve(mustParse("https://example.com/about")))
+	assert.True(t, d.reserve(mustParse("https://example.com/forum/1")))
+	// charged to the longest matching prefix only
+	assert.True(t, d.reserve(mustParse("https://example.com/forum/archive/1")))
+	assert.True(t, d.exhausted(mustParse("https://example.com/forum/archive/2")))
+	assert.False(t, d.exhausted(mustParse("https://example.com/forum/2")))
+	assert.True(t, d.reserve(mustParse("https://example.com/forum/2")))
+	assert.False(t, d.reserve(mustParse("https://example.com/forum/3")))
+	d.release(mustParse("https://example.com/forum/2"))
+	assert.True(t, d.reserve(mustParse("https://example.com/forum/3")))
+	assert.False(t, d.reserve(mustParse("https://example.com/blog/1")))
+
+	assert.Equal(t, map[string]DirBudgetUsage{
+		"/forum/":         {Max: 2, Fetched: 2, Skipped: 1},
+		"/forum/archive/": {Max: 1, Fetched: 1, Skipped: 1},
+		"/blog/":          {Max: 0, Fetched: 0, Skipped: 1},
+	}, d.snapshot())
+
+	var nilBudgets *dirBudgets
+	assert.True(t, nilBudgets.reserve(mustParse("https://example.com/forum/1")))
+	assert.False(t, nilBudgets.exhausted(mustParse("https://example.com/forum/1")))
+	assert.Nil(t, nilBudgets.snapshot())
+}
@@ -0,0 +1,50 @@
+package crawler
+
+import (
+	"context"
+	"sync"
+)
+
+// hostSemaphores limits the number of concurrent requests to each host.
+type hostSemaphores struct {
+	mu    sync.Mutex
+	max   int // zero means no limit
+	slots map[string]chan struct{}
+}
+
+func newHostSemaphores(max int) *hostSemaphores {
+	return &hostSemaphores{max: max, slots: make(map[string]chan struct{})}
+}
+
+// acquire blocks until a request to host can be made. It returns the ctx
+// error if ctx is done first. Every successful acquire must be followed
+// by a release.
+func (h *hostSemaphores) acquire(ctx context.Context, host string) error {
+	if h.max == 0 {
+		return nil
+	}
+	select {
+	case h.hostSlots(host) <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *hostSemaphores) release(host string) {
+	if h.max == 0 {
+		return
+	}
+	<-h.hostSlots(host)
+}
+
+func (h *hostSemaphores) hostSlots(host string) chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	slots, ok := h.slots[host]
+	if !ok {
+		slots = make(chan struct{}, h.max)
+		h.slots[host] = slots
+	}
+	return slots
+}
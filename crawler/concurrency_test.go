@@ -0,0 +1,32 @@
+package crawler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostSemaphores(t *testing.T) {
+	t.Run("Limited per host", func(t *testing.T) {
+		h := newHostSemaphores(2)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.NoError(t, h.acquire(ctx, "a.example.com"))
+		assert.NoError(t, h.acquire(ctx, "a.example.com"))
+		assert.NoError(t, h.acquire(ctx, "b.example.com"))
+		// a third request to the same host waits
+		assert.Equal(t, context.DeadlineExceeded, h.acquire(ctx, "a.example.com"))
+		h.release("a.example.com")
+		assert.NoError(t, h.acquire(context.Background(), "a.example.com"))
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		h := newHostSemaphores(0)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, h.acquire(context.Background(), "example.com"))
+		}
+		h.release("example.com")
+	})
+}
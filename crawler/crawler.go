@@ -4,257 +4,1850 @@
 package crawler
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 const (
 	DefaultNumWorkers           = 5
 	DefaultHTTPClientTimeoutSec = 2
 	DefaultCrawlerUserAgent     = "CrawlerBot/0.1"
+	DefaultMaxURLLength         = 2048
+	DefaultMaxLinkTextLength    = 200
+	DefaultMaxLinksPerPage      = 10000
+	DefaultMaxAttributeLength   = 1024 * 1024
+	DefaultMaxRepeatedSegments  = 3
+	DefaultMaxCrawlDelay        = 30 * time.Second
+	DefaultMaxSitemapURLs       = 50000
+	DefaultMaxJSONPages         = 100000
+	DefaultMaxMermaidNodes      = 300
+	DefaultMaxExternalURLs      = 100000
+	DefaultMaxExternalSources   = 10
+	DefaultMaxDuplicatePages    = 100000
+	DefaultMaxSlowestPages      = 20
+	DefaultMaxDedupeEdges       = 1000000
+	DefaultExternalWorkers      = 4
+	DefaultExternalDelay        = 500 * time.Millisecond
 )
 
+// Crawl orders. Ordering holds for every site handed to a worker, but
+// pages are fetched concurrently unless NumWorkers is 1.
+const (
+	OrderBFS = "bfs" // breadth-first: shallow pages are crawled first
+	OrderDFS = "dfs" // depth-first: the most recently discovered pages are crawled first
+)
+
+// DefaultSessionParams holds the names of the most common session ID
+// parameters, which are removed from every URL.
+var DefaultSessionParams = []string{"jsessionid", "PHPSESSID", "sid"}
+
 var (
 	ErrInvalidURL               = errors.New("invalid URL")
 	ErrInvalidAbsoluteURL       = errors.New("invalid absolute URL")
 	ErrInvalidURLScheme         = errors.New("invalid URL scheme: only http(s) supported")
 	ErrInvalidNumWorkers        = errors.New("invalid number of workers")
 	ErrInvalidHTTPClientTimeout = errors.New("invalid HTTP Client timeout: it must be at least 0 (no timeout)")
+	ErrInvalidMaxConcurrent     = errors.New("invalid max concurrent requests per host: it must be at least 0 (no limit)")
+	ErrInvalidMaxURLLength      = errors.New("invalid max URL length: it must be at least 0 (default)")
+	ErrInvalidMaxLinkTextLength = errors.New("invalid max link text length: it must be at least 0 (default)")
+	ErrInvalidMaxLinksPerPage   = errors.New("invalid max links per page: it must be at least 0 (default)")
+	ErrInvalidMaxAttributeLen   = errors.New("invalid max attribute length: it must be at least 0 (default)")
+	ErrURLTooLong               = errors.New("URL exceeds the max URL length")
+	ErrInvalidMaxPathSegments   = errors.New("invalid max path segments: it must be at least 0 (unlimited)")
+	ErrInvalidMaxRepeatedSegs   = errors.New("invalid max repeated segments: it must be at least 0 (default)")
+	ErrInvalidMaxDepth          = errors.New("invalid max depth: it must be at least 0 (unlimited)")
+	ErrInvalidMaxPages          = errors.New("invalid max pages: it must be at least 0 (unlimited)")
+	ErrInvalidMaxDuration       = errors.New("invalid max duration: it must be at least 0 (unlimited)")
+	ErrInvalidPageDeadline      = errors.New("invalid page deadline: it must be at least 0 (no deadline)")
+	ErrInvalidMaxParseTime      = errors.New("invalid max parse time: it must be at least 0 (unlimited)")
+	ErrInvalidOnlyLang          = errors.New("invalid only lang: it must be a language tag, e.g. de or de-AT")
+	ErrInvalidOrder             = errors.New("invalid order: it must be bfs or dfs")
+	ErrInvalidDelay             = errors.New("invalid delay: it must be at least 0 (no delay)")
+	ErrInvalidRate              = errors.New("invalid rate: it must be at least 0 (unlimited)")
+	ErrInvalidMaxCrawlDelay     = errors.New("invalid max crawl delay: it must be at least 0 (default)")
+	ErrInvalidFormat            = errors.New("invalid format: it must be text, xml-sitemap, image-sitemap, json, ndjson, csv, dot, mermaid, tree or html")
+	ErrInvalidMaxSitemapURLs    = errors.New("invalid max sitemap URLs: it must be at least 0 (default)")
+	ErrInvalidMaxJSONPages      = errors.New("invalid max JSON pages: it must be at least 0 (default)")
+	ErrSiteMapTooLarge          = errors.New("site map too large: more pages than MaxJSONPages")
+	ErrInvalidDOTMaxDepth       = errors.New("invalid DOT max depth: it must be at least 0 (unlimited)")
+	ErrInvalidMaxMermaidNodes   = errors.New("invalid max Mermaid nodes: it must be at least 0 (default)")
+	ErrInvalidMaxExternalURLs   = errors.New("invalid max external URLs: it must be at least 0 (default)")
+	ErrInvalidMaxDuplicatePages = errors.New("invalid max duplicate pages: it must be at least 0 (default)")
+	ErrInvalidMaxSlowestPages   = errors.New("invalid max slowest pages: it must be at least 0 (default)")
+	ErrInvalidExternalSources   = errors.New("invalid max external URL sources: it must be at least 0 (default)")
+	ErrInvalidCompress          = errors.New("invalid compression: it must be none or gzip")
+	ErrInvalidOutput            = errors.New("invalid output: it must have a writer or a file")
+	ErrInvalidTemplateScope     = errors.New("invalid template scope: it must be edge or page")
+	ErrInvalidMaxDedupeEdges    = errors.New("invalid max dedupe edges: it must be at least 0 (default)")
+	ErrInvalidExternalWorkers   = errors.New("invalid external workers: it must be at least 0 (default)")
+	ErrInvalidExternalRate      = errors.New("invalid external rate: it must be at least 0 (unlimited)")
+	ErrInvalidExternalDelay     = errors.New("invalid external delay: it must be at least 0 (default)")
+	ErrAlreadyRunning           = errors.New("the crawler is already running")
+	errStopped                  = errors.New("request aborted: crawl stopped")
+	errPageDeadline             = errors.New("deadline exceeded")
+	errParseTime                = errors.New("parse time exceeded")
+	ErrInvalidExpectedURLs      = errors.New("invalid expected URLs: it must be at least 1")
+	ErrInvalidFPRate            = errors.New("invalid false positive rate: it must be between 0 and 1")
+	ErrSeedFetchFailed          = errors.New("seed fetch failed")
 )
 
+// statusError is the error of a page answered with a 4xx or 5xx status.
+type statusError struct {
+	code   int
+	status string // e.g. "404 Not Found"
+}
+
+func (e *statusError) Error() string {
+	return e.status
+}
+
+// SeedFetchError is returned by Run when no page was fetched because the
+// seed failed, e.g. the connection was refused or it answered 404. It
+// matches ErrSeedFetchFailed with errors.Is and unwraps to the cause.
+type SeedFetchError struct {
+	URL string
+	Err error
+}
+
+func (e *SeedFetchError) Error() string {
+	return fmt.Sprintf("%s: %q: %s", ErrSeedFetchFailed, e.URL, e.Err.Error())
+}
+
+func (e *SeedFetchError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SeedFetchError) Is(target error) bool {
+	return target == ErrSeedFetchFailed
+}
+
 type Crawler struct {
-	SeedURL              string          // initial str URL for crawling
-	NumWorkers           int             // number of concurrent workers polling the job queue
-	HTTPClientTimeoutSec int             // time limit (in seconds) for a HTTP request
-	SiteMapOutputFile    string          // file where the site map will be written to
-	SiteMapWriter        io.Writer       // this takes precedence over SiteMapOutputFile. If this is not provided, this is backed by SiteMapOutputFile.
-	workQueue            chan webSite    // job queue - collection of WebSites - for the workers
-	workQueueCapacity    int             // max numbers of elements before the write to the queue gets blocked
-	workQueueDelta       chan int        // channel for notifying enqueue/dequeue operations
-	siteFilterQueue      chan webSite    // intermediate channel for filtering before adding more WebSites to the queue
-	visitedSites         map[string]bool // set for keeping the collection of already visited sites
-	resultQueue          chan result     // channel for sending the scrape result
-	siteMapDone          chan bool       // channel for signaling the end of the site map build
-	wg                   sync.WaitGroup  // waitGroup for waiting on workers to finish execution
-	startOnce            sync.Once       // avoid executing init more than once.
+	SeedURL              string                          // initial str URL for crawling
+	SeedURLs             []string                        // more URLs to start crawling from (see ReadSeeds). SeedURL can be empty when set.
+	NumWorkers           int                             // number of concurrent workers polling the job queue
+	MaxConcurrentPerHost int                             // max number of concurrent requests to a single host. Zero means no limit other than NumWorkers.
+	HTTPClientTimeoutSec int                             // time limit (in seconds) for a HTTP request
+	SiteMapOutputFile    string                          // file where the site map will be written to
+	SiteMapWriter        io.Writer                       // this takes precedence over SiteMapOutputFile. If this is not provided, this is backed by SiteMapOutputFile, which is closed at the end of Run. SiteMapWriter is never closed.
+	Compress             string                          // compression of the site map: CompressNone (default) or CompressGzip. It's CompressGzip by default when SiteMapOutputFile ends in ".gz" and SiteMapWriter is not provided.
+	Outputs              []OutputConfig                  // site maps written in addition to the one above, e.g. in other formats, from the same crawl
+	IgnoreOutputErrors   bool                            // log the errors writing a site map and keep writing it. Otherwise the site map isn't written anymore and Run returns the error once the crawl ends.
+	Format               string                          // format of the site map: FormatText (default), FormatXMLSitemap, FormatImageSitemap, FormatJSON, FormatNDJSON, FormatCSV, FormatDOT, FormatMermaid, FormatTree or FormatHTML
+	Template             string                          // text/template written for every edge or page of the site map, followed by a newline, instead of Format (see OutputConfig)
+	TemplateScope        string                          // with Template, what it's written for: TemplateScopeEdge (default), a TemplateEdge per link, or TemplateScopePage, a TemplatePage per page
+	CSVPagesWriter       io.Writer                       // with FormatCSV, also write a CSV row per fetched page to it, once even if there are several CSV site maps (see CSVPagesHeader)
+	MaxSitemapURLs       int                             // with FormatXMLSitemap and FormatImageSitemap, max number of URLs per sitemap file. Beyond it, they are split into files next to SiteMapOutputFile, which lists them in a sitemap index. Zero means DefaultMaxSitemapURLs.
+	MaxJSONPages         int                             // with FormatJSON, max number of pages kept in memory until the document is written at the end of the crawl. Beyond it, nothing is written and Run returns ErrSiteMapTooLarge. Zero means DefaultMaxJSONPages.
+	DOTMaxDepth          int                             // with FormatDOT, only draw the links of the pages less than this many links away from a seed, to keep big graphs renderable. Zero means unlimited.
+	DOTStatusColors      bool                            // with FormatDOT, fill the nodes fetched with a color by status code: green for 2xx, yellow for 3xx and red for 4xx and 5xx
+	MaxMermaidNodes      int                             // with FormatMermaid, max number of nodes drawn, the nearest to the seeds, as Mermaid struggles with big graphs. The links to the rest point to a node counting them. Zero means DefaultMaxMermaidNodes.
+	InternalOnly         bool                            // omit the edges to external URLs from the site map
+	GroupExternalDomains bool                            // count the links to external hosts by registrable domain, e.g. "google.com" for "maps.google.com" (see Stats)
+	DedupeEdges          bool                            // write each edge of the site map once, even when its source is written again, e.g. over another scheme. Sources and targets are compared by their dedup key (see DedupKeyFunc), so e.g. the http and https links of a page to the same URL are merged.
+	MaxDedupeEdges       int                             // with DedupeEdges, max number of edges remembered. Beyond it, the edges not remembered may be written again. Zero means DefaultMaxDedupeEdges.
+	EdgeCounts           bool                            // with FormatText, annotate each edge with the number of links of the page to the target, e.g. "A -> B [3]"
+	IncludeAssets        bool                            // also write the edges to the resources of the pages (images, video and audio, stylesheets, scripts, frames and form actions) to the site map. They are never crawled.
+	CrawlFrames          bool                            // crawl the pages embedded with iframe and frame on the host of the page, like links, instead of recording them as assets
+	FetchStylesheets     bool                            // with IncludeAssets, also fetch the stylesheets on the host of the pages to write the edges to the resources they reference, e.g. fonts
+	FollowFeeds          bool                            // fetch the RSS and Atom feeds on the host of the pages (see PageMetadata) to crawl their items, e.g. posts not linked from the pages
+	FollowForms          bool                            // crawl the actions of the GET forms, like links, instead of recording them as assets. POST forms are never crawled.
+	RecordSkipped        bool                            // keep a record of every skipped URL with its reason (see SkippedURLs)
+	MaxSlowestPages      int                             // number of pages in Stats.SlowestPages. Zero means DefaultMaxSlowestPages.
+	RecordExternalURLs   bool                            // keep a record of every external URL linked with the pages linking to it (see ExternalURLs)
+	MaxExternalURLs      int                             // with RecordExternalURLs, max number of URLs recorded, the first ones found. Zero means DefaultMaxExternalURLs.
+	MaxExternalSources   int                             // with RecordExternalURLs, max number of pages recorded per URL. Zero means DefaultMaxExternalSources.
+	RecordRedirects      bool                            // keep a record of the pages fetched after 2 or more redirects and of the redirect loops (see RedirectChains)
+	RecordBrokenLinks    bool                            // keep a record of every URL that could not be fetched with the pages linking to it (see BrokenLinks)
+	CheckExternal        bool                            // check that the external URLs linked resolve, without crawling them, with a HEAD request falling back to GET. The broken ones are recorded with RecordBrokenLinks.
+	ExternalWorkers      int                             // with CheckExternal, max number of concurrent checks. Zero means DefaultExternalWorkers.
+	ExternalRate         float64                         // with CheckExternal, max number of checks per second, across all hosts. Zero means unlimited.
+	ExternalDelay        time.Duration                   // with CheckExternal, min time between the start of two checks to the same host, which are never concurrent. Zero means DefaultExternalDelay.
+	EquateWWW            bool                            // treat "www.<host>" and "<host>" as the same site. URLs are written using the seed's form.
+	SchemeSensitive      bool                            // treat http and https variants of a URL as different pages
+	IncludeSubdomains    bool                            // follow links to other hosts of the same registrable domain (see SameSite)
+	FollowSeedRedirect   bool                            // when the seed redirects to another host, adopt that host as the internal one. The seeds are fetched once before the crawl to find out.
+	UseSitemap           bool                            // also crawl the pages listed in the /sitemap.xml of the seed host, which are linked from it in the site map
+	KeepFragments        bool                            // keep URL fragments (e.g. hash routes) instead of dropping them
+	KeepTrailingSlash    bool                            // keep trailing slashes so "/docs" and "/docs/" are different pages
+	MaxURLLength         int                             // discovered URLs longer than this are not crawled. Zero means DefaultMaxURLLength.
+	MaxLinkTextLength    int                             // the text of the links is cut to this many characters. Zero means DefaultMaxLinkTextLength.
+	MaxLinksPerPage      int                             // max number of links, and of assets, taken from a page. The others are left out and the page marked as truncated (see PageMetadata). Zero means DefaultMaxLinksPerPage.
+	MaxAttributeLength   int                             // attribute values of the HTML pages longer than this are ignored, marking the page as truncated. Zero means DefaultMaxAttributeLength.
+	IncludeTemplates     bool                            // also crawl the links inside template elements, which are inert content never shown as is
+	SkipNoscript         bool                            // don't crawl the links inside noscript elements, often a degraded duplicate of the page
+	HashNormalizeSpace   bool                            // collapse the runs of whitespace of the pages before hashing them, so pages only differing in whitespace are duplicates (see Duplicates)
+	MaxDuplicatePages    int                             // max number of pages indexed by content hash for Duplicates, the first ones fetched. The others are left out of the clusters. Zero means DefaultMaxDuplicatePages.
+	MaxPathSegments      int                             // discovered URLs with more path segments than this are not crawled. Zero means unlimited.
+	MaxRepeatedSegments  int                             // discovered URLs repeating a path segment consecutively more than this are not crawled. Zero means DefaultMaxRepeatedSegments.
+	MaxDepth             int                             // pages more links away from the seed than this are not fetched, only recorded as edges. Zero means unlimited.
+	MaxPages             int                             // stop crawling once this many pages have been fetched successfully. Zero means unlimited.
+	MaxDuration          time.Duration                   // stop crawling once this much time has elapsed, aborting in-flight requests. Zero means unlimited.
+	PageDeadline         time.Duration                   // time limit to fetch, read and parse a page, from the moment its host can be requested. Unlike HTTPClientTimeoutSec, it also covers parsing. It's a budget for the whole page, which any retry would share. Zero means no deadline.
+	MaxParseTime         time.Duration                   // time limit to parse a page, within its PageDeadline if any. The page fails when exceeded. Zero means unlimited.
+	Order                string                          // order the pages are crawled in: OrderBFS (default) or OrderDFS
+	PriorityFunc         func(u *url.URL, depth int) int // pages with a higher priority are crawled first, in discovery order on a tie. It takes precedence over Order.
+	Delay                time.Duration                   // min time between the start of two requests to the same host, randomly changed by up to 20%. Zero means no delay.
+	OverrideCrawlDelay   bool                            // use Delay even when the robots.txt Crawl-delay is longer
+	MaxCrawlDelay        time.Duration                   // robots.txt Crawl-delay values longer than this are clamped. Zero means DefaultMaxCrawlDelay.
+	Rate                 float64                         // max number of requests per second across the whole crawl, including the retries of a Fetcher calling Throttle. Zero means unlimited.
+	PatternBudgets       []PatternBudget                 // max number of pages fetched successfully matching each pattern
+	DirBudgets           map[string]int                  // max number of pages fetched under each path prefix, e.g. "/forum/". A page counts against the longest matching prefix only.
+	RespectNofollow      bool                            // don't crawl links marked as rel="nofollow", "ugc" or "sponsored"
+	RespectRobotsMeta    bool                            // honor the noindex and nofollow directives of the robots meta tags
+	OnlyLang             string                          // only follow the links of the pages in this language or its variants, e.g. "de" for "de-AT", or with no language (see PageMetadata)
+	SessionParams        []string                        // session ID parameters removed from URLs (case insensitive). Nil means DefaultSessionParams.
+	Filters              []URLFilter                     // custom filters evaluated after the built-in ones
+	DenylistFile         string                          // file with URLs, path prefixes and "re:" regular expressions never crawled, one per line
+	IgnoreRobots         bool                            // don't fetch the robots.txt of the seed host nor honor its rules
+	DedupKeyFunc         func(*url.URL) string           // key identifying a URL in the visited set. It must be pure and fast since it's called once per discovered link. Nil means the URL without scheme (see SchemeSensitive and EquateWWW).
+	OnPage               func(PageResult)                // called with every page crawled, with its Links, and with every page failed, with its Error. It is called from a single goroutine, in the order the pages are written to the site map. Pages sharing a canonical URL are passed once.
+	RequestHook          func(*http.Request)             // called with the request of every page before it is sent, e.g. to set headers. It is called concurrently from the workers.
+	ResponseHook         func(*http.Response)            // called with the response of every fetched page before its body is parsed. It is called concurrently from the workers.
+	Fetcher              Fetcher                         // fetches the pages and the other resources. Nil means a net/http one, the only one calling RequestHook and ResponseHook and sending the conditional requests of IncrementalStateFile.
+	PanicOnError         bool                            // don't recover from panics while fetching and parsing a page, e.g. in the hooks, but crash. Useful for development.
+	KeepState            bool                            // keep the visited set of the previous Run, so its pages are not fetched again
+	IncrementalStateFile string                          // file where the state of the crawl is saved for the next one, which fetches the pages again with conditional requests and takes the links of the unchanged ones from it (see PageStatuses)
+	SQLiteOutputFile     string                          // file of a SQLite database where the pages and links are written as soon as the pages are fetched (see SQLiteSchema). An existing database is appended to, each crawl having its own run_id.
+	Extractor            LinkExtractor                   // extracts the links and metadata of the pages. Nil means a HTMLExtractor, but for the XML sitemaps (see UseSitemap).
+	Extractors           map[string]LinkExtractor        // extractors of the pages by media type, e.g. "application/json" for a JSONExtractor. They take precedence over Extractor.
+	VisitedStore         VisitedStore                    // set of visited pages, e.g. a BoltVisitedStore. Nil means an in-memory one. It's kept across runs regardless of KeepState and closing it is up to the caller.
+	workQueue            chan webSite                    // job queue - collection of WebSites - for the workers
+	workQueueCapacity    int                             // max numbers of elements before the write to the queue gets blocked
+	workDone             chan bool                       // channel for notifying the dispatcher that a worker finished a site
+	siteFilterQueue      chan webSite                    // intermediate channel for filtering before adding more WebSites to the queue
+	frontier             frontier                        // sites waiting to be crawled. Only used by dispatcher.
+	visited              VisitedStore                    // VisitedStore or the in-memory default. Only used by dispatcher.
+	resultQueue          chan PageResult                 // channel for sending the scrape result
+	siteMapDone          chan bool                       // channel for signaling the end of the site map build
+	siteMapErr           error                           // error ending the site map, returned by Run. Written by siteMapBuilder before siteMapDone.
+	siteMapSinks         []*siteMapSink                  // one per outputConfigs. Only used by siteMapBuilder between openSiteMapSinks and closeSiteMapSinks.
+	started              time.Time                       // when the running crawl started
+	running              int32                           // set while Run is running. Only accessed atomically.
+	workersMu            sync.Mutex                      // guards the worker pool fields below
+	workerQuits          []chan bool                     // one per worker not retired yet, closed to retire it
+	workers              int                             // running workers, including the retired ones finishing a page
+	nextWorkerID         int                             // id given to the next spawned worker
+	workersDone          chan bool                       // closed when every worker has exited
+	workersExited        bool                            // set once workersDone is closed
+	ctx                  context.Context                 // cancelled when the crawl is stopped
+	cancel               context.CancelFunc
+	normalizer           urlNormalizer // options applied to every discovered URL
+	stats                Stats         // counters collected while crawling
+	statsMu              sync.Mutex    // guards stats and fetchedSchemes
+	fetchedSchemes       map[string]uint8
+	pageDepths           map[string]int             // depth of the fetched pages. Guarded by statsMu.
+	statusCodes          map[string]int             // status code of the fetched pages and of the ones failed with an HTTP error. Guarded by statsMu.
+	inboundLinks         map[string]int             // pages linking to each URL, by URL. Guarded by statsMu.
+	slowestPages         []SlowPage                 // up to MaxSlowestPages, the slowest first. Guarded by statsMu.
+	pageMetadata         map[string]PageMetadata    // metadata of the fetched pages. Guarded by statsMu.
+	contentHashes        *contentHashes             // pages by content hash, for Duplicates. Guarded by statsMu.
+	resourcesMu          sync.Mutex                 // guards resources
+	resources            map[string]bool            // stylesheets and feeds fetched, by URL
+	seedErr              *SeedFetchError            // first seed that failed. Guarded by statsMu.
+	patternBudgetsMu     sync.Mutex                 // guards the usage of patternBudgets
+	patternBudgets       []*patternBudget           // compiled PatternBudgets, charged by dispatcher and refunded by the workers
+	dirBudgets           *dirBudgets                // enforces DirBudgets
+	filters              []URLFilter                // built-in filters followed by Filters
+	denylist             *denylist                  // loaded from DenylistFile
+	hostLimiter          *hostLimiter               // enforces Delay
+	rateLimiter          *rate.Limiter              // enforces Rate
+	hostSemaphores       *hostSemaphores            // enforces MaxConcurrentPerHost
+	robotsMu             sync.RWMutex               // guards robots, robotsFetching and hostDelays
+	robots               map[string]*robotsRules    // robots.txt rules by host, fetched the first time a URL on the host is admitted
+	robotsFetching       map[string]chan bool       // closed once the robots.txt rules of the host are fetched, by host
+	hostDelays           map[string]time.Duration   // delay in force by host, when it differs from Delay
+	skipped              *skippedURLs               // skipped URLs recorded when RecordSkipped is set
+	externalURLs         *externalURLs              // recorded when RecordExternalURLs is set
+	redirectChains       *redirectChains            // recorded when RecordRedirects is set
+	brokenLinks          *brokenLinks               // failed URLs and link sources, recorded when RecordBrokenLinks is set
+	externalChecker      *externalChecker           // checks the external URLs with CheckExternal
+	canonicals           map[string]string          // fetched URL -> canonical URL declared by the page
+	canonicalsMu         sync.Mutex                 // guards canonicals
+	pagesReserved        int32                      // pages fetched successfully or being fetched. Only accessed atomically.
+	stopped              int32                      // set by Stop. Only accessed atomically.
+	abortable            map[int]context.CancelFunc // cancel the requests waiting for a response, by id, when calling Stop
+	nextAbortableID      int
+	abortableMu          sync.Mutex        // guards abortable and nextAbortableID
+	dryRun               *dryRunReport     // set during a DryRun
+	incremental          *incrementalState // loaded from IncrementalStateFile
+	sqlite               *sqliteOutput     // opened from SQLiteOutputFile
 }
 
 type webSite struct {
-	URL    *url.URL
-	Parent *url.URL
+	URL         *url.URL
+	Parent      *url.URL
+	Depth       int      // number of links followed from the seed to the URL, the first time it was discovered
+	sitemap     *url.URL // sitemap listing the site, for the pages crawled from the sitemap
+	markVisited bool     // only flag URL as visited, without crawling it
+	noFollow    bool     // all the links to this URL are marked as rel="nofollow"
+	element     string   // element of the first link to the URL, e.g. "a" or "iframe". Empty for the seeds.
+	text        string   // text of the first link to the URL with some, whitespace-normalized
+	occurrences int      // number of links to the URL on the parent page. Zero when unknown, e.g. for an unchanged page of an incremental crawl.
+}
+
+// asset is a resource referenced by a page, which is never crawled.
+type asset struct {
+	URL     *url.URL
+	Element string // element referencing it, e.g. "img" or "script"
+	Method  string // method of the forms: "get" or "post"
+}
+
+// PageResult is a page crawled, as written to the site map and passed to
+// OnPage. The exported fields are the data of the page, the unexported ones
+// the state the crawl keeps for it, so fields can be added to both without
+// breaking the callers.
+type PageResult struct {
+	URL          string        // URL crawled
+	FinalURL     string        // URL fetched, after any redirect (see Redirects). Empty for the failed pages.
+	StatusCode   int           // status code of the response, e.g. 304 when revalidated. Zero if none was received.
+	Depth        int           // number of links followed from the seed to the page
+	Duration     time.Duration // time taken to get the response (see FetchResult)
+	Bytes        int64         // size of the body of the response
+	Metadata     PageMetadata  // title, description and the other metadata of the page
+	Links        []PageLink    // links written to the site map. Only set once the page is written, e.g. not for the failed pages.
+	Redirects    []Redirect    // redirects followed to FinalURL, in order
+	Attempts     int           // requests made to get the response, more than one if the Fetcher retried. Zero for the failed pages.
+	Canonical    *url.URL      // canonical URL declared by the page, if any
+	NoIndex      bool          // the page robots meta asks not to be indexed
+	NoFollow     bool          // the page robots meta asks not to follow its links
+	LastModified time.Time     // Last-Modified header of the page, if any
+	Error        error         // why the page could not be fetched or parsed. Nil if it was.
+
+	site           webSite
+	children       []*webSite
+	assets         []asset        // resources referenced by the page (see IncludeAssets)
+	skippedSchemes map[string]int // number of links with a non-web scheme (mailto, tel...) by scheme
+	resource       bool           // the result of a feed or a stylesheet instead of a page
 }
 
-type result struct {
-	SourceSite    webSite
-	ChildrenSites []*webSite
+// PageLink is a link or an asset of a page written to the site map.
+type PageLink struct {
+	URL      string
+	Element  string // e.g. "a" or "img". Empty if unknown.
+	Text     string // text of the link, if any
+	Asset    bool   // a resource referenced by the page (see IncludeAssets)
+	External bool
+	Count    int // number of links of the page to the URL, at least 1
 }
 
 // Run runs the crawling process by spawning "NumWorkers" workers and
 // performing the scraping in each site found. It generates the textual
 // site map in the provided "SiteMapOutputFile" file.
+//
+// When MaxDuration elapses, in-flight requests are aborted and Run returns
+// nil once the site map of the pages fetched so far has been written. The
+// crawl is then reported as truncated by Stats.
 func (c *Crawler) Run() error {
+	return c.RunContext(context.Background())
+}
+
+// RunContext is like Run but the crawl is stopped when ctx is done. In that
+// case in-flight requests are aborted and, once the site map of the pages
+// fetched so far has been written, ctx.Err() is returned.
+//
+// A Crawler can be run again once Run returns, e.g. after changing its
+// filters. Every Run starts from scratch unless KeepState is set, in which
+// case the pages visited by the previous runs are skipped as already
+// visited. ErrAlreadyRunning is returned if the Crawler is running.
+func (c *Crawler) RunContext(ctx context.Context) error {
+	return c.run(ctx, nil)
+}
+
+// run runs the crawl, or a dry run if dryRun is not nil.
+func (c *Crawler) run(ctx context.Context, dryRun *dryRunReport) error {
+	if !atomic.CompareAndSwapInt32(&c.running, 0, 1) {
+		return ErrAlreadyRunning
+	}
+	defer atomic.StoreInt32(&c.running, 0)
+	c.dryRun = dryRun
 	err := c.validate()
 	if err != nil {
 		return err
 	}
-	c.startOnce.Do(c.init)
+	c.init()
+	if c.MaxDuration > 0 {
+		c.ctx, c.cancel = context.WithTimeout(ctx, c.MaxDuration)
+	} else {
+		c.ctx, c.cancel = context.WithCancel(ctx)
+	}
+	defer c.cancel()
+	// the seeds redirecting to another host are resolved before the
+	// workers start, since adopting their host changes the normalizer
+	var seedURLs []*url.URL
+	for _, seed := range c.seedURLs() {
+		seedURL, _ := c.normalizer.parseAbsolute(seed)
+		if c.FollowSeedRedirect {
+			seedURL = c.resolveSeedRedirect(seedURL)
+		}
+		seedURLs = append(seedURLs, seedURL)
+	}
+	// the exact URLs are normalized as the URLs crawled, once init
+	// configured the normalizer and the seed redirects were adopted
+	c.denylist = nil
+	if c.DenylistFile != "" {
+		c.denylist, err = loadDenylist(c.DenylistFile, c.normalizer)
+		if err != nil {
+			c.closeSiteMapSinks()
+			return err
+		}
+	}
+	c.sqlite = nil
+	if c.SQLiteOutputFile != "" && c.dryRun == nil {
+		c.sqlite, err = openSQLiteOutput(c.SQLiteOutputFile, c.seedURLs(), c.started)
+		if err != nil {
+			c.closeSiteMapSinks()
+			return err
+		}
+	}
+
+	// the checks outlive c.ctx, cancelled once the pages are crawled, so
+	// they are only stopped with the crawl
+	c.externalChecker = nil
+	if c.CheckExternal && c.dryRun == nil {
+		c.externalChecker = newExternalChecker(ctx, c)
+	}
+
+	var roots, sitemapRoots []webSite
+	seedHosts := map[string]bool{}
+	for _, seedURL := range seedURLs {
+		roots = append(roots, webSite{URL: seedURL, Parent: nil})
+		if seedHosts[seedURL.Host] {
+			continue
+		}
+		seedHosts[seedURL.Host] = true
+		if !c.IgnoreRobots {
+			c.hostRobots(seedURL)
+		} else {
+			c.recordDelay(seedURL.Host, c.delay(seedURL.Host))
+		}
+		if c.UseSitemap && c.dryRun == nil {
+			sitemapRoots = append(sitemapRoots, c.sitemapSites(seedURL)...)
+		}
+	}
+	roots = append(roots, sitemapRoots...)
 
 	log.Debug("Crawler started")
+	// the pipeline goroutines are waited for so a later Run can't race
+	// with them
+	var pipeline sync.WaitGroup
+	pipeline.Add(1)
 	go func() {
-		u, _ := strToAbsoluteURL(c.SeedURL)
-		c.siteFilterQueue <- webSite{URL: u, Parent: nil}
-		c.workQueueDelta <- 1
+		defer pipeline.Done()
+		c.dispatcher(roots)
 	}()
-
-	go c.workQueueDoneChecker()
-	go c.workQueueAppender()
 	go c.siteMapBuilder()
 
-	for i := 0; i < c.NumWorkers; i++ {
-		c.wg.Add(1)
-		go c.startWorker(i)
+	c.workersMu.Lock()
+	c.workersDone = make(chan bool)
+	c.startWorkers(c.NumWorkers)
+	c.workersMu.Unlock()
+	<-c.workersDone
+	stopped := c.ctx.Err() != nil
+	if stopped && ctx.Err() != nil {
+		log.Infof("Crawl cancelled: %s", ctx.Err().Error())
+		c.recordTruncated(TruncatedCancelled)
+	} else if stopped {
+		log.Infof("Max duration of %v reached: stopping crawl", c.MaxDuration)
+		c.recordTruncated(TruncatedMaxDuration)
 	}
-	c.wg.Wait()
-	close(c.siteFilterQueue)
+	// stop the pipeline goroutines. siteFilterQueue is not closed since
+	// pending links may still be sent to it when the crawl is stopped.
+	c.cancel()
 	close(c.resultQueue)
 	<-c.siteMapDone
+	pipeline.Wait()
+	c.externalChecker.wait()
+	if err := c.sqlite.close(c.Stats().Truncated, c.InboundLinks()); err != nil {
+		return fmt.Errorf("can't close SQLite output file: %s", err.Error())
+	}
+	if c.incremental != nil && c.dryRun == nil {
+		truncated := c.Stats().Truncated != ""
+		if err := c.incremental.save(c.IncrementalStateFile, truncated); err != nil {
+			return err
+		}
+	}
+	if c.siteMapErr != nil {
+		return c.siteMapErr
+	}
+	if stopped {
+		return ctx.Err()
+	}
+	// a crawl where some pages failed is still a success, but not one
+	// where nothing could be fetched
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.stats.PagesFetched == 0 && c.seedErr != nil {
+		return c.seedErr
+	}
 	return nil
 }
 
+// seedURLs returns SeedURL, if set, followed by SeedURLs.
+func (c *Crawler) seedURLs() []string {
+	if c.SeedURL == "" && len(c.SeedURLs) > 0 {
+		return c.SeedURLs
+	}
+	return append([]string{c.SeedURL}, c.SeedURLs...)
+}
+
 func (c *Crawler) validate() error {
-	_, err := strToAbsoluteURL(c.SeedURL)
-	if err != nil {
-		return err
+	for _, seed := range c.seedURLs() {
+		if _, err := strToAbsoluteURL(seed); err != nil {
+			return err
+		}
 	}
+	var err error
 	if c.NumWorkers <= 0 {
 		return ErrInvalidNumWorkers
 	}
 	if c.HTTPClientTimeoutSec < 0 {
 		return ErrInvalidHTTPClientTimeout
 	}
+	if c.MaxConcurrentPerHost < 0 {
+		return ErrInvalidMaxConcurrent
+	}
+	if c.MaxURLLength < 0 {
+		return ErrInvalidMaxURLLength
+	}
+	if c.MaxURLLength == 0 {
+		c.MaxURLLength = DefaultMaxURLLength
+	}
+	if c.MaxLinkTextLength < 0 {
+		return ErrInvalidMaxLinkTextLength
+	}
+	if c.MaxLinkTextLength == 0 {
+		c.MaxLinkTextLength = DefaultMaxLinkTextLength
+	}
+	if c.MaxLinksPerPage < 0 {
+		return ErrInvalidMaxLinksPerPage
+	}
+	if c.MaxLinksPerPage == 0 {
+		c.MaxLinksPerPage = DefaultMaxLinksPerPage
+	}
+	if c.MaxAttributeLength < 0 {
+		return ErrInvalidMaxAttributeLen
+	}
+	if c.MaxAttributeLength == 0 {
+		c.MaxAttributeLength = DefaultMaxAttributeLength
+	}
+	for _, seed := range c.seedURLs() {
+		if len(seed) > c.MaxURLLength {
+			return ErrURLTooLong
+		}
+	}
+	if c.MaxPathSegments < 0 {
+		return ErrInvalidMaxPathSegments
+	}
+	if c.MaxRepeatedSegments < 0 {
+		return ErrInvalidMaxRepeatedSegs
+	}
+	if c.MaxRepeatedSegments == 0 {
+		c.MaxRepeatedSegments = DefaultMaxRepeatedSegments
+	}
+	if c.MaxDepth < 0 {
+		return ErrInvalidMaxDepth
+	}
+	if c.MaxPages < 0 {
+		return ErrInvalidMaxPages
+	}
+	if c.MaxDuration < 0 {
+		return ErrInvalidMaxDuration
+	}
+	if c.PageDeadline < 0 {
+		return ErrInvalidPageDeadline
+	}
+	if c.MaxParseTime < 0 {
+		return ErrInvalidMaxParseTime
+	}
+	if c.OnlyLang != "" && parseLang(c.OnlyLang) != c.OnlyLang {
+		return ErrInvalidOnlyLang
+	}
+	switch c.Order {
+	case "":
+		c.Order = OrderBFS
+	case OrderBFS, OrderDFS:
+	default:
+		return ErrInvalidOrder
+	}
+	if c.Delay < 0 {
+		return ErrInvalidDelay
+	}
+	if c.Rate < 0 {
+		return ErrInvalidRate
+	}
+	if c.MaxCrawlDelay < 0 {
+		return ErrInvalidMaxCrawlDelay
+	}
+	if c.MaxCrawlDelay == 0 {
+		c.MaxCrawlDelay = DefaultMaxCrawlDelay
+	}
+	if c.Format == "" {
+		c.Format = FormatText
+	}
+	if c.MaxSitemapURLs < 0 {
+		return ErrInvalidMaxSitemapURLs
+	}
+	if c.MaxSitemapURLs == 0 {
+		c.MaxSitemapURLs = DefaultMaxSitemapURLs
+	}
+	if c.MaxJSONPages < 0 {
+		return ErrInvalidMaxJSONPages
+	}
+	if c.MaxJSONPages == 0 {
+		c.MaxJSONPages = DefaultMaxJSONPages
+	}
+	if c.DOTMaxDepth < 0 {
+		return ErrInvalidDOTMaxDepth
+	}
+	if c.ExternalWorkers < 0 {
+		return ErrInvalidExternalWorkers
+	}
+	if c.ExternalWorkers == 0 {
+		c.ExternalWorkers = DefaultExternalWorkers
+	}
+	if c.ExternalRate < 0 {
+		return ErrInvalidExternalRate
+	}
+	if c.ExternalDelay < 0 {
+		return ErrInvalidExternalDelay
+	}
+	if c.ExternalDelay == 0 {
+		c.ExternalDelay = DefaultExternalDelay
+	}
+	if c.MaxDedupeEdges < 0 {
+		return ErrInvalidMaxDedupeEdges
+	}
+	if c.MaxDedupeEdges == 0 {
+		c.MaxDedupeEdges = DefaultMaxDedupeEdges
+	}
+	if c.MaxSlowestPages < 0 {
+		return ErrInvalidMaxSlowestPages
+	}
+	if c.MaxSlowestPages == 0 {
+		c.MaxSlowestPages = DefaultMaxSlowestPages
+	}
+	if c.MaxExternalURLs < 0 {
+		return ErrInvalidMaxExternalURLs
+	}
+	if c.MaxExternalURLs == 0 {
+		c.MaxExternalURLs = DefaultMaxExternalURLs
+	}
+	if c.MaxExternalSources < 0 {
+		return ErrInvalidExternalSources
+	}
+	if c.MaxExternalSources == 0 {
+		c.MaxExternalSources = DefaultMaxExternalSources
+	}
+	if c.MaxDuplicatePages < 0 {
+		return ErrInvalidMaxDuplicatePages
+	}
+	if c.MaxDuplicatePages == 0 {
+		c.MaxDuplicatePages = DefaultMaxDuplicatePages
+	}
+	if c.MaxMermaidNodes < 0 {
+		return ErrInvalidMaxMermaidNodes
+	}
+	if c.MaxMermaidNodes == 0 {
+		c.MaxMermaidNodes = DefaultMaxMermaidNodes
+	}
+	c.patternBudgets, err = compilePatternBudgets(c.PatternBudgets)
+	if err != nil {
+		return err
+	}
+	c.dirBudgets, err = newDirBudgets(c.DirBudgets)
+	if err != nil {
+		return err
+	}
+	c.incremental = nil
+	if c.IncrementalStateFile != "" {
+		c.incremental, err = loadIncrementalState(c.IncrementalStateFile)
+		if err != nil {
+			return err
+		}
+	}
 	if c.SiteMapOutputFile == "" {
 		c.SiteMapOutputFile = os.Stdout.Name()
 	}
-	if c.SiteMapWriter == nil {
-		f, err := os.Create(c.SiteMapOutputFile)
-		if err != nil {
-			return fmt.Errorf("can't create siteMap output file: %q", err.Error())
+	for _, config := range c.outputConfigs() {
+		if err := config.validate(); err != nil {
+			return err
 		}
-		c.SiteMapWriter = f
+	}
+	if c.dryRun == nil {
+		return c.openSiteMapSinks()
 	}
 	return nil
 }
 
+// init resets the state of the crawler before every Run.
 func (c *Crawler) init() {
 	c.workQueueCapacity = c.NumWorkers * 2
-	c.workQueue = make(chan webSite, c.workQueueCapacity)
-	c.workQueueDelta = make(chan int)
+	// unbuffered so the sites are taken from the frontier in order
+	c.workQueue = make(chan webSite)
+	c.workDone = make(chan bool)
 	c.siteFilterQueue = make(chan webSite, c.workQueueCapacity)
-	c.visitedSites = make(map[string]bool)
-	c.resultQueue = make(chan result, c.workQueueCapacity)
+	if c.dryRun != nil {
+		// a dry run doesn't visit the pages it reports
+		c.visited = mapVisitedStore{}
+	} else if c.VisitedStore != nil {
+		c.visited = c.VisitedStore
+	} else if _, ok := c.visited.(mapVisitedStore); !ok || !c.KeepState {
+		c.visited = mapVisitedStore{}
+	}
+	c.resultQueue = make(chan PageResult, c.workQueueCapacity)
 	c.siteMapDone = make(chan bool)
+	c.siteMapErr = nil
+	c.started = time.Now()
+	c.statsMu.Lock()
+	c.stats = Stats{}
+	c.fetchedSchemes = make(map[string]uint8)
+	c.pageDepths = make(map[string]int)
+	c.statusCodes = make(map[string]int)
+	c.inboundLinks = make(map[string]int)
+	c.slowestPages = nil
+	c.pageMetadata = make(map[string]PageMetadata)
+	c.contentHashes = newContentHashes(c.MaxDuplicatePages)
+	c.seedErr = nil
+	c.statsMu.Unlock()
+	c.resourcesMu.Lock()
+	c.resources = make(map[string]bool)
+	c.resourcesMu.Unlock()
+	c.canonicalsMu.Lock()
+	c.canonicals = make(map[string]string)
+	c.canonicalsMu.Unlock()
+	c.filters = append([]URLFilter{MediaFilter{}}, c.Filters...)
+	c.skipped = newSkippedURLs()
+	c.brokenLinks = nil
+	if c.RecordBrokenLinks {
+		c.brokenLinks = newBrokenLinks()
+	}
+	c.externalURLs = nil
+	if c.RecordExternalURLs {
+		c.externalURLs = newExternalURLs(c.MaxExternalURLs, c.MaxExternalSources)
+	}
+	c.redirectChains = nil
+	if c.RecordRedirects {
+		c.redirectChains = &redirectChains{}
+	}
+	c.hostLimiter = newHostLimiter()
+	c.rateLimiter = nil
+	if c.Rate > 0 {
+		c.rateLimiter = rate.NewLimiter(rate.Limit(c.Rate), 1)
+	}
+	c.hostSemaphores = newHostSemaphores(c.MaxConcurrentPerHost)
+	c.frontier = newFrontier(c.Order, c.PriorityFunc)
+	c.robots = make(map[string]*robotsRules)
+	c.robotsFetching = make(map[string]chan bool)
+	c.hostDelays = make(map[string]time.Duration)
+	atomic.StoreInt32(&c.pagesReserved, 0)
+	c.abortableMu.Lock()
+	atomic.StoreInt32(&c.stopped, 0)
+	c.abortable = make(map[int]context.CancelFunc)
+	c.abortableMu.Unlock()
+
+	c.workersMu.Lock()
+	c.workerQuits = nil
+	c.workers = 0
+	c.nextWorkerID = 0
+	c.workersDone = nil
+	c.workersExited = false
+	c.workersMu.Unlock()
+
+	c.normalizer = urlNormalizer{}
+	c.normalizer.keepFragments = c.KeepFragments
+	c.normalizer.keepSlash = c.KeepTrailingSlash
+	sessionParams := c.SessionParams
+	if sessionParams == nil {
+		sessionParams = DefaultSessionParams
+	}
+	for _, param := range sessionParams {
+		c.normalizer.sessionParams = append(c.normalizer.sessionParams, strings.ToLower(param))
+	}
+	seedURL, _ := strToAbsoluteURL(c.seedURLs()[0])
+	if c.EquateWWW {
+		c.normalizer.wwwHost = seedURL.Host
+	}
 }
 
-func (c *Crawler) workQueueDoneChecker() {
-	log.Debug("workQueueDoneChecker started.")
-	workQueueSize := 0
-	for delta := range c.workQueueDelta {
-		workQueueSize += delta
-		log.Debugf("Current WorkQueueSize is: %d", workQueueSize)
-		if workQueueSize == 0 {
-			close(c.workQueue)
-		}
+// finishSite notifies the dispatcher that the worker is done with the site
+// it took from workQueue, the sites found in it being already handed over.
+// It's a no-op once the crawl is stopped.
+func (c *Crawler) finishSite() {
+	select {
+	case c.workDone <- true:
+	case <-c.ctx.Done():
 	}
 }
 
-func (c *Crawler) workQueueAppender() {
-	log.Debug("workQueueAppender started.")
-	for newSite := range c.siteFilterQueue {
-		if isExternalURL(newSite) || isMediaURL(newSite.URL) {
-			c.workQueueDelta <- -1
+// dispatcher admits the discovered sites into the frontier and feeds the
+// workers from it, in the order given by Order. The frontier is unbounded
+// so the dispatcher never blocks on the workers, which in turn can always
+// hand their discovered sites over: however many links a page has, the
+// pipeline can't wedge and memory only grows in the frontier, whose size is
+// reported by Stats.
+//
+// The dispatcher alone accounts for the work: inFlight counts the sites
+// handed over to the workers and not finished yet. Since the workers hand
+// the sites they found over before finishing theirs, the crawl is done,
+// and workQueue closed, when nothing is in flight, the frontier is empty
+// and no site is pending in siteFilterQueue.
+func (c *Crawler) dispatcher(roots []webSite) {
+	log.Debug("dispatcher started.")
+	for _, root := range roots {
+		c.admit(root)
+	}
+	inFlight := 0
+	for {
+		// admit every pending site first, so they are ordered among the
+		// ones already in the frontier
+		select {
+		case newSite := <-c.siteFilterQueue:
+			c.admit(newSite)
 			continue
-
+		default:
+		}
+		if inFlight == 0 && c.frontier.len() == 0 {
+			close(c.workQueue)
+			return
 		}
 
-		siteURL := strings.TrimPrefix(newSite.URL.String(), newSite.URL.Scheme)
-		if !c.visitedSites[siteURL] {
-			c.visitedSites[siteURL] = true
-			c.workQueue <- newSite
-		} else {
-			c.workQueueDelta <- -1
+		var workQueue chan webSite
+		var next webSite
+		if c.frontier.len() > 0 {
+			workQueue = c.workQueue
+			next = c.frontier.peek()
+		}
+		select {
+		case newSite := <-c.siteFilterQueue:
+			c.admit(newSite)
+		case workQueue <- next:
+			c.frontier.pop()
+			c.recordFrontier(c.frontier.len())
+			inFlight++
+		case <-c.workDone:
+			inFlight--
+		case <-c.ctx.Done():
+			return
 		}
 	}
 }
 
+// admit pushes the site into the frontier, unless it must not be crawled.
+func (c *Crawler) admit(newSite webSite) {
+	if newSite.markVisited {
+		c.markVisited(c.dedupKey(newSite.URL))
+		return
+	}
+
+	if reason, skip := c.skipReason(newSite); skip {
+		c.skip(newSite, reason)
+		return
+	}
+
+	if f, rejected := c.rejectingFilter(newSite); rejected {
+		c.recordFiltered(filterName(f))
+		c.skip(newSite, filteredBy(f))
+		return
+	}
+
+	siteURL := c.dedupKey(newSite.URL)
+	if c.visited.Seen(siteURL) {
+		c.skip(newSite, SkipVisited)
+		return
+	}
+	// too deep URLs are not marked as visited so a shallower link
+	// found later can still have them crawled. A crawled page keeps
+	// the depth of the first link accepted for it which, since pages
+	// are fetched concurrently, may not be its shortest distance to
+	// the seed.
+	if c.MaxDepth > 0 && newSite.Depth > c.MaxDepth {
+		c.skip(newSite, SkipMaxDepth)
+		return
+	}
+	if c.maxPagesReached() {
+		c.skip(newSite, SkipMaxPages)
+		return
+	}
+	// like for MaxPages, the site is not marked as visited since the
+	// budget is given back when a fetch fails
+	if c.dirBudgets.exhausted(newSite.URL) {
+		c.skip(newSite, SkipDirBudgetExhausted)
+		return
+	}
+	if c.isStopped() {
+		c.skip(newSite, SkipStopped)
+		return
+	}
+	// over budget URLs are marked as visited so they are tallied once
+	c.markVisited(siteURL)
+	if pattern, exhausted := c.spendPatternBudget(newSite.URL.String()); exhausted {
+		log.Debugf("Budget for %q exhausted", pattern)
+		c.recordBudgetExhausted(pattern)
+		c.skip(newSite, SkipBudgetExhausted)
+		return
+	}
+	c.frontier.push(newSite)
+	c.recordFrontier(c.frontier.len())
+}
+
+// markVisited adds the key to the visited set. A page not recorded because
+// of a store error may be crawled again, so it's only logged.
+func (c *Crawler) markVisited(key string) {
+	if err := c.visited.Add(key); err != nil {
+		log.Errorf("Failed to mark %q as visited: %s", key, err.Error())
+	}
+	if b, ok := c.visited.(*BloomVisitedStore); ok {
+		c.recordVisitedFillRatio(b.FillRatio())
+	}
+}
+
+// skip records the site as not crawled for the given reason.
+func (c *Crawler) skip(s webSite, reason SkipReason) {
+	log.Debugf("Skipping %q: %s", s.URL.String(), reason)
+	c.recordSkipped(reason)
+	if reason == SkipExternal {
+		c.externalChecker.check(s)
+	}
+	if c.RecordSkipped {
+		c.skipped.add(s, reason)
+	}
+	if c.dryRun != nil {
+		c.dryRun.addLink(s, reason)
+	}
+}
+
+// skipReason reports whether the given site must not be crawled and why.
+func (c *Crawler) skipReason(s webSite) (SkipReason, bool) {
+	if c.isExternal(s) {
+		return SkipExternal, true
+	}
+	if len(s.URL.String()) > c.MaxURLLength {
+		return SkipURLTooLong, true
+	}
+	if c.MaxPathSegments > 0 && pathSegments(s.URL) > c.MaxPathSegments {
+		return SkipPathTooDeep, true
+	}
+	if c.denylist.match(s.URL) {
+		return SkipDenylisted, true
+	}
+	// the hosts whose rules weren't fetched yet are checked by the worker
+	if !c.cachedRobots(s.URL.Host).allowed(s.URL) {
+		return SkipRobots, true
+	}
+	if c.RespectNofollow && s.noFollow {
+		return SkipNofollow, true
+	}
+	if maxConsecutiveSegments(s.URL) > c.MaxRepeatedSegments {
+		return SkipRepeatedSegments, true
+	}
+	return "", false
+}
+
+// isExternal reports whether the site is on a different host than its
+// parent or, with IncludeSubdomains, on a different registrable domain.
+func (c *Crawler) isExternal(s webSite) bool {
+	if c.IncludeSubdomains {
+		return s.Parent != nil && !SameSite(s.URL.Host, s.Parent.Host)
+	}
+	return isExternalURL(s)
+}
+
+// dedupKey returns the key used in the visited set for the given URL.
+// DedupKeyFunc is used if set, defaultDedupKey otherwise.
+func (c *Crawler) dedupKey(u *url.URL) string {
+	if c.DedupKeyFunc != nil {
+		return c.DedupKeyFunc(u)
+	}
+	return c.defaultDedupKey(u)
+}
+
+// defaultDedupKey returns the URL without the scheme, unless
+// SchemeSensitive is set, so http and https variants are visited once.
+func (c *Crawler) defaultDedupKey(u *url.URL) string {
+	key := schemelessKey(u)
+	if c.SchemeSensitive {
+		key = u.String()
+	}
+	if c.EquateWWW {
+		key = strings.Replace(key, "//"+u.Host, "//"+stripWWW(u.Host), 1)
+	}
+	return key
+}
+
 func (c *Crawler) siteMapBuilder() {
+	// pages sharing a canonical URL are written once
+	sources := map[string]bool{}
+	var edges *edgeSet
+	if c.DedupeEdges {
+		edges = newEdgeSet(c.MaxDedupeEdges)
+	}
 	for r := range c.resultQueue {
-		for _, s := range r.ChildrenSites {
-			line := fmt.Sprintf("%v -> %v\n", r.SourceSite.URL.String(), s.URL.String())
-			fmt.Fprint(c.SiteMapWriter, line)
+		r.URL = r.site.URL.String()
+		r.Depth = r.site.Depth
+		if r.Error != nil {
+			if c.OnPage != nil {
+				c.OnPage(r)
+			}
+			for _, sink := range c.siteMapSinks {
+				sink.write(c, r)
+			}
+			continue
+		}
+		source := c.dedupKey(r.site.URL)
+		if sources[source] {
+			continue
+		}
+		sources[source] = true
+		r.Links = c.pageLinks(r)
+		c.recordInboundLinks(r)
+		c.recordLatency(r)
+		if c.OnPage != nil && !r.resource {
+			c.OnPage(r)
+		}
+		c.brokenLinks.addLinks(r)
+		c.externalURLs.add(c, r)
+		if err := c.sqlite.write(r); err != nil {
+			log.Errorf("Failed to write %q to the SQLite output file: %s", r.URL, err.Error())
+		}
+		if c.RespectRobotsMeta && r.NoIndex {
+			log.Debugf("Not writing %q: robots meta noindex", r.URL)
+			continue
+		}
+		external := map[string]int{}
+		for _, s := range r.children {
+			if c.isExternal(*s) {
+				external[c.externalDomain(s.URL.Hostname())]++
+			}
+		}
+		c.recordExternalLinks(external)
+		if edges != nil {
+			r = c.dedupeEdges(r, edges)
+			r.Links = c.pageLinks(r)
+		}
+		for _, sink := range c.siteMapSinks {
+			sink.write(c, r)
 		}
 	}
+	c.siteMapErr = c.closeSiteMapSinks()
 	c.siteMapDone <- true
 }
 
-func (c *Crawler) startWorker(id int) {
+// SetNumWorkers changes the number of workers of a running crawl. Surplus
+// workers finish the page they are crawling, if any, before exiting. When
+// the crawl is not running it sets NumWorkers for the next Run.
+func (c *Crawler) SetNumWorkers(n int) error {
+	if n <= 0 {
+		return ErrInvalidNumWorkers
+	}
+	c.workersMu.Lock()
+	defer c.workersMu.Unlock()
+	switch {
+	case c.workersDone == nil || c.workersExited:
+		c.NumWorkers = n
+	case n > len(c.workerQuits):
+		c.startWorkers(n - len(c.workerQuits))
+	default:
+		for _, quit := range c.workerQuits[n:] {
+			close(quit)
+		}
+		c.workerQuits = c.workerQuits[:n]
+	}
+	return nil
+}
+
+// startWorkers spawns n more workers. workersMu must be held.
+func (c *Crawler) startWorkers(n int) {
+	for i := 0; i < n; i++ {
+		quit := make(chan bool)
+		c.workerQuits = append(c.workerQuits, quit)
+		c.workers++
+		go c.startWorker(c.nextWorkerID, quit)
+		c.nextWorkerID++
+	}
+}
+
+// workerExited signals workersDone when the last worker exits. It's closed
+// once workersMu is unlocked, as Run may return as soon as it is.
+func (c *Crawler) workerExited(quit chan bool) {
+	c.workersMu.Lock()
+	for i, q := range c.workerQuits {
+		if q == quit {
+			c.workerQuits = append(c.workerQuits[:i], c.workerQuits[i+1:]...)
+			break
+		}
+	}
+	c.workers--
+	last := c.workers == 0
+	if last {
+		c.workersExited = true
+	}
+	c.workersMu.Unlock()
+	if last {
+		close(c.workersDone)
+	}
+}
+
+func (c *Crawler) startWorker(id int, quit chan bool) {
 	log.Debugf("Started worker %d", id)
-	defer c.wg.Done()
-	for site := range c.workQueue {
+	defer c.workerExited(quit)
+	for {
+		select {
+		case <-quit:
+			log.Debugf("Retired worker %d", id)
+			return
+		default:
+		}
+		var site webSite
+		select {
+		case <-quit:
+			log.Debugf("Retired worker %d", id)
+			return
+		case s, ok := <-c.workQueue:
+			if !ok {
+				return
+			}
+			site = s
+		case <-c.ctx.Done():
+			return
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
 		log.Debugf("[worker %d] Reading site out of work queue: %v\n", id, site)
-		newSites, err := c.scrape(site)
+		if c.isStopped() {
+			c.refundPatternBudget(site.URL)
+			c.skip(site, SkipStopped)
+			c.finishSite()
+			continue
+		}
+		if !c.IgnoreRobots && !c.hostRobots(site.URL).allowed(site.URL) {
+			// the rules of the host weren't fetched when it was admitted
+			c.refundPatternBudget(site.URL)
+			c.skip(site, SkipRobots)
+			c.finishSite()
+			continue
+		}
+		if c.dryRun != nil && (site.Parent != nil || site.sitemap != nil) {
+			// only the seeds are fetched by a dry run
+			c.dryRun.addLink(site, "")
+			c.finishSite()
+			continue
+		}
+		if !c.reservePage() {
+			c.refundPatternBudget(site.URL)
+			c.skip(site, SkipMaxPages)
+			c.finishSite()
+			continue
+		}
+		if !c.dirBudgets.reserve(site.URL) {
+			c.releasePage()
+			c.refundPatternBudget(site.URL)
+			c.skip(site, SkipDirBudgetExhausted)
+			c.finishSite()
+			continue
+		}
+		r, err := c.scrapeRecovering(site)
+		if err != nil && c.ctx.Err() != nil {
+			// the request was aborted because the crawl was stopped
+			return
+		}
+		if err == errStopped {
+			c.recordTruncated(TruncatedStopped)
+			c.releasePage()
+			c.dirBudgets.release(site.URL)
+			c.refundPatternBudget(site.URL)
+			c.incremental.keep(site.URL)
+			c.skip(site, SkipStopped)
+			c.finishSite()
+			continue
+		}
 		if err != nil {
 			log.Errorf("Failed to parse %q: %s", site.URL.String(), err.Error())
-			c.workQueueDelta <- -1
+			c.releasePage()
+			c.dirBudgets.release(site.URL)
+			c.refundPatternBudget(site.URL)
+			c.incremental.keep(site.URL)
+			c.recordPageFailed(site, err)
+			c.brokenLinks.addFailure(site, err)
+			if c.dryRun == nil {
+				c.resultQueue <- failedResult(site, err)
+			}
+			if err := c.sqlite.writeFailed(site, err); err != nil {
+				log.Errorf("Failed to write %q to the SQLite output file: %s", site.URL.String(), err.Error())
+			}
+			c.finishSite()
 			continue
 		}
 
-		c.resultQueue <- result{SourceSite: site, ChildrenSites: newSites}
+		c.recordPageFetched(site.URL)
+		c.recordPageDepth(site.URL, site.Depth)
+		c.recordStatusCode(site.URL, r.StatusCode)
+		r.Metadata.OGURLMismatch = c.ogURLMismatch(r)
+		c.recordPageMetadata(site.URL, r.Metadata)
+		c.recordSkippedSchemes(r.skippedSchemes)
+		if c.dryRun != nil {
+			c.dryRun.addFetched(site)
+		}
+		var newSites []*webSite
+		if c.RespectRobotsMeta && r.NoFollow {
+			log.Debugf("Not following links of %q: robots meta nofollow", site.URL.String())
+		} else if c.OnlyLang != "" && r.Metadata.Lang != "" && !matchesLang(r.Metadata.Lang, c.OnlyLang) {
+			log.Debugf("Not following links of %q: language %q", site.URL.String(), r.Metadata.Lang)
+		} else {
+			newSites = r.children
+		}
+		if c.dedupKey(r.site.URL) != c.dedupKey(site.URL) {
+			// the seed redirect was adopted
+			marker := &webSite{URL: r.site.URL, markVisited: true}
+			newSites = append([]*webSite{marker}, newSites...)
+		}
+		if marker, ok := c.applyCanonical(&r); ok {
+			newSites = append([]*webSite{marker}, newSites...)
+		}
+		if c.FollowFeeds && c.dryRun == nil {
+			// sent with the children of the page, so the crawl can't
+			// end before they are admitted
+			for _, feed := range c.feedResults(r) {
+				newSites = append(newSites, feed.children...)
+				c.resultQueue <- feed
+			}
+		}
+		if c.dryRun == nil {
+			c.resultQueue <- r
+			if c.IncludeAssets && c.FetchStylesheets {
+				for _, sheet := range c.stylesheetResults(r) {
+					c.resultQueue <- sheet
+				}
+			}
+		}
 
-		go func() {
-			for _, s := range newSites {
-				c.siteFilterQueue <- *s
+		// sent before taking more work so the Order applies to them. The
+		// dispatcher never blocks on the workers, so this can't deadlock.
+		for _, s := range newSites {
+			select {
+			case c.siteFilterQueue <- *s:
+			case <-c.ctx.Done():
+				return
 			}
-		}()
+		}
+		c.finishSite()
+	}
+}
 
-		c.workQueueDelta <- -1
+// Stop finishes the crawl early: no more pages are fetched, the requests
+// still waiting for a response are aborted and the pages being read are
+// finished. Run returns nil once the site map of the pages fetched so far
+// has been written. The crawl is then reported as truncated by Stats.
+// It's safe to call it several times, also once the crawl has ended.
+func (c *Crawler) Stop() {
+	c.abortableMu.Lock()
+	defer c.abortableMu.Unlock()
+	atomic.StoreInt32(&c.stopped, 1)
+	for id, cancel := range c.abortable {
+		cancel()
+		delete(c.abortable, id)
 	}
 }
 
-func (c *Crawler) scrape(s webSite) ([]*webSite, error) {
-	log.Debugf("Starting to parse webSite: %v", s)
-	client := &http.Client{
-		Timeout: time.Duration(c.HTTPClientTimeoutSec) * time.Second,
+// abortOnStop makes Stop call cancel, right away if the crawl is already
+// stopped, until the returned function is called.
+func (c *Crawler) abortOnStop(cancel context.CancelFunc) func() {
+	c.abortableMu.Lock()
+	defer c.abortableMu.Unlock()
+	if atomic.LoadInt32(&c.stopped) != 0 {
+		cancel()
+		return func() {}
 	}
+	id := c.nextAbortableID
+	c.nextAbortableID++
+	c.abortable[id] = cancel
+	return func() {
+		c.abortableMu.Lock()
+		defer c.abortableMu.Unlock()
+		delete(c.abortable, id)
+	}
+}
 
-	request, err := http.NewRequest("GET", s.URL.String(), nil)
-	if err != nil {
-		return nil, err
+// isStopped reports whether Stop was called, so pending pages are not
+// fetched.
+func (c *Crawler) isStopped() bool {
+	if atomic.LoadInt32(&c.stopped) == 0 {
+		return false
+	}
+	c.recordTruncated(TruncatedStopped)
+	return true
+}
+
+// reservePage reserves one of the MaxPages pages for a fetch. Pages are
+// reserved before being fetched so concurrent workers never exceed it.
+func (c *Crawler) reservePage() bool {
+	if c.MaxPages == 0 {
+		return true
+	}
+	if atomic.AddInt32(&c.pagesReserved, 1) > int32(c.MaxPages) {
+		atomic.AddInt32(&c.pagesReserved, -1)
+		c.recordTruncated(TruncatedMaxPages)
+		return false
+	}
+	return true
+}
+
+// releasePage gives back the page reserved for a failed fetch.
+func (c *Crawler) releasePage() {
+	if c.MaxPages != 0 {
+		atomic.AddInt32(&c.pagesReserved, -1)
+	}
+}
+
+// maxPagesReached reports whether no more pages can be reserved, so
+// discovered URLs are not enqueued.
+func (c *Crawler) maxPagesReached() bool {
+	if c.MaxPages == 0 || atomic.LoadInt32(&c.pagesReserved) < int32(c.MaxPages) {
+		return false
+	}
+	c.recordTruncated(TruncatedMaxPages)
+	return true
+}
+
+// applyCanonical records the canonical URL declared by the page, if it
+// differs from the page URL. Internal canonicals replace the page URL as
+// the source of the discovered links and are returned as a marker so the
+// canonical URL is flagged as visited instead of being fetched again.
+func (c *Crawler) applyCanonical(r *PageResult) (*webSite, bool) {
+	if r.Canonical == nil || c.dedupKey(r.Canonical) == c.dedupKey(r.site.URL) {
+		return nil, false
+	}
+	c.recordCanonical(r.site.URL, r.Canonical)
+	if c.isExternal(webSite{URL: r.Canonical, Parent: r.site.URL}) {
+		return nil, false
+	}
+	log.Debugf("Attributing %q to canonical %q", r.site.URL.String(), r.Canonical.String())
+	marker := &webSite{URL: r.Canonical, Parent: r.site.URL, markVisited: true}
+	r.site.URL = r.Canonical
+	return marker, true
+}
+
+func (c *Crawler) recordCanonical(u, canonical *url.URL) {
+	c.canonicalsMu.Lock()
+	defer c.canonicalsMu.Unlock()
+	c.canonicals[u.String()] = canonical.String()
+}
+
+// Canonicals returns the mapping between fetched URLs and the canonical
+// URL they declared through <link rel="canonical">, when they differ.
+func (c *Crawler) Canonicals() map[string]string {
+	c.canonicalsMu.Lock()
+	defer c.canonicalsMu.Unlock()
+	canonicals := make(map[string]string, len(c.canonicals))
+	for u, canonical := range c.canonicals {
+		canonicals[u] = canonical
+	}
+	return canonicals
+}
+
+// failedResult returns the result of the site whose crawl failed with err,
+// for OnPage and the outputs recording the failed pages.
+func failedResult(s webSite, err error) PageResult {
+	r := PageResult{site: s, Error: err}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		r.StatusCode = statusErr.code
+	}
+	var loopErr *RedirectLoopError
+	if errors.As(err, &loopErr) {
+		r.Redirects = loopErr.Redirects
+	}
+	return r
+}
+
+// scrapeRecovering is like scrape but a panic, e.g. in a hook or while
+// parsing a pathological page, is logged and returned as an error so the
+// page is counted as failed, unless PanicOnError is set.
+func (c *Crawler) scrapeRecovering(s webSite) (r PageResult, err error) {
+	if !c.PanicOnError {
+		defer func() {
+			if p := recover(); p != nil {
+				log.Errorf("Panic while crawling %q: %v\n%s", s.URL.String(), p, debug.Stack())
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+	}
+	return c.scrape(s)
+}
+
+func (c *Crawler) scrape(s webSite) (PageResult, error) {
+	log.Debugf("Starting to parse webSite: %v", s)
+	// the request is aborted by Stop until the response arrives
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	responded := c.abortOnStop(cancel)
+	defer responded()
+	pageCtx := ctx
+	abortErr := func(err error) error {
+		switch {
+		case c.ctx.Err() != nil:
+			return err
+		case ctx.Err() != nil:
+			return errStopped
+		case pageCtx.Err() != nil:
+			return errPageDeadline
+		}
+		return err
 	}
-	request.Header.Set("User-Agent", DefaultCrawlerUserAgent)
+	previous := c.incremental.page(s.URL)
 
-	response, err := client.Do(request)
+	if err := c.hostSemaphores.acquire(ctx, s.URL.Host); err != nil {
+		return PageResult{}, abortErr(err)
+	}
+	defer c.hostSemaphores.release(s.URL.Host)
+	if err := c.throttle(ctx, s.URL.Host); err != nil {
+		return PageResult{}, abortErr(err)
+	}
+	if c.PageDeadline > 0 {
+		// waiting for the host doesn't count
+		var cancelPage context.CancelFunc
+		pageCtx, cancelPage = context.WithTimeout(ctx, c.PageDeadline)
+		defer cancelPage()
+	}
+	response, err := c.pageFetcher().Fetch(c.withThrottle(pageCtx, s.URL.Host), s.URL)
+	responded()
 	if err != nil {
-		return nil, err
+		c.recordRedirectLoop(s, err)
+		return PageResult{}, abortErr(err)
 	}
 	defer response.Body.Close()
+	if response.URL == nil {
+		response.URL = s.URL
+	}
+	c.recordRedirects(s, response)
+	log.Debugf("Fetched %q in %v: %s", s.URL.String(), response.Duration, response.status())
 
+	if previous != nil && response.StatusCode == http.StatusNotModified {
+		c.incremental.record(s.URL, PageRevalidated, previous)
+		r := previous.result(s)
+		r.StatusCode = response.StatusCode
+		r.Duration = response.Duration
+		r.FinalURL = response.URL.String()
+		r.Redirects = response.Redirects
+		r.Attempts = response.attempts()
+		return r, nil
+	}
 	if response.StatusCode >= http.StatusBadRequest {
-		return nil, fmt.Errorf("%v", response.Status)
+		if previous != nil && (response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone) {
+			log.Infof("Page %q was removed", s.URL.String())
+			c.incremental.record(s.URL, PageRemoved, nil)
+		}
+		return PageResult{}, &statusError{code: response.StatusCode, status: response.status()}
 	}
 
-	sites, err := s.getNewSites(response.Body)
+	var r PageResult
+	hash := sha256.New()
+	var hashWriter io.Writer = hash
+	if c.HashNormalizeSpace {
+		hashWriter = &spaceCollapser{w: hash}
+	}
+	size := &byteCounter{}
+	sink := io.MultiWriter(hashWriter, size)
+	body := io.TeeReader(response.Body, sink)
+	contentType := response.Header.Get("Content-Type")
+	extractor := c.extractor(contentType)
+	switch {
+	case extractor != nil:
+		r, err = c.parse(pageCtx, s, extractor, contentType, body)
+	case isSitemapResponse(response):
+		r, err = c.sitemapResult(s, body)
+	default:
+		html := HTMLExtractor{
+			MaxLinks:           c.MaxLinksPerPage,
+			MaxAttributeLength: c.MaxAttributeLength,
+			IncludeTemplates:   c.IncludeTemplates,
+			SkipNoscript:       c.SkipNoscript,
+		}
+		r, err = c.parse(pageCtx, s, html, contentType, body)
+	}
 	if err != nil {
-		return nil, err
+		return PageResult{}, abortErr(err)
+	}
+	// the part of the body not read by the extractor
+	if _, err := io.Copy(sink, response.Body); err != nil {
+		return PageResult{}, abortErr(err)
+	}
+	r.Metadata.ContentHash = hex.EncodeToString(hash.Sum(nil))
+	if r.Metadata.Lang == "" {
+		r.Metadata.Lang = parseLang(response.Header.Get("Content-Language"))
+	}
+	if c.CrawlFrames {
+		r.crawlAssets(r.isFrame)
+	}
+	if c.FollowForms {
+		r.crawlAssets(isGetForm)
+	}
+	r.Metadata.DeadEnd = c.isDeadEnd(r, contentType)
+	r.StatusCode = response.StatusCode
+	r.Duration = response.Duration
+	r.Bytes = size.n
+	r.FinalURL = response.URL.String()
+	r.Redirects = response.Redirects
+	r.Attempts = response.attempts()
+	if lastModified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		r.LastModified = lastModified
+	}
+	for _, child := range r.children {
+		child.text = truncateText(child.text, c.MaxLinkTextLength)
+	}
+	if previous != nil {
+		c.incremental.record(s.URL, PageRefetched, newPageState(r, response))
+	} else {
+		c.incremental.record(s.URL, PageNew, newPageState(r, response))
 	}
 
-	if len(sites) != 0 {
-		c.workQueueDelta <- len(sites)
+	return r, nil
+}
+
+// applyCrawlDelay sets the delay between requests to host to the robots.txt
+// Crawl-delay, clamped to MaxCrawlDelay, when it's longer than Delay and
+// OverrideCrawlDelay is not set.
+func (c *Crawler) applyCrawlDelay(host string) {
+	rules := c.cachedRobots(host)
+	if rules == nil || rules.crawlDelay == 0 {
+		return
+	}
+	crawlDelay := rules.crawlDelay
+	if crawlDelay > c.MaxCrawlDelay {
+		log.Warnf("Clamping robots.txt Crawl-delay of %q from %v to %v", host, crawlDelay, c.MaxCrawlDelay)
+		crawlDelay = c.MaxCrawlDelay
 	}
+	if crawlDelay > c.Delay && !c.OverrideCrawlDelay {
+		c.robotsMu.Lock()
+		c.hostDelays[host] = crawlDelay
+		c.robotsMu.Unlock()
+	}
+	log.Debugf("Delay between requests to %q: %v", host, c.delay(host))
+}
+
+// delay returns the min time between the start of two requests to host.
+func (c *Crawler) delay(host string) time.Duration {
+	c.robotsMu.RLock()
+	defer c.robotsMu.RUnlock()
+	if d, ok := c.hostDelays[host]; ok {
+		return d
+	}
+	return c.Delay
+}
+
+func (c *Crawler) httpClient() *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(c.HTTPClientTimeoutSec) * time.Second,
+	}
+}
+
+// resolveSeedRedirect fetches the seed and returns the final URL of the
+// fetch when redirects ended on a different host, so that host becomes the
+// internal one, or the seed otherwise. It's only called before the crawl
+// starts, as it may change the normalizer. The seed isn't fetched if the
+// robots.txt of its host disallows it.
+func (c *Crawler) resolveSeedRedirect(seedURL *url.URL) *url.URL {
+	if !c.IgnoreRobots && !c.hostRobots(seedURL).allowed(seedURL) {
+		return seedURL
+	}
+	response, err := c.fetch(seedURL)
+	if err != nil {
+		// the seed fails again when crawled
+		return seedURL
+	}
+	response.Body.Close()
+	if response.URL == nil {
+		return seedURL
+	}
+	finalURL, err := c.normalizer.parseAbsolute(response.URL.String())
+	if err != nil || finalURL.Host == seedURL.Host {
+		return seedURL
+	}
+	log.Infof("Seed %q redirected to %q: adopting %q as the internal host", seedURL.String(), finalURL.String(), finalURL.Host)
+	if c.EquateWWW {
+		c.normalizer.wwwHost = finalURL.Host
+	}
+	return finalURL
+}
+
+// isFrame reports whether the asset is a frame on the host of the page,
+// which is crawled with CrawlFrames: it holds a HTML page.
+func (r *PageResult) isFrame(a asset) bool {
+	return (a.Element == "iframe" || a.Element == "frame") && a.URL.Host == r.site.URL.Host
+}
+
+// isGetForm reports whether the asset is the action of a GET form, which
+// is crawled with FollowForms.
+func isGetForm(a asset) bool {
+	return a.Element == "form" && a.Method == "get"
+}
+
+// crawlAssets moves the assets matching crawl to the children of the
+// page, so they are crawled.
+func (r *PageResult) crawlAssets(crawl func(asset) bool) {
+	assets := r.assets[:0]
+	for _, a := range r.assets {
+		if !crawl(a) {
+			assets = append(assets, a)
+			continue
+		}
+		duplicate := false
+		for _, child := range r.children {
+			duplicate = duplicate || child.URL.String() == a.URL.String()
+		}
+		if !duplicate {
+			s := r.site
+			r.children = append(r.children, &webSite{URL: a.URL, Parent: s.URL, Depth: s.Depth + 1, element: a.Element})
+		}
+	}
+	r.assets = assets
+}
 
-	return sites, nil
+// firstResourceFetch reports whether the resource of a page, e.g. a
+// stylesheet, is allowed by robots.txt and fetched for the first time in
+// the crawl, marking it as fetched.
+func (c *Crawler) firstResourceFetch(u *url.URL) bool {
+	if !c.cachedRobots(u.Host).allowed(u) {
+		return false
+	}
+	c.resourcesMu.Lock()
+	defer c.resourcesMu.Unlock()
+	if c.resources[u.String()] {
+		return false
+	}
+	c.resources[u.String()] = true
+	return true
 }
 
-func (s webSite) getNewSites(siteContent io.Reader) ([]*webSite, error) {
-	log.Debugf("Starting to get new webSites for %v", s)
-	links, err := getLinks(siteContent)
+// fetchResource returns up to maxSize bytes of the body of the resource.
+func (c *Crawler) fetchResource(u *url.URL, maxSize int64) ([]byte, error) {
+	response, err := c.fetch(u)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get links: %s", err.Error())
+		return nil, err
 	}
-	log.Debugf("Extracted links: %v", links)
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("%v", response.status())
+	}
+	return ioutil.ReadAll(io.LimitReader(response.Body, maxSize))
+}
+
+// extractor returns the LinkExtractor of the pages of the media type:
+// the one in Extractors or else Extractor, which may be nil.
+func (c *Crawler) extractor(contentType string) LinkExtractor {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if extractor, ok := c.Extractors[mediaType]; ok {
+		return extractor
+	}
+	return c.Extractor
+}
 
-	urlSet := map[string]bool{}
-	var newSites []*webSite
-	for _, link := range links {
-		newURL, err := strToURL(link)
+// extract gets the new sites of the page from the data extracted by
+// extractor.
+func (c *Crawler) extract(s webSite, extractor LinkExtractor, contentType string, body io.Reader) (PageResult, error) {
+	page, err := extractor.Extract(s.URL, contentType, body)
+	if err != nil {
+		return PageResult{}, fmt.Errorf("failed to get links: %s", err.Error())
+	}
+	// the limits of custom extractors
+	if len(page.Links) > c.MaxLinksPerPage {
+		page.Links = page.Links[:c.MaxLinksPerPage]
+		page.Truncated = true
+	}
+	if len(page.Assets) > c.MaxLinksPerPage {
+		page.Assets = page.Assets[:c.MaxLinksPerPage]
+		page.Truncated = true
+	}
+	if page.Truncated {
+		log.Warnf("Page %q truncated: some links or attributes were left out", s.URL.String())
+	}
+	return s.getNewSites(page, c.normalizer), nil
+}
+
+// parse gets the new sites of the page, giving up when ctx is done. With a
+// PageDeadline or MaxParseTime, the parsing is abandoned at the deadline
+// and finishes in the background, so a pathological page doesn't hold the
+// worker.
+func (c *Crawler) parse(ctx context.Context, s webSite, extractor LinkExtractor, contentType string, body io.Reader) (PageResult, error) {
+	if c.PageDeadline == 0 && c.MaxParseTime == 0 {
+		return c.extract(s, extractor, contentType, body)
+	}
+	parseCtx := ctx
+	if c.MaxParseTime > 0 {
+		var cancel context.CancelFunc
+		parseCtx, cancel = context.WithTimeout(ctx, c.MaxParseTime)
+		defer cancel()
+	}
+	type parsed struct {
+		r   PageResult
+		err error
+	}
+	done := make(chan parsed, 1)
+	go func() {
+		if !c.PanicOnError {
+			defer func() {
+				if p := recover(); p != nil {
+					log.Errorf("Panic while parsing %q: %v\n%s", s.URL.String(), p, debug.Stack())
+					done <- parsed{err: fmt.Errorf("panic: %v", p)}
+				}
+			}()
+		}
+		r, err := c.extract(s, extractor, contentType, body)
+		done <- parsed{r, err}
+	}()
+	select {
+	case p := <-done:
+		return p.r, p.err
+	case <-parseCtx.Done():
+		if ctx.Err() == nil {
+			return PageResult{}, errParseTime
+		}
+		return PageResult{}, ctx.Err()
+	}
+}
+
+// getNewSites returns the result of the page: the links, assets and
+// metadata of its data resolved against its URL.
+func (s webSite) getNewSites(page PageData, n urlNormalizer) PageResult {
+	log.Debugf("Extracted links of %v: %v", s, page.Links)
+
+	r := PageResult{site: s, NoIndex: page.NoIndex, NoFollow: page.NoFollow, Metadata: page.Metadata}
+	r.Metadata.Truncated = page.Truncated
+	if page.Canonical != "" {
+		var err error
+		r.Canonical, err = s.resolve(page.Canonical, n)
 		if err != nil {
-			log.Debugf("Skipping %q. Error: %q", link, err.Error())
+			log.Debugf("Ignoring canonical %q. Error: %q", page.Canonical, err.Error())
+		} else {
+			r.Metadata.Canonical = r.Canonical.String()
+		}
+	}
+	for _, field := range []*string{&r.Metadata.OGURL, &r.Metadata.OGImage} {
+		if *field == "" {
+			continue
+		}
+		u, err := s.resolve(*field, n)
+		if err != nil {
+			log.Debugf("Ignoring OpenGraph URL %q. Error: %q", *field, err.Error())
+			*field = ""
 			continue
 		}
+		*field = u.String()
+	}
 
-		if isRelativeURL(newURL) {
-			if newURL.Scheme == "" {
-				newURL.Scheme = s.URL.Scheme
+	urlSet := map[string]*webSite{}
+	for _, link := range page.Links {
+		if scheme, ok := nonWebScheme(link.Href); ok {
+			if r.skippedSchemes == nil {
+				r.skippedSchemes = map[string]int{}
 			}
-			if newURL.Host == "" {
-				newURL.Host = s.URL.Host
+			r.skippedSchemes[scheme]++
+			continue
+		}
+
+		newURL, err := s.resolve(link.Href, n)
+		if err != nil {
+			log.Debugf("Skipping %q. Error: %q", link.Href, err.Error())
+			continue
+		}
+
+		if site, ok := urlSet[newURL.String()]; ok {
+			site.occurrences++
+			// a single followable link is enough to follow the URL
+			site.noFollow = site.noFollow && link.isNofollow()
+			if site.text == "" {
+				site.text = link.Text
 			}
+			continue
 		}
+		log.Debugf("Appending newSite: %s -> %s", s.URL.String(), newURL.String())
+		site := &webSite{URL: newURL, Parent: s.URL, Depth: s.Depth + 1, noFollow: link.isNofollow(), element: link.Element, text: link.Text, occurrences: 1}
+		urlSet[newURL.String()] = site
+		r.children = append(r.children, site)
+	}
+	for scheme, n := range r.skippedSchemes {
+		log.Debugf("%d %s links on %s", n, scheme, s.URL.String())
+	}
 
-		if !urlSet[newURL.String()] {
-			urlSet[newURL.String()] = true
-			log.Debugf("Appending newSite: %s -> %s", s.URL.String(), newURL.String())
-			newSites = append(newSites, &webSite{URL: newURL, Parent: s.URL})
+	// the alternates on the host of the page are pages of the site too
+	for _, link := range page.Alternates {
+		altURL, err := s.resolve(link.Href, n)
+		if err != nil {
+			log.Debugf("Ignoring alternate %q. Error: %q", link.Href, err.Error())
+			continue
 		}
+		r.Metadata.Alternates = append(r.Metadata.Alternates, AlternateLink{Rel: strings.Join(link.Rel, " "), Hreflang: link.Lang, URL: altURL.String()})
+		if _, ok := urlSet[altURL.String()]; ok || altURL.Host != s.URL.Host {
+			continue
+		}
+		site := &webSite{URL: altURL, Parent: s.URL, Depth: s.Depth + 1, element: link.Element}
+		urlSet[altURL.String()] = site
+		r.children = append(r.children, site)
+	}
+
+	for _, href := range page.Feeds {
+		feedURL, err := s.resolve(href, n)
+		if err != nil {
+			log.Debugf("Ignoring feed %q. Error: %q", href, err.Error())
+			continue
+		}
+		r.Metadata.Feeds = append(r.Metadata.Feeds, feedURL.String())
+	}
+
+	assetSet := map[string]bool{}
+	for _, link := range page.Assets {
+		if _, ok := nonWebScheme(link.Href); ok {
+			// e.g. inline data: images
+			continue
+		}
+		assetURL, err := s.resolve(link.Href, n)
+		if err != nil {
+			log.Debugf("Skipping asset %q. Error: %q", link.Href, err.Error())
+			continue
+		}
+		if !assetSet[assetURL.String()] {
+			assetSet[assetURL.String()] = true
+			r.assets = append(r.assets, asset{URL: assetURL, Element: link.Element, Method: link.Method})
+		}
+	}
+	r.Metadata.MixedContent = r.mixedContent()
+
+	return r
+}
+
+// resolve parses a link found in the site and makes it absolute.
+func (s webSite) resolve(link string, n urlNormalizer) (*url.URL, error) {
+	newURL, err := n.parse(link)
+	if err != nil {
+		return nil, err
 	}
 
-	return newSites, nil
+	if isRelativeURL(newURL) {
+		if newURL.Scheme == "" {
+			newURL.Scheme = s.URL.Scheme
+		}
+		if newURL.Host == "" {
+			newURL.Host = s.URL.Host
+		}
+	}
+	n.normalizeHost(newURL)
+	n.normalizeRoot(newURL)
+	return newURL, nil
 }
@@ -1,12 +1,29 @@
 package crawler_test
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/scanterog/crawler/crawler"
 	log "github.com/sirupsen/logrus"
@@ -46,45 +63,3647 @@ func TestInitialConfigValidation(t *testing.T) {
 		assert.Error(t, err, crawler.ErrInvalidHTTPClientTimeout)
 	})
 
+	t.Run("Invalid MaxURLLength", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:      "https://example.com",
+			NumWorkers:   1,
+			MaxURLLength: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxURLLength, err)
+	})
+
+	t.Run("Invalid MaxLinkTextLength", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:           "https://example.com",
+			NumWorkers:        1,
+			MaxLinkTextLength: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxLinkTextLength, err)
+	})
+
+	t.Run("Invalid MaxLinksPerPage", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:         "https://example.com",
+			NumWorkers:      1,
+			MaxLinksPerPage: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxLinksPerPage, err)
+	})
+
+	t.Run("Invalid MaxAttributeLength", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:            "https://example.com",
+			NumWorkers:         1,
+			MaxAttributeLength: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxAttributeLen, err)
+	})
+
+	t.Run("SeedURL exceeding MaxURLLength", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:      "https://example.com/" + strings.Repeat("a", 100),
+			NumWorkers:   1,
+			MaxURLLength: 50,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrURLTooLong, err)
+	})
+
+	t.Run("Invalid MaxPathSegments", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:         "https://example.com",
+			NumWorkers:      1,
+			MaxPathSegments: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxPathSegments, err)
+	})
+
+	t.Run("Invalid MaxRepeatedSegments", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:             "https://example.com",
+			NumWorkers:          1,
+			MaxRepeatedSegments: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxRepeatedSegs, err)
+	})
+
+	t.Run("Invalid MaxDepth", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:    "https://example.com",
+			NumWorkers: 1,
+			MaxDepth:   -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxDepth, err)
+	})
+
+	t.Run("Invalid MaxPages", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:    "https://example.com",
+			NumWorkers: 1,
+			MaxPages:   -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxPages, err)
+	})
+
+	t.Run("Invalid MaxDuration", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:     "https://example.com",
+			NumWorkers:  1,
+			MaxDuration: -time.Second,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxDuration, err)
+	})
+
+	t.Run("Invalid PageDeadline", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:      "https://example.com",
+			NumWorkers:   1,
+			PageDeadline: -time.Second,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidPageDeadline, err)
+	})
+
+	t.Run("Invalid OnlyLang", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:    "https://example.com",
+			NumWorkers: 1,
+			OnlyLang:   "de_DE",
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidOnlyLang, err)
+	})
+
+	t.Run("Invalid MaxParseTime", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:      "https://example.com",
+			NumWorkers:   1,
+			MaxParseTime: -time.Second,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxParseTime, err)
+	})
+
+	t.Run("Invalid Delay", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:    "https://example.com",
+			NumWorkers: 1,
+			Delay:      -time.Second,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidDelay, err)
+	})
+
+	t.Run("Invalid MaxCrawlDelay", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:       "https://example.com",
+			NumWorkers:    1,
+			MaxCrawlDelay: -time.Second,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxCrawlDelay, err)
+	})
+
+	t.Run("Invalid SeedURLs", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURLs:   []string{"https://example.com", "/home"},
+			NumWorkers: 1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidAbsoluteURL, err)
+	})
+
+	t.Run("Invalid Order", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:    "https://example.com",
+			NumWorkers: 1,
+			Order:      "random",
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidOrder, err)
+	})
+
+	t.Run("Invalid Format", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:    "https://example.com",
+			NumWorkers: 1,
+			Format:     "yaml",
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidFormat, err)
+	})
+
+	t.Run("Invalid MaxSitemapURLs", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:        "https://example.com",
+			NumWorkers:     1,
+			Format:         crawler.FormatXMLSitemap,
+			MaxSitemapURLs: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxSitemapURLs, err)
+	})
+
+	t.Run("Invalid MaxJSONPages", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:      "https://example.com",
+			NumWorkers:   1,
+			Format:       crawler.FormatJSON,
+			MaxJSONPages: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxJSONPages, err)
+	})
+
+	t.Run("Invalid DOTMaxDepth", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:     "https://example.com",
+			NumWorkers:  1,
+			Format:      crawler.FormatDOT,
+			DOTMaxDepth: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidDOTMaxDepth, err)
+	})
+
+	t.Run("Invalid MaxMermaidNodes", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:         "https://example.com",
+			NumWorkers:      1,
+			Format:          crawler.FormatMermaid,
+			MaxMermaidNodes: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxMermaidNodes, err)
+	})
+
+	t.Run("Invalid MaxConcurrentPerHost", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:              "https://example.com",
+			NumWorkers:           1,
+			MaxConcurrentPerHost: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxConcurrent, err)
+	})
+
+	t.Run("Invalid Rate", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:    "https://example.com",
+			NumWorkers: 1,
+			Rate:       -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidRate, err)
+	})
+
+	t.Run("Invalid Compress", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:    "https://example.com",
+			NumWorkers: 1,
+			Compress:   "zip",
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidCompress, err)
+	})
+
+	t.Run("Invalid Outputs", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:    "https://example.com",
+			NumWorkers: 1,
+			Outputs:    []crawler.OutputConfig{{Format: crawler.FormatNDJSON}},
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidOutput, err)
+
+		c.Outputs = []crawler.OutputConfig{{Format: "yaml", Writer: ioutil.Discard}}
+		err = c.Run()
+		assert.Equal(t, crawler.ErrInvalidFormat, err)
+	})
+
+	t.Run("Invalid MaxDedupeEdges", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:        "https://example.com",
+			NumWorkers:     1,
+			DedupeEdges:    true,
+			MaxDedupeEdges: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxDedupeEdges, err)
+	})
+
+	t.Run("Invalid MaxSlowestPages", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:         "https://example.com",
+			NumWorkers:      1,
+			MaxSlowestPages: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxSlowestPages, err)
+	})
+
+	t.Run("Invalid MaxExternalURLs", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:            "https://example.com",
+			NumWorkers:         1,
+			RecordExternalURLs: true,
+			MaxExternalURLs:    -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxExternalURLs, err)
+	})
+
+	t.Run("Invalid MaxExternalSources", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:            "https://example.com",
+			NumWorkers:         1,
+			RecordExternalURLs: true,
+			MaxExternalSources: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidExternalSources, err)
+	})
+
+	t.Run("Invalid MaxDuplicatePages", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:           "https://example.com",
+			NumWorkers:        1,
+			MaxDuplicatePages: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidMaxDuplicatePages, err)
+	})
+
+	t.Run("Invalid ExternalWorkers", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:         "https://example.com",
+			NumWorkers:      1,
+			CheckExternal:   true,
+			ExternalWorkers: -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidExternalWorkers, err)
+	})
+
+	t.Run("Invalid ExternalRate", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:       "https://example.com",
+			NumWorkers:    1,
+			CheckExternal: true,
+			ExternalRate:  -1,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidExternalRate, err)
+	})
+
+	t.Run("Invalid ExternalDelay", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:       "https://example.com",
+			NumWorkers:    1,
+			CheckExternal: true,
+			ExternalDelay: -time.Second,
+		}
+		err := c.Run()
+		assert.Equal(t, crawler.ErrInvalidExternalDelay, err)
+	})
+
 	t.Run("Invalid SiteMapOutputFile", func(t *testing.T) {
 		c := crawler.Crawler{
-			SiteMapOutputFile: "/tmp/",
+			SiteMapOutputFile: "/tmp/",
+		}
+		err := c.Run()
+		assert.Error(t, err)
+	})
+}
+
+func TestRun(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+
+	siteMapOutBuf := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:              httpTestServer.URL,
+		NumWorkers:           crawler.DefaultNumWorkers,
+		HTTPClientTimeoutSec: crawler.DefaultHTTPClientTimeoutSec,
+		SiteMapWriter:        siteMapOutBuf,
+	}
+	errBuf := &bytes.Buffer{}
+	log.SetOutput(errBuf)
+
+	err := c.Run()
+	assert.NoError(t, err)
+
+	errLog := errBuf.String()
+	assert.True(t, strings.Contains(errLog, "404 Not Found"))
+	outSiteMapTokens := strings.Split(siteMapOutBuf.String(), "\n")
+	generatedSiteMap := []string{}
+	for _, line := range outSiteMapTokens[:len(outSiteMapTokens)-1] {
+		generatedSiteMap = append(generatedSiteMap, fmt.Sprintf("%s\n", line))
+	}
+	expectedSiteMap := getExpectedSiteMap(httpTestServer.URL)
+	// siteMap might be in any order on units of "result"
+	assert.ElementsMatch(t, generatedSiteMap, expectedSiteMap)
+	assert.Equal(t, map[string]int{"mailto": 1}, c.Stats().SkippedSchemes)
+	assert.Contains(t, c.Stats().String(), "mailto links: 1")
+}
+
+func TestRunEquateWWW(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	httpMux := http.NewServeMux()
+	httpTestServer := httptest.NewServer(httpMux)
+	defer httpTestServer.Close()
+	// localhost resolves to the test server while www.localhost is
+	// never fetched since it must be rewritten to the seed's form.
+	seedURL := strings.Replace(httpTestServer.URL, "127.0.0.1", "localhost", 1)
+	wwwURL := strings.Replace(httpTestServer.URL, "127.0.0.1", "www.localhost", 1)
+	httpMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `<a href="%s/about">about</a>`, wwwURL)
+		case "/about":
+			fmt.Fprintf(w, `<a href="%s/">home</a><a href="/careers">careers</a>`, seedURL)
+		case "/careers":
+			fmt.Fprintf(w, `<a href="%s/about">about</a>`, wwwURL)
+		}
+	})
+
+	t.Run("www links are external by default", func(t *testing.T) {
+		fetched = nil
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       seedURL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/"}, fetched)
+		assert.Equal(t, fmt.Sprintf("%s -> %s/about\n", seedURL, wwwURL), siteMapOutBuf.String())
+	})
+
+	t.Run("www links are crawled when enabled", func(t *testing.T) {
+		fetched = nil
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       seedURL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			EquateWWW:     true,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"/", "/about", "/careers"}, fetched)
+		expectedSiteMap := []string{
+			fmt.Sprintf("%s -> %s/about\n", seedURL, seedURL),
+			fmt.Sprintf("%s/about -> %s\n", seedURL, seedURL),
+			fmt.Sprintf("%s/about -> %s/careers\n", seedURL, seedURL),
+			fmt.Sprintf("%s/careers -> %s/about\n", seedURL, seedURL),
+		}
+		assert.ElementsMatch(t, expectedSiteMap, siteMapLines(siteMapOutBuf))
+	})
+}
+
+func TestRunSchemeSensitive(t *testing.T) {
+	httpMux := http.NewServeMux()
+	httpTestServer := httptest.NewServer(httpMux)
+	defer httpTestServer.Close()
+	httpsAboutURL := strings.Replace(httpTestServer.URL, "http://", "https://", 1) + "/about"
+	httpMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<a href="/about">about</a><a href="%s">secure about</a>`, httpsAboutURL)
+	})
+
+	t.Run("http and https variants deduplicated by default", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			NumWorkers:    1,
+			SiteMapWriter: &bytes.Buffer{},
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		stats := c.Stats()
+		assert.Equal(t, 2, stats.PagesFetched)
+		assert.Equal(t, 0, stats.PagesFailed)
+	})
+
+	t.Run("https variant fetched when scheme sensitive", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:         httpTestServer.URL,
+			NumWorkers:      1,
+			SiteMapWriter:   siteMapOutBuf,
+			SchemeSensitive: true,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		stats := c.Stats()
+		assert.Equal(t, 2, stats.PagesFetched)
+		// the test server only speaks plain http
+		assert.Equal(t, 1, stats.PagesFailed)
+		assert.Contains(t, siteMapLines(siteMapOutBuf), fmt.Sprintf("%s/about -> %s\n", httpTestServer.URL, httpsAboutURL))
+	})
+}
+
+func TestRunKeepFragments(t *testing.T) {
+	var fetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/#/settings">settings</a><a href="/#/users">users</a>`))
+	}))
+	defer httpTestServer.Close()
+
+	t.Run("Hash routes collapsed by default", func(t *testing.T) {
+		atomic.StoreInt32(&fetches, 0)
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+		assert.Equal(t, []string{fmt.Sprintf("%s -> %s\n", httpTestServer.URL, httpTestServer.URL)}, siteMapLines(siteMapOutBuf))
+	})
+
+	t.Run("Hash routes kept when enabled", func(t *testing.T) {
+		atomic.StoreInt32(&fetches, 0)
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			KeepFragments: true,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		// the seed plus one fetch per hash route
+		assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+		lines := siteMapLines(siteMapOutBuf)
+		assert.Contains(t, lines, fmt.Sprintf("%s -> %s#/settings\n", httpTestServer.URL, httpTestServer.URL))
+		assert.Contains(t, lines, fmt.Sprintf("%s -> %s#/users\n", httpTestServer.URL, httpTestServer.URL))
+	})
+}
+
+func TestRunKeepTrailingSlash(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/">home</a><a href="/docs">docs</a><a href="/docs/">docs index</a>`))
+	}))
+	defer httpTestServer.Close()
+
+	t.Run("Trailing slash ignored by default", func(t *testing.T) {
+		fetched = nil
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"/", "/docs"}, fetched)
+	})
+
+	t.Run("Trailing slash significant when enabled", func(t *testing.T) {
+		fetched = nil
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:           httpTestServer.URL,
+			IgnoreRobots:      true,
+			NumWorkers:        crawler.DefaultNumWorkers,
+			SiteMapWriter:     siteMapOutBuf,
+			KeepTrailingSlash: true,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"/", "/docs", "/docs/"}, fetched)
+		assert.Contains(t, siteMapLines(siteMapOutBuf), fmt.Sprintf("%s/ -> %s/docs/\n", httpTestServer.URL, httpTestServer.URL))
+	})
+}
+
+func TestRunStripsCredentials(t *testing.T) {
+	var httpTestServer *httptest.Server
+	httpTestServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		withCredentials := strings.Replace(httpTestServer.URL, "http://", "http://user:pass@", 1)
+		fmt.Fprintf(w, `<a href="%s/area">area</a><a href="/area">area</a>`, withCredentials)
+	}))
+	defer httpTestServer.Close()
+
+	siteMapOutBuf := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: siteMapOutBuf,
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+	assert.NotContains(t, siteMapOutBuf.String(), "user:pass")
+	assert.Equal(t, 2, c.Stats().PagesFetched)
+	assert.ElementsMatch(t, []string{
+		fmt.Sprintf("%s -> %s/area\n", httpTestServer.URL, httpTestServer.URL),
+		fmt.Sprintf("%s/area -> %s/area\n", httpTestServer.URL, httpTestServer.URL),
+	}, siteMapLines(siteMapOutBuf))
+}
+
+func TestRunMaxURLLength(t *testing.T) {
+	var fetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "text/html")
+		// every hop grows the query string by 300 bytes
+		next := r.URL.Query().Get("q") + strings.Repeat("x", 300)
+		fmt.Fprintf(w, `<a href="/loop?q=%s">next</a>`, next)
+	}))
+	defer httpTestServer.Close()
+
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+		MaxURLLength:  1024,
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+	// the seed plus the links with 300, 600 and 900 byte queries
+	assert.Equal(t, int32(4), atomic.LoadInt32(&fetches))
+	stats := c.Stats()
+	assert.Equal(t, 1, stats.Skipped[crawler.SkipURLTooLong])
+	assert.Contains(t, stats.String(), "skipped (url too long): 1")
+}
+
+func TestRunMaxPathSegments(t *testing.T) {
+	var fetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "text/html")
+		// always link one level deeper
+		fmt.Fprintf(w, `<a href="%s/a">deeper</a>`, strings.TrimSuffix(r.URL.Path, "/"))
+	}))
+	defer httpTestServer.Close()
+
+	siteMapOutBuf := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:         httpTestServer.URL,
+		IgnoreRobots:    true,
+		NumWorkers:      crawler.DefaultNumWorkers,
+		SiteMapWriter:   siteMapOutBuf,
+		MaxPathSegments: 3,
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+	// /, /a, /a/a and /a/a/a
+	assert.Equal(t, int32(4), atomic.LoadInt32(&fetches))
+	assert.Equal(t, 1, c.Stats().Skipped[crawler.SkipPathTooDeep])
+	// the too deep URL is still recorded as an edge
+	assert.Contains(t, siteMapLines(siteMapOutBuf), fmt.Sprintf("%s/a/a/a -> %s/a/a/a/a\n", httpTestServer.URL, httpTestServer.URL))
+}
+
+func TestRunMaxDepth(t *testing.T) {
+	t.Run("Linear chain", func(t *testing.T) {
+		var fetches int32
+		httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			// /, /1, /2... each page linking to the next one
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+			fmt.Fprintf(w, `<a href="/%d">next</a>`, n+1)
+		}))
+		defer httpTestServer.Close()
+
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			MaxDepth:      3,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		// /, /1, /2 and /3
+		assert.Equal(t, int32(4), atomic.LoadInt32(&fetches))
+		assert.Equal(t, 1, c.Stats().Skipped[crawler.SkipMaxDepth])
+		// the too deep page is still recorded as an edge
+		assert.Contains(t, siteMapLines(siteMapOutBuf), fmt.Sprintf("%s/3 -> %s/4\n", httpTestServer.URL, httpTestServer.URL))
+	})
+
+	t.Run("Too deep page linked from a shallower one", func(t *testing.T) {
+		var fetches int32
+		httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			switch r.URL.Path {
+			case "/":
+				w.Write([]byte(`<a href="/1">1</a><a href="/slow">slow</a>`))
+			case "/1":
+				w.Write([]byte(`<a href="/2">2</a>`))
+			case "/2":
+				w.Write([]byte(`<a href="/target">target</a>`))
+			case "/slow":
+				// delay the shallow link so /target is first found too deep
+				time.Sleep(100 * time.Millisecond)
+				w.Write([]byte(`<a href="/target">target</a>`))
+			}
+		}))
+		defer httpTestServer.Close()
+
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			MaxDepth:      2,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, c.Stats().Skipped[crawler.SkipMaxDepth])
+		// /, /1, /2, /slow and /target through /slow
+		assert.Equal(t, int32(5), atomic.LoadInt32(&fetches))
+	})
+}
+
+func TestRunMaxPages(t *testing.T) {
+	var fetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// every page links to a broken one and to 5 new pages
+		page := strings.TrimSuffix(r.URL.Path, "/")
+		fmt.Fprint(w, `<a href="/broken">broken</a>`)
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, `<a href="%s/%d">%d</a>`, page, i, i)
+		}
+	}))
+	defer httpTestServer.Close()
+
+	t.Run("Truncated", func(t *testing.T) {
+		atomic.StoreInt32(&fetches, 0)
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			MaxPages:      10,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		stats := c.Stats()
+		// failed fetches don't count towards the limit
+		assert.Equal(t, 10, stats.PagesFetched)
+		assert.Equal(t, 1, stats.PagesFailed)
+		assert.Equal(t, int32(11), atomic.LoadInt32(&fetches))
+		assert.Equal(t, crawler.TruncatedMaxPages, stats.Truncated)
+		assert.Contains(t, stats.String(), "crawl truncated: max pages reached")
+		assert.Len(t, siteMapLines(siteMapOutBuf), 10*6)
+	})
+
+	t.Run("Not truncated below the limit", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    1,
+			SiteMapWriter: &bytes.Buffer{},
+			MaxPages:      1000,
+			MaxDepth:      1,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		stats := c.Stats()
+		assert.Equal(t, 6, stats.PagesFetched)
+		assert.Empty(t, stats.Truncated)
+	})
+}
+
+func TestRunMaxDuration(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<a href="/slow1">1</a><a href="/slow2">2</a>`))
+			return
+		}
+		// hang until the request is aborted
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer httpTestServer.Close()
+
+	siteMapOutBuf := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:              httpTestServer.URL,
+		IgnoreRobots:         true,
+		NumWorkers:           crawler.DefaultNumWorkers,
+		HTTPClientTimeoutSec: 20,
+		SiteMapWriter:        siteMapOutBuf,
+		MaxDuration:          200 * time.Millisecond,
+	}
+	start := time.Now()
+	err := c.Run()
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "in-flight requests not aborted")
+	stats := c.Stats()
+	assert.Equal(t, crawler.TruncatedMaxDuration, stats.Truncated)
+	// aborted requests are not failures
+	assert.Equal(t, 1, stats.PagesFetched)
+	assert.Equal(t, 0, stats.PagesFailed)
+	// the site map of the fetched pages is written
+	assert.Equal(t, []string{
+		fmt.Sprintf("%s -> %s/slow1\n", httpTestServer.URL, httpTestServer.URL),
+		fmt.Sprintf("%s -> %s/slow2\n", httpTestServer.URL, httpTestServer.URL),
+	}, siteMapLines(siteMapOutBuf))
+}
+
+func TestRunContext(t *testing.T) {
+	inFlight := make(chan bool, 10)
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<a href="/slow1">1</a><a href="/slow2">2</a>`))
+		case "/single":
+			w.Write([]byte(`<a href="/slow1">1</a>`))
+		default:
+			inFlight <- true
+			// hang until the request is aborted
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}))
+	defer httpTestServer.Close()
+
+	newCrawler := func(seedURL string, siteMapOutBuf *bytes.Buffer) crawler.Crawler {
+		return crawler.Crawler{
+			SeedURL:              seedURL,
+			IgnoreRobots:         true,
+			NumWorkers:           crawler.DefaultNumWorkers,
+			HTTPClientTimeoutSec: 20,
+			SiteMapWriter:        siteMapOutBuf,
+		}
+	}
+
+	t.Run("Cancelled while requests are in flight", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-inFlight
+			<-inFlight
+			cancel()
+		}()
+		siteMapOutBuf := &bytes.Buffer{}
+		c := newCrawler(httpTestServer.URL, siteMapOutBuf)
+		start := time.Now()
+		err := c.RunContext(ctx)
+		assert.Equal(t, context.Canceled, err)
+		assert.True(t, time.Since(start) < 2*time.Second, "in-flight requests not aborted")
+		stats := c.Stats()
+		assert.Equal(t, crawler.TruncatedCancelled, stats.Truncated)
+		assert.Equal(t, 1, stats.PagesFetched)
+		assert.Equal(t, 0, stats.PagesFailed)
+		assert.Len(t, siteMapLines(siteMapOutBuf), 2)
+	})
+
+	t.Run("Cancelled while workers are idle", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-inFlight
+			// let the other workers wait on the empty queue
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+		c := newCrawler(httpTestServer.URL+"/single", &bytes.Buffer{})
+		err := c.RunContext(ctx)
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, 1, c.Stats().PagesFetched)
+	})
+
+	t.Run("Already cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		siteMapOutBuf := &bytes.Buffer{}
+		c := newCrawler(httpTestServer.URL, siteMapOutBuf)
+		err := c.RunContext(ctx)
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, 0, c.Stats().PagesFetched)
+		assert.Empty(t, siteMapOutBuf.String())
+	})
+
+	t.Run("Context deadline is not MaxDuration", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		c := newCrawler(httpTestServer.URL+"/single", &bytes.Buffer{})
+		c.MaxDuration = time.Minute
+		err := c.RunContext(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.Equal(t, crawler.TruncatedCancelled, c.Stats().Truncated)
+	})
+
+	t.Run("Completed", func(t *testing.T) {
+		ts := newTestServer()
+		defer ts.Close()
+		c := newCrawler(ts.URL, &bytes.Buffer{})
+		err := c.RunContext(context.Background())
+		assert.NoError(t, err)
+		assert.Empty(t, c.Stats().Truncated)
+	})
+}
+
+func TestStop(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every page links to 5 new pages
+		page := strings.TrimSuffix(r.URL.Path, "/")
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, `<a href="%s/%d">%d</a>`, page, i, i)
+		}
+	}))
+	defer httpTestServer.Close()
+
+	t.Run("Stopped from a ResponseHook", func(t *testing.T) {
+		var responses int32
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			NumWorkers:    1,
+			SiteMapWriter: siteMapOutBuf,
+		}
+		c.ResponseHook = func(*http.Response) {
+			if atomic.AddInt32(&responses, 1) >= 3 {
+				// called more than once on purpose
+				c.Stop()
+			}
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		stats := c.Stats()
+		// the page in flight when stopping is finished
+		assert.Equal(t, 3, stats.PagesFetched)
+		assert.Equal(t, crawler.TruncatedStopped, stats.Truncated)
+		assert.Len(t, siteMapLines(siteMapOutBuf), 3*5)
+	})
+
+	t.Run("Stopped with concurrent workers", func(t *testing.T) {
+		var responses int32
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+		}
+		c.ResponseHook = func(*http.Response) {
+			if atomic.AddInt32(&responses, 1) == 10 {
+				c.Stop()
+			}
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		stats := c.Stats()
+		assert.True(t, stats.PagesFetched >= 10)
+		assert.True(t, stats.PagesFetched < 10+crawler.DefaultNumWorkers)
+		assert.Equal(t, crawler.TruncatedStopped, stats.Truncated)
+	})
+
+	t.Run("Stopped after the crawl ended", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			NumWorkers:    1,
+			SiteMapWriter: &bytes.Buffer{},
+			MaxDepth:      1,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		c.Stop()
+		c.Stop()
+		assert.Equal(t, 6, c.Stats().PagesFetched)
+		assert.Empty(t, c.Stats().Truncated)
+	})
+}
+
+func TestStopAbortsRequests(t *testing.T) {
+	release := make(chan bool)
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `<a href="/slow/1">1</a><a href="/slow/2">2</a>`)
+			return
+		}
+		select {
+		case <-release:
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer httpTestServer.Close()
+	defer close(release)
+
+	t.Run("Stopped", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    2,
+			SiteMapWriter: &bytes.Buffer{},
+			// no client timeout
+			HTTPClientTimeoutSec: 0,
+		}
+		c.ResponseHook = func(r *http.Response) {
+			if r.Request.URL.Path == "" {
+				time.AfterFunc(50*time.Millisecond, c.Stop)
+			}
+		}
+		start := time.Now()
+		assert.NoError(t, c.Run())
+		assert.True(t, time.Since(start) < time.Second, "stopped after %v", time.Since(start))
+		stats := c.Stats()
+		assert.Equal(t, 1, stats.PagesFetched)
+		assert.Equal(t, 0, stats.PagesFailed)
+		assert.Equal(t, 2, stats.Skipped[crawler.SkipStopped])
+		assert.Equal(t, crawler.TruncatedStopped, stats.Truncated)
+	})
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		c := crawler.Crawler{
+			SeedURL:              httpTestServer.URL,
+			IgnoreRobots:         true,
+			NumWorkers:           2,
+			SiteMapWriter:        &bytes.Buffer{},
+			HTTPClientTimeoutSec: 0,
+			ResponseHook: func(r *http.Response) {
+				if r.Request.URL.Path == "" {
+					time.AfterFunc(50*time.Millisecond, cancel)
+				}
+			},
+		}
+		start := time.Now()
+		assert.Equal(t, context.Canceled, c.RunContext(ctx))
+		assert.True(t, time.Since(start) < time.Second, "cancelled after %v", time.Since(start))
+		assert.Equal(t, 1, c.Stats().PagesFetched)
+	})
+}
+
+func TestRunDelay(t *testing.T) {
+	var mu sync.Mutex
+	var starts []time.Time
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		starts = append(starts, time.Now())
+		mu.Unlock()
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<a href="/1">1</a><a href="/2">2</a><a href="/3">3</a><a href="/4">4</a>`))
+		}
+	}))
+	defer httpTestServer.Close()
+
+	delay := 100 * time.Millisecond
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+		Delay:         delay,
+	}
+	start := time.Now()
+	err := c.Run()
+	assert.NoError(t, err)
+	assert.Len(t, starts, 5)
+	// requests are serialized despite the concurrent workers
+	minDelay := time.Duration(float64(delay) * 0.8)
+	assert.True(t, time.Since(start) >= 4*minDelay)
+	for i := 1; i < len(starts); i++ {
+		// allow some scheduling slack
+		assert.True(t, starts[i].Sub(starts[i-1]) >= minDelay-10*time.Millisecond)
+	}
+}
+
+func TestRunRobots(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	robots := ""
+	robotsStatus := http.StatusOK
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/robots.txt":
+			w.WriteHeader(robotsStatus)
+			w.Write([]byte(robots))
+		case "/":
+			w.Write([]byte(`<a href="/private">private</a><a href="/private/public">public</a><a href="/about">about</a>`))
+		}
+	}))
+	defer httpTestServer.Close()
+
+	run := func(ignoreRobots bool) (*crawler.Crawler, []string) {
+		mu.Lock()
+		fetched = nil
+		mu.Unlock()
+		c := &crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			IgnoreRobots:  ignoreRobots,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		return c, fetched
+	}
+
+	t.Run("Disallowed URLs skipped", func(t *testing.T) {
+		robots = "User-agent: *\nDisallow: /private\nAllow: /private/public\n"
+		robotsStatus = http.StatusOK
+		c, fetched := run(false)
+		assert.ElementsMatch(t, []string{"/robots.txt", "/", "/private/public", "/about"}, fetched)
+		assert.Equal(t, 1, c.Stats().Skipped[crawler.SkipRobots])
+	})
+
+	t.Run("Ignored", func(t *testing.T) {
+		robots = "User-agent: *\nDisallow: /private\n"
+		robotsStatus = http.StatusOK
+		_, fetched := run(true)
+		assert.ElementsMatch(t, []string{"/", "/private", "/private/public", "/about"}, fetched)
+	})
+
+	t.Run("Crawl-delay honored", func(t *testing.T) {
+		robots = "User-agent: *\nCrawl-delay: 0.1\n"
+		robotsStatus = http.StatusOK
+		start := time.Now()
+		c, _ := run(false)
+		// / and its 3 links, each one 80ms apart at least
+		assert.True(t, time.Since(start) >= 3*80*time.Millisecond)
+		host := strings.TrimPrefix(httpTestServer.URL, "http://")
+		assert.Equal(t, map[string]time.Duration{host: 100 * time.Millisecond}, c.Stats().Delays)
+		assert.Contains(t, c.Stats().String(), "delay between requests to "+host+": 100ms")
+	})
+
+	t.Run("Unreachable robots.txt allows everything", func(t *testing.T) {
+		robots = "User-agent: *\nDisallow: /\n"
+		robotsStatus = http.StatusServiceUnavailable
+		errBuf := &bytes.Buffer{}
+		log.SetOutput(errBuf)
+		defer log.SetOutput(os.Stderr)
+		_, fetched := run(false)
+		assert.ElementsMatch(t, []string{"/robots.txt", "/", "/private", "/private/public", "/about"}, fetched)
+		assert.Contains(t, errBuf.String(), "allowing everything")
+	})
+}
+
+func TestRunRobotsSubdomains(t *testing.T) {
+	fetcher := &fakeFetcher{pages: map[string]fakePage{
+		"http://example.test/robots.txt": {contentType: "text/plain", body: "User-agent: *\n"},
+		"http://example.test":            {body: `<a href="http://blog.example.test">blog</a>`},
+		"http://blog.example.test/robots.txt": {contentType: "text/plain",
+			body: "User-agent: *\nDisallow: /drafts\nCrawl-delay: 0.01\n"},
+		"http://blog.example.test":        {body: `<a href="/post">post</a><a href="/drafts/next">draft</a>`},
+		"http://blog.example.test/post":   {body: `<a href="/">blog</a>`},
+		"http://blog.example.test/drafts": {body: `draft`},
+	}}
+	c := crawler.Crawler{
+		SeedURL:           "http://example.test",
+		NumWorkers:        crawler.DefaultNumWorkers,
+		SiteMapWriter:     &bytes.Buffer{},
+		IncludeSubdomains: true,
+		Fetcher:           fetcher,
+	}
+	assert.NoError(t, c.Run())
+	assert.ElementsMatch(t, []string{
+		"http://example.test/robots.txt",
+		"http://example.test",
+		"http://blog.example.test/robots.txt",
+		"http://blog.example.test",
+		"http://blog.example.test/post",
+	}, fetcher.fetched)
+	assert.Equal(t, 1, c.Stats().Skipped[crawler.SkipRobots])
+	assert.Equal(t, map[string]time.Duration{"blog.example.test": 10 * time.Millisecond}, c.Stats().Delays)
+}
+
+// slowRobotsFetcher blocks the fetch of robots.txt until a URL is fetched,
+// or a second elapsed.
+type slowRobotsFetcher struct {
+	*fakeFetcher
+	robots  string
+	until   string
+	fetched chan bool
+	once    sync.Once
+}
+
+func (f *slowRobotsFetcher) Fetch(ctx context.Context, u *url.URL) (*crawler.FetchResult, error) {
+	if u.String() == f.until {
+		f.once.Do(func() { close(f.fetched) })
+	}
+	if u.String() == f.robots {
+		select {
+		case <-f.fetched:
+		case <-time.After(time.Second):
+		}
+	}
+	return f.fakeFetcher.Fetch(ctx, u)
+}
+
+func TestRunRobotsSlowSubdomain(t *testing.T) {
+	fetcher := &slowRobotsFetcher{
+		fakeFetcher: &fakeFetcher{pages: map[string]fakePage{
+			"http://example.test/robots.txt":      {contentType: "text/plain", body: "User-agent: *\n"},
+			"http://example.test":                 {body: `<a href="http://blog.example.test">blog</a><a href="/about">about</a>`},
+			"http://example.test/about":           {body: `about`},
+			"http://blog.example.test/robots.txt": {contentType: "text/plain", body: "User-agent: *\n"},
+			"http://blog.example.test":            {body: `blog`},
+		}},
+		robots:  "http://blog.example.test/robots.txt",
+		until:   "http://example.test/about",
+		fetched: make(chan bool),
+	}
+	c := crawler.Crawler{
+		SeedURL:           "http://example.test",
+		NumWorkers:        crawler.DefaultNumWorkers,
+		SiteMapWriter:     &bytes.Buffer{},
+		IncludeSubdomains: true,
+		Fetcher:           fetcher,
+	}
+	start := time.Now()
+	assert.NoError(t, c.Run())
+	// /about was crawled while the robots.txt of the blog was fetched
+	assert.True(t, time.Since(start) < time.Second, time.Since(start))
+	assert.Equal(t, 3, c.Stats().PagesFetched)
+}
+
+func TestRunUseSitemap(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	httpMux := http.NewServeMux()
+	httpTestServer := httptest.NewServer(httpMux)
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+	httpMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<a href="/about">about</a>`))
+		case "/orphan1":
+			w.Write([]byte(`<a href="/">home</a>`))
+		}
+	})
+	httpMux.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>%s/sitemap1.xml</loc></sitemap>
+  <sitemap><loc>%s/sitemap2.xml.gz</loc></sitemap>
+  <sitemap><loc>%s/nested1.xml</loc></sitemap>
+</sitemapindex>`, serverURL, serverURL, serverURL)
+	})
+	httpMux.HandleFunc("/sitemap1.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%s/</loc></url>
+  <url><loc>%s/orphan1</loc></url>
+  <url><loc>https://example.com/external</loc></url>
+</urlset>`, serverURL, serverURL)
+	})
+	httpMux.HandleFunc("/sitemap2.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+		gw := gzip.NewWriter(w)
+		fmt.Fprintf(gw, `<urlset><url><loc>%s/orphan2</loc></url></urlset>`, serverURL)
+		gw.Close()
+	})
+	// index files nested deeper than allowed
+	for i := 1; i <= 4; i++ {
+		next := i + 1
+		httpMux.HandleFunc(fmt.Sprintf("/nested%d.xml", i), func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `<sitemapindex><sitemap><loc>%s/nested%d.xml</loc></sitemap></sitemapindex>`, serverURL, next)
+		})
+	}
+	httpMux.HandleFunc("/nested5.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<urlset><url><loc>%s/too-nested</loc></url></urlset>`, serverURL)
+	})
+
+	t.Run("Sitemap not used by default", func(t *testing.T) {
+		fetched = nil
+		c := crawler.Crawler{
+			SeedURL:       serverURL,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			IgnoreRobots:  true,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.ElementsMatch(t, []string{"/", "/about"}, fetched)
+	})
+
+	t.Run("Sitemap pages crawled", func(t *testing.T) {
+		fetched = nil
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       serverURL,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			IgnoreRobots:  true,
+			UseSitemap:    true,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		assert.ElementsMatch(t, []string{"/", "/about", "/orphan1", "/orphan2"}, fetched)
+		assert.ElementsMatch(t, []string{
+			fmt.Sprintf("%s -> %s/about\n", serverURL, serverURL),
+			fmt.Sprintf("%s/sitemap1.xml -> %s/orphan1\n", serverURL, serverURL),
+			fmt.Sprintf("%s/orphan1 -> %s\n", serverURL, serverURL),
+			fmt.Sprintf("%s/sitemap2.xml.gz -> %s/orphan2\n", serverURL, serverURL),
+		}, siteMapLines(siteMapOutBuf))
+	})
+}
+
+func TestRunSeedURLs(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	newServer := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			fetched = append(fetched, r.Host+r.URL.Path)
+			mu.Unlock()
+			switch r.URL.Path {
+			case "/docs":
+				w.Write([]byte(`<a href="/docs/intro">intro</a>`))
+			case "/blog":
+				w.Write([]byte(`<a href="/blog/post">post</a><a href="/docs">docs</a>`))
+			}
+		}))
+	}
+	server1 := newServer()
+	defer server1.Close()
+	server2 := newServer()
+	defer server2.Close()
+	host1 := strings.TrimPrefix(server1.URL, "http://")
+	host2 := strings.TrimPrefix(server2.URL, "http://")
+
+	c := crawler.Crawler{
+		SeedURLs:      []string{server1.URL + "/docs", server1.URL + "/blog", server2.URL + "/blog"},
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+		IgnoreRobots:  true,
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.ElementsMatch(t, []string{
+		host1 + "/docs", host1 + "/docs/intro", host1 + "/blog", host1 + "/blog/post",
+		host2 + "/blog", host2 + "/blog/post", host2 + "/docs", host2 + "/docs/intro",
+	}, fetched)
+}
+
+func TestRunOrder(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	// a tree of pages 3 levels deep, each one linking to 3 children
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		page := strings.TrimSuffix(r.URL.Path, "/")
+		if strings.Count(page, "/") >= 3 {
+			return
+		}
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, `<a href="%s/%d">%d</a>`, page, i, i)
+		}
+	}))
+	defer httpTestServer.Close()
+
+	run := func(order string, maxPages int) []string {
+		mu.Lock()
+		fetched = nil
+		mu.Unlock()
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			NumWorkers:    1,
+			SiteMapWriter: &bytes.Buffer{},
+			IgnoreRobots:  true,
+			Order:         order,
+			MaxPages:      maxPages,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		return fetched
+	}
+
+	t.Run("Breadth-first prefers shallow pages", func(t *testing.T) {
+		fetched := run(crawler.OrderBFS, 1+3+9)
+		assert.Len(t, fetched, 13)
+		for _, path := range fetched {
+			assert.True(t, strings.Count(path, "/") <= 2, "%s fetched", path)
+		}
+	})
+
+	t.Run("Breadth-first by default", func(t *testing.T) {
+		fetched := run("", 4)
+		assert.Equal(t, []string{"/", "/0", "/1", "/2"}, fetched)
+	})
+
+	t.Run("Depth-first", func(t *testing.T) {
+		fetched := run(crawler.OrderDFS, 4)
+		assert.Equal(t, []string{"/", "/2", "/2/2", "/2/2/2"}, fetched)
+	})
+
+	t.Run("Whole site", func(t *testing.T) {
+		assert.Len(t, run(crawler.OrderDFS, 0), 1+3+9+27)
+	})
+}
+
+func TestRunPriorityFunc(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/" {
+			for i := 0; i < 5; i++ {
+				fmt.Fprintf(w, `<a href="/blog/%d">blog</a><a href="/products/%d">product</a>`, i, i)
+			}
+		}
+	}))
+	defer httpTestServer.Close()
+
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		NumWorkers:    1,
+		SiteMapWriter: &bytes.Buffer{},
+		IgnoreRobots:  true,
+		MaxPages:      1 + 5 + 1,
+		PriorityFunc: func(u *url.URL, depth int) int {
+			if strings.HasPrefix(u.Path, "/products/") {
+				return 1
+			}
+			return 0
+		},
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	// every product page before any blog one, ties in discovery order
+	assert.Equal(t, []string{"/", "/products/0", "/products/1", "/products/2", "/products/3", "/products/4", "/blog/0"}, fetched)
+}
+
+func TestRunMaxConcurrentPerHost(t *testing.T) {
+	var mu sync.Mutex
+	inFlight := map[string]int{}
+	peak := map[string]int{}
+	newServer := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			inFlight[r.Host]++
+			if inFlight[r.Host] > peak[r.Host] {
+				peak[r.Host] = inFlight[r.Host]
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				inFlight[r.Host]--
+				mu.Unlock()
+			}()
+			if r.URL.Path == "/" {
+				for i := 0; i < 20; i++ {
+					fmt.Fprintf(w, `<a href="/%d">%d</a>`, i, i)
+				}
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}))
+	}
+	server1 := newServer()
+	defer server1.Close()
+	server2 := newServer()
+	defer server2.Close()
+
+	c := crawler.Crawler{
+		SeedURLs:             []string{server1.URL, server2.URL},
+		NumWorkers:           20,
+		MaxConcurrentPerHost: 2,
+		SiteMapWriter:        &bytes.Buffer{},
+		IgnoreRobots:         true,
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, 2*21, c.Stats().PagesFetched)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{
+		strings.TrimPrefix(server1.URL, "http://"): 2,
+		strings.TrimPrefix(server2.URL, "http://"): 2,
+	}, peak)
+}
+
+func TestRunRate(t *testing.T) {
+	var fetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if r.URL.Path == "/" {
+			for i := 0; i < 5; i++ {
+				fmt.Fprintf(w, `<a href="/%d">%d</a>`, i, i)
+			}
+		}
+	}))
+	defer httpTestServer.Close()
+
+	t.Run("Requests limited", func(t *testing.T) {
+		atomic.StoreInt32(&fetches, 0)
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			Rate:          20,
+		}
+		start := time.Now()
+		err := c.Run()
+		assert.NoError(t, err)
+		// robots.txt, / and its 5 links
+		assert.Equal(t, int32(7), atomic.LoadInt32(&fetches))
+		assert.True(t, time.Since(start) >= 6*time.Second/20)
+	})
+
+	t.Run("Wait cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			IgnoreRobots:  true,
+			Rate:          0.1,
+		}
+		start := time.Now()
+		err := c.RunContext(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.True(t, time.Since(start) < time.Second)
+		assert.Equal(t, 1, c.Stats().PagesFetched)
+	})
+
+	t.Run("Unlimited once unset", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL + "/0",
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			IgnoreRobots:  true,
+			Rate:          1,
+		}
+		assert.NoError(t, c.Run())
+		c.SeedURL = httpTestServer.URL
+		c.Rate = 0
+		start := time.Now()
+		assert.NoError(t, c.Run())
+		// / and its 5 links, which would take 5s at the rate of the first run
+		assert.Equal(t, 6, c.Stats().PagesFetched)
+		assert.True(t, time.Since(start) < time.Second)
+	})
+
+	t.Run("Retries limited", func(t *testing.T) {
+		fetcher := &retryingFetcher{
+			fakeFetcher: &fakeFetcher{pages: map[string]fakePage{
+				"http://example.test": {body: "retried"},
+			}},
+			attempts: 3,
+		}
+		c := crawler.Crawler{
+			SeedURL:       "http://example.test",
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			IgnoreRobots:  true,
+			Fetcher:       fetcher,
+			Rate:          10,
+		}
+		start := time.Now()
+		assert.NoError(t, c.Run())
+		// the first attempt and the 2 retries
+		assert.True(t, time.Since(start) >= 2*time.Second/10)
+		assert.Equal(t, 1, c.Stats().PagesFetched)
+	})
+
+	t.Run("Throttle outside the crawl", func(t *testing.T) {
+		assert.NoError(t, crawler.Throttle(context.Background()))
+	})
+}
+
+// retryingFetcher makes attempts requests to each URL, calling Throttle
+// before each retry.
+type retryingFetcher struct {
+	*fakeFetcher
+	attempts int
+}
+
+func (f *retryingFetcher) Fetch(ctx context.Context, u *url.URL) (*crawler.FetchResult, error) {
+	for i := 1; i < f.attempts; i++ {
+		if err := crawler.Throttle(ctx); err != nil {
+			return nil, err
+		}
+	}
+	result, err := f.fakeFetcher.Fetch(ctx, u)
+	if err == nil {
+		result.Attempts = f.attempts
+	}
+	return result, err
+}
+
+func TestSetNumWorkers(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+		time.Sleep(5 * time.Millisecond)
+		// a tree of pages 3 levels deep, each one linking to 4 children
+		page := strings.TrimSuffix(r.URL.Path, "/")
+		if strings.Count(page, "/") >= 3 {
+			return
+		}
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(w, `<a href="%s/%d">%d</a>`, page, i, i)
+		}
+	}))
+	defer httpTestServer.Close()
+	pages := 1 + 4 + 16 + 64
+
+	siteMapOutBuf := &bytes.Buffer{}
+	var responses int32
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		NumWorkers:    1,
+		SiteMapWriter: siteMapOutBuf,
+		IgnoreRobots:  true,
+	}
+	assert.Equal(t, crawler.ErrInvalidNumWorkers, c.SetNumWorkers(0))
+	c.ResponseHook = func(*http.Response) {
+		switch atomic.AddInt32(&responses, 1) {
+		case 5:
+			assert.NoError(t, c.SetNumWorkers(10))
+		case 40:
+			assert.Equal(t, crawler.ErrInvalidNumWorkers, c.SetNumWorkers(0))
+			assert.NoError(t, c.SetNumWorkers(2))
+		case 60:
+			assert.NoError(t, c.SetNumWorkers(4))
+		}
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, pages, c.Stats().PagesFetched)
+	assert.Len(t, siteMapLines(siteMapOutBuf), pages-1)
+	mu.Lock()
+	assert.True(t, peak > 2, "workers not added")
+	mu.Unlock()
+	// once the crawl has ended it applies to the next run
+	assert.NoError(t, c.SetNumWorkers(3))
+	assert.Equal(t, 3, c.NumWorkers)
+}
+
+func TestRunTwice(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<a href="/a">a</a><a href="/private">private</a>`)
+		case "/private":
+			fmt.Fprint(w, `<a href="/private/b">b</a>`)
+		}
+	}))
+	defer httpTestServer.Close()
+	takeFetched := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		f := fetched
+		fetched = nil
+		return f
+	}
+	noPrivate := crawler.URLFilterFunc(func(u *url.URL, parent *url.URL) bool {
+		return !strings.HasPrefix(u.Path, "/private")
+	})
+
+	t.Run("Without state", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Filters:       []crawler.URLFilter{noPrivate},
+		}
+		assert.NoError(t, c.Run())
+		assert.ElementsMatch(t, []string{"/", "/a"}, takeFetched())
+		assert.Equal(t, 2, c.Stats().PagesFetched)
+
+		siteMapOutBuf.Reset()
+		c.Filters = nil
+		assert.NoError(t, c.Run())
+		assert.ElementsMatch(t, []string{"/", "/a", "/private", "/private/b"}, takeFetched())
+		assert.Equal(t, 4, c.Stats().PagesFetched)
+		assert.Len(t, siteMapLines(siteMapOutBuf), 3)
+	})
+	t.Run("Keeping state", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			KeepState:     true,
+			Filters:       []crawler.URLFilter{noPrivate},
+		}
+		assert.NoError(t, c.Run())
+		assert.ElementsMatch(t, []string{"/", "/a"}, takeFetched())
+
+		// the pages visited by the first run are not fetched again
+		c.Filters = nil
+		c.SeedURL = httpTestServer.URL + "/private"
+		assert.NoError(t, c.Run())
+		assert.ElementsMatch(t, []string{"/private", "/private/b"}, takeFetched())
+		assert.Equal(t, 2, c.Stats().PagesFetched)
+
+		assert.NoError(t, c.Run())
+		assert.Empty(t, takeFetched())
+		assert.Equal(t, 1, c.Stats().Skipped[crawler.SkipVisited])
+	})
+	t.Run("Already running", func(t *testing.T) {
+		requested := make(chan bool, 1)
+		release := make(chan bool)
+		slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested <- true
+			<-release
+		}))
+		defer slowServer.Close()
+		c := crawler.Crawler{
+			SeedURL:       slowServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    1,
+			SiteMapWriter: &bytes.Buffer{},
+		}
+		done := make(chan error)
+		go func() { done <- c.Run() }()
+		<-requested
+		assert.Equal(t, crawler.ErrAlreadyRunning, c.Run())
+		close(release)
+		assert.NoError(t, <-done)
+	})
+}
+
+func TestRunVisitedStore(t *testing.T) {
+	var fetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		fmt.Fprint(w, `<a href="/a">a</a><a href="/b">b</a>`)
+	}))
+	defer httpTestServer.Close()
+	dir, err := ioutil.TempDir("", "visited")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "visited.db")
+
+	crawl := func() crawler.Stats {
+		store, err := crawler.NewBoltVisitedStore(path)
+		assert.NoError(t, err)
+		defer store.Close()
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			VisitedStore:  store,
+		}
+		assert.NoError(t, c.Run())
+		return c.Stats()
+	}
+	assert.Equal(t, 3, crawl().PagesFetched)
+	// the pages visited by the previous process are not fetched again, so
+	// the seed is skipped along with everything linked from it: the store
+	// prevents fetching pages twice, it doesn't resume crawls
+	stats := crawl()
+	assert.Equal(t, 0, stats.PagesFetched)
+	assert.Equal(t, 1, stats.Skipped[crawler.SkipVisited])
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+}
+
+func TestRunBloomVisitedStore(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<a href="/a">a</a><a href="/b">b</a>`)
+	}))
+	defer httpTestServer.Close()
+
+	store, err := crawler.NewBloomVisitedStore(100, 0.001)
+	assert.NoError(t, err)
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+		VisitedStore:  store,
+	}
+	assert.NoError(t, c.Run())
+	stats := c.Stats()
+	assert.Equal(t, 3, stats.PagesFetched)
+	assert.Equal(t, store.FillRatio(), stats.VisitedFillRatio)
+	assert.True(t, stats.VisitedFillRatio > 0)
+	assert.Contains(t, stats.String(), "visited set fill ratio: ")
+}
+
+func TestRunManyLinksPerPage(t *testing.T) {
+	const pages = 5000
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			fmt.Fprint(w, `<a href="/">home</a>`)
+			return
+		}
+		// many more links than the channels used for the hand-off can hold
+		for i := 1; i < pages; i++ {
+			fmt.Fprintf(w, `<a href="/%d">%d</a>`, i, i)
+		}
+	}))
+	defer httpTestServer.Close()
+
+	siteMapOutBuf := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    1,
+		SiteMapWriter: siteMapOutBuf,
+	}
+	done := make(chan error)
+	go func() { done <- c.Run() }()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Minute):
+		t.Fatal("crawl is stuck")
+	}
+	stats := c.Stats()
+	assert.Equal(t, pages, stats.PagesFetched)
+	assert.Equal(t, pages-1, stats.FrontierPeak)
+	assert.Equal(t, 0, stats.Frontier)
+	assert.Len(t, siteMapLines(siteMapOutBuf), 2*(pages-1))
+}
+
+func TestRunTransientZeroWork(t *testing.T) {
+	var fetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		// every link is external
+		fmt.Fprint(w, `<a href="https://example.com/a">a</a><a href="https://example.org/b">b</a>`)
+	}))
+	defer httpTestServer.Close()
+
+	for i := 0; i < 50; i++ {
+		atomic.StoreInt32(&fetches, 0)
+		c := crawler.Crawler{
+			// skipped seeds may be done with before the next ones are queued
+			SeedURLs: []string{
+				httpTestServer.URL + "/skipped/1",
+				httpTestServer.URL + "/skipped/2",
+				httpTestServer.URL,
+				httpTestServer.URL + "/skipped/3",
+				httpTestServer.URL + "/other",
+			},
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			Filters: []crawler.URLFilter{crawler.URLFilterFunc(func(u *url.URL, parent *url.URL) bool {
+				return !strings.HasPrefix(u.Path, "/skipped")
+			})},
+		}
+		assert.NoError(t, c.Run())
+		assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+		assert.Equal(t, 2, c.Stats().PagesFetched)
+	}
+}
+
+func TestRunWorkAccounting(t *testing.T) {
+	// runWithin fails the test if the crawl doesn't end, e.g. because the
+	// in-flight sites were miscounted
+	runWithin := func(t *testing.T, c *crawler.Crawler) {
+		done := make(chan error, 1)
+		go func() { done <- c.Run() }()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("crawl didn't end")
+		}
+	}
+
+	t.Run("Everything filtered", func(t *testing.T) {
+		var fetches int32
+		httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			fmt.Fprint(w, `<a href="/a">a</a><a href="/b">b</a>`)
+		}))
+		defer httpTestServer.Close()
+		c := crawler.Crawler{
+			SeedURLs:      []string{httpTestServer.URL + "/1", httpTestServer.URL + "/2"},
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			Filters: []crawler.URLFilter{crawler.URLFilterFunc(func(u *url.URL, parent *url.URL) bool {
+				return false
+			})},
+		}
+		runWithin(t, &c)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&fetches))
+		assert.Equal(t, 0, c.Stats().PagesFetched)
+	})
+
+	t.Run("Error after partial enqueue", func(t *testing.T) {
+		var lostFetches int32
+		httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/broken":
+				// the connection is closed after the links, before the
+				// announced length is sent, so the page fails to parse
+				w.Header().Set("Content-Length", "100000")
+				fmt.Fprint(w, `<a href="/lost/1">1</a><a href="/lost/2">2</a>`)
+			case "/lost/1", "/lost/2":
+				atomic.AddInt32(&lostFetches, 1)
+			default:
+				fmt.Fprint(w, `<a href="/broken">broken</a><a href="/ok">ok</a><a href="/panic">panic</a>`)
+			}
+		}))
+		defer httpTestServer.Close()
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			ResponseHook: func(r *http.Response) {
+				if r.Request.URL.Path == "/panic" {
+					panic("boom")
+				}
+			},
+		}
+		runWithin(t, &c)
+		stats := c.Stats()
+		assert.Equal(t, 2, stats.PagesFetched)
+		assert.Equal(t, 2, stats.PagesFailed)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&lostFetches))
+	})
+}
+
+func TestRunLargeSite(t *testing.T) {
+	const pages = 2000
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		// a tree so every page is reachable, plus links across it
+		for _, child := range []int{2*page + 1, 2*page + 2, page * 7919 % pages, page * 104729 % pages} {
+			if child < pages {
+				fmt.Fprintf(w, `<a href="/%d">%d</a>`, child, child)
+			}
+		}
+	}))
+	defer httpTestServer.Close()
+	const numWorkers = 20
+	crawl := func(ctx context.Context) (crawler.Stats, int, error) {
+		var mu sync.Mutex
+		maxGoroutines := 0
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL + "/0",
+			IgnoreRobots:  true,
+			NumWorkers:    numWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			ResponseHook: func(*http.Response) {
+				mu.Lock()
+				defer mu.Unlock()
+				if n := runtime.NumGoroutine(); n > maxGoroutines {
+					maxGoroutines = n
+				}
+			},
+		}
+		err := c.RunContext(ctx)
+		return c.Stats(), maxGoroutines, err
+	}
+	baseline := runtime.NumGoroutine()
+
+	t.Run("Complete", func(t *testing.T) {
+		stats, maxGoroutines, err := crawl(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, pages, stats.PagesFetched)
+		// the workers, the pipeline and the client and server side of
+		// the connections: nothing grows with the number of pages
+		assert.True(t, maxGoroutines < baseline+10*numWorkers, "%d goroutines", maxGoroutines)
+	})
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+		}()
+		stats, _, err := crawl(ctx)
+		if err != nil {
+			assert.Equal(t, context.Canceled, err)
+			assert.True(t, stats.PagesFetched < pages)
+		}
+	})
+}
+
+func TestRunRecoverPanic(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<a href="/a">a</a><a href="/panic">panic</a><a href="/b">b</a>`)
+	}))
+	defer httpTestServer.Close()
+
+	siteMapOutBuf := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: siteMapOutBuf,
+		RequestHook: func(r *http.Request) {
+			if r.URL.Path == "/panic" {
+				panic("boom")
+			}
+		},
+	}
+	assert.NoError(t, c.Run())
+	stats := c.Stats()
+	assert.Equal(t, 3, stats.PagesFetched)
+	assert.Equal(t, 1, stats.PagesFailed)
+	assert.Len(t, siteMapLines(siteMapOutBuf), 9)
+}
+
+func TestDryRun(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+		default:
+			for i := 0; i < 100; i++ {
+				fmt.Fprintf(w, `<a href="/page/%d">%d</a>`, i, i)
+			}
+			fmt.Fprint(w, `<a href="/private">private</a><a href="/draft">draft</a><a href="https://example.com/ext">ext</a>`)
+		}
+	}))
+	defer httpTestServer.Close()
+
+	c := crawler.Crawler{
+		SeedURL:    httpTestServer.URL,
+		NumWorkers: crawler.DefaultNumWorkers,
+		Filters: []crawler.URLFilter{crawler.URLFilterFunc(func(u *url.URL, parent *url.URL) bool {
+			return u.Path != "/draft"
+		})},
+	}
+	report, err := c.DryRun(context.Background())
+	assert.NoError(t, err)
+	// only the seed page and its robots.txt are fetched
+	assert.ElementsMatch(t, []string{"/robots.txt", "/"}, fetched)
+	assert.Equal(t, []string{httpTestServer.URL}, report.Fetched)
+	assert.Len(t, report.Links, 103)
+	reasons := map[string]crawler.SkipReason{}
+	for _, link := range report.Links {
+		assert.Equal(t, httpTestServer.URL, link.Parent)
+		reasons[link.URL] = link.Reason
+	}
+	assert.Equal(t, crawler.SkipReason(""), reasons[httpTestServer.URL+"/page/7"])
+	assert.Equal(t, crawler.SkipRobots, reasons[httpTestServer.URL+"/private"])
+	assert.Equal(t, crawler.SkipReason("filtered by crawler.URLFilterFunc"), reasons[httpTestServer.URL+"/draft"])
+	assert.Equal(t, crawler.SkipExternal, reasons["https://example.com/ext"])
+	assert.Equal(t, 1, c.Stats().PagesFetched)
+}
+
+func TestRunIncremental(t *testing.T) {
+	var mu sync.Mutex
+	site := map[string]string{
+		"/":   `<a href="/a">a</a><a href="/b">b</a><a href="/c">c</a>`,
+		"/a":  `<a href="/a1">a1</a>`,
+		"/a1": `<p>a1</p>`,
+		"/b":  `<p>b</p>`,
+		"/c":  `<p>c</p>`,
+	}
+	var bodies int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		content, ok := site[r.URL.Path]
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		etag := fmt.Sprintf(`"%x"`, len(content))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&bodies, 1)
+		fmt.Fprint(w, content)
+	}))
+	defer httpTestServer.Close()
+	dir, err := ioutil.TempDir("", "incremental")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	crawl := func() (*crawler.Crawler, []string) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := &crawler.Crawler{
+			SeedURL:              httpTestServer.URL,
+			IgnoreRobots:         true,
+			NumWorkers:           crawler.DefaultNumWorkers,
+			SiteMapWriter:        siteMapOutBuf,
+			IncrementalStateFile: stateFile,
+		}
+		assert.NoError(t, c.Run())
+		return c, siteMapLines(siteMapOutBuf)
+	}
+	u := func(path string) string {
+		return httpTestServer.URL + path
+	}
+
+	c, _ := crawl()
+	assert.Equal(t, map[crawler.PageStatus]int{crawler.PageNew: 5}, c.Stats().PageStatuses)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&bodies))
+
+	mu.Lock()
+	site["/b"] = `<p>b</p><a href="/d">d</a>`
+	site["/d"] = `<p>d</p>`
+	delete(site, "/c")
+	mu.Unlock()
+	atomic.StoreInt32(&bodies, 0)
+	c, siteMap := crawl()
+	assert.Equal(t, map[string]crawler.PageStatus{
+		u(""):    crawler.PageRevalidated,
+		u("/a"):  crawler.PageRevalidated,
+		u("/a1"): crawler.PageRevalidated,
+		u("/b"):  crawler.PageRefetched,
+		u("/c"):  crawler.PageRemoved,
+		u("/d"):  crawler.PageNew,
+	}, c.PageStatuses())
+	// only the changed and new pages are downloaded again
+	assert.Equal(t, int32(2), atomic.LoadInt32(&bodies))
+	// the links of the unchanged pages are carried forward
+	assert.ElementsMatch(t, []string{
+		u("") + " -> " + u("/a") + "\n",
+		u("") + " -> " + u("/b") + "\n",
+		u("") + " -> " + u("/c") + "\n",
+		u("/a") + " -> " + u("/a1") + "\n",
+		u("/b") + " -> " + u("/d") + "\n",
+	}, siteMap)
+	stats := c.Stats()
+	assert.Equal(t, 1, stats.PageStatuses[crawler.PageRemoved])
+	assert.Contains(t, stats.String(), "revalidated pages: 3\n")
+	report := &bytes.Buffer{}
+	assert.NoError(t, c.WriteIncrementalReport(report))
+	assert.Contains(t, report.String(), "removed\t"+u("/c")+"\n")
+
+	// the removed page is dropped from the state
+	atomic.StoreInt32(&bodies, 0)
+	c, _ = crawl()
+	assert.Equal(t, map[crawler.PageStatus]int{crawler.PageRevalidated: 5}, c.Stats().PageStatuses)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&bodies))
+}
+
+func TestRunPageDepths(t *testing.T) {
+	links := map[string]string{
+		"/":  `<a href="/a">a</a><a href="/b">b</a>`,
+		"/a": `<a href="/c">c</a><a href="/">home</a>`,
+		"/b": `<a href="/c">c</a>`,
+		"/c": `<a href="/d">d</a><a href="/a">a</a>`,
+	}
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, links[r.URL.Path])
+	}))
+	defer httpTestServer.Close()
+
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+	}
+	assert.NoError(t, c.Run())
+	assert.Equal(t, map[string]int{
+		httpTestServer.URL:        0,
+		httpTestServer.URL + "/a": 1,
+		httpTestServer.URL + "/b": 1,
+		httpTestServer.URL + "/c": 2,
+		httpTestServer.URL + "/d": 3,
+	}, c.PageDepths())
+	stats := c.Stats()
+	assert.Equal(t, map[int]int{0: 1, 1: 2, 2: 1, 3: 1}, stats.PagesByDepth)
+	assert.Contains(t, stats.String(), "pages at depth 1: 2\n")
+
+	report := &bytes.Buffer{}
+	assert.NoError(t, c.WriteDepthReport(report))
+	assert.Equal(t, "0\t"+httpTestServer.URL+"\n"+
+		"1\t"+httpTestServer.URL+"/a\n"+
+		"1\t"+httpTestServer.URL+"/b\n"+
+		"2\t"+httpTestServer.URL+"/c\n"+
+		"3\t"+httpTestServer.URL+"/d\n", report.String())
+}
+
+func TestRunSeedFetchFailed(t *testing.T) {
+	t.Run("Connection refused", func(t *testing.T) {
+		httpTestServer := httptest.NewServer(http.NotFoundHandler())
+		seedURL := httpTestServer.URL
+		httpTestServer.Close()
+		c := crawler.Crawler{
+			SeedURL:       seedURL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+		}
+		err := c.Run()
+		assert.True(t, errors.Is(err, crawler.ErrSeedFetchFailed), "unexpected error: %v", err)
+		var urlErr *url.Error
+		assert.True(t, errors.As(err, &urlErr), "the cause is not wrapped: %v", err)
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		httpTestServer := httptest.NewServer(http.NotFoundHandler())
+		defer httpTestServer.Close()
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+		}
+		err := c.Run()
+		var seedErr *crawler.SeedFetchError
+		if assert.True(t, errors.As(err, &seedErr), "unexpected error: %v", err) {
+			assert.Equal(t, httpTestServer.URL, seedErr.URL)
+			assert.Contains(t, seedErr.Err.Error(), "404")
+		}
+	})
+
+	t.Run("Failing children", func(t *testing.T) {
+		httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "" && r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, `<a href="/a">a</a><a href="/b">b</a>`)
+		}))
+		defer httpTestServer.Close()
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+		}
+		assert.NoError(t, c.Run())
+		assert.Equal(t, 1, c.Stats().PagesFetched)
+		assert.Equal(t, 2, c.Stats().PagesFailed)
+	})
+}
+
+func TestRunPageDeadline(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slow" {
+			fmt.Fprint(w, `<a href="/slow">slow</a><a href="/a">a</a>`)
+			return
+		}
+		// a byte per second: the client timeout never triggers
+		for i := 0; i < 30; i++ {
+			fmt.Fprint(w, " ")
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer httpTestServer.Close()
+
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+		PageDeadline:  500 * time.Millisecond,
+	}
+	start := time.Now()
+	assert.NoError(t, c.Run())
+	assert.True(t, time.Since(start) < 5*time.Second, "the slow page held the crawl for %v", time.Since(start))
+	stats := c.Stats()
+	assert.Equal(t, 2, stats.PagesFetched)
+	assert.Equal(t, 1, stats.PagesFailed)
+	assert.Equal(t, 1, stats.PagesDeadline)
+	assert.Contains(t, stats.String(), "pages failed with deadline exceeded: 1\n")
+}
+
+func TestRunIncludeAssets(t *testing.T) {
+	var assetFetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/docs/page":
+			fmt.Fprintf(w, `<img src="/docs/shot.png"><img src="http://%s/logo.svg">`, r.Host)
+		case "/logo.svg", "/docs/shot.png", "/docs/clip.mp4", "/docs/clip.jpg", "/theme.ogg":
+			atomic.AddInt32(&assetFetches, 1)
+		default:
+			fmt.Fprint(w, `<a href="/docs/page">docs</a><img src="/logo.svg"><img src="data:image/png;base64,AAAA">
+<picture><source src="https://cdn.example.com/hero.webp"><img src="/logo.svg"></picture>
+<video poster="/docs/clip.jpg"><source src="/docs/clip.mp4"></video><audio src="/theme.ogg"></audio>`)
+		}
+	}))
+	defer httpTestServer.Close()
+	crawl := func(includeAssets, internalOnly bool) []string {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			IncludeAssets: includeAssets,
+			InternalOnly:  internalOnly,
+		}
+		assert.NoError(t, c.Run())
+		lines := siteMapLines(siteMapOutBuf)
+		sort.Strings(lines)
+		return lines
+	}
+	seed := httpTestServer.URL
+	page := httpTestServer.URL + "/docs/page"
+
+	assert.Equal(t, []string{
+		seed + " -> " + page + "\n",
+	}, crawl(false, false))
+	assert.Equal(t, []string{
+		seed + " -> " + httpTestServer.URL + "/docs/clip.jpg\n",
+		seed + " -> " + httpTestServer.URL + "/docs/clip.mp4\n",
+		seed + " -> " + page + "\n",
+		seed + " -> " + httpTestServer.URL + "/logo.svg\n",
+		seed + " -> " + httpTestServer.URL + "/theme.ogg\n",
+		seed + " -> https://cdn.example.com/hero.webp\n",
+		page + " -> " + httpTestServer.URL + "/docs/shot.png\n",
+		page + " -> " + httpTestServer.URL + "/logo.svg\n",
+	}, crawl(true, false))
+	assert.NotContains(t, crawl(true, true), seed+" -> https://cdn.example.com/hero.webp\n")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&assetFetches))
+}
+
+func TestRunMaxLinkTextLength(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" || r.URL.Path == "/" {
+			fmt.Fprint(w, `<a href="/a">  A   rather <b>long</b> text </a>`)
+		}
+	}))
+	defer httpTestServer.Close()
+	// the link texts are only written to the incremental state for now
+	dir, err := ioutil.TempDir("", "incremental")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+	c := crawler.Crawler{
+		SeedURL:              httpTestServer.URL,
+		IgnoreRobots:         true,
+		NumWorkers:           crawler.DefaultNumWorkers,
+		SiteMapWriter:        &bytes.Buffer{},
+		IncrementalStateFile: stateFile,
+		MaxLinkTextLength:    13,
+	}
+	assert.NoError(t, c.Run())
+	data, err := ioutil.ReadFile(stateFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"text":"A rather long"`)
+}
+
+// contentHash returns the hex SHA-256 of the body.
+func contentHash(body string) string {
+	hash := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestRunPageMetadata(t *testing.T) {
+	const (
+		home    = `<title>Example Inc</title><a href="/pricing">pricing</a><a href="/untitled">untitled</a>`
+		pricing = `<title> Pricing —  Example Inc </title><meta name="description" content="Plans"><meta name="robots" content="noarchive"><h1>Pricing</h1>`
+	)
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pricing":
+			fmt.Fprint(w, pricing)
+		case "/untitled":
+		default:
+			fmt.Fprint(w, home)
+		}
+	}))
+	defer httpTestServer.Close()
+
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+	}
+	assert.NoError(t, c.Run())
+	assert.Equal(t, map[string]crawler.PageMetadata{
+		httpTestServer.URL:               {Title: "Example Inc", ContentHash: contentHash(home)},
+		httpTestServer.URL + "/pricing":  {Title: "Pricing — Example Inc", H1: "Pricing", H1Count: 1, Description: "Plans", Robots: "noarchive", ContentHash: contentHash(pricing), DeadEnd: true},
+		httpTestServer.URL + "/untitled": {ContentHash: contentHash(""), DeadEnd: true},
+	}, c.PageMetadata())
+
+	report := &bytes.Buffer{}
+	assert.NoError(t, c.WriteTitleReport(report))
+	assert.Equal(t, httpTestServer.URL+"\tExample Inc\n"+
+		httpTestServer.URL+"/pricing\tPricing — Example Inc\n"+
+		httpTestServer.URL+"/untitled\t\n", report.String())
+}
+
+func TestRunFollowForms(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "" || r.URL.Path == "/" {
+			fmt.Fprint(w, `<form action="/search" method="get"><input name="q"></form>
+<form action="/login" method="post"></form>
+<form><input name="here"></form>`)
+		}
+	}))
+	defer httpTestServer.Close()
+	crawl := func(followForms bool) []string {
+		fetched = nil
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			IncludeAssets: true,
+			FollowForms:   followForms,
+		}
+		assert.NoError(t, c.Run())
+		lines := siteMapLines(siteMapOutBuf)
+		sort.Strings(lines)
+		return lines
+	}
+
+	assert.Equal(t, []string{
+		httpTestServer.URL + " -> " + httpTestServer.URL + "/login\n",
+		httpTestServer.URL + " -> " + httpTestServer.URL + "/search\n",
+	}, crawl(false))
+	assert.ElementsMatch(t, []string{"GET /"}, fetched)
+	crawl(true)
+	assert.ElementsMatch(t, []string{"GET /", "GET /search"}, fetched)
+}
+
+func TestRunFetchStylesheets(t *testing.T) {
+	var cssFetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/style.css":
+			atomic.AddInt32(&cssFetches, 1)
+			fmt.Fprint(w, `@font-face { src: url("/font.woff2") } i { background: url(data:image/png;base64,AAAA) }`)
+		case "/other":
+			fmt.Fprint(w, `<link rel="stylesheet" href="/style.css">`)
+		default:
+			fmt.Fprint(w, `<link rel="stylesheet" href="/style.css"><link rel="stylesheet" href="https://cdn.example.com/lib.css">
+<a href="/other">other</a>`)
+		}
+	}))
+	defer httpTestServer.Close()
+	siteMapOutBuf := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:          httpTestServer.URL,
+		IgnoreRobots:     true,
+		NumWorkers:       crawler.DefaultNumWorkers,
+		SiteMapWriter:    siteMapOutBuf,
+		IncludeAssets:    true,
+		FetchStylesheets: true,
+	}
+	assert.NoError(t, c.Run())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&cssFetches))
+	lines := siteMapLines(siteMapOutBuf)
+	sort.Strings(lines)
+	seed, other, css := httpTestServer.URL, httpTestServer.URL+"/other", httpTestServer.URL+"/style.css"
+	assert.Equal(t, []string{
+		seed + " -> " + other + "\n",
+		seed + " -> " + css + "\n",
+		seed + " -> https://cdn.example.com/lib.css\n",
+		other + " -> " + css + "\n",
+		css + " -> " + httpTestServer.URL + "/font.woff2\n",
+	}, lines)
+}
+
+func TestRunFollowFeeds(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/feed":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprint(w, `<rss version="2.0"><channel><item><link>/posts/1</link></item></channel></rss>`)
+		case "/atom.xml":
+			fmt.Fprint(w, `<feed xmlns="http://www.w3.org/2005/Atom"><entry><link href="/posts/2"/></entry></feed>`)
+		case "/posts/1", "/posts/2":
+		default:
+			fmt.Fprint(w, `<link rel="alternate" type="application/rss+xml" href="/feed">
+<link rel="alternate" type="application/atom+xml" href="/atom.xml">
+<link rel="alternate" type="application/rss+xml" href="https://other.example.com/feed">`)
+		}
+	}))
+	defer httpTestServer.Close()
+	crawl := func(followFeeds bool) (*crawler.Crawler, []string) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := &crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			FollowFeeds:   followFeeds,
+		}
+		assert.NoError(t, c.Run())
+		lines := siteMapLines(siteMapOutBuf)
+		sort.Strings(lines)
+		return c, lines
+	}
+	feeds := []string{httpTestServer.URL + "/atom.xml", httpTestServer.URL + "/feed", "https://other.example.com/feed"}
+
+	c, lines := crawl(false)
+	assert.Equal(t, feeds, c.Feeds())
+	assert.Empty(t, lines)
+	assert.Equal(t, 1, c.Stats().PagesFetched)
+
+	c, lines = crawl(true)
+	assert.Equal(t, feeds, c.Feeds())
+	assert.Equal(t, []string{
+		httpTestServer.URL + "/atom.xml -> " + httpTestServer.URL + "/posts/2\n",
+		httpTestServer.URL + "/feed -> " + httpTestServer.URL + "/posts/1\n",
+	}, lines)
+	assert.Equal(t, 3, c.Stats().PagesFetched)
+	report := &bytes.Buffer{}
+	assert.NoError(t, c.WriteFeedReport(report))
+	assert.Equal(t, strings.Join(feeds, "\n")+"\n", report.String())
+}
+
+func TestRunAlternates(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		fmt.Fprintf(w, `<link rel="canonical" href="http://%s/en">
+<link rel="alternate" hreflang="en" href="/en">
+<link rel="alternate" hreflang="de" href="/de">
+<link rel="alternate" hreflang="fr" href="https://fr.example.com/">
+<link rel="alternate" hreflang="x-default" href="/">`, r.Host)
+	}))
+	defer httpTestServer.Close()
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL + "/en",
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+	}
+	assert.NoError(t, c.Run())
+	assert.ElementsMatch(t, []string{"/en", "/de", "/"}, fetched)
+	metadata := c.PageMetadata()[httpTestServer.URL+"/de"]
+	assert.Equal(t, httpTestServer.URL+"/en", metadata.Canonical)
+	assert.Equal(t, []crawler.AlternateLink{
+		{Rel: "alternate", Hreflang: "en", URL: httpTestServer.URL + "/en"},
+		{Rel: "alternate", Hreflang: "de", URL: httpTestServer.URL + "/de"},
+		{Rel: "alternate", Hreflang: "fr", URL: "https://fr.example.com"},
+		{Rel: "alternate", Hreflang: "x-default", URL: httpTestServer.URL},
+	}, metadata.Alternates)
+}
+
+func TestRunLinkedSitemaps(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	httpMux := http.NewServeMux()
+	httpTestServer := httptest.NewServer(httpMux)
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+	httpMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<a href="/sitemap.xml">sitemap</a>`))
+		case "/feed.xml":
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, `<rss><channel><item><link>%s/item</link></item></channel></rss>`, serverURL)
+		}
+	})
+	httpMux.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%s/page1</loc></url>
+  <url><loc>https://example.com/external</loc></url>
+</urlset>`, serverURL)
+	})
+	httpMux.HandleFunc("/index.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		fmt.Fprintf(w, `<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>%s/sitemap.xml</loc></sitemap>
+  <sitemap><loc>%s/sitemap2.xml.gz</loc></sitemap>
+</sitemapindex>`, serverURL, serverURL)
+	})
+	httpMux.HandleFunc("/sitemap2.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+		gw := gzip.NewWriter(w)
+		fmt.Fprintf(gw, `<urlset><url><loc>%s/page2</loc></url></urlset>`, serverURL)
+		gw.Close()
+	})
+
+	tests := []struct {
+		name          string
+		seed          string
+		expected      []string
+		expectedEdges []string
+	}{
+		{
+			name:     "Sitemap linked from a page",
+			seed:     serverURL,
+			expected: []string{"/", "/page1"},
+			expectedEdges: []string{
+				fmt.Sprintf("%s -> %s/sitemap.xml\n", serverURL, serverURL),
+				fmt.Sprintf("%s/sitemap.xml -> %s/page1\n", serverURL, serverURL),
+			},
+		},
+		{
+			name:     "Sitemap index seed",
+			seed:     serverURL + "/index.xml",
+			expected: []string{"/page1", "/page2"},
+			expectedEdges: []string{
+				fmt.Sprintf("%s/index.xml -> %s/page1\n", serverURL, serverURL),
+				fmt.Sprintf("%s/index.xml -> %s/page2\n", serverURL, serverURL),
+			},
+		},
+		{
+			name:     "Gzipped sitemap seed",
+			seed:     serverURL + "/sitemap2.xml.gz",
+			expected: []string{"/page2"},
+			expectedEdges: []string{
+				fmt.Sprintf("%s/sitemap2.xml.gz -> %s/page2\n", serverURL, serverURL),
+			},
+		},
+		{
+			name:     "Other XML documents",
+			seed:     serverURL + "/feed.xml",
+			expected: []string{"/feed.xml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetched = nil
+			siteMapOutBuf := &bytes.Buffer{}
+			c := crawler.Crawler{
+				SeedURL:       tt.seed,
+				NumWorkers:    crawler.DefaultNumWorkers,
+				SiteMapWriter: siteMapOutBuf,
+				IgnoreRobots:  true,
+			}
+			assert.NoError(t, c.Run())
+			mu.Lock()
+			defer mu.Unlock()
+			assert.ElementsMatch(t, tt.expected, fetched)
+			assert.ElementsMatch(t, tt.expectedEdges, siteMapLines(siteMapOutBuf))
+		})
+	}
+}
+
+// templateExtractor extracts the links of a template format holding one
+// "link: <URL>" per line.
+type templateExtractor struct{}
+
+func (templateExtractor) Extract(pageURL *url.URL, contentType string, body io.Reader) (crawler.PageData, error) {
+	var page crawler.PageData
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "link: ") {
+			page.Links = append(page.Links, crawler.Link{Href: strings.TrimPrefix(scanner.Text(), "link: ")})
+		}
+	}
+	return page, scanner.Err()
+}
+
+func TestRunExtractors(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "", "/":
+			w.Write([]byte(`<a href="/api">api</a><a href="/page.tpl">template</a>`))
+		case "/api":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{"data": [{"href": "/from-json"}]}`))
+		case "/page.tpl":
+			w.Header().Set("Content-Type", "text/x-template")
+			w.Write([]byte("title: page\nlink: /from-template\n"))
+		}
+	}))
+	defer httpTestServer.Close()
+
+	t.Run("HTML by default", func(t *testing.T) {
+		fetched = nil
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			IgnoreRobots:  true,
+		}
+		assert.NoError(t, c.Run())
+		assert.ElementsMatch(t, []string{"/", "/api", "/page.tpl"}, fetched)
+	})
+
+	t.Run("Extractors by media type", func(t *testing.T) {
+		fetched = nil
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			IgnoreRobots:  true,
+			Extractors: map[string]crawler.LinkExtractor{
+				"application/json": crawler.JSONExtractor{Paths: []string{"data.href"}},
+				"text/x-template":  templateExtractor{},
+			},
+		}
+		assert.NoError(t, c.Run())
+		assert.ElementsMatch(t, []string{"/", "/api", "/page.tpl", "/from-json", "/from-template"}, fetched)
+	})
+
+	t.Run("Extractor for every page", func(t *testing.T) {
+		fetched = nil
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL + "/page.tpl",
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			IgnoreRobots:  true,
+			Extractor:     templateExtractor{},
+			Extractors: map[string]crawler.LinkExtractor{
+				"text/html": crawler.HTMLExtractor{},
+			},
+		}
+		assert.NoError(t, c.Run())
+		assert.ElementsMatch(t, []string{"/page.tpl", "/from-template"}, fetched)
+	})
+}
+
+func TestRunPathologicalPages(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "", "/":
+			fmt.Fprint(w, `<a href="/many">many</a><a href="/long">long</a>`)
+		case "/many":
+			for i := 0; i < 200000; i++ {
+				fmt.Fprintf(w, `<a href="/many/%d">%d</a>`, i, i)
+			}
+		case "/long":
+			fmt.Fprintf(w, `<a href="/%s">long</a><a href="/short">short</a>`, strings.Repeat("a", 3*1024*1024))
+		case "/deep":
+			// the parse time grows quadratically with the nesting
+			fmt.Fprint(w, strings.Repeat("<div>", 5000)+`<a href="/short">short</a>`)
+		}
+	}))
+	defer httpTestServer.Close()
+
+	t.Run("Links and attributes left out", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:            httpTestServer.URL,
+			NumWorkers:         crawler.DefaultNumWorkers,
+			SiteMapWriter:      siteMapOutBuf,
+			IgnoreRobots:       true,
+			MaxDepth:           1,
+			MaxLinksPerPage:    100,
+			MaxAttributeLength: 1024 * 1024,
+		}
+		assert.NoError(t, c.Run())
+		stats := c.Stats()
+		assert.Equal(t, 2, stats.PagesTruncated)
+		assert.Contains(t, stats.String(), "pages truncated: 2\n")
+		metadata := c.PageMetadata()
+		assert.False(t, metadata[httpTestServer.URL].Truncated)
+		assert.True(t, metadata[httpTestServer.URL+"/many"].Truncated)
+		assert.True(t, metadata[httpTestServer.URL+"/long"].Truncated)
+		lines := siteMapLines(siteMapOutBuf)
+		var many int
+		for _, line := range lines {
+			if strings.HasPrefix(line, httpTestServer.URL+"/many -> ") {
+				many++
+			}
+		}
+		assert.Equal(t, 100, many)
+		assert.Contains(t, lines, fmt.Sprintf("%s/long -> %s/short\n", httpTestServer.URL, httpTestServer.URL))
+	})
+
+	t.Run("MaxParseTime exceeded", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL + "/deep",
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			IgnoreRobots:  true,
+			MaxParseTime:  20 * time.Millisecond,
 		}
 		err := c.Run()
-		assert.Error(t, err)
+		assert.True(t, errors.Is(err, crawler.ErrSeedFetchFailed))
+		stats := c.Stats()
+		assert.Equal(t, 1, stats.PagesFailed)
+		assert.Equal(t, 1, stats.PagesDeadline)
 	})
 }
 
-func TestRun(t *testing.T) {
-	httpTestServer := newTestServer()
+func TestRunTemplateNoscript(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `<template><a href="/template">template</a></template><noscript><a href="/noscript">noscript</a></noscript>`)
+		}
+	}))
+	defer httpTestServer.Close()
+
+	tests := []struct {
+		name             string
+		includeTemplates bool
+		skipNoscript     bool
+		expected         []string
+	}{
+		{name: "Default", expected: []string{"/", "/noscript"}},
+		{name: "IncludeTemplates", includeTemplates: true, expected: []string{"/", "/template", "/noscript"}},
+		{name: "SkipNoscript", skipNoscript: true, expected: []string{"/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetched = nil
+			c := crawler.Crawler{
+				SeedURL:          httpTestServer.URL + "/",
+				NumWorkers:       crawler.DefaultNumWorkers,
+				SiteMapWriter:    &bytes.Buffer{},
+				IgnoreRobots:     true,
+				IncludeTemplates: tt.includeTemplates,
+				SkipNoscript:     tt.skipNoscript,
+			}
+			assert.NoError(t, c.Run())
+			mu.Lock()
+			defer mu.Unlock()
+			assert.ElementsMatch(t, tt.expected, fetched)
+		})
+	}
+}
+
+func TestRunMixedContent(t *testing.T) {
+	httpsTestServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "", "/":
+			fmt.Fprintf(w, `<a href="/secure">secure</a><a href="http://%s/insecure">insecure</a>
+<img src="http://cdn.example.com/a.png"><img src="https://cdn.example.com/b.png">
+<script src="http://cdn.example.com/app.js"></script><link rel="stylesheet" href="http://cdn.example.com/style.css">`, r.Host)
+		case "/secure":
+			fmt.Fprint(w, `<img src="/logo.png">`)
+		}
+	}))
+	defer httpsTestServer.Close()
+	seedURL := httpsTestServer.URL
+	host := strings.TrimPrefix(seedURL, "https://")
+
+	c := crawler.Crawler{
+		SeedURL:       seedURL,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+		IgnoreRobots:  true,
+		IncludeAssets: true,
+		Fetcher:       clientFetcher{client: httpsTestServer.Client()},
+	}
+	assert.NoError(t, c.Run())
+	metadata := c.PageMetadata()
+	assert.Equal(t, map[string][]string{
+		"a":      {"http://" + host + "/insecure"},
+		"img":    {"http://cdn.example.com/a.png"},
+		"link":   {"http://cdn.example.com/style.css"},
+		"script": {"http://cdn.example.com/app.js"},
+	}, metadata[seedURL].MixedContent)
+	assert.Nil(t, metadata[seedURL+"/secure"].MixedContent)
+
+	report := &bytes.Buffer{}
+	assert.NoError(t, c.WriteMixedContentReport(report))
+	assert.Equal(t, seedURL+"\ta\thttp://"+host+"/insecure\n"+
+		seedURL+"\timg\thttp://cdn.example.com/a.png\n"+
+		seedURL+"\tlink\thttp://cdn.example.com/style.css\n"+
+		seedURL+"\tscript\thttp://cdn.example.com/app.js\n", report.String())
+}
+
+func TestRunDuplicates(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "", "/":
+			fmt.Fprint(w, `<a href="/a">a</a><a href="/b">b</a><a href="/c">c</a><a href="/d">d</a><a href="/e">e</a>`)
+		case "/a", "/b", "/c":
+			fmt.Fprint(w, `<p>The same content</p>`)
+		case "/d":
+			fmt.Fprint(w, "<p>The same\n  content</p>\n")
+		case "/e":
+			fmt.Fprint(w, `<p>Other content</p>`)
+		}
+	}))
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	tests := []struct {
+		name               string
+		hashNormalizeSpace bool
+		expected           [][]string
+	}{
+		{
+			name:     "Same body",
+			expected: [][]string{{serverURL + "/a", serverURL + "/b", serverURL + "/c"}},
+		},
+		{
+			name:               "Same body but for whitespace",
+			hashNormalizeSpace: true,
+			expected:           [][]string{{serverURL + "/a", serverURL + "/b", serverURL + "/c", serverURL + "/d"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := crawler.Crawler{
+				SeedURL:            serverURL,
+				IgnoreRobots:       true,
+				NumWorkers:         crawler.DefaultNumWorkers,
+				SiteMapWriter:      &bytes.Buffer{},
+				HashNormalizeSpace: tt.hashNormalizeSpace,
+			}
+			assert.NoError(t, c.Run())
+			assert.Equal(t, tt.expected, c.Duplicates())
+			metadata := c.PageMetadata()
+			assert.Equal(t, metadata[serverURL+"/a"].ContentHash, metadata[serverURL+"/b"].ContentHash)
+			assert.NotEqual(t, metadata[serverURL+"/a"].ContentHash, metadata[serverURL+"/e"].ContentHash)
+
+			report := &bytes.Buffer{}
+			assert.NoError(t, c.WriteDuplicatesReport(report))
+			assert.Equal(t, strings.Join(tt.expected[0], "\t")+"\n", report.String())
+		})
+	}
+
+	t.Run("Max duplicate pages", func(t *testing.T) {
+		// with a single worker the pages are fetched in the order of the
+		// links, so only the seed, /a and /b are indexed
+		c := crawler.Crawler{
+			SeedURL:           serverURL,
+			IgnoreRobots:      true,
+			NumWorkers:        1,
+			SiteMapWriter:     &bytes.Buffer{},
+			MaxDuplicatePages: 3,
+		}
+		assert.NoError(t, c.Run())
+		assert.Equal(t, [][]string{{serverURL + "/a", serverURL + "/b"}}, c.Duplicates())
+		assert.Len(t, c.PageMetadata(), 6)
+	})
+}
+
+func TestRunPageLang(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "", "/":
+			fmt.Fprint(w, `<html lang="en"><a href="/attribute">a</a><a href="/header">h</a><a href="/both">b</a><a href="/neither">n</a><a href="/malformed">m</a></html>`)
+		case "/attribute":
+			fmt.Fprint(w, `<html lang="de-AT"><a href="/attribute/child">c</a></html>`)
+		case "/header":
+			w.Header().Set("Content-Language", "fr, en")
+			fmt.Fprint(w, `<a href="/header/child">c</a>`)
+		case "/both":
+			w.Header().Set("Content-Language", "fr")
+			fmt.Fprint(w, `<html lang="de"><a href="/both/child">c</a></html>`)
+		case "/neither":
+			fmt.Fprint(w, `<a href="/neither/child">c</a>`)
+		case "/malformed":
+			fmt.Fprint(w, `<html lang="{{ lang }}"><a href="/malformed/child">c</a></html>`)
+		}
+	}))
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	t.Run("Language recorded", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:       serverURL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			MaxDepth:      1,
+		}
+		assert.NoError(t, c.Run())
+		langs := map[string]string{}
+		for u, metadata := range c.PageMetadata() {
+			langs[u] = metadata.Lang
+		}
+		assert.Equal(t, map[string]string{
+			serverURL:                "en",
+			serverURL + "/attribute": "de-AT",
+			serverURL + "/header":    "fr",
+			serverURL + "/both":      "de",
+			serverURL + "/neither":   "",
+			serverURL + "/malformed": "",
+		}, langs)
+	})
+
+	t.Run("OnlyLang", func(t *testing.T) {
+		mu.Lock()
+		fetched = nil
+		mu.Unlock()
+		c := crawler.Crawler{
+			SeedURL:       serverURL + "/attribute",
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			OnlyLang:      "de",
+		}
+		assert.NoError(t, c.Run())
+		c = crawler.Crawler{
+			SeedURL:       serverURL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			OnlyLang:      "en",
+		}
+		assert.NoError(t, c.Run())
+		mu.Lock()
+		defer mu.Unlock()
+		assert.ElementsMatch(t, []string{
+			"/attribute", "/attribute/child",
+			"/", "/attribute", "/header", "/both", "/neither", "/neither/child", "/malformed", "/malformed/child",
+		}, fetched)
+	})
+}
+
+func TestRunExternalDomains(t *testing.T) {
+	t.Run("By host", func(t *testing.T) {
+		httpTestServer := newTestServer()
+		defer httpTestServer.Close()
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			InternalOnly:  true,
+		}
+		assert.NoError(t, c.Run())
+		assert.Equal(t, map[string]crawler.ExternalLinks{
+			"twitter.com": {Pages: 1, Links: 1},
+			"fb.com":      {Pages: 1, Links: 1},
+			"golang.org":  {Pages: 1, Links: 1},
+		}, c.Stats().ExternalDomains)
+		assert.Contains(t, c.Stats().String(), "links to fb.com: 1 from 1 pages\n")
+
+		report := &bytes.Buffer{}
+		assert.NoError(t, c.WriteExternalDomainsReport(report))
+		assert.Equal(t, "fb.com\t1\t1\ngolang.org\t1\t1\ntwitter.com\t1\t1\n", report.String())
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "", "/":
+			fmt.Fprint(w, `<a href="/a">a</a><a href="https://www.google.com/">g</a><a href="https://maps.google.com/">m</a>`)
+		case "/a":
+			fmt.Fprint(w, `<a href="https://www.google.com/search">g</a><a href="https://WWW.Google.com:443/">g</a><a href="https://example.org">e</a>`)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		group    bool
+		expected map[string]crawler.ExternalLinks
+	}{
+		{
+			name: "Subdomains",
+			expected: map[string]crawler.ExternalLinks{
+				"www.google.com":  {Pages: 2, Links: 3},
+				"maps.google.com": {Pages: 1, Links: 1},
+				"example.org":     {Pages: 1, Links: 1},
+			},
+		},
+		{
+			name:  "Grouped by registrable domain",
+			group: true,
+			expected: map[string]crawler.ExternalLinks{
+				"google.com":  {Pages: 2, Links: 4},
+				"example.org": {Pages: 1, Links: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := crawler.Crawler{
+				SeedURL:              server.URL,
+				IgnoreRobots:         true,
+				NumWorkers:           crawler.DefaultNumWorkers,
+				SiteMapWriter:        &bytes.Buffer{},
+				GroupExternalDomains: tt.group,
+			}
+			assert.NoError(t, c.Run())
+			assert.Equal(t, tt.expected, c.Stats().ExternalDomains)
+		})
+	}
+}
+
+func TestRunSocialMetadata(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pricing":
+			fmt.Fprint(w, `<meta property="og:title" content="Pricing"><meta property="og:description" content="Plans">
+<meta property="og:image" content="/share/pricing.png"><meta property="og:url" content="/pricing">
+<meta name="twitter:card" content="summary_large_image">`)
+		case "/pricing-old":
+			fmt.Fprint(w, `<meta property="og:url" content="/pricing"><meta name="twitter:card" content="summary">`)
+		case "/plain":
+			fmt.Fprint(w, `<title>Plain</title>`)
+		default:
+			fmt.Fprint(w, `<a href="/pricing">p</a><a href="/pricing-old">o</a><a href="/plain">n</a>`)
+		}
+	}))
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	c := crawler.Crawler{
+		SeedURL:       serverURL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+	}
+	assert.NoError(t, c.Run())
+	metadata := c.PageMetadata()
+	pricing := metadata[serverURL+"/pricing"]
+	assert.Equal(t, "Pricing", pricing.OGTitle)
+	assert.Equal(t, "Plans", pricing.OGDescription)
+	assert.Equal(t, serverURL+"/share/pricing.png", pricing.OGImage)
+	assert.Equal(t, serverURL+"/pricing", pricing.OGURL)
+	assert.Equal(t, "summary_large_image", pricing.TwitterCard)
+	assert.False(t, pricing.OGURLMismatch)
+
+	old := metadata[serverURL+"/pricing-old"]
+	assert.Equal(t, "summary", old.TwitterCard)
+	assert.True(t, old.OGURLMismatch)
+
+	plain := metadata[serverURL+"/plain"]
+	assert.Equal(t, crawler.PageMetadata{Title: "Plain", ContentHash: plain.ContentHash, DeadEnd: true}, plain)
+
+	assert.Equal(t, map[string]string{serverURL + "/pricing-old": serverURL + "/pricing"}, c.OGURLMismatches())
+}
+
+func TestRunDeadEnds(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/about":
+			fmt.Fprint(w, `<a href="/">home</a><a href="https://twitter.com/example">twitter</a>`)
+		case "/external":
+			fmt.Fprint(w, `<a href="https://twitter.com/example">twitter</a><a href="https://golang.org">go</a>`)
+		case "/empty":
+			w.Header().Set("Content-Type", "application/xhtml+xml")
+			fmt.Fprint(w, `<html xmlns="http://www.w3.org/1999/xhtml"><p>Nothing here</p></html>`)
+		case "/badge":
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, "\x89PNG")
+		default:
+			fmt.Fprint(w, `<a href="/about">a</a><a href="/external">e</a><a href="/empty">m</a><a href="/badge">b</a>`)
+		}
+	}))
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	c := crawler.Crawler{
+		SeedURL:       serverURL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+	}
+	assert.NoError(t, c.Run())
+	expected := []string{serverURL + "/empty", serverURL + "/external"}
+	assert.Equal(t, expected, c.DeadEnds())
+	stats := c.Stats()
+	assert.Equal(t, expected, stats.DeadEnds)
+	assert.Contains(t, stats.String(), "dead-end page: "+serverURL+"/external\n")
+	assert.True(t, c.PageMetadata()[serverURL+"/external"].DeadEnd)
+	badge, ok := c.PageMetadata()[serverURL+"/badge"]
+	assert.True(t, ok)
+	assert.False(t, badge.DeadEnd)
+}
+
+func TestRunRepeatedSegments(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/a/b/a/b" {
+			return
+		}
+		// a misconfigured server resolving a self-referential relative link
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		fmt.Fprintf(w, `<a href="%s/docs">docs</a><a href="/a/b/a/b">ab</a>`, path)
+	}))
+	defer httpTestServer.Close()
+
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"/", "/docs", "/docs/docs", "/docs/docs/docs", "/a/b/a/b",
+	}, fetched)
+	assert.Equal(t, 1, c.Stats().Skipped[crawler.SkipRepeatedSegments])
+}
+
+func TestRunPatternBudgets(t *testing.T) {
+	var fetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "text/html")
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		fmt.Fprintf(w, `<a href="/list?page=%d">next</a><a href="/about">about</a>`, page+1)
+	}))
+	defer httpTestServer.Close()
+
+	c := crawler.Crawler{
+		SeedURL:        httpTestServer.URL,
+		IgnoreRobots:   true,
+		NumWorkers:     crawler.DefaultNumWorkers,
+		SiteMapWriter:  &bytes.Buffer{},
+		PatternBudgets: []crawler.PatternBudget{{Pattern: `\?page=\d+`, Max: 5}},
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+	// the seed, /about and five pages
+	assert.Equal(t, int32(7), atomic.LoadInt32(&fetches))
+	stats := c.Stats()
+	assert.Equal(t, 1, stats.Skipped[crawler.SkipBudgetExhausted])
+	assert.Equal(t, map[string]int{`\?page=\d+`: 1}, stats.BudgetExhausted)
+	assert.Contains(t, stats.String(), "budget exhausted for")
+}
+
+func TestRunPatternBudgetsRefunded(t *testing.T) {
+	var fetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<a href="/broken?page=1">1</a><a href="/broken?page=2">2</a><a href="/next">next</a>`)
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/next":
+			for i := 1; i <= 3; i++ {
+				fmt.Fprintf(w, `<a href="/list?page=%d">%d</a>`, i, i)
+			}
+		}
+	}))
+	defer httpTestServer.Close()
+
+	// with a single worker the broken pages fail before the links of /next
+	// are admitted
+	c := crawler.Crawler{
+		SeedURL:        httpTestServer.URL,
+		IgnoreRobots:   true,
+		NumWorkers:     1,
+		SiteMapWriter:  &bytes.Buffer{},
+		PatternBudgets: []crawler.PatternBudget{{Pattern: `\?page=\d+`, Max: 3}},
+	}
+	assert.NoError(t, c.Run())
+	// the seed, the broken pages, /next and its three pages
+	assert.Equal(t, int32(7), atomic.LoadInt32(&fetches))
+	assert.Zero(t, c.Stats().Skipped[crawler.SkipBudgetExhausted])
+}
+
+func TestRunDirBudgets(t *testing.T) {
+	var fetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<a href="/forum/broken">broken</a>`)
+			for i := 0; i < 10; i++ {
+				fmt.Fprintf(w, `<a href="/forum/%d">%d</a><a href="/docs/%d">%d</a>`, i, i, i, i)
+			}
+		case "/forum/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			fmt.Fprint(w, `<a href="/forum/1">1</a>`)
+		}
+	}))
+	defer httpTestServer.Close()
+
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+		DirBudgets:    map[string]int{"/forum/": 3},
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+	stats := c.Stats()
+	// the failed fetch of /forum/broken doesn't count
+	usage := stats.DirBudgets["/forum/"]
+	assert.Equal(t, 3, usage.Fetched)
+	assert.Equal(t, 3, usage.Max)
+	assert.True(t, usage.Skipped >= 7, "skipped %d", usage.Skipped)
+	assert.Equal(t, usage.Skipped, stats.Skipped[crawler.SkipDirBudgetExhausted])
+	// the seed, the ten /docs pages, three forum pages and the broken one
+	assert.Equal(t, 11+3, stats.PagesFetched)
+	assert.Equal(t, int32(11+3+1), atomic.LoadInt32(&fetches))
+	assert.Contains(t, stats.String(), `dir budget for "/forum/": 3/3 pages fetched`)
+}
+
+func TestRunCanonical(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.RequestURI())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<a href="/p?v=1">1</a><a href="/p?v=2">2</a><a href="/p?v=3">3</a><a href="/ext">ext</a>`))
+		case "/p":
+			w.Write([]byte(`<link rel="canonical" href="/p"><a href="/about">about</a><a href="/p">p</a>`))
+		case "/ext":
+			w.Write([]byte(`<link rel="canonical" href="https://example.com/ext"><a href="/">home</a>`))
+		}
+	}))
 	defer httpTestServer.Close()
 
 	siteMapOutBuf := &bytes.Buffer{}
 	c := crawler.Crawler{
-		SeedURL:              httpTestServer.URL,
-		NumWorkers:           crawler.DefaultNumWorkers,
-		HTTPClientTimeoutSec: crawler.DefaultHTTPClientTimeoutSec,
-		SiteMapWriter:        siteMapOutBuf,
+		SeedURL:       httpTestServer.URL,
+		NumWorkers:    1,
+		SiteMapWriter: siteMapOutBuf,
 	}
-	errBuf := &bytes.Buffer{}
-	log.SetOutput(errBuf)
+	err := c.Run()
+	assert.NoError(t, err)
+
+	// the canonical URL itself is never fetched as it's already known
+	assert.NotContains(t, fetched, "/p")
+	assert.Contains(t, fetched, "/about")
+	canonicals := c.Canonicals()
+	assert.Len(t, canonicals, 4)
+	assert.Equal(t, httpTestServer.URL+"/p", canonicals[httpTestServer.URL+"/p?v=2"])
+	assert.Equal(t, "https://example.com/ext", canonicals[httpTestServer.URL+"/ext"])
+
+	lines := siteMapLines(siteMapOutBuf)
+	for _, line := range lines {
+		assert.False(t, strings.HasPrefix(line, httpTestServer.URL+"/p?"), line)
+	}
+	assert.Contains(t, lines, fmt.Sprintf("%s/p -> %s/about\n", httpTestServer.URL, httpTestServer.URL))
+	assert.Contains(t, lines, fmt.Sprintf("%s/ext -> %s\n", httpTestServer.URL, httpTestServer.URL))
+	// each source page is written once: 4 from the seed, 2 from the canonical,
+	// 1 from /ext and none from /about
+	assert.Len(t, lines, 7)
+}
+
+func TestRunRespectNofollow(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			// the only path to the /private subtree is nofollow
+			w.Write([]byte(`<a href="/about">about</a><a href="/private" rel="NoFollow noopener">private</a>`))
+		case "/private":
+			w.Write([]byte(`<a href="/private/area">area</a>`))
+		}
+	}))
+	defer httpTestServer.Close()
+
+	t.Run("nofollow links crawled by default", func(t *testing.T) {
+		fetched = nil
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"/", "/about", "/private", "/private/area"}, fetched)
+	})
+
+	t.Run("nofollow subtree not crawled when respected", func(t *testing.T) {
+		fetched = nil
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:         httpTestServer.URL,
+			IgnoreRobots:    true,
+			NumWorkers:      crawler.DefaultNumWorkers,
+			SiteMapWriter:   siteMapOutBuf,
+			RespectNofollow: true,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"/", "/about"}, fetched)
+		assert.Equal(t, 1, c.Stats().Skipped[crawler.SkipNofollow])
+		// nofollow links are still edges
+		assert.Contains(t, siteMapLines(siteMapOutBuf), fmt.Sprintf("%s -> %s/private\n", httpTestServer.URL, httpTestServer.URL))
+	})
+}
+
+func TestRunRespectRobotsMeta(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		meta := map[string]string{
+			"/noindex":  "noindex",
+			"/nofollow": "nofollow",
+			"/none":     "noindex, nofollow",
+		}[r.URL.Path]
+		fmt.Fprintf(w, `<meta name="robots" content="%s">`, meta)
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<a href="/noindex">a</a><a href="/nofollow">b</a><a href="/none">c</a>`))
+			return
+		}
+		if meta != "" {
+			fmt.Fprintf(w, `<a href="%s/child">child</a><a href="/">home</a>`, r.URL.Path)
+		}
+	}))
+	defer httpTestServer.Close()
+
+	run := func(respect bool) (*crawler.Crawler, []string) {
+		fetched = nil
+		siteMapOutBuf := &bytes.Buffer{}
+		c := &crawler.Crawler{
+			SeedURL:           httpTestServer.URL,
+			IgnoreRobots:      true,
+			NumWorkers:        crawler.DefaultNumWorkers,
+			SiteMapWriter:     siteMapOutBuf,
+			RespectRobotsMeta: respect,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		return c, siteMapLines(siteMapOutBuf)
+	}
+	edge := func(from, to string) string {
+		return fmt.Sprintf("%s%s -> %s%s\n", httpTestServer.URL, from, httpTestServer.URL, to)
+	}
+
+	t.Run("Robots meta ignored by default", func(t *testing.T) {
+		c, lines := run(false)
+		assert.Equal(t, 7, c.Stats().PagesFetched)
+		assert.Contains(t, lines, edge("/noindex", "/noindex/child"))
+		assert.Contains(t, lines, edge("/none", "/none/child"))
+	})
+
+	t.Run("Robots meta respected", func(t *testing.T) {
+		c, lines := run(true)
+		// pages are still fetched to see the tags
+		assert.ElementsMatch(t, []string{"/", "/noindex", "/nofollow", "/none", "/noindex/child"}, fetched)
+		assert.Equal(t, 5, c.Stats().PagesFetched)
+		// noindex: not written but followed
+		assert.NotContains(t, lines, edge("/noindex", "/noindex/child"))
+		// nofollow: written but not followed
+		assert.Contains(t, lines, edge("/nofollow", "/nofollow/child"))
+		// none: neither written nor followed
+		assert.NotContains(t, lines, edge("/none", "/none/child"))
+	})
+}
+
+func TestRunSessionIDs(t *testing.T) {
+	var fetches int32
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "text/html")
+		// every link gets a fresh session ID
+		fmt.Fprintf(w, `<a href="/;jsessionid=%d">home</a>`, n)
+		fmt.Fprintf(w, `<a href="/about;JSESSIONID=%d">about</a>`, n)
+		fmt.Fprintf(w, `<a href="/search?q=go&PHPSESSID=%d">search</a>`, n)
+	}))
+	defer httpTestServer.Close()
 
+	siteMapOutBuf := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: siteMapOutBuf,
+	}
 	err := c.Run()
 	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+	lines := siteMapLines(siteMapOutBuf)
+	assert.Len(t, lines, 9)
+	assert.Contains(t, lines, fmt.Sprintf("%s/about -> %s/search?q=go\n", httpTestServer.URL, httpTestServer.URL))
+	assert.NotContains(t, siteMapOutBuf.String(), "SESSID")
+}
 
-	errLog := errBuf.String()
-	assert.True(t, strings.Contains(errLog, "404 Not Found"))
-	outSiteMapTokens := strings.Split(siteMapOutBuf.String(), "\n")
-	generatedSiteMap := []string{}
-	for _, line := range outSiteMapTokens[:len(outSiteMapTokens)-1] {
-		generatedSiteMap = append(generatedSiteMap, fmt.Sprintf("%s\n", line))
+func TestRunFollowSeedRedirect(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	var targetServer *httptest.Server
+	targetServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `<a href="%s/about">about</a><a href="%s/">home</a>`, targetServer.URL, targetServer.URL)
+		case "/about":
+			fmt.Fprintf(w, `<a href="/">home</a>`)
+		case "/robots.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, "User-agent: *\nDisallow: /about\n")
+		}
+	}))
+	defer targetServer.Close()
+	redirectServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, targetServer.URL+r.URL.Path, http.StatusMovedPermanently)
+	}))
+	defer redirectServer.Close()
+
+	t.Run("Redirected host is external by default", func(t *testing.T) {
+		fetched = nil
+		c := crawler.Crawler{
+			SeedURL:       redirectServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/"}, fetched)
+	})
+
+	t.Run("Redirected host adopted", func(t *testing.T) {
+		fetched = nil
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:            redirectServer.URL,
+			IgnoreRobots:       true,
+			NumWorkers:         crawler.DefaultNumWorkers,
+			SiteMapWriter:      siteMapOutBuf,
+			FollowSeedRedirect: true,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		// the seed redirect is followed once before the crawl
+		assert.ElementsMatch(t, []string{"/", "/", "/about"}, fetched)
+		assert.ElementsMatch(t, []string{
+			fmt.Sprintf("%s -> %s/about\n", targetServer.URL, targetServer.URL),
+			fmt.Sprintf("%s -> %s\n", targetServer.URL, targetServer.URL),
+			fmt.Sprintf("%s/about -> %s\n", targetServer.URL, targetServer.URL),
+		}, siteMapLines(siteMapOutBuf))
+	})
+
+	t.Run("Robots of the redirected host", func(t *testing.T) {
+		fetched = nil
+		c := crawler.Crawler{
+			SeedURL:            redirectServer.URL,
+			NumWorkers:         crawler.DefaultNumWorkers,
+			SiteMapWriter:      &bytes.Buffer{},
+			FollowSeedRedirect: true,
+		}
+		assert.NoError(t, c.Run())
+		// the robots.txt of the seed host redirects to the one of the
+		// redirected host, which is also fetched once adopted
+		assert.ElementsMatch(t, []string{"/robots.txt", "/", "/robots.txt", "/"}, fetched)
+		assert.Equal(t, 1, c.Stats().Skipped[crawler.SkipRobots])
+	})
+}
+
+func TestRunInternalOnly(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+
+	siteMapOutBuf := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: siteMapOutBuf,
+		InternalOnly:  true,
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+
+	var expectedSiteMap []string
+	for _, line := range getExpectedSiteMap(httpTestServer.URL) {
+		if strings.Contains(line, "-> "+httpTestServer.URL) {
+			expectedSiteMap = append(expectedSiteMap, line)
+		}
+	}
+	assert.Len(t, expectedSiteMap, 7)
+	assert.ElementsMatch(t, expectedSiteMap, siteMapLines(siteMapOutBuf))
+	for _, external := range []string{"twitter.com", "fb.com", "golang.org"} {
+		assert.NotContains(t, siteMapOutBuf.String(), external)
 	}
-	expectedSiteMap := getExpectedSiteMap(httpTestServer.URL)
-	// siteMap might be in any order on units of "result"
-	assert.ElementsMatch(t, generatedSiteMap, expectedSiteMap)
 }
 
 // Helpers
+func siteMapLines(siteMapOutBuf *bytes.Buffer) []string {
+	lines := []string{}
+	for _, line := range strings.SplitAfter(siteMapOutBuf.String(), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 func getExpectedSiteMap(serverURL string) []string {
 	mainPage := fmt.Sprintf("%s", serverURL)
 	aboutPage := fmt.Sprintf("%s/about", serverURL)
@@ -158,3 +3777,144 @@ func newTestServer() *httptest.Server {
 
 	return httptest.NewServer(httpMux)
 }
+
+func TestRunOnPage(t *testing.T) {
+	httpTestServer := newRedirectsTestServer()
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	pages := map[string]crawler.PageResult{}
+	c := crawler.Crawler{
+		SeedURL:       serverURL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+		OnPage: func(r crawler.PageResult) {
+			pages[r.URL] = r
+		},
+	}
+	assert.NoError(t, c.Run())
+	assert.Len(t, pages, 4)
+
+	old := pages[serverURL+"/old"]
+	assert.Equal(t, serverURL+"/new", old.FinalURL)
+	assert.Equal(t, http.StatusOK, old.StatusCode)
+	assert.Equal(t, 1, old.Depth)
+	assert.True(t, old.Duration > 0)
+	assert.Equal(t, int64(len(`<html><head><title>New page</title></head><body><a href="/">home</a></body></html>`)), old.Bytes)
+	assert.Equal(t, "New page", old.Metadata.Title)
+	assert.Equal(t, []crawler.PageLink{{URL: serverURL, Element: "a", Text: "home", Count: 1}}, old.Links)
+	assert.Equal(t, []crawler.Redirect{
+		{URL: serverURL + "/old", Status: http.StatusMovedPermanently},
+		{URL: serverURL + "/older", Status: http.StatusFound},
+	}, old.Redirects)
+	assert.NoError(t, old.Error)
+
+	seed := pages[serverURL]
+	assert.Equal(t, serverURL, seed.FinalURL)
+	assert.Zero(t, seed.Depth)
+	assert.Empty(t, seed.Redirects)
+	assert.Equal(t, []crawler.PageLink{
+		{URL: serverURL + "/old", Element: "a", Text: "old", Count: 1},
+		{URL: serverURL + "/moved", Element: "a", Text: "moved", Count: 1},
+		{URL: serverURL + "/ping", Element: "a", Text: "ping", Count: 1},
+	}, seed.Links)
+
+	loop := pages[serverURL+"/ping"]
+	assert.IsType(t, &url.Error{}, loop.Error)
+	assert.Zero(t, loop.StatusCode)
+	assert.Empty(t, loop.FinalURL)
+	assert.Len(t, loop.Redirects, 2)
+	assert.Empty(t, loop.Links)
+}
+
+func TestRunInboundLinks(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	c := crawler.Crawler{
+		SeedURL:       serverURL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+	}
+	assert.NoError(t, c.Run())
+	// / links to /about, /help and twitter, /about to /, /help, fb and
+	// /careers, and /careers to /, golang and /help
+	assert.Equal(t, map[string]int{
+		serverURL:              2,
+		serverURL + "/about":   1,
+		serverURL + "/careers": 1,
+		serverURL + "/help":    3,
+		"https://twitter.com":  1,
+		"https://fb.com":       1,
+		"https://golang.org":   1,
+	}, c.InboundLinks())
+
+	stats := c.Stats()
+	if assert.Len(t, stats.MostLinked, 7) {
+		assert.Equal(t, crawler.LinkedURL{URL: serverURL + "/help", Inbound: 3}, stats.MostLinked[0])
+		assert.Equal(t, crawler.LinkedURL{URL: serverURL, Inbound: 2}, stats.MostLinked[1])
+	}
+	assert.Contains(t, stats.String(), "most linked: "+serverURL+"/help from 3 pages\n")
+}
+
+func TestRunSlowestPages(t *testing.T) {
+	t.Run("Ordering", func(t *testing.T) {
+		httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/slow":
+				time.Sleep(50 * time.Millisecond)
+			case "/slower":
+				time.Sleep(100 * time.Millisecond)
+			}
+			fmt.Fprint(w, `<a href="/slow">slow</a><a href="/slower">slower</a><a href="/fast">fast</a>`)
+		}))
+		defer httpTestServer.Close()
+		serverURL := httpTestServer.URL
+
+		c := crawler.Crawler{
+			SeedURL:         serverURL,
+			IgnoreRobots:    true,
+			NumWorkers:      crawler.DefaultNumWorkers,
+			SiteMapWriter:   &bytes.Buffer{},
+			MaxSlowestPages: 2,
+		}
+		assert.NoError(t, c.Run())
+		slowest := c.Stats().SlowestPages
+		if assert.Len(t, slowest, 2) {
+			assert.Equal(t, serverURL+"/slower", slowest[0].URL)
+			assert.Equal(t, serverURL+"/slow", slowest[1].URL)
+			assert.Equal(t, http.StatusOK, slowest[0].Status)
+			assert.Equal(t, int64(len(`<a href="/slow">slow</a><a href="/slower">slower</a><a href="/fast">fast</a>`)), slowest[0].Bytes)
+			assert.True(t, slowest[0].Duration >= 100*time.Millisecond)
+			assert.False(t, slowest[0].Retried)
+		}
+	})
+
+	t.Run("Ties and retries", func(t *testing.T) {
+		fetcher := &fakeFetcher{pages: map[string]fakePage{
+			"http://example.test":         {body: `<a href="/b">b</a><a href="/a">a</a><a href="/retried">retried</a>`},
+			"http://example.test/a":       {duration: 20 * time.Millisecond},
+			"http://example.test/b":       {duration: 20 * time.Millisecond},
+			"http://example.test/retried": {duration: 10 * time.Millisecond, attempts: 3, body: "retried"},
+		}}
+		c := crawler.Crawler{
+			SeedURL:       "http://example.test",
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			Fetcher:       fetcher,
+		}
+		assert.NoError(t, c.Run())
+		stats := c.Stats()
+		assert.Equal(t, []crawler.SlowPage{
+			{URL: "http://example.test/a", Status: http.StatusOK, Duration: 20 * time.Millisecond},
+			{URL: "http://example.test/b", Status: http.StatusOK, Duration: 20 * time.Millisecond},
+			{URL: "http://example.test/retried", Status: http.StatusOK, Bytes: 7, Duration: 10 * time.Millisecond, Retried: true},
+			{URL: "http://example.test", Status: http.StatusOK, Bytes: int64(len(`<a href="/b">b</a><a href="/a">a</a><a href="/retried">retried</a>`)), Duration: time.Millisecond},
+		}, stats.SlowestPages)
+		assert.Contains(t, stats.String(), "slow page: http://example.test/retried in 10ms (200, 7 bytes, retried)\n")
+	})
+}
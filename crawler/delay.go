@@ -0,0 +1,96 @@
+package crawler
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// delayJitter is the max fraction a delay is randomly shortened or
+// lengthened by, to avoid requests in lockstep.
+const delayJitter = 0.2
+
+// hostLimiter enforces a minimum interval between the start of the
+// requests to each host. It's shared by all the workers.
+type hostLimiter struct {
+	mu     sync.Mutex
+	next   map[string]time.Time // time of the next request allowed per host
+	jitter func() float64       // random number in [0, 1)
+}
+
+func newHostLimiter() *hostLimiter {
+	return &hostLimiter{next: make(map[string]time.Time), jitter: rand.Float64}
+}
+
+// wait blocks until a request to host can be started, given the delay
+// between requests to it. It returns the ctx error if ctx is done first.
+func (l *hostLimiter) wait(ctx context.Context, host string, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next[host]
+	if start.Before(now) {
+		start = now
+	}
+	// the slot is booked right away so concurrent workers queue up
+	l.next[host] = start.Add(l.jittered(delay))
+	l.mu.Unlock()
+
+	timer := time.NewTimer(start.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jittered returns the delay randomly changed by up to delayJitter.
+func (l *hostLimiter) jittered(delay time.Duration) time.Duration {
+	factor := 1 - delayJitter + 2*delayJitter*l.jitter()
+	return time.Duration(float64(delay) * factor)
+}
+
+// throttle blocks until a request to host can be started according to the
+// crawl Rate and the delay between requests to host. It returns the ctx
+// error if ctx, the crawl or request context, is done first.
+func (c *Crawler) throttle(ctx context.Context, host string) error {
+	if c.rateLimiter != nil {
+		if err := c.rateLimiter.Wait(ctx); err != nil {
+			// Wait fails right away when the next request is allowed after
+			// the deadline, so wait for ctx to be done.
+			<-ctx.Done()
+			return ctx.Err()
+		}
+	}
+	return c.hostLimiter.wait(ctx, host, c.delay(host))
+}
+
+// throttleKey is the context key of the throttle of the request passed to
+// a Fetcher.
+type throttleKey struct{}
+
+// Throttle blocks until a Fetcher retrying the request of ctx, the context
+// passed to Fetch, can make a new attempt according to the crawl Rate and
+// the delay between requests to the host. Fetchers retrying requests call it
+// before each retry. It returns the ctx error if ctx is done first, and nil
+// right away for a context not passed by the crawler.
+func Throttle(ctx context.Context) error {
+	throttle, ok := ctx.Value(throttleKey{}).(func(context.Context) error)
+	if !ok {
+		return nil
+	}
+	return throttle(ctx)
+}
+
+// withThrottle returns ctx carrying the throttle of the requests to host,
+// for the Fetcher to call Throttle with.
+func (c *Crawler) withThrottle(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, throttleKey{}, func(ctx context.Context) error {
+		return c.throttle(ctx, host)
+	})
+}
@@ -0,0 +1,56 @@
+package crawler
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostLimiterJittered(t *testing.T) {
+	l := newHostLimiter()
+	l.jitter = func() float64 { return 0 }
+	assert.Equal(t, 80*time.Millisecond, l.jittered(100*time.Millisecond))
+	l.jitter = func() float64 { return 0.5 }
+	assert.Equal(t, 100*time.Millisecond, l.jittered(100*time.Millisecond))
+	l.jitter = func() float64 { return 0.99 }
+	assert.True(t, l.jittered(100*time.Millisecond) < 120*time.Millisecond)
+}
+
+func TestHostLimiterWait(t *testing.T) {
+	delay := 50 * time.Millisecond
+
+	t.Run("Requests to the same host are spaced", func(t *testing.T) {
+		l := newHostLimiter()
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, l.wait(context.Background(), "example.com", delay))
+			}()
+		}
+		wg.Wait()
+		// the first request starts right away
+		assert.True(t, time.Since(start) >= 3*time.Duration(float64(delay)*(1-delayJitter)))
+	})
+
+	t.Run("Hosts are limited independently", func(t *testing.T) {
+		l := newHostLimiter()
+		start := time.Now()
+		assert.NoError(t, l.wait(context.Background(), "a.example.com", time.Minute))
+		assert.NoError(t, l.wait(context.Background(), "b.example.com", time.Minute))
+		assert.True(t, time.Since(start) < time.Second)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		l := newHostLimiter()
+		ctx, cancel := context.WithCancel(context.Background())
+		assert.NoError(t, l.wait(ctx, "example.com", time.Minute))
+		cancel()
+		assert.Equal(t, context.Canceled, l.wait(ctx, "example.com", time.Minute))
+	})
+}
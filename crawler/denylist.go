@@ -0,0 +1,92 @@
+package crawler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// denylist holds URL patterns that must never be crawled.
+// Each line of a denylist file is one of:
+//   - an exact absolute URL, e.g. https://example.com/logout
+//   - a path prefix starting with "/", e.g. /admin/
+//   - a regular expression prefixed with "re:", e.g. re:/archive/\d{4}/
+//
+// Blank lines and lines starting with "#" are ignored.
+type denylist struct {
+	exact    map[string]bool
+	prefixes []string
+	regexps  []*regexp.Regexp
+}
+
+// loadDenylist loads the denylist file, normalizing the exact URLs with n
+// as the URLs crawled are, e.g. keeping their trailing slash with
+// KeepTrailingSlash.
+func loadDenylist(path string, n urlNormalizer) (*denylist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open denylist file: %q", err.Error())
+	}
+	defer f.Close()
+	return parseDenylist(f, n)
+}
+
+func parseDenylist(r io.Reader, n urlNormalizer) (*denylist, error) {
+	d := &denylist{exact: map[string]bool{}}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "re:"):
+			re, err := regexp.Compile(strings.TrimPrefix(line, "re:"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid denylist line %d: %s", lineNum, err.Error())
+			}
+			d.regexps = append(d.regexps, re)
+		case strings.HasPrefix(line, "/"):
+			d.prefixes = append(d.prefixes, line)
+		default:
+			u, err := n.parseAbsolute(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid denylist line %d: %s", lineNum, err.Error())
+			}
+			n.normalizeHost(u)
+			d.exact[u.String()] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read denylist: %q", err.Error())
+	}
+	return d, nil
+}
+
+// match reports whether the URL is denylisted. Regular expressions are
+// matched against the full URL.
+func (d *denylist) match(u *url.URL) bool {
+	if d == nil {
+		return false
+	}
+	s := u.String()
+	if d.exact[s] {
+		return true
+	}
+	for _, prefix := range d.prefixes {
+		if strings.HasPrefix(u.Path, prefix) {
+			return true
+		}
+	}
+	for _, re := range d.regexps {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
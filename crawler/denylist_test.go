@@ -0,0 +1,156 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDenylist(t *testing.T) {
+	t.Run("All pattern kinds", func(t *testing.T) {
+		d, err := parseDenylist(strings.NewReader(`
+# logout endpoints
+https://example.com/logout/
+
+/admin/
+re:/archive/\d{4}/
+`), urlNormalizer{})
+		assert.NoError(t, err)
+		for _, stringURL := range []string{
+			"https://example.com/logout",
+			"https://example.com/admin/delete",
+			"https://example.com/archive/2019/01",
+		} {
+			u, _ := strToURL(stringURL)
+			assert.True(t, d.match(u), stringURL)
+		}
+		for _, stringURL := range []string{
+			"https://example.com/logout/now",
+			"https://example.com/administration",
+			"https://example.com/archive/latest",
+		} {
+			u, _ := strToURL(stringURL)
+			assert.False(t, d.match(u), stringURL)
+		}
+	})
+	t.Run("Malformed regexp", func(t *testing.T) {
+		_, err := parseDenylist(strings.NewReader("/admin\n# comment\nre:(\n"), urlNormalizer{})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "line 3")
+	})
+	t.Run("Malformed URL", func(t *testing.T) {
+		_, err := parseDenylist(strings.NewReader("admin/\n"), urlNormalizer{})
+		assert.EqualError(t, err, "invalid denylist line 1: "+ErrInvalidAbsoluteURL.Error())
+	})
+	t.Run("Nil denylist matches nothing", func(t *testing.T) {
+		var d *denylist
+		u, _ := strToURL("https://example.com")
+		assert.False(t, d.match(u))
+	})
+}
+
+func TestRunDenylistFile(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<a href="/about">about</a><a href="/logout">logout</a>
+<a href="/admin/delete">delete</a><a href="/archive/2019">archive</a>`))
+		}
+	}))
+	defer httpTestServer.Close()
+
+	f, err := ioutil.TempFile("", "denylist")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "%s/logout\n/admin/\nre:/archive/\\d+$\n", httpTestServer.URL)
+	f.Close()
+
+	c := Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+		DenylistFile:  f.Name(),
+	}
+	err = c.Run()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"/", "/about"}, fetched)
+	assert.Equal(t, 3, c.Stats().Skipped[SkipDenylisted])
+
+	t.Run("Invalid denylist fails validation", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "denylist")
+		assert.NoError(t, err)
+		defer os.Remove(f.Name())
+		f.WriteString("re:[\n")
+		f.Close()
+
+		c := Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			DenylistFile:  f.Name(),
+		}
+		err = c.Run()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "line 1")
+	})
+}
+
+// denylistFetcher serves the same page for every URL, recording them.
+type denylistFetcher struct {
+	mu      sync.Mutex
+	fetched []string
+}
+
+func (f *denylistFetcher) Fetch(ctx context.Context, u *url.URL) (*FetchResult, error) {
+	f.mu.Lock()
+	f.fetched = append(f.fetched, u.String())
+	f.mu.Unlock()
+	body := `<a href="/about/">about</a><a href="/logout/">logout</a><a href="http://www.example.test/delete/">delete</a>`
+	return &FetchResult{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/html"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+func TestRunDenylistNormalized(t *testing.T) {
+	f, err := ioutil.TempFile("", "denylist")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	// normalized as the URLs crawled: the trailing slashes are kept and
+	// www.example.test is example.test
+	f.WriteString("http://example.test/logout/\nhttp://www.example.test/delete/\n")
+	f.Close()
+
+	fetcher := &denylistFetcher{}
+	c := Crawler{
+		SeedURL:           "http://example.test/",
+		IgnoreRobots:      true,
+		NumWorkers:        DefaultNumWorkers,
+		SiteMapWriter:     &bytes.Buffer{},
+		DenylistFile:      f.Name(),
+		KeepTrailingSlash: true,
+		EquateWWW:         true,
+		Fetcher:           fetcher,
+	}
+	assert.NoError(t, c.Run())
+	assert.ElementsMatch(t, []string{"http://example.test/", "http://example.test/about/"}, fetcher.fetched)
+	// both pages link to the two denylisted URLs
+	assert.Equal(t, 4, c.Stats().Skipped[SkipDenylisted])
+}
@@ -0,0 +1,178 @@
+package crawler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// CrawlDiff holds the differences between two crawls written with
+// FormatNDJSON (see DiffCrawls), sorted by URL.
+type CrawlDiff struct {
+	AddedPages    []DiffPage     `json:"added_pages"`
+	RemovedPages  []DiffPage     `json:"removed_pages"`
+	StatusChanges []StatusChange `json:"status_changes"`
+	AddedLinks    []DiffLink     `json:"added_links"`
+	RemovedLinks  []DiffLink     `json:"removed_links"`
+}
+
+// DiffPage is a page only in one of the crawls.
+type DiffPage struct {
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"` // zero if no response was received, or for the feeds and stylesheets
+}
+
+// StatusChange is a page in both crawls with different statuses, e.g. a
+// page fetched before and now failing with 404.
+type StatusChange struct {
+	URL string `json:"url"`
+	Old int    `json:"old"`
+	New int    `json:"new"`
+}
+
+// DiffLink is a link only in one of the crawls.
+type DiffLink struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// diffPage is a page of the old crawl, kept until it's found in the new one.
+type diffPage struct {
+	status int
+	links  []string
+}
+
+// DiffCrawls compares two crawls written with FormatNDJSON. Only the pages
+// and links of the old one are kept in memory: the new one is streamed, so
+// the larger crawl should be passed as the new one.
+func DiffCrawls(old, newer io.Reader) (*CrawlDiff, error) {
+	pages := map[string]*diffPage{}
+	err := readPageRecords(old, func(record PageRecord) {
+		pages[record.URL] = &diffPage{status: record.Status, links: record.Links}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't read the old crawl: %s", err.Error())
+	}
+	diff := &CrawlDiff{
+		AddedPages:    []DiffPage{},
+		RemovedPages:  []DiffPage{},
+		StatusChanges: []StatusChange{},
+		AddedLinks:    []DiffLink{},
+		RemovedLinks:  []DiffLink{},
+	}
+	err = readPageRecords(newer, func(record PageRecord) {
+		page, ok := pages[record.URL]
+		if !ok {
+			diff.AddedPages = append(diff.AddedPages, DiffPage{URL: record.URL, Status: record.Status})
+			diff.AddedLinks = appendLinks(diff.AddedLinks, record.URL, record.Links, nil)
+			return
+		}
+		delete(pages, record.URL)
+		if page.status != record.Status {
+			diff.StatusChanges = append(diff.StatusChanges, StatusChange{URL: record.URL, Old: page.status, New: record.Status})
+		}
+		diff.AddedLinks = appendLinks(diff.AddedLinks, record.URL, record.Links, page.links)
+		diff.RemovedLinks = appendLinks(diff.RemovedLinks, record.URL, page.links, record.Links)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't read the new crawl: %s", err.Error())
+	}
+	for u, page := range pages {
+		diff.RemovedPages = append(diff.RemovedPages, DiffPage{URL: u, Status: page.status})
+		diff.RemovedLinks = appendLinks(diff.RemovedLinks, u, page.links, nil)
+	}
+	diff.sort()
+	return diff, nil
+}
+
+// readPageRecords calls read with every record of the FormatNDJSON crawl.
+func readPageRecords(r io.Reader, read func(PageRecord)) error {
+	scanner := bufio.NewScanner(r)
+	// the records of the pages with many links are long
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record PageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		read(record)
+	}
+	return scanner.Err()
+}
+
+// appendLinks appends the links from source to the targets not in
+// excluded.
+func appendLinks(links []DiffLink, source string, targets, excluded []string) []DiffLink {
+	skip := make(map[string]bool, len(excluded))
+	for _, target := range excluded {
+		skip[target] = true
+	}
+	for _, target := range targets {
+		if !skip[target] {
+			skip[target] = true
+			links = append(links, DiffLink{Source: source, Target: target})
+		}
+	}
+	return links
+}
+
+func (d *CrawlDiff) sort() {
+	for _, pages := range [][]DiffPage{d.AddedPages, d.RemovedPages} {
+		sort.Slice(pages, func(i, j int) bool {
+			return pages[i].URL < pages[j].URL
+		})
+	}
+	sort.Slice(d.StatusChanges, func(i, j int) bool {
+		return d.StatusChanges[i].URL < d.StatusChanges[j].URL
+	})
+	for _, links := range [][]DiffLink{d.AddedLinks, d.RemovedLinks} {
+		sort.Slice(links, func(i, j int) bool {
+			if links[i].Source != links[j].Source {
+				return links[i].Source < links[j].Source
+			}
+			return links[i].Target < links[j].Target
+		})
+	}
+}
+
+// Empty reports whether the crawls have the same pages, statuses and links.
+func (d *CrawlDiff) Empty() bool {
+	return len(d.AddedPages) == 0 && len(d.RemovedPages) == 0 && len(d.StatusChanges) == 0 &&
+		len(d.AddedLinks) == 0 && len(d.RemovedLinks) == 0
+}
+
+// WriteText writes the differences as lines of the form "+ page URL
+// (status)", "- page URL (status)", "~ status URL old -> new", "+ link
+// source -> target" and "- link source -> target", in that order.
+func (d *CrawlDiff) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, page := range d.AddedPages {
+		fmt.Fprintf(bw, "+ page %s (%s)\n", page.URL, formatDiffStatus(page.Status))
+	}
+	for _, page := range d.RemovedPages {
+		fmt.Fprintf(bw, "- page %s (%s)\n", page.URL, formatDiffStatus(page.Status))
+	}
+	for _, change := range d.StatusChanges {
+		fmt.Fprintf(bw, "~ status %s %s -> %s\n", change.URL, formatDiffStatus(change.Old), formatDiffStatus(change.New))
+	}
+	for _, link := range d.AddedLinks {
+		fmt.Fprintf(bw, "+ link %s -> %s\n", link.Source, link.Target)
+	}
+	for _, link := range d.RemovedLinks {
+		fmt.Fprintf(bw, "- link %s -> %s\n", link.Source, link.Target)
+	}
+	return bw.Flush()
+}
+
+// formatDiffStatus returns the status code, or "no response" if zero.
+func formatDiffStatus(code int) string {
+	if code == 0 {
+		return "no response"
+	}
+	return formatStatus(code)
+}
@@ -0,0 +1,69 @@
+package crawler_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/scanterog/crawler/crawler"
+	"github.com/stretchr/testify/assert"
+)
+
+const diffOldCrawl = `{"url":"http://site/","parents":[],"status":200,"depth":0,"latency_ms":1,"bytes":10,"links":["http://site/about","http://site/help"]}
+{"url":"http://site/about","parents":["http://site/"],"status":200,"depth":1,"latency_ms":1,"bytes":10,"links":["http://site/"]}
+{"url":"http://site/help","parents":["http://site/"],"status":200,"depth":1,"latency_ms":1,"bytes":10,"links":["http://site/faq"]}
+{"url":"http://site/faq","parents":["http://site/help"],"status":200,"depth":2,"latency_ms":1,"bytes":10,"links":[]}
+`
+
+const diffNewCrawl = `{"url":"http://site/","parents":[],"status":200,"depth":0,"latency_ms":1,"bytes":10,"links":["http://site/about","http://site/help","http://site/careers"]}
+{"url":"http://site/careers","parents":["http://site/"],"status":200,"depth":1,"latency_ms":1,"bytes":10,"links":["http://site/"]}
+{"url":"http://site/about","parents":["http://site/"],"status":200,"depth":1,"latency_ms":1,"bytes":10,"links":[]}
+{"url":"http://site/help","parents":["http://site/"],"status":404,"depth":1,"latency_ms":1,"bytes":0,"links":[],"error":"404 Not Found"}
+`
+
+func TestDiffCrawls(t *testing.T) {
+	diff, err := crawler.DiffCrawls(strings.NewReader(diffOldCrawl), strings.NewReader(diffNewCrawl))
+	assert.NoError(t, err)
+	assert.Equal(t, &crawler.CrawlDiff{
+		AddedPages:   []crawler.DiffPage{{URL: "http://site/careers", Status: 200}},
+		RemovedPages: []crawler.DiffPage{{URL: "http://site/faq", Status: 200}},
+		StatusChanges: []crawler.StatusChange{
+			{URL: "http://site/help", Old: 200, New: 404},
+		},
+		AddedLinks: []crawler.DiffLink{
+			{Source: "http://site/", Target: "http://site/careers"},
+			{Source: "http://site/careers", Target: "http://site/"},
+		},
+		RemovedLinks: []crawler.DiffLink{
+			{Source: "http://site/about", Target: "http://site/"},
+			{Source: "http://site/help", Target: "http://site/faq"},
+		},
+	}, diff)
+	assert.False(t, diff.Empty())
+
+	text := &bytes.Buffer{}
+	assert.NoError(t, diff.WriteText(text))
+	assert.Equal(t, `+ page http://site/careers (200)
+- page http://site/faq (200)
+~ status http://site/help 200 -> 404
++ link http://site/ -> http://site/careers
++ link http://site/careers -> http://site/
+- link http://site/about -> http://site/
+- link http://site/help -> http://site/faq
+`, text.String())
+}
+
+func TestDiffCrawlsSame(t *testing.T) {
+	diff, err := crawler.DiffCrawls(strings.NewReader(diffOldCrawl), strings.NewReader(diffOldCrawl))
+	assert.NoError(t, err)
+	assert.True(t, diff.Empty())
+
+	text := &bytes.Buffer{}
+	assert.NoError(t, diff.WriteText(text))
+	assert.Empty(t, text.String())
+}
+
+func TestDiffCrawlsInvalid(t *testing.T) {
+	_, err := crawler.DiffCrawls(strings.NewReader(diffOldCrawl), strings.NewReader(diffOldCrawl+"{\n"))
+	assert.EqualError(t, err, "can't read the new crawl: line 5: unexpected end of JSON input")
+}
@@ -0,0 +1,104 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// DryRunLink is a URL found by a dry run with what a crawl would do with it.
+type DryRunLink struct {
+	URL    string
+	Parent string     // seed page linking to the URL. Empty for the seeds.
+	Reason SkipReason // why the URL would not be crawled. Empty if it would be.
+}
+
+// DryRunReport is the result of DryRun.
+type DryRunReport struct {
+	Fetched []string     // seed pages fetched
+	Links   []DryRunLink // sorted by URL and reason
+}
+
+// dryRunReport collects the DryRunReport while the workers run.
+type dryRunReport struct {
+	mu      sync.Mutex
+	fetched []string
+	links   map[skippedKey]DryRunLink
+}
+
+func (d *dryRunReport) addFetched(site webSite) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.fetched = append(d.fetched, site.URL.String())
+}
+
+// addLink records the site, once per URL and reason.
+func (d *dryRunReport) addLink(site webSite, reason SkipReason) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := skippedKey{url: site.URL.String(), reason: reason}
+	if _, ok := d.links[key]; ok {
+		return
+	}
+	link := DryRunLink{URL: key.url, Reason: reason}
+	if site.Parent != nil {
+		link.Parent = site.Parent.String()
+	}
+	d.links[key] = link
+}
+
+func (d *dryRunReport) report() DryRunReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := DryRunReport{Fetched: append([]string(nil), d.fetched...)}
+	sort.Strings(r.Fetched)
+	for _, link := range d.links {
+		r.Links = append(r.Links, link)
+	}
+	sort.Slice(r.Links, func(i, j int) bool {
+		if r.Links[i].URL != r.Links[j].URL {
+			return r.Links[i].URL < r.Links[j].URL
+		}
+		return r.Links[i].Reason < r.Links[j].Reason
+	})
+	return r
+}
+
+// DryRun previews a crawl: only the seed pages (and their robots.txt) are
+// fetched and every link found in them goes through the same checks as in
+// a crawl, e.g. the filters, budgets and robots.txt rules, to report whether
+// it would be crawled or why not. The site map is not written and the
+// sitemaps of UseSitemap are not fetched. It's useful to debug the filters.
+func (c *Crawler) DryRun(ctx context.Context) (DryRunReport, error) {
+	d := &dryRunReport{links: make(map[skippedKey]DryRunLink)}
+	if err := c.run(ctx, d); err != nil {
+		return DryRunReport{}, err
+	}
+	return d.report(), nil
+}
+
+// Write writes the report as tab separated lines: "fetch" and the URL for
+// the fetched seeds, then "crawl" and the URL for the links that would be
+// crawled or "skip", the URL and the reason for the others. The parent
+// page of the links is written last.
+func (r DryRunReport) Write(w io.Writer) error {
+	for _, u := range r.Fetched {
+		if _, err := fmt.Fprintf(w, "fetch\t%s\n", u); err != nil {
+			return err
+		}
+	}
+	for _, link := range r.Links {
+		var err error
+		if link.Reason == "" {
+			_, err = fmt.Fprintf(w, "crawl\t%s\t%s\n", link.URL, link.Parent)
+		} else {
+			_, err = fmt.Fprintf(w, "skip\t%s\t%s\t%s\n", link.URL, link.Reason, link.Parent)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
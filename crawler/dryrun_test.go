@@ -0,0 +1,40 @@
+package crawler
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunReportWrite(t *testing.T) {
+	r := DryRunReport{
+		Fetched: []string{"https://example.com"},
+		Links: []DryRunLink{
+			{URL: "https://example.com/a", Parent: "https://example.com"},
+			{URL: "https://example.org/b", Parent: "https://example.com", Reason: SkipExternal},
+		},
+	}
+	buf := &bytes.Buffer{}
+	assert.NoError(t, r.Write(buf))
+	assert.Equal(t, "fetch\thttps://example.com\n"+
+		"crawl\thttps://example.com/a\thttps://example.com\n"+
+		"skip\thttps://example.org/b\texternal\thttps://example.com\n", buf.String())
+}
+
+func TestDryRunReportAddLink(t *testing.T) {
+	d := &dryRunReport{links: make(map[skippedKey]DryRunLink)}
+	parent, _ := url.Parse("https://example.com")
+	b, _ := url.Parse("https://example.com/b")
+	a, _ := url.Parse("https://example.com/a")
+	d.addLink(webSite{URL: b, Parent: parent}, "")
+	d.addLink(webSite{URL: b, Parent: parent}, SkipVisited)
+	d.addLink(webSite{URL: b, Parent: parent}, SkipVisited)
+	d.addLink(webSite{URL: a, Parent: parent}, SkipNofollow)
+	assert.Equal(t, []DryRunLink{
+		{URL: "https://example.com/a", Parent: "https://example.com", Reason: SkipNofollow},
+		{URL: "https://example.com/b", Parent: "https://example.com"},
+		{URL: "https://example.com/b", Parent: "https://example.com", Reason: SkipVisited},
+	}, d.report().Links)
+}
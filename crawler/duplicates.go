@@ -0,0 +1,114 @@
+package crawler
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// spaceCollapser writes to w the bytes written to it with their runs of
+// whitespace collapsed into a single space and the leading and trailing
+// ones removed.
+type spaceCollapser struct {
+	w       io.Writer
+	started bool // a byte other than whitespace was written
+	pending bool // whitespace to write before the next byte
+	buf     []byte
+}
+
+func (s *spaceCollapser) Write(p []byte) (int, error) {
+	s.buf = s.buf[:0]
+	for _, b := range p {
+		switch b {
+		case ' ', '\t', '\n', '\r', '\f', '\v':
+			s.pending = s.started
+			continue
+		}
+		if s.pending {
+			s.buf = append(s.buf, ' ')
+			s.pending = false
+		}
+		s.buf = append(s.buf, b)
+		s.started = true
+	}
+	if _, err := s.w.Write(s.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// contentHashes holds the URLs of the fetched pages by content hash, up to
+// maxPages, so the clusters of duplicates don't need the metadata of every
+// page.
+type contentHashes struct {
+	urls     map[string][]string
+	pages    int
+	maxPages int
+	warned   bool // whether the max number of pages being reached was logged
+}
+
+func newContentHashes(maxPages int) *contentHashes {
+	return &contentHashes{urls: make(map[string][]string), maxPages: maxPages}
+}
+
+// add indexes the page by the hash of its content, if any.
+func (h *contentHashes) add(hash, u string) {
+	if hash == "" {
+		return
+	}
+	if h.pages >= h.maxPages {
+		if !h.warned {
+			log.Warnf("Max duplicate pages reached (%d): the next ones are not checked for duplicates", h.maxPages)
+			h.warned = true
+		}
+		return
+	}
+	h.urls[hash] = append(h.urls[hash], u)
+	h.pages++
+}
+
+// Duplicates returns the clusters of fetched pages sharing the same
+// content (see PageMetadata.ContentHash), largest first. The URLs of each
+// cluster are sorted. Only the first MaxDuplicatePages pages fetched are
+// clustered.
+func (c *Crawler) Duplicates() [][]string {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.contentHashes == nil {
+		return nil
+	}
+	var clusters [][]string
+	for _, urls := range c.contentHashes.urls {
+		if len(urls) > 1 {
+			cluster := append([]string(nil), urls...)
+			sort.Strings(cluster)
+			clusters = append(clusters, cluster)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i]) != len(clusters[j]) {
+			return len(clusters[i]) > len(clusters[j])
+		}
+		return clusters[i][0] < clusters[j][0]
+	})
+	return clusters
+}
+
+// WriteDuplicatesReport writes the clusters of pages sharing the same
+// content (see Duplicates), one per line with their URLs tab separated.
+func (c *Crawler) WriteDuplicatesReport(w io.Writer) error {
+	for _, cluster := range c.Duplicates() {
+		for i, u := range cluster {
+			sep := "\t"
+			if i == len(cluster)-1 {
+				sep = "\n"
+			}
+			if _, err := fmt.Fprint(w, u, sep); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
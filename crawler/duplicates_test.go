@@ -0,0 +1,34 @@
+package crawler
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpaceCollapser(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   []string
+		expected string
+	}{
+		{name: "No whitespace", writes: []string{"abc"}, expected: "abc"},
+		{name: "Runs", writes: []string{"a  b\t\n c"}, expected: "a b c"},
+		{name: "Leading and trailing", writes: []string{" \n a b \n "}, expected: "a b"},
+		{name: "Across writes", writes: []string{"a ", " ", " b", "\n"}, expected: "a b"},
+		{name: "Only whitespace", writes: []string{" ", "\t"}, expected: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			s := &spaceCollapser{w: buf}
+			for _, w := range tt.writes {
+				n, err := s.Write([]byte(w))
+				assert.NoError(t, err)
+				assert.Equal(t, len(w), n)
+			}
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
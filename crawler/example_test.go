@@ -0,0 +1,115 @@
+package crawler_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/scanterog/crawler/crawler"
+)
+
+// This example deduplicates URLs ignoring their query string, so
+// "/list?page=1" and "/list?page=2" are crawled once.
+func ExampleCrawler_dedupKeyFunc() {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Printf("fetched %s\n", r.URL.RequestURI())
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<a href="/list?page=1">1</a><a href="/list?page=2">2</a>`))
+		}
+	}))
+	defer httpTestServer.Close()
+
+	siteMap := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		NumWorkers:    1,
+		SiteMapWriter: siteMap,
+		DedupKeyFunc: func(u *url.URL) string {
+			return u.Host + u.Path
+		},
+	}
+	if err := c.Run(); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Print(strings.Replace(siteMap.String(), httpTestServer.URL, "", -1))
+	// Output:
+	// fetched /robots.txt
+	// fetched /
+	// fetched /list?page=1
+	//  -> /list?page=1
+	//  -> /list?page=2
+}
+
+// This example crawls the product pages before any other page, so they are
+// all fetched in spite of the small page budget.
+func ExampleCrawler_priorityFunc() {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Write([]byte(`<a href="/blog/1">b1</a><a href="/products/1">p1</a><a href="/blog/2">b2</a><a href="/products/2">p2</a>`))
+			return
+		}
+		fmt.Printf("fetched %s\n", r.URL.Path)
+	}))
+	defer httpTestServer.Close()
+
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		NumWorkers:    1,
+		SiteMapWriter: ioutil.Discard,
+		IgnoreRobots:  true,
+		MaxPages:      3,
+		PriorityFunc: func(u *url.URL, depth int) int {
+			if strings.HasPrefix(u.Path, "/products/") {
+				return 1
+			}
+			return 0
+		},
+	}
+	if err := c.Run(); err != nil {
+		fmt.Println(err)
+	}
+	// Output:
+	// fetched /products/1
+	// fetched /products/2
+}
+
+// This example crawls a JSON API, following the URLs of its items and the
+// link to its next page.
+func ExampleJSONExtractor() {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.RequestURI() {
+		case "/":
+			w.Write([]byte(`{"items": [{"url": "/items/1"}, {"url": "/items/2"}], "next": "/list?page=2"}`))
+		case "/list?page=2":
+			w.Write([]byte(`{"items": [{"url": "/items/3"}]}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer httpTestServer.Close()
+
+	siteMap := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		NumWorkers:    1,
+		SiteMapWriter: siteMap,
+		IgnoreRobots:  true,
+		Extractors: map[string]crawler.LinkExtractor{
+			"application/json": crawler.JSONExtractor{Paths: []string{"items.url", "next"}},
+		},
+	}
+	if err := c.Run(); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Print(strings.Replace(siteMap.String(), httpTestServer.URL, "", -1))
+	// Output:
+	//  -> /items/1
+	//  -> /items/2
+	//  -> /list?page=2
+	// /list?page=2 -> /items/3
+}
@@ -0,0 +1,218 @@
+package crawler
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// maxExternalBodySize is the max number of bytes of a GET check read
+// before closing it, so the connection can be reused.
+const maxExternalBodySize = 64 << 10
+
+// maxPendingExternalChecks is the max number of URLs waiting to be checked.
+// The ones found beyond it are not checked.
+const maxPendingExternalChecks = 100000
+
+// externalChecker checks that the external URLs linked from the pages
+// resolve, with a HEAD request falling back to a GET one, without crawling
+// them (see CheckExternal). It has its own workers and limits, and it's
+// polite to each host: a single request at a time, ExternalDelay apart.
+// The URLs are queued by host, and a worker only takes the next URL of a
+// host once its delay elapsed, so a slow host can't hold every worker.
+type externalChecker struct {
+	crawler     *Crawler
+	ctx         context.Context
+	mu          sync.Mutex // guards the fields below
+	cond        *sync.Cond // signalled when a host is ready, the queue closed or ctx done
+	checked     map[string]bool
+	pending     map[string][]webSite // URLs to check, by host
+	ready       []string             // hosts with pending URLs and free, in the order they became ready
+	busy        map[string]bool      // hosts being checked, or waiting for ExternalDelay
+	queued      int                  // number of pending URLs
+	closed      bool                 // no more URLs are queued
+	warned      bool                 // whether the max number of pending URLs being reached was logged
+	rateLimiter *rate.Limiter        // enforces ExternalRate. Nil means unlimited.
+	wg          sync.WaitGroup
+	done        chan bool // closed once the workers exited
+}
+
+// newExternalChecker starts the ExternalWorkers workers of the checker.
+func newExternalChecker(ctx context.Context, c *Crawler) *externalChecker {
+	e := &externalChecker{
+		crawler: c,
+		ctx:     ctx,
+		checked: make(map[string]bool),
+		pending: make(map[string][]webSite),
+		busy:    make(map[string]bool),
+		done:    make(chan bool),
+	}
+	e.cond = sync.NewCond(&e.mu)
+	if c.ExternalRate > 0 {
+		e.rateLimiter = rate.NewLimiter(rate.Limit(c.ExternalRate), 1)
+	}
+	go func() {
+		// wake the workers up to exit
+		select {
+		case <-ctx.Done():
+			e.mu.Lock()
+			e.cond.Broadcast()
+			e.mu.Unlock()
+		case <-e.done:
+		}
+	}()
+	e.wg.Add(c.ExternalWorkers)
+	for i := 0; i < c.ExternalWorkers; i++ {
+		go e.worker()
+	}
+	return e
+}
+
+// check queues the URL of the site to be checked, unless it was already.
+// It never blocks, so it can be called by the dispatcher. A nil
+// *externalChecker checks nothing.
+func (e *externalChecker) check(s webSite) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.checked[s.URL.String()] {
+		return
+	}
+	e.checked[s.URL.String()] = true
+	if e.queued >= maxPendingExternalChecks {
+		if !e.warned {
+			log.Warnf("Max external URLs waiting to be checked reached (%d): the next ones are not checked", maxPendingExternalChecks)
+			e.warned = true
+		}
+		return
+	}
+	host := s.URL.Host
+	if len(e.pending[host]) == 0 && !e.busy[host] {
+		e.ready = append(e.ready, host)
+		e.cond.Signal()
+	}
+	e.pending[host] = append(e.pending[host], s)
+	e.queued++
+}
+
+// wait blocks until every URL queued is checked.
+func (e *externalChecker) wait() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.closed = true
+	e.cond.Broadcast()
+	e.mu.Unlock()
+	e.wg.Wait()
+	close(e.done)
+}
+
+// worker checks the URLs of the ready hosts until the queue is closed and
+// empty, or ctx is done.
+func (e *externalChecker) worker() {
+	defer e.wg.Done()
+	for {
+		s, ok := e.next()
+		if !ok {
+			return
+		}
+		started := time.Now()
+		e.run(s)
+		e.release(s.URL.Host, started)
+	}
+}
+
+// next takes the next URL of the first ready host, marking the host busy.
+// It returns false once there's nothing left to check.
+func (e *externalChecker) next() (webSite, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for len(e.ready) == 0 && e.ctx.Err() == nil && !(e.closed && e.queued == 0) {
+		e.cond.Wait()
+	}
+	if len(e.ready) == 0 || e.ctx.Err() != nil {
+		return webSite{}, false
+	}
+	host := e.ready[0]
+	e.ready = e.ready[1:]
+	s := e.pending[host][0]
+	e.pending[host] = e.pending[host][1:]
+	if len(e.pending[host]) == 0 {
+		delete(e.pending, host)
+	}
+	e.queued--
+	e.busy[host] = true
+	return s, true
+}
+
+// release makes the host ready again ExternalDelay after the start of its
+// last check, without holding a worker meanwhile.
+func (e *externalChecker) release(host string, started time.Time) {
+	free := func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.busy, host)
+		if len(e.pending[host]) > 0 {
+			e.ready = append(e.ready, host)
+			e.cond.Signal()
+		} else if e.closed && e.queued == 0 {
+			e.cond.Broadcast()
+		}
+	}
+	if wait := e.crawler.ExternalDelay - time.Since(started); wait > 0 {
+		time.AfterFunc(wait, free)
+		return
+	}
+	free()
+}
+
+// run checks the site, recording it as broken if it fails.
+func (e *externalChecker) run(s webSite) {
+	c := e.crawler
+	ctx := e.ctx
+	if e.rateLimiter != nil {
+		if err := e.rateLimiter.Wait(ctx); err != nil {
+			return
+		}
+	}
+	err := e.request(ctx, http.MethodHead, s.URL)
+	if err != nil && ctx.Err() == nil {
+		// many servers don't handle HEAD properly
+		log.Debugf("HEAD %q failed, trying GET: %s", s.URL.String(), err.Error())
+		err = e.request(ctx, http.MethodGet, s.URL)
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Errorf("External link %q is broken: %s", s.URL.String(), err.Error())
+		c.brokenLinks.addExternalFailure(s, err)
+	}
+}
+
+// request sends a request to u, returning a statusError if it's answered
+// with a 4xx or 5xx status. The body is discarded.
+func (e *externalChecker) request(ctx context.Context, method string, u *url.URL) error {
+	request, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", DefaultCrawlerUserAgent)
+	response, err := e.crawler.httpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	io.CopyN(ioutil.Discard, response.Body, maxExternalBodySize)
+	response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		return &statusError{code: response.StatusCode, status: response.Status}
+	}
+	return nil
+}
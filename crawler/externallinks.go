@@ -0,0 +1,99 @@
+package crawler
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ExternalURL is an external URL linked from the pages written to the site
+// map, with the pages linking to it.
+type ExternalURL struct {
+	URL     string
+	Pages   int      // pages linking to the URL, also the ones left out of Sources
+	Sources []string // pages linking to the URL, sorted, up to MaxExternalSources
+}
+
+// externalURLs holds the external URLs linked, by URL, up to
+// MaxExternalURLs. A nil *externalURLs records nothing.
+type externalURLs struct {
+	mu         sync.Mutex
+	urls       map[string]*ExternalURL
+	maxURLs    int
+	maxSources int
+	warned     bool // whether the max number of URLs being reached was logged
+}
+
+func newExternalURLs(maxURLs, maxSources int) *externalURLs {
+	return &externalURLs{urls: make(map[string]*ExternalURL), maxURLs: maxURLs, maxSources: maxSources}
+}
+
+// add records the page of the result as the source of its external links.
+func (e *externalURLs) add(c *Crawler, r PageResult) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range r.children {
+		if !c.isExternal(*s) {
+			continue
+		}
+		u := s.URL.String()
+		external, ok := e.urls[u]
+		if !ok {
+			if len(e.urls) >= e.maxURLs {
+				if !e.warned {
+					log.Warnf("Max external URLs reached (%d): the next ones are not recorded", e.maxURLs)
+					e.warned = true
+				}
+				continue
+			}
+			external = &ExternalURL{URL: u}
+			e.urls[u] = external
+		}
+		external.Pages++
+		if len(external.Sources) < e.maxSources {
+			external.Sources = append(external.Sources, r.URL)
+		}
+	}
+}
+
+// ExternalURLs returns the external URLs linked from the pages written to
+// the site map, sorted by URL, with the pages linking to them. They are only
+// recorded if RecordExternalURLs is set.
+func (c *Crawler) ExternalURLs() []ExternalURL {
+	e := c.externalURLs
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	urls := make([]ExternalURL, 0, len(e.urls))
+	for _, external := range e.urls {
+		u := *external
+		u.Sources = append([]string(nil), external.Sources...)
+		sort.Strings(u.Sources)
+		urls = append(urls, u)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].URL < urls[j].URL
+	})
+	return urls
+}
+
+// WriteExternalLinksReport writes the external URLs (see ExternalURLs) as
+// tab separated lines: URL, number of pages linking to it and the comma
+// separated sources.
+func (c *Crawler) WriteExternalLinksReport(w io.Writer) error {
+	for _, u := range c.ExternalURLs() {
+		if _, err := fmt.Fprintf(w, "%s\t%d\t%s\n", u.URL, u.Pages, strings.Join(u.Sources, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package crawler_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/scanterog/crawler/crawler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunRecordExternalURLs(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	c := crawler.Crawler{
+		SeedURL:            serverURL,
+		IgnoreRobots:       true,
+		NumWorkers:         crawler.DefaultNumWorkers,
+		SiteMapWriter:      &bytes.Buffer{},
+		RecordExternalURLs: true,
+	}
+	assert.NoError(t, c.Run())
+	assert.Equal(t, []crawler.ExternalURL{
+		{URL: "https://fb.com", Pages: 1, Sources: []string{serverURL + "/about"}},
+		{URL: "https://golang.org", Pages: 1, Sources: []string{serverURL + "/careers"}},
+		{URL: "https://twitter.com", Pages: 1, Sources: []string{serverURL}},
+	}, c.ExternalURLs())
+
+	report := &bytes.Buffer{}
+	assert.NoError(t, c.WriteExternalLinksReport(report))
+	assert.Equal(t, fmt.Sprintf(`https://fb.com	1	%[1]s/about
+https://golang.org	1	%[1]s/careers
+https://twitter.com	1	%[1]s
+`, serverURL), report.String())
+}
+
+func TestRunRecordExternalURLsLimits(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<a href="/a">a</a><a href="/b">b</a><a href="https://example.org/x">x</a><a href="https://example.org/y">y</a>`)
+	}))
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	c := crawler.Crawler{
+		SeedURL:            serverURL,
+		IgnoreRobots:       true,
+		NumWorkers:         crawler.DefaultNumWorkers,
+		SiteMapWriter:      &bytes.Buffer{},
+		RecordExternalURLs: true,
+		MaxExternalURLs:    1,
+		MaxExternalSources: 2,
+	}
+	assert.NoError(t, c.Run())
+	external := c.ExternalURLs()
+	if assert.Len(t, external, 1) {
+		assert.Equal(t, "https://example.org/x", external[0].URL)
+		assert.Equal(t, 3, external[0].Pages)
+		assert.Len(t, external[0].Sources, 2)
+	}
+}
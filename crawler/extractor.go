@@ -0,0 +1,104 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// LinkExtractor extracts the links and metadata of the fetched pages, e.g.
+// from HTML documents (see HTMLExtractor) or JSON API responses (see
+// JSONExtractor). It is called concurrently from the workers.
+type LinkExtractor interface {
+	// Extract returns the information of the page at pageURL. contentType
+	// is the Content-Type header of the response, which may be empty.
+	Extract(pageURL *url.URL, contentType string, body io.Reader) (PageData, error)
+}
+
+// Link is a URL found in a page.
+type Link struct {
+	Href    string   // URL as found in the page, which may be relative to it
+	Rel     []string // lower-cased tokens of the rel attribute
+	Element string   // name of the element holding the URL, e.g. "a" or "img"
+	Text    string   // whitespace-normalized text of the anchors
+	Method  string   // method of the forms, lower-cased: "get" or "post"
+	Lang    string   // hreflang attribute of the link elements
+}
+
+// PageData holds the information extracted from a page. Only the links
+// are crawled, the rest is recorded.
+type PageData struct {
+	Links      []Link       // anchors found in the page, e.g. a and area elements
+	Assets     []Link       // resources the page depends on (see assetSelector)
+	Canonical  string       // href of the <link rel="canonical"> element, if any
+	NoIndex    bool         // robots meta tags contain noindex
+	NoFollow   bool         // robots meta tags contain nofollow
+	Metadata   PageMetadata // title, description and robots meta. The other fields are set by the crawler.
+	Feeds      []string     // href of the link elements advertising a RSS or Atom feed
+	Alternates []Link       // link elements declaring an alternate version of the page (see isAlternate)
+	Truncated  bool         // some links or attributes were left out because of the limits of the extractor
+}
+
+// HTMLExtractor is the default LinkExtractor, which parses the pages as
+// HTML documents. The limits guard against pathological documents, e.g.
+// with hundreds of thousands of anchors.
+type HTMLExtractor struct {
+	MaxLinks           int  // max number of anchors, and of resources, extracted. Zero means unlimited.
+	MaxAttributeLength int  // attribute values longer than this are ignored. Zero means unlimited.
+	IncludeTemplates   bool // also extract the links inside template elements, inert content never shown as is
+	SkipNoscript       bool // don't extract the links inside noscript elements, often a degraded duplicate of the page
+}
+
+// Extract returns the anchors, resources and metadata of the document.
+func (e HTMLExtractor) Extract(pageURL *url.URL, contentType string, body io.Reader) (PageData, error) {
+	return e.parse(body)
+}
+
+// JSONExtractor is a LinkExtractor for JSON documents, e.g. API responses,
+// taking the links from the string values at Paths.
+type JSONExtractor struct {
+	// Paths are dot separated object keys, e.g. "next" or "items.url".
+	// Arrays are traversed, so "items.url" matches the url of every
+	// element of items. Values other than strings are ignored.
+	Paths []string
+}
+
+// Extract returns the strings at Paths of the document as links.
+func (e JSONExtractor) Extract(pageURL *url.URL, contentType string, body io.Reader) (PageData, error) {
+	var doc interface{}
+	if err := json.NewDecoder(body).Decode(&doc); err != nil {
+		return PageData{}, fmt.Errorf("invalid JSON: %q", err.Error())
+	}
+	var page PageData
+	for _, path := range e.Paths {
+		for _, href := range jsonStrings(doc, strings.Split(path, ".")) {
+			page.Links = append(page.Links, Link{Href: href})
+		}
+	}
+	return page, nil
+}
+
+// jsonStrings returns the string values at the keys path of the decoded
+// JSON value, traversing the arrays.
+func jsonStrings(value interface{}, keys []string) []string {
+	switch v := value.(type) {
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, jsonStrings(item, keys)...)
+		}
+		return values
+	case map[string]interface{}:
+		if len(keys) == 0 {
+			return nil
+		}
+		return jsonStrings(v[keys[0]], keys[1:])
+	case string:
+		if len(keys) == 0 {
+			return []string{v}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package crawler
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONExtractor(t *testing.T) {
+	pageURL := &url.URL{Scheme: "https", Host: "example.com"}
+	document := `{
+  "next": "/page/2",
+  "count": 2,
+  "items": [
+    {"url": "/items/1", "tags": [{"url": "/tags/a"}, {"url": "/tags/b"}]},
+    {"url": "/items/2", "tags": []},
+    {"url": 3},
+    "/not-an-object"
+  ],
+  "nested": {"links": ["/x", "/y", {"url": "/z"}]}
+}`
+
+	tests := []struct {
+		name     string
+		paths    []string
+		expected []string
+	}{
+		{name: "Top level key", paths: []string{"next"}, expected: []string{"/page/2"}},
+		{name: "Array of objects", paths: []string{"items.url"}, expected: []string{"/items/1", "/items/2"}},
+		{name: "Nested arrays", paths: []string{"items.tags.url"}, expected: []string{"/tags/a", "/tags/b"}},
+		{name: "Array of strings", paths: []string{"nested.links"}, expected: []string{"/x", "/y"}},
+		{name: "Not a string", paths: []string{"count", "nested"}},
+		{name: "Missing keys", paths: []string{"missing", "next.url"}},
+		{name: "Several paths", paths: []string{"next", "items.url"}, expected: []string{"/page/2", "/items/1", "/items/2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := JSONExtractor{Paths: tt.paths}.Extract(pageURL, "application/json", strings.NewReader(document))
+			assert.NoError(t, err)
+			var hrefs []string
+			for _, l := range page.Links {
+				hrefs = append(hrefs, l.Href)
+			}
+			assert.Equal(t, tt.expected, hrefs)
+		})
+	}
+
+	t.Run("Invalid JSON", func(t *testing.T) {
+		_, err := JSONExtractor{Paths: []string{"next"}}.Extract(pageURL, "application/json", strings.NewReader(`<html>`))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,141 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxFeedSize is the max number of bytes of a feed read by FollowFeeds.
+const maxFeedSize = 10 * 1024 * 1024
+
+// feedTypes holds the types of the link elements advertising a feed.
+var feedTypes = []string{"application/rss+xml", "application/atom+xml"}
+
+// feedFile holds the item links of either a RSS 2.0 or an Atom feed.
+type feedFile struct {
+	Items   []feedItem  `xml:"channel>item"` // RSS
+	Entries []feedEntry `xml:"entry"`        // Atom
+}
+
+type feedItem struct {
+	Link string `xml:"link"`
+}
+
+type feedEntry struct {
+	Links []feedLink `xml:"link"`
+	ID    string     `xml:"id"`
+}
+
+type feedLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+// parseFeed returns the links of the items of a RSS or Atom feed. The
+// Atom entries without an alternate link fall back to their id when it's
+// a web URL.
+func parseFeed(r io.Reader) ([]string, error) {
+	var feed feedFile
+	if err := xml.NewDecoder(r).Decode(&feed); err != nil {
+		return nil, fmt.Errorf("invalid feed: %q", err.Error())
+	}
+	var links []string
+	for _, item := range feed.Items {
+		if link := strings.TrimSpace(item.Link); link != "" {
+			links = append(links, link)
+		}
+	}
+	for _, entry := range feed.Entries {
+		link := ""
+		for _, l := range entry.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				link = strings.TrimSpace(l.Href)
+				break
+			}
+		}
+		if id := strings.TrimSpace(entry.ID); link == "" && (strings.HasPrefix(id, "http://") || strings.HasPrefix(id, "https://")) {
+			link = id
+		}
+		if link != "" {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+// feedResults fetches the feeds on the host of the page not fetched yet
+// and returns a result per feed holding its items as children, so they
+// are crawled and the feed is linked to them in the site map.
+func (c *Crawler) feedResults(r PageResult) []PageResult {
+	var results []PageResult
+	for _, feedURL := range r.Metadata.Feeds {
+		feed, err := r.site.resolve(feedURL, c.normalizer)
+		if err != nil || feed.Host != r.site.URL.Host || !c.firstResourceFetch(feed) {
+			continue
+		}
+		data, err := c.fetchResource(feed, maxFeedSize)
+		if err == nil {
+			var links []string
+			links, err = parseFeed(bytes.NewReader(data))
+			if err == nil {
+				feedSite := webSite{URL: feed, Depth: r.site.Depth + 1}
+				results = append(results, feedSite.itemsResult(links, c.normalizer))
+				continue
+			}
+		}
+		log.Errorf("Failed to read feed %q: %s", feed.String(), err.Error())
+	}
+	return results
+}
+
+// itemsResult returns the result of the feed with its item links.
+func (s webSite) itemsResult(links []string, n urlNormalizer) PageResult {
+	r := PageResult{site: s, resource: true}
+	seen := map[string]bool{}
+	for _, link := range links {
+		u, err := s.resolve(link, n)
+		if err != nil {
+			log.Debugf("Skipping %q. Error: %q", link, err.Error())
+			continue
+		}
+		if !seen[u.String()] {
+			seen[u.String()] = true
+			r.children = append(r.children, &webSite{URL: u, Parent: s.URL, Depth: s.Depth + 1})
+		}
+	}
+	return r
+}
+
+// Feeds returns the URLs of the RSS and Atom feeds advertised by the
+// fetched pages, sorted.
+func (c *Crawler) Feeds() []string {
+	set := map[string]bool{}
+	for _, metadata := range c.PageMetadata() {
+		for _, feed := range metadata.Feeds {
+			set[feed] = true
+		}
+	}
+	feeds := make([]string, 0, len(set))
+	for feed := range set {
+		feeds = append(feeds, feed)
+	}
+	sort.Strings(feeds)
+	return feeds
+}
+
+// WriteFeedReport writes the URLs of the feeds found (see Feeds), one per
+// line.
+func (c *Crawler) WriteFeedReport(w io.Writer) error {
+	for _, feed := range c.Feeds() {
+		if _, err := fmt.Fprintln(w, feed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
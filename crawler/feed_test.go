@@ -0,0 +1,53 @@
+package crawler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFeed(t *testing.T) {
+	t.Run("RSS 2.0", func(t *testing.T) {
+		feed := `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom">
+<channel>
+  <title>Blog</title>
+  <link>https://example.com/</link>
+  <atom:link href="https://example.com/feed" rel="self" type="application/rss+xml"/>
+  <item><title>First</title><link>https://example.com/posts/1</link></item>
+  <item><title>Second</title><link>
+    /posts/2
+  </link></item>
+  <item><title>No link</title><guid isPermaLink="false">42</guid></item>
+</channel>
+</rss>`
+		links, err := parseFeed(strings.NewReader(feed))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"https://example.com/posts/1", "/posts/2"}, links)
+	})
+	t.Run("Atom", func(t *testing.T) {
+		feed := `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Blog</title>
+  <link href="https://example.com/"/>
+  <link rel="self" href="https://example.com/atom.xml"/>
+  <id>urn:uuid:60a76c80-d399-11d9-b93C-0003939e0af6</id>
+  <entry>
+    <link rel="edit" href="https://example.com/edit/1"/>
+    <link rel="alternate" href="https://example.com/posts/1"/>
+    <id>urn:uuid:1225c695-cfb8-4ebb-aaaa-80da344efa6a</id>
+  </entry>
+  <entry><link href="/posts/2"/><id>https://example.com/ids/2</id></entry>
+  <entry><id>https://example.com/posts/3</id></entry>
+  <entry><id>tag:example.com,2024:4</id></entry>
+</feed>`
+		links, err := parseFeed(strings.NewReader(feed))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"https://example.com/posts/1", "/posts/2", "https://example.com/posts/3"}, links)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := parseFeed(strings.NewReader(`<html><body>not a feed`))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,146 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Fetcher fetches the pages and the other resources of the crawl, e.g. the
+// robots.txt and the sitemaps. A custom one can render the JavaScript of
+// the pages with a headless browser, so the links added client-side are
+// crawled. It is called concurrently from the workers, once each request is
+// allowed by Rate and Delay. A Fetcher retrying requests calls Throttle
+// before each retry, otherwise the retries aren't limited.
+type Fetcher interface {
+	// Fetch gets u, giving up when ctx is done. Responses with an error
+	// status are returned as a FetchResult, not as an error.
+	Fetch(ctx context.Context, u *url.URL) (*FetchResult, error)
+}
+
+// FetchResult is the response of a Fetcher.
+type FetchResult struct {
+	StatusCode int
+	Status     string        // e.g. "404 Not Found". Empty means the text of StatusCode.
+	URL        *url.URL      // final URL, after any redirect. Nil means the fetched one.
+	Header     http.Header   // headers of the response, e.g. Content-Type and ETag
+	Body       io.ReadCloser // closed by the crawler
+	Duration   time.Duration // time taken to get the response, by the last attempt if there were several
+	Redirects  []Redirect    // redirects followed to URL, in order
+	Attempts   int           // requests made to get the response, for a Fetcher retrying them. Zero means one.
+}
+
+// Redirect is a redirect followed by a fetch.
+type Redirect struct {
+	URL    string // URL redirected
+	Status int    // status code of its response, e.g. 301
+}
+
+// maxRedirects is the max number of redirects followed by a fetch, as
+// net/http does by default.
+const maxRedirects = 10
+
+// RedirectLoopError is returned by a fetch whose redirects lead back to a
+// URL already redirected.
+type RedirectLoopError struct {
+	Redirects []Redirect // redirects followed, in order
+	URL       string     // URL redirected to, already in Redirects
+}
+
+func (e *RedirectLoopError) Error() string {
+	return fmt.Sprintf("redirect loop back to %q", e.URL)
+}
+
+// status returns the status of the response, e.g. "404 Not Found".
+func (r *FetchResult) status() string {
+	if r.Status != "" {
+		return r.Status
+	}
+	return fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode))
+}
+
+// attempts returns the number of requests made to get the response.
+func (r *FetchResult) attempts() int {
+	if r.Attempts == 0 {
+		return 1
+	}
+	return r.Attempts
+}
+
+// httpFetcher is the default Fetcher, which uses net/http.
+type httpFetcher struct {
+	crawler *Crawler
+	pages   bool // apply RequestHook, ResponseHook and the conditional requests of the incremental crawls
+}
+
+func (f httpFetcher) Fetch(ctx context.Context, u *url.URL) (*FetchResult, error) {
+	c := f.crawler
+	request, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", DefaultCrawlerUserAgent)
+	if f.pages {
+		if previous := c.incremental.page(u); previous != nil {
+			previous.setValidators(request)
+		}
+		if c.RequestHook != nil {
+			c.RequestHook(request)
+		}
+	}
+	var redirects []Redirect
+	client := c.httpClient()
+	client.CheckRedirect = func(request *http.Request, via []*http.Request) error {
+		redirects = append(redirects, Redirect{URL: via[len(via)-1].URL.String(), Status: request.Response.StatusCode})
+		for _, previous := range via {
+			if previous.URL.String() == request.URL.String() {
+				return &RedirectLoopError{Redirects: redirects, URL: request.URL.String()}
+			}
+		}
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if f.pages && c.ResponseHook != nil {
+		c.ResponseHook(response)
+	}
+	return &FetchResult{
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+		URL:        response.Request.URL,
+		Header:     response.Header,
+		Body:       response.Body,
+		Duration:   time.Since(start),
+		Redirects:  redirects,
+	}, nil
+}
+
+// pageFetcher returns the Fetcher of the pages.
+func (c *Crawler) pageFetcher() Fetcher {
+	if c.Fetcher != nil {
+		return c.Fetcher
+	}
+	return httpFetcher{crawler: c, pages: true}
+}
+
+// fetch gets a resource other than a page, e.g. the robots.txt, once its
+// host can be requested. The body of the result must be closed.
+func (c *Crawler) fetch(u *url.URL) (*FetchResult, error) {
+	if err := c.throttle(c.ctx, u.Host); err != nil {
+		return nil, err
+	}
+	var fetcher Fetcher = httpFetcher{crawler: c}
+	if c.Fetcher != nil {
+		fetcher = c.Fetcher
+	}
+	return fetcher.Fetch(c.withThrottle(c.ctx, u.Host), u)
+}
@@ -0,0 +1,153 @@
+package crawler_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scanterog/crawler/crawler"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePage is a response of a fakeFetcher.
+type fakePage struct {
+	status      int           // zero means 200
+	contentType string        // empty means text/html
+	redirect    string        // final URL, if the page redirects
+	duration    time.Duration // zero means a millisecond
+	attempts    int           // requests reported, as if the fetcher retried
+	body        string
+}
+
+// fakeFetcher serves pages from memory, so no request reaches the network.
+type fakeFetcher struct {
+	pages   map[string]fakePage
+	mu      sync.Mutex
+	fetched []string
+}
+
+func (f *fakeFetcher) Fetch(ctx context.Context, u *url.URL) (*crawler.FetchResult, error) {
+	f.mu.Lock()
+	f.fetched = append(f.fetched, u.String())
+	f.mu.Unlock()
+	page, ok := f.pages[u.String()]
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	r := &crawler.FetchResult{
+		StatusCode: page.status,
+		Header:     http.Header{"Content-Type": []string{page.contentType}},
+		Body:       ioutil.NopCloser(strings.NewReader(page.body)),
+		Duration:   page.duration,
+		Attempts:   page.attempts,
+	}
+	if r.Duration == 0 {
+		r.Duration = time.Millisecond
+	}
+	if r.StatusCode == 0 {
+		r.StatusCode = http.StatusOK
+	}
+	if page.contentType == "" {
+		r.Header.Set("Content-Type", "text/html")
+	}
+	if page.redirect != "" {
+		r.URL, _ = url.Parse(page.redirect)
+	}
+	return r, nil
+}
+
+// clientFetcher fetches with the client, e.g. the one of a
+// httptest.NewTLSServer trusting its certificate.
+type clientFetcher struct {
+	client *http.Client
+}
+
+func (f clientFetcher) Fetch(ctx context.Context, u *url.URL) (*crawler.FetchResult, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := f.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	return &crawler.FetchResult{
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+		URL:        response.Request.URL,
+		Header:     response.Header,
+		Body:       response.Body,
+	}, nil
+}
+
+func TestRunFetcher(t *testing.T) {
+	fetcher := &fakeFetcher{pages: map[string]fakePage{
+		"http://example.test/robots.txt": {contentType: "text/plain", body: "User-agent: *\nDisallow: /private\n"},
+		"http://example.test":            {body: `<a href="/about">about</a><a href="/private">private</a><a href="/missing">missing</a><a href="/gone">gone</a>`},
+		"http://example.test/about":      {body: `<title>About</title><a href="/">home</a>`},
+		"http://example.test/missing":    {status: http.StatusNotFound},
+		"http://example.test/sitemap.xml": {contentType: "application/xml", body: `<urlset>
+  <url><loc>http://example.test/orphan</loc></url>
+</urlset>`},
+		"http://example.test/orphan": {body: `orphan`},
+	}}
+	siteMapOutBuf := &bytes.Buffer{}
+	var responses int
+	c := crawler.Crawler{
+		SeedURL:       "http://example.test",
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: siteMapOutBuf,
+		UseSitemap:    true,
+		Fetcher:       fetcher,
+		ResponseHook:  func(*http.Response) { responses++ },
+	}
+	assert.NoError(t, c.Run())
+	assert.ElementsMatch(t, []string{
+		"http://example.test/robots.txt",
+		"http://example.test/sitemap.xml",
+		"http://example.test",
+		"http://example.test/about",
+		"http://example.test/missing",
+		"http://example.test/gone",
+		"http://example.test/orphan",
+	}, fetcher.fetched)
+	assert.ElementsMatch(t, []string{
+		"http://example.test -> http://example.test/about\n",
+		"http://example.test -> http://example.test/private\n",
+		"http://example.test -> http://example.test/missing\n",
+		"http://example.test -> http://example.test/gone\n",
+		"http://example.test/about -> http://example.test\n",
+		"http://example.test/sitemap.xml -> http://example.test/orphan\n",
+	}, siteMapLines(siteMapOutBuf))
+	stats := c.Stats()
+	assert.Equal(t, 3, stats.PagesFetched)
+	assert.Equal(t, 2, stats.PagesFailed)
+	assert.Equal(t, "About", c.PageMetadata()["http://example.test/about"].Title)
+	assert.Zero(t, responses, "ResponseHook is only called by the default fetcher")
+
+	t.Run("Seed redirect", func(t *testing.T) {
+		fetcher := &fakeFetcher{pages: map[string]fakePage{
+			"http://example.test":          {redirect: "http://www.example.test/"},
+			"http://www.example.test":      {body: `<a href="/docs">docs</a>`},
+			"http://www.example.test/docs": {body: `docs`},
+		}}
+		c := crawler.Crawler{
+			SeedURL:            "http://example.test",
+			NumWorkers:         crawler.DefaultNumWorkers,
+			SiteMapWriter:      &bytes.Buffer{},
+			IgnoreRobots:       true,
+			FollowSeedRedirect: true,
+			Fetcher:            fetcher,
+		}
+		assert.NoError(t, c.Run())
+		// the seed is fetched before the crawl to adopt the host it redirects to
+		assert.ElementsMatch(t, []string{"http://example.test", "http://www.example.test", "http://www.example.test/docs"}, fetcher.fetched)
+	})
+}
@@ -0,0 +1,76 @@
+package crawler
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// URLFilter decides whether a discovered URL should be crawled.
+// Filters are evaluated by the dispatcher after the built-in checks
+// (external and media URLs), in order, and the first filter rejecting a
+// URL wins. Parent is nil for the seed URL.
+type URLFilter interface {
+	Allow(u *url.URL, parent *url.URL) bool
+}
+
+// ElementURLFilter is a URLFilter also told the element of the link to the
+// URL: "a", "area", "link" for the alternates (see PageMetadata), "iframe"
+// or "frame" (see CrawlFrames) or "form" (see FollowForms). AllowElement is
+// called instead of Allow, with an empty element for the seeds and the
+// pages of the sitemaps.
+type ElementURLFilter interface {
+	URLFilter
+	AllowElement(u *url.URL, parent *url.URL, element string) bool
+}
+
+// URLFilterFunc is an adapter to allow the use of ordinary functions
+// as URL filters.
+type URLFilterFunc func(u *url.URL, parent *url.URL) bool
+
+// Allow calls f(u, parent).
+func (f URLFilterFunc) Allow(u *url.URL, parent *url.URL) bool {
+	return f(u, parent)
+}
+
+// MediaFilter rejects URLs pointing to media files like images, PDF
+// or CSV documents. It's always the first filter applied by the crawler.
+type MediaFilter struct{}
+
+// Allow returns false for media URLs.
+func (MediaFilter) Allow(u *url.URL, parent *url.URL) bool {
+	return !isMediaURL(u)
+}
+
+func (MediaFilter) String() string {
+	return "media"
+}
+
+// filterName returns the name under which the filter rejections are
+// counted: its String method if any or its type otherwise.
+func filterName(f URLFilter) string {
+	if s, ok := f.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", f)
+}
+
+// filteredBy returns the skip reason for URLs rejected by the filter.
+func filteredBy(f URLFilter) SkipReason {
+	return SkipReason("filtered by " + filterName(f))
+}
+
+// rejectingFilter returns the first filter not allowing the site, if any.
+func (c *Crawler) rejectingFilter(s webSite) (URLFilter, bool) {
+	for _, f := range c.filters {
+		allowed := false
+		if ef, ok := f.(ElementURLFilter); ok {
+			allowed = ef.AllowElement(s.URL, s.Parent, s.element)
+		} else {
+			allowed = f.Allow(s.URL, s.Parent)
+		}
+		if !allowed {
+			return f, true
+		}
+	}
+	return nil, false
+}
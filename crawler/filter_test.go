@@ -0,0 +1,119 @@
+package crawler_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/scanterog/crawler/crawler"
+	"github.com/stretchr/testify/assert"
+)
+
+// maxQueryParams rejects URLs with more than N query parameters.
+type maxQueryParams int
+
+func (m maxQueryParams) Allow(u *url.URL, parent *url.URL) bool {
+	return len(u.Query()) <= int(m)
+}
+
+func TestMediaFilter(t *testing.T) {
+	f := crawler.MediaFilter{}
+	assert.False(t, f.Allow(&url.URL{Path: "/image.PNG"}, nil))
+	assert.True(t, f.Allow(&url.URL{Path: "/about"}, nil))
+}
+
+func TestRunFilters(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.RequestURI())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/" {
+			w.Write([]byte(`
+<a href="/about">about</a>
+<a href="/logo.png">logo</a>
+<a href="/media/video">video</a>
+<a href="/media/index.html">media index</a>
+<a href="/search?a=1&b=2">search</a>
+<a href="/search?a=1&b=2&c=3&d=4">search</a>`))
+		}
+	}))
+	defer httpTestServer.Close()
+
+	mediaDir := crawler.URLFilterFunc(func(u *url.URL, parent *url.URL) bool {
+		return !strings.HasPrefix(u.Path, "/media/") || strings.HasSuffix(u.Path, ".html")
+	})
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: &bytes.Buffer{},
+		Filters:       []crawler.URLFilter{mediaDir, maxQueryParams(3)},
+	}
+	err := c.Run()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"/", "/about", "/media/index.html", "/search?a=1&b=2"}, fetched)
+	assert.Equal(t, map[string]int{
+		"media":                       1,
+		"crawler.URLFilterFunc":       1,
+		"crawler_test.maxQueryParams": 1,
+	}, c.Stats().Filtered)
+	assert.Contains(t, c.Stats().String(), fmt.Sprintf("skipped (filtered by %s): 1", "media"))
+}
+
+// noImageMaps rejects the links of image map areas.
+type noImageMaps struct{}
+
+func (noImageMaps) Allow(u *url.URL, parent *url.URL) bool {
+	return true
+}
+
+func (noImageMaps) AllowElement(u *url.URL, parent *url.URL, element string) bool {
+	return element != "area"
+}
+
+func TestRunElementFilters(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.RequestURI())
+		mu.Unlock()
+		if r.URL.Path == "/" {
+			w.Write([]byte(`
+<a href="/about">about</a>
+<map><area href="/region"></map>
+<iframe src="/embed"></iframe>
+<iframe src="https://widgets.example.com/embed"></iframe>`))
+		}
+		if r.URL.Path == "/embed" {
+			w.Write([]byte(`<a href="/inside">inside</a>`))
+		}
+	}))
+	defer httpTestServer.Close()
+
+	crawl := func(crawlFrames bool) {
+		fetched = nil
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: &bytes.Buffer{},
+			Filters:       []crawler.URLFilter{noImageMaps{}},
+			CrawlFrames:   crawlFrames,
+		}
+		assert.NoError(t, c.Run())
+		assert.Equal(t, map[string]int{"crawler_test.noImageMaps": 1}, c.Stats().Filtered)
+	}
+	crawl(false)
+	assert.ElementsMatch(t, []string{"/", "/about"}, fetched)
+	crawl(true)
+	assert.ElementsMatch(t, []string{"/", "/about", "/embed", "/inside"}, fetched)
+}
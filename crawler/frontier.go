@@ -0,0 +1,129 @@
+package crawler
+
+import (
+	"container/heap"
+	"net/url"
+)
+
+// frontier holds the sites waiting to be crawled.
+type frontier interface {
+	push(s webSite)
+	peek() webSite // next site to crawl. The frontier must not be empty.
+	pop() webSite
+	len() int
+}
+
+func newFrontier(order string, priority func(u *url.URL, depth int) int) frontier {
+	if priority != nil {
+		return &priorityFrontier{priority: priority}
+	}
+	if order == OrderDFS {
+		return &stackFrontier{}
+	}
+	return &queueFrontier{}
+}
+
+// queueFrontier is a FIFO frontier, for a breadth-first crawl.
+type queueFrontier struct {
+	sites []webSite
+}
+
+func (q *queueFrontier) push(s webSite) {
+	q.sites = append(q.sites, s)
+}
+
+func (q *queueFrontier) peek() webSite {
+	return q.sites[0]
+}
+
+func (q *queueFrontier) pop() webSite {
+	s := q.sites[0]
+	q.sites[0] = webSite{} // release the URLs
+	q.sites = q.sites[1:]
+	return s
+}
+
+func (q *queueFrontier) len() int {
+	return len(q.sites)
+}
+
+// stackFrontier is a LIFO frontier, for a depth-first crawl.
+type stackFrontier struct {
+	sites []webSite
+}
+
+func (st *stackFrontier) push(s webSite) {
+	st.sites = append(st.sites, s)
+}
+
+func (st *stackFrontier) peek() webSite {
+	return st.sites[len(st.sites)-1]
+}
+
+func (st *stackFrontier) pop() webSite {
+	s := st.sites[len(st.sites)-1]
+	st.sites[len(st.sites)-1] = webSite{}
+	st.sites = st.sites[:len(st.sites)-1]
+	return s
+}
+
+func (st *stackFrontier) len() int {
+	return len(st.sites)
+}
+
+// priorityFrontier crawls the sites with the highest priority first and,
+// on a tie, in discovery order.
+type priorityFrontier struct {
+	priority func(u *url.URL, depth int) int
+	items    priorityItems
+	seq      int // discovery order of the next site
+}
+
+type priorityItem struct {
+	site     webSite
+	priority int
+	seq      int
+}
+
+func (p *priorityFrontier) push(s webSite) {
+	heap.Push(&p.items, priorityItem{site: s, priority: p.priority(s.URL, s.Depth), seq: p.seq})
+	p.seq++
+}
+
+func (p *priorityFrontier) peek() webSite {
+	return p.items[0].site
+}
+
+func (p *priorityFrontier) pop() webSite {
+	return heap.Pop(&p.items).(priorityItem).site
+}
+
+func (p *priorityFrontier) len() int {
+	return len(p.items)
+}
+
+// priorityItems implements heap.Interface.
+type priorityItems []priorityItem
+
+func (h priorityItems) Len() int { return len(h) }
+
+func (h priorityItems) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h priorityItems) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *priorityItems) Push(x interface{}) {
+	*h = append(*h, x.(priorityItem))
+}
+
+func (h *priorityItems) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = priorityItem{}
+	*h = old[:len(old)-1]
+	return item
+}
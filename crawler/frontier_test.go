@@ -0,0 +1,63 @@
+package crawler
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrontier(t *testing.T) {
+	site := func(path string) webSite {
+		return webSite{URL: &url.URL{Scheme: "https", Host: "example.com", Path: path}}
+	}
+	for _, tc := range []struct {
+		order    string
+		expected []string
+	}{
+		{OrderBFS, []string{"/a", "/b", "/c", "/d"}},
+		{OrderDFS, []string{"/c", "/d", "/b", "/a"}},
+	} {
+		t.Run(tc.order, func(t *testing.T) {
+			f := newFrontier(tc.order, nil)
+			f.push(site("/a"))
+			f.push(site("/b"))
+			f.push(site("/c"))
+			var paths []string
+			next := f.peek()
+			paths = append(paths, f.pop().URL.Path)
+			assert.Equal(t, next.URL.Path, paths[0])
+			f.push(site("/d"))
+			for f.len() > 0 {
+				paths = append(paths, f.pop().URL.Path)
+			}
+			assert.Equal(t, tc.expected, paths)
+		})
+	}
+}
+
+func TestPriorityFrontier(t *testing.T) {
+	site := func(path string, depth int) webSite {
+		return webSite{URL: &url.URL{Scheme: "https", Host: "example.com", Path: path}, Depth: depth}
+	}
+	priority := func(u *url.URL, depth int) int {
+		if strings.HasPrefix(u.Path, "/products/") {
+			return 10 - depth
+		}
+		return 0
+	}
+	f := newFrontier(OrderDFS, priority)
+	f.push(site("/blog/1", 1))
+	f.push(site("/products/deep", 3))
+	f.push(site("/blog/2", 1))
+	f.push(site("/products/1", 1))
+	f.push(site("/products/2", 1))
+	assert.Equal(t, "/products/1", f.peek().URL.Path)
+	var paths []string
+	for f.len() > 0 {
+		paths = append(paths, f.pop().URL.Path)
+	}
+	// ties in discovery order
+	assert.Equal(t, []string{"/products/1", "/products/2", "/products/deep", "/blog/1", "/blog/2"}, paths)
+}
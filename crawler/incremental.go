@@ -0,0 +1,253 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+)
+
+// PageStatus tells how a page changed since the previous incremental crawl
+// (see IncrementalStateFile).
+type PageStatus string
+
+const (
+	PageRevalidated PageStatus = "revalidated" // unchanged: the server answered 304 Not Modified
+	PageRefetched   PageStatus = "refetched"   // crawled by the previous run and fetched again
+	PageNew         PageStatus = "new"         // not crawled by the previous run
+	PageRemoved     PageStatus = "removed"     // crawled by the previous run and now 404 or 410
+)
+
+// pageState is what is kept about a crawled page for the next incremental
+// crawl: its validators for the conditional requests and what is needed
+// to rebuild its result when it didn't change.
+type pageState struct {
+	ETag         string       `json:"etag,omitempty"`
+	LastModified string       `json:"last_modified,omitempty"`
+	Canonical    string       `json:"canonical,omitempty"`
+	NoIndex      bool         `json:"noindex,omitempty"`
+	NoFollow     bool         `json:"nofollow,omitempty"`
+	Metadata     PageMetadata `json:"metadata"`
+	Links        []stateLink  `json:"links,omitempty"`
+	Assets       []stateLink  `json:"assets,omitempty"`
+}
+
+type stateLink struct {
+	URL      string `json:"url"`
+	NoFollow bool   `json:"nofollow,omitempty"`
+	Element  string `json:"element,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Method   string `json:"method,omitempty"`
+}
+
+// crawlState is the content of the IncrementalStateFile.
+type crawlState struct {
+	Pages map[string]*pageState `json:"pages"` // by URL
+}
+
+// incrementalState holds the state of the previous crawl, which is read
+// only, and the one of the current crawl. A nil *incrementalState is a
+// non-incremental crawl.
+type incrementalState struct {
+	previous map[string]*pageState
+	mu       sync.Mutex // guards current and statuses
+	current  map[string]*pageState
+	statuses map[string]PageStatus
+}
+
+// loadIncrementalState reads the state saved by the previous crawl, if any.
+func loadIncrementalState(path string) (*incrementalState, error) {
+	s := &incrementalState{
+		previous: make(map[string]*pageState),
+		current:  make(map[string]*pageState),
+		statuses: make(map[string]PageStatus),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read incremental state file: %s", err.Error())
+	}
+	var state crawlState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid incremental state file %q: %s", path, err.Error())
+	}
+	if state.Pages != nil {
+		s.previous = state.Pages
+	}
+	return s, nil
+}
+
+// page returns the state of the page in the previous crawl, if any.
+func (s *incrementalState) page(u *url.URL) *pageState {
+	if s == nil {
+		return nil
+	}
+	return s.previous[u.String()]
+}
+
+// record sets the status and state of a page crawled.
+func (s *incrementalState) record(u *url.URL, status PageStatus, page *pageState) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[u.String()] = status
+	if page != nil {
+		s.current[u.String()] = page
+	}
+}
+
+// keep carries the state of a page of the previous crawl over to the next
+// one, e.g. when it can't be fetched but it was not removed.
+func (s *incrementalState) keep(u *url.URL) {
+	if s == nil || s.previous[u.String()] == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.statuses[u.String()] != PageRemoved {
+		s.current[u.String()] = s.previous[u.String()]
+	}
+}
+
+// counts returns the number of pages by status.
+func (s *incrementalState) counts() map[PageStatus]int {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[PageStatus]int)
+	for _, status := range s.statuses {
+		counts[status]++
+	}
+	return counts
+}
+
+// save writes the state of the current crawl to path. The pages of the
+// previous crawl that were not visited are kept if keepUnvisited is set,
+// e.g. because the crawl was truncated. The file is replaced atomically.
+func (s *incrementalState) save(path string, keepUnvisited bool) error {
+	s.mu.Lock()
+	state := crawlState{Pages: make(map[string]*pageState, len(s.current))}
+	for u, page := range s.current {
+		state.Pages[u] = page
+	}
+	if keepUnvisited {
+		for u, page := range s.previous {
+			if _, visited := s.statuses[u]; !visited {
+				state.Pages[u] = page
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("can't write incremental state file: %s", err.Error())
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("can't write incremental state file: %s", err.Error())
+	}
+	return nil
+}
+
+// newPageState returns the state of a fetched page.
+func newPageState(r PageResult, response *FetchResult) *pageState {
+	page := &pageState{
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+		NoIndex:      r.NoIndex,
+		NoFollow:     r.NoFollow,
+		Metadata:     r.Metadata,
+	}
+	if r.Canonical != nil {
+		page.Canonical = r.Canonical.String()
+	}
+	for _, child := range r.children {
+		page.Links = append(page.Links, stateLink{URL: child.URL.String(), NoFollow: child.noFollow, Element: child.element, Text: child.text})
+	}
+	for _, a := range r.assets {
+		page.Assets = append(page.Assets, stateLink{URL: a.URL.String(), Element: a.Element, Method: a.Method})
+	}
+	return page
+}
+
+// setValidators makes the request conditional on the page having changed.
+func (p *pageState) setValidators(request *http.Request) {
+	if p.ETag != "" {
+		request.Header.Set("If-None-Match", p.ETag)
+	}
+	if p.LastModified != "" {
+		request.Header.Set("If-Modified-Since", p.LastModified)
+	}
+}
+
+// result rebuilds the result of the unchanged page without parsing it.
+func (p *pageState) result(s webSite) PageResult {
+	r := PageResult{site: s, NoIndex: p.NoIndex, NoFollow: p.NoFollow, Metadata: p.Metadata}
+	if lastModified, err := http.ParseTime(p.LastModified); err == nil {
+		r.LastModified = lastModified
+	}
+	if p.Canonical != "" {
+		r.Canonical, _ = url.Parse(p.Canonical)
+	}
+	for _, link := range p.Links {
+		u, err := url.Parse(link.URL)
+		if err != nil {
+			continue
+		}
+		r.children = append(r.children, &webSite{URL: u, Parent: s.URL, Depth: s.Depth + 1, noFollow: link.NoFollow, element: link.Element, text: link.Text})
+	}
+	for _, link := range p.Assets {
+		if u, err := url.Parse(link.URL); err == nil {
+			r.assets = append(r.assets, asset{URL: u, Element: link.Element, Method: link.Method})
+		}
+	}
+	return r
+}
+
+// PageStatuses returns how every page crawled changed since the previous
+// incremental crawl, by URL. It's nil unless IncrementalStateFile is set.
+func (c *Crawler) PageStatuses() map[string]PageStatus {
+	s := c.incremental
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make(map[string]PageStatus, len(s.statuses))
+	for u, status := range s.statuses {
+		statuses[u] = status
+	}
+	return statuses
+}
+
+// WriteIncrementalReport writes the pages crawled as tab separated lines:
+// status (see PageStatus) and URL, sorted by URL.
+func (c *Crawler) WriteIncrementalReport(w io.Writer) error {
+	statuses := c.PageStatuses()
+	urls := make([]string, 0, len(statuses))
+	for u := range statuses {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	for _, u := range urls {
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", statuses[u], u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
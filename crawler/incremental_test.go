@@ -0,0 +1,71 @@
+package crawler
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadIncrementalState(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s, err := loadIncrementalState(path)
+	assert.NoError(t, err)
+	assert.Empty(t, s.previous)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+	_, err = loadIncrementalState(path)
+	assert.Error(t, err)
+}
+
+func TestIncrementalStateSave(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	a, _ := url.Parse("https://example.com/a")
+	b, _ := url.Parse("https://example.com/b")
+	c, _ := url.Parse("https://example.com/c")
+
+	s, _ := loadIncrementalState(path)
+	s.record(a, PageNew, &pageState{ETag: `"a"`, Links: []stateLink{{URL: b.String()}}})
+	s.record(b, PageNew, &pageState{LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"})
+	s.record(c, PageNew, &pageState{})
+	assert.NoError(t, s.save(path, false))
+
+	s, err := loadIncrementalState(path)
+	assert.NoError(t, err)
+	assert.Equal(t, `"a"`, s.page(a).ETag)
+	assert.Equal(t, []stateLink{{URL: b.String()}}, s.page(a).Links)
+	assert.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", s.page(b).LastModified)
+
+	// pages not visited are dropped unless keepUnvisited is set
+	s.record(a, PageRevalidated, s.page(a))
+	s.record(b, PageRemoved, nil)
+	assert.NoError(t, s.save(path, true))
+	s, _ = loadIncrementalState(path)
+	assert.NotNil(t, s.page(a))
+	assert.Nil(t, s.page(b))
+	assert.NotNil(t, s.page(c))
+	s.record(a, PageRevalidated, s.page(a))
+	assert.NoError(t, s.save(path, false))
+	s, _ = loadIncrementalState(path)
+	assert.NotNil(t, s.page(a))
+	assert.Nil(t, s.page(c))
+
+	// pages failing for other reasons than being removed are kept
+	s.keep(a)
+	assert.NoError(t, s.save(path, false))
+	s, _ = loadIncrementalState(path)
+	assert.NotNil(t, s.page(a))
+	s.record(a, PageRemoved, nil)
+	s.keep(a)
+	assert.NoError(t, s.save(path, false))
+	s, _ = loadIncrementalState(path)
+	assert.Nil(t, s.page(a))
+}
@@ -0,0 +1,270 @@
+package crawler
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PageMetadata holds the information about a fetched page found in its
+// HTML document, besides its links.
+type PageMetadata struct {
+	Title       string   `json:"title,omitempty"`       // first title element, whitespace-normalized. Empty if none.
+	H1          string   `json:"h1,omitempty"`          // text of the first h1 element, whitespace-normalized and cut to maxHeadingLength characters. Empty if none.
+	H1Count     int      `json:"h1_count"`              // number of h1 elements, usually one
+	Description string   `json:"description,omitempty"` // content of the first description meta tag, whitespace-normalized. Empty if none.
+	Robots      string   `json:"robots,omitempty"`      // content of the first robots meta tag, e.g. "noindex, follow". Empty if none.
+	Feeds       []string `json:"feeds,omitempty"`       // URLs of the RSS and Atom feeds advertised by the page
+	Canonical   string   `json:"canonical,omitempty"`   // URL of the rel="canonical" link element. Empty if none.
+	// Alternates holds the link elements declaring alternate versions of
+	// the page, e.g. its translations with hreflang.
+	Alternates []AlternateLink `json:"alternates,omitempty"`
+	// Truncated is set when some links or attributes of the page were left
+	// out because of MaxLinksPerPage or MaxAttributeLength.
+	Truncated bool `json:"truncated,omitempty"`
+	// MixedContent holds the http URLs referenced by a https page, which
+	// trigger browser warnings, by element, e.g. "img" or "a".
+	MixedContent map[string][]string `json:"mixed_content,omitempty"`
+	// ContentHash is the hex SHA-256 of the body of the page, with its
+	// whitespace collapsed with HashNormalizeSpace. Pages sharing it are
+	// duplicates (see Duplicates).
+	ContentHash string `json:"content_hash,omitempty"`
+	// Lang is the language of the page: the lang attribute of its html
+	// element or else its Content-Language header, e.g. "de-AT". Empty if
+	// none or malformed.
+	Lang string `json:"lang,omitempty"`
+	// The OpenGraph and Twitter card meta properties of the page, used for
+	// its social previews. The URLs are resolved against the page URL.
+	// Empty if none.
+	OGTitle       string `json:"og_title,omitempty"`       // og:title, whitespace-normalized
+	OGDescription string `json:"og_description,omitempty"` // og:description, whitespace-normalized
+	OGImage       string `json:"og_image,omitempty"`       // og:image
+	OGURL         string `json:"og_url,omitempty"`         // og:url
+	TwitterCard   string `json:"twitter_card,omitempty"`   // twitter:card, e.g. "summary_large_image"
+	// OGURLMismatch is set when the og:url of the page differs from the
+	// page URL, so the shares of the page are attributed to another one
+	// (see OGURLMismatches).
+	OGURLMismatch bool `json:"og_url_mismatch,omitempty"`
+	// DeadEnd is set when the page is a HTML one without links to internal
+	// pages, usually a templating bug. The other content, e.g. images or
+	// feeds, are intentional leaves.
+	DeadEnd bool `json:"dead_end,omitempty"`
+}
+
+// setSocialProperty sets the metadata field of the OpenGraph or Twitter card
+// property, unless it was already set by an earlier meta tag.
+func (m *PageMetadata) setSocialProperty(property, content string) {
+	var field *string
+	switch property {
+	case "og:title":
+		field, content = &m.OGTitle, normalizeSpace(content)
+	case "og:description":
+		field, content = &m.OGDescription, normalizeSpace(content)
+	case "og:image":
+		field, content = &m.OGImage, strings.TrimSpace(content)
+	case "og:url":
+		field, content = &m.OGURL, strings.TrimSpace(content)
+	case "twitter:card":
+		field, content = &m.TwitterCard, strings.TrimSpace(content)
+	default:
+		return
+	}
+	if *field == "" {
+		*field = content
+	}
+}
+
+// AlternateLink is a link element declaring an alternate version of a
+// page, e.g. <link rel="alternate" hreflang="de" href="/de/">.
+type AlternateLink struct {
+	Rel      string `json:"rel"`                // rel attribute, lower-cased
+	Hreflang string `json:"hreflang,omitempty"` // language of the alternate, e.g. "de" or "x-default"
+	URL      string `json:"url"`
+}
+
+func (c *Crawler) recordPageMetadata(u *url.URL, metadata PageMetadata) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.pageMetadata[u.String()] = metadata
+	c.contentHashes.add(metadata.ContentHash, u.String())
+	if metadata.Truncated {
+		c.stats.PagesTruncated++
+	}
+	if metadata.DeadEnd {
+		c.stats.DeadEnds = append(c.stats.DeadEnds, u.String())
+	}
+}
+
+// PageMetadata returns the metadata of every fetched page, by URL.
+func (c *Crawler) PageMetadata() map[string]PageMetadata {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	metadata := make(map[string]PageMetadata, len(c.pageMetadata))
+	for u, m := range c.pageMetadata {
+		m.Feeds = append([]string(nil), m.Feeds...)
+		m.Alternates = append([]AlternateLink(nil), m.Alternates...)
+		if m.MixedContent != nil {
+			mixed := make(map[string][]string, len(m.MixedContent))
+			for element, urls := range m.MixedContent {
+				mixed[element] = append([]string(nil), urls...)
+			}
+			m.MixedContent = mixed
+		}
+		metadata[u] = m
+	}
+	return metadata
+}
+
+// WriteTitleReport writes the fetched pages as tab separated lines: URL and
+// title, empty if the page has none, sorted by URL.
+func (c *Crawler) WriteTitleReport(w io.Writer) error {
+	metadata := c.PageMetadata()
+	urls := make([]string, 0, len(metadata))
+	for u := range metadata {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	for _, u := range urls {
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", u, metadata[u].Title); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// langRegexp matches a language tag, e.g. "en" or "zh-Hant-TW".
+var langRegexp = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// parseLang returns the first language tag of a lang attribute or of a
+// Content-Language header, e.g. "de" for "de, en". Empty if malformed.
+func parseLang(value string) string {
+	lang := strings.TrimSpace(strings.Split(value, ",")[0])
+	if !langRegexp.MatchString(lang) {
+		return ""
+	}
+	return lang
+}
+
+// matchesLang reports whether the language tag is the given one or one of
+// its variants, e.g. "de-AT" for "de", ignoring case.
+func matchesLang(lang, only string) bool {
+	return strings.EqualFold(lang, only) || strings.HasPrefix(strings.ToLower(lang), strings.ToLower(only)+"-")
+}
+
+// htmlMediaTypes holds the media types of the HTML pages. Responses without
+// Content-Type are parsed as HTML too.
+var htmlMediaTypes = []string{"", "text/html", "application/xhtml+xml"}
+
+// isDeadEnd reports whether the page, with the given Content-Type, is a
+// HTML one without links to internal pages.
+func (c *Crawler) isDeadEnd(r PageResult, contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	isHTML := false
+	for _, t := range htmlMediaTypes {
+		if mediaType == t {
+			isHTML = true
+		}
+	}
+	if !isHTML {
+		return false
+	}
+	for _, child := range r.children {
+		if !c.isExternal(*child) {
+			return false
+		}
+	}
+	return true
+}
+
+// DeadEnds returns the fetched HTML pages without links to internal pages,
+// sorted (see PageMetadata.DeadEnd).
+func (c *Crawler) DeadEnds() []string {
+	var deadEnds []string
+	for u, m := range c.PageMetadata() {
+		if m.DeadEnd {
+			deadEnds = append(deadEnds, u)
+		}
+	}
+	sort.Strings(deadEnds)
+	return deadEnds
+}
+
+// ogURLMismatch reports whether the og:url of the page differs from its URL.
+func (c *Crawler) ogURLMismatch(r PageResult) bool {
+	if r.Metadata.OGURL == "" {
+		return false
+	}
+	ogURL, err := url.Parse(r.Metadata.OGURL)
+	return err == nil && c.dedupKey(ogURL) != c.dedupKey(r.site.URL)
+}
+
+// OGURLMismatches returns the mapping between fetched URLs and the og:url
+// they declared, when they differ.
+func (c *Crawler) OGURLMismatches() map[string]string {
+	mismatches := map[string]string{}
+	for u, m := range c.PageMetadata() {
+		if m.OGURLMismatch {
+			mismatches[u] = m.OGURL
+		}
+	}
+	return mismatches
+}
+
+// mixedContent returns the http links and assets of the page when it's a
+// https one, by element. Nil if there are none.
+func (r PageResult) mixedContent() map[string][]string {
+	if r.site.URL.Scheme != "https" {
+		return nil
+	}
+	var mixed map[string][]string
+	add := func(u *url.URL, element string) {
+		if u.Scheme != "http" {
+			return
+		}
+		if mixed == nil {
+			mixed = map[string][]string{}
+		}
+		mixed[element] = append(mixed[element], u.String())
+	}
+	for _, child := range r.children {
+		add(child.URL, child.element)
+	}
+	for _, a := range r.assets {
+		add(a.URL, a.Element)
+	}
+	return mixed
+}
+
+// WriteMixedContentReport writes the http URLs referenced by the https pages
+// fetched as tab separated lines: page URL, element and referenced URL,
+// sorted by page and grouped by element.
+func (c *Crawler) WriteMixedContentReport(w io.Writer) error {
+	metadata := c.PageMetadata()
+	urls := make([]string, 0, len(metadata))
+	for u, m := range metadata {
+		if len(m.MixedContent) > 0 {
+			urls = append(urls, u)
+		}
+	}
+	sort.Strings(urls)
+	for _, u := range urls {
+		mixed := metadata[u].MixedContent
+		elements := make([]string, 0, len(mixed))
+		for element := range mixed {
+			elements = append(elements, element)
+		}
+		sort.Strings(elements)
+		for _, element := range elements {
+			for _, ref := range mixed[element] {
+				if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", u, element, ref); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
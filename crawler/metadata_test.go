@@ -0,0 +1,36 @@
+package crawler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLang(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "de", expected: "de"},
+		{value: " de-AT ", expected: "de-AT"},
+		{value: "zh-Hant-TW", expected: "zh-Hant-TW"},
+		{value: "de, en", expected: "de"},
+		{value: "", expected: ""},
+		{value: "de_DE", expected: ""},
+		{value: "e", expected: ""},
+		{value: "en-", expected: ""},
+		{value: "{{ lang }}", expected: ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, parseLang(tt.value), tt.value)
+	}
+}
+
+func TestMatchesLang(t *testing.T) {
+	assert.True(t, matchesLang("de", "de"))
+	assert.True(t, matchesLang("DE-at", "de"))
+	assert.True(t, matchesLang("de-AT", "de-at"))
+	assert.False(t, matchesLang("de", "de-AT"))
+	assert.False(t, matchesLang("dei", "de"))
+	assert.False(t, matchesLang("en", "de"))
+}
@@ -0,0 +1,1186 @@
+package crawler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Formats of the site map.
+const (
+	FormatText         = "text"          // "parent -> child" lines, one per link
+	FormatXMLSitemap   = "xml-sitemap"   // sitemaps.org urlset of the indexable pages fetched, to submit to search engines
+	FormatImageSitemap = "image-sitemap" // sitemaps.org urlset of the indexable pages fetched with their images on the same host, using the Google image extension
+	FormatJSON         = "json"          // JSONSiteMap document, written at the end of the crawl
+	FormatNDJSON       = "ndjson"        // a PageRecord per line, written as soon as the page is fetched or fails
+	FormatCSV          = "csv"           // a CSV row per link with the CSVHeader columns, written at the end of the crawl
+	FormatDOT          = "dot"           // Graphviz digraph with a node per URL and an edge per link, written at the end of the crawl
+	FormatMermaid      = "mermaid"       // Mermaid flowchart with a node per URL and an edge per link, written at the end of the crawl
+	FormatTree         = "tree"          // indented tree of the internal URLs by path, written at the end of the crawl
+	FormatHTML         = "html"          // self-contained HTML report of the crawl, written at the end of the crawl
+)
+
+// Compressions of the site map.
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+)
+
+// OutputConfig is a site map written by the crawl. The one configured by
+// Format, SiteMapWriter, SiteMapOutputFile, Compress, Template and
+// TemplateScope is always written, followed by Outputs.
+type OutputConfig struct {
+	Format        string    // format of the site map, FormatText by default
+	Writer        io.Writer // where the site map is written. It takes precedence over File and it's never closed.
+	File          string    // file created for the site map when Writer is not provided, closed at the end of Run
+	Compress      string    // compression of the site map: CompressNone (default) or CompressGzip. It's CompressGzip by default when File ends in ".gz" and Writer is not provided.
+	Template      string    // text/template written for every edge or page, followed by a newline, instead of Format. The fields available are the ones of TemplateEdge and TemplatePage.
+	TemplateScope string    // with Template, what it's written for: TemplateScopeEdge (default) or TemplateScopePage
+}
+
+// compression returns the compression of the site map, CompressGzip by
+// default for a ".gz" File.
+func (o OutputConfig) compression() string {
+	if o.Compress == "" && o.Writer == nil && strings.HasSuffix(o.File, ".gz") {
+		return CompressGzip
+	}
+	return o.Compress
+}
+
+// validate checks the format, the compression, the template and that the
+// site map has somewhere to be written.
+func (o OutputConfig) validate() error {
+	switch o.Format {
+	case "", FormatText, FormatXMLSitemap, FormatImageSitemap, FormatJSON, FormatNDJSON, FormatCSV, FormatDOT, FormatMermaid, FormatTree, FormatHTML:
+	default:
+		return ErrInvalidFormat
+	}
+	switch o.Compress {
+	case "", CompressNone, CompressGzip:
+	default:
+		return ErrInvalidCompress
+	}
+	switch o.TemplateScope {
+	case "", TemplateScopeEdge, TemplateScopePage:
+	default:
+		return ErrInvalidTemplateScope
+	}
+	if o.Template != "" {
+		if _, err := o.parseTemplate(); err != nil {
+			return err
+		}
+	}
+	if o.Writer == nil && o.File == "" {
+		return ErrInvalidOutput
+	}
+	return nil
+}
+
+// siteMapSink is a site map being written, one per OutputConfig.
+type siteMapSink struct {
+	config  OutputConfig
+	output  siteMapOutput
+	closers []io.Closer // closed in order by close
+	err     error       // first error writing the site map
+}
+
+// outputConfigs returns the main OutputConfig followed by Outputs.
+func (c *Crawler) outputConfigs() []OutputConfig {
+	main := OutputConfig{
+		Format:        c.Format,
+		Writer:        c.SiteMapWriter,
+		File:          c.SiteMapOutputFile,
+		Compress:      c.Compress,
+		Template:      c.Template,
+		TemplateScope: c.TemplateScope,
+	}
+	return append([]OutputConfig{main}, c.Outputs...)
+}
+
+// openSiteMapSinks opens a sink per OutputConfig, writing to its Writer or,
+// if not provided, to its File created, compressed with its Compress. The
+// files are buffered, and the buffered Writers flushed when the sink is
+// closed, but only the files are closed.
+func (c *Crawler) openSiteMapSinks() error {
+	c.siteMapSinks = nil
+	for _, config := range c.outputConfigs() {
+		if config.Format == "" {
+			config.Format = FormatText
+		}
+		sink := &siteMapSink{config: config}
+		w := config.Writer
+		if w == nil {
+			f, err := os.Create(config.File)
+			if err != nil {
+				c.closeSiteMapSinks()
+				return fmt.Errorf("can't create siteMap output file: %q", err.Error())
+			}
+			buf := bufio.NewWriter(f)
+			w = buf
+			sink.closers = append(sink.closers, flushCloser{buf}, f)
+		} else if f, ok := w.(flusher); ok {
+			sink.closers = append(sink.closers, flushCloser{f})
+		}
+		if config.compression() == CompressGzip {
+			gz := gzip.NewWriter(w)
+			w = gz
+			// flushed before the writer it compresses to
+			sink.closers = append([]io.Closer{gz}, sink.closers...)
+		}
+		sink.output = c.newSiteMapOutput(config, w)
+		c.siteMapSinks = append(c.siteMapSinks, sink)
+	}
+	return nil
+}
+
+// write writes the result to the site map, unless writing it already
+// failed. The failed pages are only written by the failedPageOutputs. The
+// errors are only logged with IgnoreOutputErrors.
+func (s *siteMapSink) write(c *Crawler, r PageResult) {
+	if s.err != nil {
+		return
+	}
+	var err error
+	if r.Error == nil {
+		err = s.output.write(r)
+	} else if output, ok := s.output.(failedPageOutput); ok {
+		err = output.writeFailed(r)
+	}
+	if err == nil {
+		return
+	}
+	if c.IgnoreOutputErrors {
+		log.Errorf("Failed to write %q to the %s site map: %s", r.URL, s.config.Format, err.Error())
+		return
+	}
+	log.Errorf("Failed to write %q to the %s site map, not writing it anymore: %s", r.URL, s.config.Format, err.Error())
+	s.err = err
+}
+
+// close ends the site map and closes what openSiteMapSinks opened. It
+// returns the first error writing the site map, if any.
+func (s *siteMapSink) close() error {
+	err := s.err
+	if err == nil {
+		err = s.output.close()
+	}
+	for _, closer := range s.closers {
+		if closeErr := closer.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("can't close siteMap output: %s", closeErr.Error())
+		}
+	}
+	s.closers = nil
+	return err
+}
+
+// closeSiteMapSinks closes the sinks, returning the first error.
+func (c *Crawler) closeSiteMapSinks() error {
+	var err error
+	for _, sink := range c.siteMapSinks {
+		if closeErr := sink.close(); err == nil {
+			err = closeErr
+		}
+	}
+	c.siteMapSinks = nil
+	return err
+}
+
+// siteMapOutput writes the results of the crawl to the site map in one of
+// the formats. It's only used by siteMapBuilder.
+type siteMapOutput interface {
+	// write writes the result of a page, in the order they are fetched.
+	// Pages sharing a canonical URL are written once.
+	write(r PageResult) error
+	// close ends the site map once every result has been written.
+	close() error
+}
+
+// newSiteMapOutput returns the output of the format of the config, writing
+// to w.
+func (c *Crawler) newSiteMapOutput(config OutputConfig, w io.Writer) siteMapOutput {
+	if config.Template != "" {
+		// already parsed by validate
+		tmpl, _ := config.parseTemplate()
+		return templateOutput{crawler: c, w: w, template: tmpl, page: config.TemplateScope == TemplateScopePage}
+	}
+	switch config.Format {
+	case FormatXMLSitemap:
+		return &xmlSitemapOutput{crawler: c, w: w, file: config.File, compress: config.compression() == CompressGzip}
+	case FormatImageSitemap:
+		return &xmlSitemapOutput{crawler: c, w: w, file: config.File, compress: config.compression() == CompressGzip, images: true}
+	case FormatJSON:
+		return &jsonOutput{crawler: c, w: w, pages: map[string]JSONPage{}}
+	case FormatNDJSON:
+		o := ndjsonOutput{crawler: c, w: w, encoder: json.NewEncoder(w)}
+		// flushing a gzip.Writer ends a compressed block, so the compressed
+		// site maps are only flushed when the sink is closed
+		if config.compression() != CompressGzip {
+			o.flusher, _ = w.(flusher)
+		}
+		return o
+	case FormatCSV:
+		o := &csvOutput{crawler: c, w: w, writePages: c.CSVPagesWriter != nil}
+		// the pages are written once, by the first CSV site map
+		for _, sink := range c.siteMapSinks {
+			if _, ok := sink.output.(*csvOutput); ok {
+				o.writePages = false
+			}
+		}
+		return o
+	case FormatDOT:
+		return &dotOutput{crawler: c, w: w, graph: newSiteGraph()}
+	case FormatMermaid:
+		return &mermaidOutput{crawler: c, w: w, graph: newSiteGraph()}
+	case FormatTree:
+		return &treeOutput{crawler: c, w: w, inbound: map[string]map[string]bool{}}
+	case FormatHTML:
+		return &htmlOutput{crawler: c, w: w}
+	default:
+		return textOutput{crawler: c, w: w}
+	}
+}
+
+// pageLinks returns the links of the page written to the site map
+// followed, with IncludeAssets, by its assets. The external ones are left out
+// with InternalOnly.
+func (c *Crawler) pageLinks(r PageResult) []PageLink {
+	var links []PageLink
+	for _, s := range r.children {
+		external := c.isExternal(*s)
+		if c.InternalOnly && external {
+			continue
+		}
+		count := s.occurrences
+		if count == 0 {
+			count = 1
+		}
+		links = append(links, PageLink{URL: s.URL.String(), Element: s.element, Text: s.text, External: external, Count: count})
+	}
+	if !c.IncludeAssets {
+		return links
+	}
+	for _, a := range r.assets {
+		external := c.isExternal(webSite{URL: a.URL, Parent: r.site.URL})
+		if c.InternalOnly && external {
+			continue
+		}
+		links = append(links, PageLink{URL: a.URL.String(), Element: a.Element, Asset: true, External: external, Count: 1})
+	}
+	return links
+}
+
+// edgeSet remembers the edges written to the site map, by the dedup keys
+// of their source and target, up to a max number of edges (see
+// DedupeEdges).
+type edgeSet struct {
+	keys   map[[2]string]bool
+	max    int
+	warned bool // whether the set being full was logged
+}
+
+func newEdgeSet(max int) *edgeSet {
+	return &edgeSet{keys: map[[2]string]bool{}, max: max}
+}
+
+// add adds the edge, reporting whether it was not there yet. Once the set
+// is full, the edges not in it are reported as new without adding them.
+func (s *edgeSet) add(key [2]string) bool {
+	if s.keys[key] {
+		return false
+	}
+	if len(s.keys) < s.max {
+		s.keys[key] = true
+	} else if !s.warned {
+		log.Warnf("Max dedupe edges reached (%d): edges may be repeated", s.max)
+		s.warned = true
+	}
+	return true
+}
+
+// dedupeEdges returns the result without the links and assets already
+// written from the same source. The links to URLs sharing a dedup key are
+// merged into the first one, adding up their occurrences. The links of r
+// are copied since the worker still reads them.
+func (c *Crawler) dedupeEdges(r PageResult, edges *edgeSet) PageResult {
+	source := c.dedupKey(r.site.URL)
+	kept := map[string]*webSite{} // by dedup key of the target
+	children := make([]*webSite, 0, len(r.children))
+	for _, s := range r.children {
+		target := c.dedupKey(s.URL)
+		if site, ok := kept[target]; ok {
+			site.occurrences += s.occurrences
+			continue
+		}
+		if !edges.add([2]string{source, target}) {
+			continue
+		}
+		site := *s
+		kept[target] = &site
+		children = append(children, &site)
+	}
+	r.children = children
+	assets := make([]asset, 0, len(r.assets))
+	for _, a := range r.assets {
+		if edges.add([2]string{source, c.dedupKey(a.URL)}) {
+			assets = append(assets, a)
+		}
+	}
+	r.assets = assets
+	return r
+}
+
+// siteMapLinks returns the URLs of the Links of the page, split into
+// links and assets. Links is never nil.
+func (c *Crawler) siteMapLinks(r PageResult) (links, assets []string) {
+	links = []string{}
+	for _, edge := range r.Links {
+		if edge.Asset {
+			assets = append(assets, edge.URL)
+		} else {
+			links = append(links, edge.URL)
+		}
+	}
+	return links, assets
+}
+
+// textOutput writes an edge per link as soon as the results arrive.
+type textOutput struct {
+	crawler *Crawler
+	w       io.Writer
+}
+
+func (o textOutput) write(r PageResult) error {
+	c := o.crawler
+	if r.site.sitemap != nil {
+		// pages only found in the sitemap are linked from it
+		line := r.site.sitemap.String() + " -> " + r.URL
+		if c.EdgeCounts {
+			line += " [1]"
+		}
+		if _, err := fmt.Fprintln(o.w, line); err != nil {
+			return err
+		}
+	}
+	for _, edge := range r.Links {
+		line := r.URL + " -> " + edge.URL
+		if c.EdgeCounts {
+			line += fmt.Sprintf(" [%d]", edge.Count)
+		}
+		if _, err := fmt.Fprintln(o.w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o textOutput) close() error {
+	return nil
+}
+
+const (
+	sitemapNamespace      = "http://www.sitemaps.org/schemas/sitemap/0.9"
+	sitemapImageNamespace = "http://www.google.com/schemas/sitemap-image/1.1"
+)
+
+// maxSitemapImages is the max number of images of a page in an image
+// sitemap, as set by the Google image extension.
+const maxSitemapImages = 1000
+
+type sitemapURLSet struct {
+	XMLName    xml.Name       `xml:"urlset"`
+	Xmlns      string         `xml:"xmlns,attr"`
+	XmlnsImage string         `xml:"xmlns:image,attr,omitempty"`
+	URLs       []sitemapEntry `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name       `xml:"sitemapindex"`
+	Xmlns    string         `xml:"xmlns,attr"`
+	Sitemaps []sitemapEntry `xml:"sitemap"`
+}
+
+type sitemapEntry struct {
+	Loc     string         `xml:"loc"`
+	LastMod string         `xml:"lastmod,omitempty"`
+	Images  []sitemapImage `xml:"image:image,omitempty"`
+}
+
+type sitemapImage struct {
+	Loc string `xml:"image:loc"`
+}
+
+// xmlSitemapOutput keeps the indexable pages until the end of the crawl,
+// since the number of sitemap files depends on their count, and writes
+// them sorted by URL.
+type xmlSitemapOutput struct {
+	crawler  *Crawler
+	w        io.Writer
+	file     string // file of the site map, next to which the sitemap files are written
+	compress bool   // compress the sitemap files with gzip
+	images   bool   // write the images of the pages, leaving out the pages without any (FormatImageSitemap)
+	entries  []sitemapEntry
+}
+
+func (o *xmlSitemapOutput) write(r PageResult) error {
+	c := o.crawler
+	if r.resource || r.NoIndex {
+		return nil
+	}
+	// internal canonicals already replaced the page URL
+	if r.Canonical != nil && c.dedupKey(r.Canonical) != c.dedupKey(r.site.URL) {
+		return nil
+	}
+	entry := sitemapEntry{Loc: r.URL}
+	if !r.LastModified.IsZero() {
+		entry.LastMod = r.LastModified.UTC().Format(time.RFC3339)
+	}
+	if o.images {
+		entry.Images = sitemapImages(r)
+		if len(entry.Images) == 0 {
+			return nil
+		}
+	}
+	o.entries = append(o.entries, entry)
+	return nil
+}
+
+// sitemapImages returns the images of the page on its host, in document
+// order, up to maxSitemapImages.
+func sitemapImages(r PageResult) []sitemapImage {
+	var images []sitemapImage
+	n := 0
+	for _, a := range r.assets {
+		if (a.Element != "img" && a.Element != "source") || a.URL.Host != r.site.URL.Host {
+			continue
+		}
+		n++
+		if len(images) < maxSitemapImages {
+			images = append(images, sitemapImage{Loc: a.URL.String()})
+		}
+	}
+	if n > maxSitemapImages {
+		log.Warnf("Page %q has %d images: only the first %d are written to the image sitemap", r.URL, n, maxSitemapImages)
+	}
+	return images
+}
+
+// close writes the urlset or, beyond MaxSitemapURLs, the sitemap files next
+// to SiteMapOutputFile and their sitemap index. The index locates them at
+// the root of the first seed, where they are meant to be uploaded.
+func (o *xmlSitemapOutput) close() error {
+	c := o.crawler
+	sort.Slice(o.entries, func(i, j int) bool {
+		return o.entries[i].Loc < o.entries[j].Loc
+	})
+	xmlnsImage := ""
+	if o.images {
+		xmlnsImage = sitemapImageNamespace
+	}
+	if len(o.entries) <= c.MaxSitemapURLs {
+		return writeSitemapXML(o.w, sitemapURLSet{Xmlns: sitemapNamespace, XmlnsImage: xmlnsImage, URLs: o.entries})
+	}
+	seedURL, err := c.normalizer.parseAbsolute(c.seedURLs()[0])
+	if err != nil {
+		return err
+	}
+	index := sitemapIndex{Xmlns: sitemapNamespace}
+	for part := 1; len(o.entries) > 0; part++ {
+		n := c.MaxSitemapURLs
+		if n > len(o.entries) {
+			n = len(o.entries)
+		}
+		name := o.partName(part)
+		if err := writeSitemapFile(name, o.compress, sitemapURLSet{Xmlns: sitemapNamespace, XmlnsImage: xmlnsImage, URLs: o.entries[:n]}); err != nil {
+			return err
+		}
+		index.Sitemaps = append(index.Sitemaps, sitemapEntry{Loc: seedURL.Scheme + "://" + seedURL.Host + "/" + filepath.Base(name)})
+		o.entries = o.entries[n:]
+	}
+	return writeSitemapXML(o.w, index)
+}
+
+// partName returns the name of the nth sitemap file, e.g. "out-2.xml" for
+// the "out.xml" SiteMapOutputFile, or "out-2.xml.gz" when compressed. The
+// files are written to the current directory when the site map goes to the
+// standard output.
+func (o *xmlSitemapOutput) partName(n int) string {
+	name := o.file
+	if name == "" || name == os.Stdout.Name() {
+		name = "sitemap.xml"
+	}
+	gz := ""
+	if o.compress {
+		gz = ".gz"
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	ext := filepath.Ext(name)
+	if ext == "" {
+		ext = ".xml"
+	}
+	return fmt.Sprintf("%s-%d%s%s", strings.TrimSuffix(name, filepath.Ext(name)), n, ext, gz)
+}
+
+// writeSitemapFile writes the sitemap file, compressed with gzip if
+// compress is set.
+func writeSitemapFile(name string, compress bool, v interface{}) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+	err = writeSitemapXML(w, v)
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeSitemapXML writes the urlset or sitemap index as an indented XML
+// document. The URLs are escaped by the encoder, e.g. "&" as "&amp;".
+func writeSitemapXML(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// JSONSiteMap is the document written with FormatJSON. Since it can't be
+// streamed, every page is kept in memory until the end of the crawl, up to
+// MaxJSONPages.
+type JSONSiteMap struct {
+	Metadata JSONSiteMapMetadata `json:"metadata"`
+	Pages    map[string]JSONPage `json:"pages"` // by URL, sorted when encoded
+}
+
+// JSONSiteMapMetadata describes the crawl of a JSONSiteMap.
+type JSONSiteMapMetadata struct {
+	Seeds       []string  `json:"seeds"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	Pages       int       `json:"pages"`               // pages in the document
+	Links       int       `json:"links"`               // links and assets of the pages in the document
+	PagesFailed int       `json:"pages_failed"`        // pages that could not be fetched or parsed, which are not in the document
+	Truncated   string    `json:"truncated,omitempty"` // reason the crawl stopped early, if it did (see Stats)
+}
+
+// JSONPage is a page of a JSONSiteMap.
+type JSONPage struct {
+	Status  int      `json:"status,omitempty"` // status code of the response. Zero for the feeds and stylesheets (see FollowFeeds and FetchStylesheets).
+	Depth   int      `json:"depth"`            // number of links away from a seed
+	Title   string   `json:"title,omitempty"`
+	Inbound int      `json:"inbound"`          // pages linking to it (see InboundLinks)
+	Links   []string `json:"links"`            // URLs linked from the page, in document order
+	Assets  []string `json:"assets,omitempty"` // URLs of the resources of the page. Only with IncludeAssets.
+}
+
+// jsonOutput keeps the pages until the end of the crawl, when the whole
+// document is written.
+type jsonOutput struct {
+	crawler  *Crawler
+	w        io.Writer
+	pages    map[string]JSONPage
+	links    int
+	tooLarge bool
+}
+
+func (o *jsonOutput) write(r PageResult) error {
+	c := o.crawler
+	if len(o.pages) >= c.MaxJSONPages {
+		// the pages are dropped so the memory stays bounded
+		o.tooLarge = true
+		return nil
+	}
+	page := JSONPage{Status: r.StatusCode, Depth: r.Depth, Title: r.Metadata.Title}
+	page.Links, page.Assets = c.siteMapLinks(r)
+	o.links += len(page.Links) + len(page.Assets)
+	o.pages[r.URL] = page
+	return nil
+}
+
+func (o *jsonOutput) close() error {
+	if o.tooLarge {
+		return ErrSiteMapTooLarge
+	}
+	c := o.crawler
+	stats := c.Stats()
+	inbound := c.InboundLinks()
+	for u, page := range o.pages {
+		page.Inbound = inbound[u]
+		o.pages[u] = page
+	}
+	siteMap := JSONSiteMap{
+		Metadata: JSONSiteMapMetadata{
+			Seeds:       c.seedURLs(),
+			Started:     c.started,
+			Finished:    time.Now(),
+			Pages:       len(o.pages),
+			Links:       o.links,
+			PagesFailed: stats.PagesFailed,
+			Truncated:   stats.Truncated,
+		},
+		Pages: o.pages,
+	}
+	encoder := json.NewEncoder(o.w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(siteMap)
+}
+
+// PageRecord is a page written with FormatNDJSON, one JSON document per
+// line.
+type PageRecord struct {
+	URL       string   `json:"url"`
+	Parents   []string `json:"parents"`          // page the URL was first found on, or the sitemap listing it. Empty for the seeds.
+	Status    int      `json:"status,omitempty"` // status code of the response. Zero for the feeds and stylesheets (see FollowFeeds and FetchStylesheets).
+	Depth     int      `json:"depth"`            // number of links away from a seed
+	LatencyMS int64    `json:"latency_ms"`       // milliseconds taken to get the response
+	Bytes     int64    `json:"bytes"`            // size of the body. Zero when revalidated (see IncrementalStateFile).
+	Title     string   `json:"title,omitempty"`
+	Links     []string `json:"links"`            // URLs linked from the page, in document order
+	Assets    []string `json:"assets,omitempty"` // URLs of the resources of the page. Only with IncludeAssets.
+	Error     string   `json:"error,omitempty"`  // why the page could not be fetched or parsed, e.g. "404 Not Found". Status is zero if no response was received.
+}
+
+// flusher is implemented by the buffered writers, e.g. bufio.Writer.
+type flusher interface {
+	Flush() error
+}
+
+// failedPageOutput is a siteMapOutput also recording the pages that could
+// not be fetched or parsed.
+type failedPageOutput interface {
+	// writeFailed writes the result of a failed page, with its Error.
+	writeFailed(r PageResult) error
+}
+
+// flushCloser closes a buffered writer by flushing it, leaving the writer
+// it buffers open.
+type flushCloser struct {
+	flusher
+}
+
+func (f flushCloser) Close() error {
+	return f.Flush()
+}
+
+// ndjsonOutput writes a line per page as soon as the results arrive. Each
+// line is written at once, so the lines are never interleaved.
+type ndjsonOutput struct {
+	crawler *Crawler
+	w       io.Writer
+	encoder *json.Encoder
+	flusher flusher // flushed after every line, if w is buffered and not compressed
+}
+
+func (o ndjsonOutput) write(r PageResult) error {
+	c := o.crawler
+	record := newPageRecord(r)
+	record.Links, record.Assets = c.siteMapLinks(r)
+	return o.encode(record)
+}
+
+// writeFailed writes a record without links for the failed page.
+func (o ndjsonOutput) writeFailed(r PageResult) error {
+	record := newPageRecord(r)
+	record.Links = []string{}
+	record.Error = r.Error.Error()
+	return o.encode(record)
+}
+
+func newPageRecord(r PageResult) PageRecord {
+	record := PageRecord{
+		URL:       r.URL,
+		Parents:   []string{},
+		Status:    r.StatusCode,
+		Depth:     r.Depth,
+		LatencyMS: int64(r.Duration / time.Millisecond),
+		Bytes:     r.Bytes,
+		Title:     r.Metadata.Title,
+	}
+	if r.site.Parent != nil {
+		record.Parents = append(record.Parents, r.site.Parent.String())
+	}
+	if r.site.sitemap != nil {
+		record.Parents = append(record.Parents, r.site.sitemap.String())
+	}
+	return record
+}
+
+func (o ndjsonOutput) encode(record PageRecord) error {
+	if err := o.encoder.Encode(record); err != nil {
+		return err
+	}
+	if o.flusher != nil {
+		return o.flusher.Flush()
+	}
+	return nil
+}
+
+func (o ndjsonOutput) close() error {
+	return nil
+}
+
+// CSVHeader holds the columns of FormatCSV, one row per link:
+//   - source: URL of the page, or of the sitemap listing it (see UseSitemap)
+//   - target: URL linked
+//   - link_type: element of the link, e.g. "a", "img" or "iframe", "sitemap"
+//     for the pages listed in the sitemap or "link" if unknown
+//   - status: status code of the target when it was fetched, also when it
+//     failed with a 4xx or 5xx status. Empty otherwise.
+//   - anchor_text: text of the link, whitespace-normalized
+var CSVHeader = []string{"source", "target", "link_type", "status", "anchor_text"}
+
+// CSVPagesHeader holds the columns of the CSV written to CSVPagesWriter, one
+// row per page as soon as it's fetched:
+//   - url: URL of the page
+//   - status: status code of the response
+//   - depth: number of links away from a seed
+//   - title: title of the page
+//   - links: number of links and assets of the page in the site map
+//   - bytes: size of the body
+//   - latency_ms: milliseconds taken to get the response
+var CSVPagesHeader = []string{"url", "status", "depth", "title", "links", "bytes", "latency_ms"}
+
+// csvOutput keeps the rows until the end of the crawl, when the status of
+// the targets is known, and writes them sorted by source, in document order
+// for each source.
+type csvOutput struct {
+	crawler    *Crawler
+	w          io.Writer
+	rows       [][]string
+	writePages bool // write the pages to CSVPagesWriter
+	pages      *csv.Writer
+}
+
+func (o *csvOutput) write(r PageResult) error {
+	c := o.crawler
+	source := r.URL
+	if r.site.sitemap != nil {
+		o.rows = append(o.rows, []string{r.site.sitemap.String(), source, "sitemap", "", ""})
+	}
+	edges := r.Links
+	for _, edge := range edges {
+		linkType := edge.Element
+		if linkType == "" {
+			linkType = "link"
+		}
+		o.rows = append(o.rows, []string{source, edge.URL, linkType, "", edge.Text})
+	}
+	if !o.writePages {
+		return nil
+	}
+	if o.pages == nil {
+		o.pages = csv.NewWriter(c.CSVPagesWriter)
+		if err := o.pages.Write(CSVPagesHeader); err != nil {
+			return err
+		}
+	}
+	o.pages.Write([]string{
+		source,
+		formatStatus(r.StatusCode),
+		strconv.Itoa(r.Depth),
+		r.Metadata.Title,
+		strconv.Itoa(len(edges)),
+		strconv.FormatInt(r.Bytes, 10),
+		strconv.FormatInt(int64(r.Duration/time.Millisecond), 10),
+	})
+	o.pages.Flush()
+	return o.pages.Error()
+}
+
+func (o *csvOutput) close() error {
+	c := o.crawler
+	codes := c.StatusCodes()
+	sort.SliceStable(o.rows, func(i, j int) bool {
+		return o.rows[i][0] < o.rows[j][0]
+	})
+	w := csv.NewWriter(o.w)
+	w.Write(CSVHeader)
+	for _, row := range o.rows {
+		row[3] = formatStatus(codes[row[1]])
+		w.Write(row)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// formatStatus returns the status code as a string, empty if zero.
+func formatStatus(code int) string {
+	if code == 0 {
+		return ""
+	}
+	return strconv.Itoa(code)
+}
+
+// siteGraph is the graph of the site, with a node per URL and an edge per
+// link, kept by the graph outputs until the end of the crawl, when the status
+// of the nodes is known.
+type siteGraph struct {
+	nodes map[string]graphNode // by URL
+	edges [][2]string
+}
+
+type graphNode struct {
+	external bool
+	depth    int // number of links away from a seed
+}
+
+func newSiteGraph() siteGraph {
+	return siteGraph{nodes: map[string]graphNode{}}
+}
+
+// add adds the page of the result, its links and, if it was found in the
+// sitemap, the sitemap linking to it.
+func (g *siteGraph) add(c *Crawler, r PageResult) {
+	source := r.URL
+	depth := r.Depth
+	g.nodes[source] = graphNode{depth: depth}
+	if r.site.sitemap != nil {
+		g.addEdge(r.site.sitemap.String(), source, graphNode{depth: depth})
+	}
+	for _, edge := range r.Links {
+		g.addEdge(source, edge.URL, graphNode{external: edge.External, depth: depth + 1})
+	}
+}
+
+func (g *siteGraph) addEdge(source, target string, node graphNode) {
+	if _, ok := g.nodes[source]; !ok {
+		g.nodes[source] = graphNode{depth: node.depth}
+	}
+	if n, ok := g.nodes[target]; !ok || n.depth > node.depth {
+		node.external = node.external || ok && n.external
+		g.nodes[target] = node
+	}
+	g.edges = append(g.edges, [2]string{source, target})
+}
+
+// sortedNodes returns the URLs of the nodes sorted.
+func (g *siteGraph) sortedNodes() []string {
+	nodes := make([]string, 0, len(g.nodes))
+	for node := range g.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// sortedEdges returns the edges sorted by source, in document order for
+// each source.
+func (g *siteGraph) sortedEdges() [][2]string {
+	sort.SliceStable(g.edges, func(i, j int) bool {
+		return g.edges[i][0] < g.edges[j][0]
+	})
+	return g.edges
+}
+
+// dotOutput writes the nodes sorted by URL followed by the edges sorted by
+// source at the end of the crawl.
+type dotOutput struct {
+	crawler *Crawler
+	w       io.Writer
+	graph   siteGraph
+}
+
+func (o *dotOutput) write(r PageResult) error {
+	c := o.crawler
+	if c.DOTMaxDepth > 0 && r.Depth >= c.DOTMaxDepth {
+		// the page is already a node if it's linked from the graph
+		return nil
+	}
+	o.graph.add(c, r)
+	return nil
+}
+
+func (o *dotOutput) close() error {
+	c := o.crawler
+	codes := c.StatusCodes()
+	var b strings.Builder
+	b.WriteString("digraph site {\n")
+	b.WriteString("  node [shape=ellipse];\n")
+	for _, node := range o.graph.sortedNodes() {
+		external := o.graph.nodes[node].external
+		attrs := []string{"label=" + dotQuote(graphLabel(node, external))}
+		if external {
+			attrs = append(attrs, "shape=box")
+		}
+		if color := dotStatusColor(codes[node]); c.DOTStatusColors && color != "" {
+			attrs = append(attrs, "style=filled", "fillcolor="+color)
+		}
+		fmt.Fprintf(&b, "  %s [%s];\n", dotQuote(node), strings.Join(attrs, ", "))
+	}
+	for _, edge := range o.graph.sortedEdges() {
+		fmt.Fprintf(&b, "  %s -> %s;\n", dotQuote(edge[0]), dotQuote(edge[1]))
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(o.w, b.String())
+	return err
+}
+
+// graphLabel returns the path and query of the internal URLs and the whole
+// external URLs.
+func graphLabel(rawURL string, external bool) string {
+	u, err := url.Parse(rawURL)
+	if external || err != nil {
+		return rawURL
+	}
+	label := u.EscapedPath()
+	if label == "" {
+		label = "/"
+	}
+	if u.RawQuery != "" {
+		label += "?" + u.RawQuery
+	}
+	return label
+}
+
+// dotQuote returns s as a DOT quoted string.
+func dotQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", " ", "\r", " ").Replace(s)
+	return `"` + s + `"`
+}
+
+// dotStatusColor returns the fill color of the nodes with the status code:
+// green for 2xx, yellow for 3xx and red for 4xx and 5xx. Empty otherwise.
+func dotStatusColor(code int) string {
+	switch {
+	case code >= 200 && code < 300:
+		return "palegreen"
+	case code >= 300 && code < 400:
+		return "khaki"
+	case code >= 400 && code < 600:
+		return "salmon"
+	default:
+		return ""
+	}
+}
+
+// mermaidOutput writes a flowchart of the nodes nearest to the seeds, up to
+// MaxMermaidNodes, at the end of the crawl. The links to the nodes left out
+// point to a single node counting them.
+type mermaidOutput struct {
+	crawler *Crawler
+	w       io.Writer
+	graph   siteGraph
+}
+
+// mermaidMoreID is the ID of the node standing for the nodes left out.
+const mermaidMoreID = "more"
+
+func (o *mermaidOutput) write(r PageResult) error {
+	o.graph.add(o.crawler, r)
+	return nil
+}
+
+func (o *mermaidOutput) close() error {
+	c := o.crawler
+	nodes := o.graph.sortedNodes()
+	kept := map[string]bool{}
+	if len(nodes) > c.MaxMermaidNodes {
+		nearest := append([]string(nil), nodes...)
+		sort.SliceStable(nearest, func(i, j int) bool {
+			return o.graph.nodes[nearest[i]].depth < o.graph.nodes[nearest[j]].depth
+		})
+		for _, node := range nearest[:c.MaxMermaidNodes] {
+			kept[node] = true
+		}
+	} else {
+		for _, node := range nodes {
+			kept[node] = true
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("graph TD\n")
+	for _, node := range nodes {
+		if !kept[node] {
+			continue
+		}
+		label := mermaidQuote(graphLabel(node, o.graph.nodes[node].external))
+		if o.graph.nodes[node].external {
+			fmt.Fprintf(&b, "  %s([%s])\n", mermaidID(node), label)
+		} else {
+			fmt.Fprintf(&b, "  %s[%s]\n", mermaidID(node), label)
+		}
+	}
+	if more := len(nodes) - len(kept); more > 0 {
+		fmt.Fprintf(&b, "  %s[%s]\n", mermaidMoreID, mermaidQuote(fmt.Sprintf("…and %d more", more)))
+	}
+	linkedToMore := map[string]bool{}
+	for _, edge := range o.graph.sortedEdges() {
+		source, target := edge[0], edge[1]
+		switch {
+		case !kept[source]:
+		case kept[target]:
+			fmt.Fprintf(&b, "  %s --> %s\n", mermaidID(source), mermaidID(target))
+		case !linkedToMore[source]:
+			linkedToMore[source] = true
+			fmt.Fprintf(&b, "  %s --> %s\n", mermaidID(source), mermaidMoreID)
+		}
+	}
+	_, err := io.WriteString(o.w, b.String())
+	return err
+}
+
+// mermaidID returns the ID of the node of the URL, a hash of it, so the IDs
+// are the same across crawls.
+func mermaidID(rawURL string) string {
+	h := fnv.New64a()
+	io.WriteString(h, rawURL)
+	return fmt.Sprintf("n%016x", h.Sum64())
+}
+
+// mermaidQuote returns s as a Mermaid quoted label. The characters breaking
+// the label are replaced by their entity codes.
+func mermaidQuote(s string) string {
+	s = strings.NewReplacer("#", "#35;", `"`, "#quot;", "[", "#91;", "]", "#93;", "<", "#lt;", ">", "#gt;", "\n", " ", "\r", " ").Replace(s)
+	return `"` + s + `"`
+}
+
+// treeOutput keeps the internal URLs, the pages and the targets of their
+// links, until the end of the crawl, when they are written as a tree by path,
+// one line per URL indented under its parent path. The parent paths not
+// crawled are added so every URL has a place in the tree.
+type treeOutput struct {
+	crawler *Crawler
+	w       io.Writer
+	inbound map[string]map[string]bool // pages linking to each URL, by URL
+}
+
+func (o *treeOutput) write(r PageResult) error {
+	source := r.URL
+	if _, ok := o.inbound[source]; !ok {
+		o.inbound[source] = map[string]bool{}
+	}
+	for _, edge := range r.Links {
+		if edge.Asset || edge.External {
+			continue
+		}
+		if _, ok := o.inbound[edge.URL]; !ok {
+			o.inbound[edge.URL] = map[string]bool{}
+		}
+		o.inbound[edge.URL][source] = true
+	}
+	return nil
+}
+
+// treeNode is a path of the tree. URL is empty if no URL has the path.
+type treeNode struct {
+	label    string
+	url      string
+	children map[string]*treeNode // by path segment, or by "?" and the query
+}
+
+func newTreeNode(label string) *treeNode {
+	return &treeNode{label: label, children: map[string]*treeNode{}}
+}
+
+// child returns the child of the node with the key, adding it if missing.
+func (n *treeNode) child(key, label string) *treeNode {
+	child, ok := n.children[key]
+	if !ok {
+		child = newTreeNode(label)
+		n.children[key] = child
+	}
+	return child
+}
+
+func (o *treeOutput) close() error {
+	c := o.crawler
+	roots := map[string]*treeNode{} // by scheme and host
+	for rawURL := range o.inbound {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			continue
+		}
+		origin := u.Scheme + "://" + u.Host
+		node, ok := roots[origin]
+		if !ok {
+			node = newTreeNode(origin)
+			roots[origin] = node
+		}
+		if path := u.EscapedPath(); path != "" && path != "/" {
+			// "/docs/" is a child of "/docs", keyed by an empty segment
+			segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+			for i, segment := range segments {
+				node = node.child(segment, "/"+strings.Join(segments[:i+1], "/"))
+			}
+		}
+		if u.RawQuery != "" {
+			label := node.label + "?" + u.RawQuery
+			if node == roots[origin] {
+				label = "/?" + u.RawQuery
+			}
+			node = node.child("?"+u.RawQuery, label)
+		}
+		node.url = rawURL
+	}
+
+	origins := make([]string, 0, len(roots))
+	for origin := range roots {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	var b strings.Builder
+	codes := c.StatusCodes()
+	for _, origin := range origins {
+		o.writeNode(&b, roots[origin], 0, codes)
+	}
+	_, err := io.WriteString(o.w, b.String())
+	return err
+}
+
+// writeNode writes the line of the node, with its status code and the number
+// of pages linking to it, followed by its children sorted.
+func (o *treeOutput) writeNode(b *strings.Builder, n *treeNode, indent int, codes map[string]int) {
+	var notes []string
+	if status := formatStatus(codes[n.url]); status != "" {
+		notes = append(notes, status)
+	} else {
+		notes = append(notes, "not crawled")
+	}
+	if n.url != "" {
+		inbound := len(o.inbound[n.url])
+		if inbound == 1 {
+			notes = append(notes, "1 inbound link")
+		} else {
+			notes = append(notes, strconv.Itoa(inbound)+" inbound links")
+		}
+	}
+	fmt.Fprintf(b, "%s%s (%s)\n", strings.Repeat("  ", indent), n.label, strings.Join(notes, ", "))
+	keys := make([]string, 0, len(n.children))
+	for key := range n.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		o.writeNode(b, n.children[key], indent+1, codes)
+	}
+}
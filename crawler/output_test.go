@@ -0,0 +1,857 @@
+package crawler_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scanterog/crawler/crawler"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenServerURL replaces the URL of the test server in the golden files.
+const goldenServerURL = "http://crawler.test"
+
+// assertGolden compares the output with the testdata golden file, once the
+// URL of the test server is replaced, or updates the file with -update.
+func assertGolden(t *testing.T, name, serverURL, output string) {
+	t.Helper()
+	golden := filepath.Join("testdata", name)
+	output = strings.Replace(output, serverURL, goldenServerURL, -1)
+	if *update {
+		assert.NoError(t, ioutil.WriteFile(golden, []byte(output), 0644))
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, string(expected), output)
+}
+
+func newSitemapTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/about":
+			w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+			fmt.Fprint(w, `<a href="/">home</a>`)
+		case "/search":
+			fmt.Fprint(w, `<a href="/search?q=go&amp;page=3">next</a>`)
+		case "/private":
+			fmt.Fprint(w, `<meta name="robots" content="noindex"><a href="/">home</a>`)
+		case "/print":
+			fmt.Fprint(w, `<link rel="canonical" href="https://example.com/print">`)
+		default:
+			fmt.Fprint(w, `<a href="/about">about</a><a href="/search?q=go&amp;page=2">search</a>
+<a href="/private">private</a><a href="/print">print</a><a href="https://golang.org">go</a>`)
+		}
+	}))
+}
+
+func TestRunXMLSitemap(t *testing.T) {
+	httpTestServer := newSitemapTestServer()
+	defer httpTestServer.Close()
+
+	t.Run("Single file", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatXMLSitemap,
+		}
+		assert.NoError(t, c.Run())
+		assertGolden(t, "xml_sitemap.golden", httpTestServer.URL, siteMapOutBuf.String())
+	})
+
+	t.Run("Split with a sitemap index", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "sitemap")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer os.RemoveAll(dir)
+		c := crawler.Crawler{
+			SeedURL:           httpTestServer.URL,
+			IgnoreRobots:      true,
+			NumWorkers:        crawler.DefaultNumWorkers,
+			SiteMapOutputFile: filepath.Join(dir, "sitemap.xml"),
+			Format:            crawler.FormatXMLSitemap,
+			MaxSitemapURLs:    2,
+		}
+		assert.NoError(t, c.Run())
+		files, err := filepath.Glob(filepath.Join(dir, "*"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			filepath.Join(dir, "sitemap-1.xml"),
+			filepath.Join(dir, "sitemap-2.xml"),
+			filepath.Join(dir, "sitemap.xml"),
+		}, files)
+		for _, name := range []string{"sitemap.xml", "sitemap-1.xml", "sitemap-2.xml"} {
+			output, err := ioutil.ReadFile(filepath.Join(dir, name))
+			assert.NoError(t, err)
+			assertGolden(t, "xml_sitemap_split_"+name+".golden", httpTestServer.URL, string(output))
+		}
+	})
+}
+
+func TestRunImageSitemap(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gallery":
+			fmt.Fprint(w, `<img src="/img/a.png"><img src="/img/b.jpg?size=large&amp;q=80">
+<img src="https://cdn.example.com/c.png"><img src="data:image/gif;base64,R0lGODlhAQABAAAAACw=">
+<picture><source srcset="/img/d.webp 1x, /img/d@2x.webp 2x"><img src="/img/d.jpg"></picture>
+<video poster="/img/poster.jpg" src="/video.mp4"></video><a href="/">home</a>`)
+		case "/about":
+			fmt.Fprint(w, `<a href="/">home</a>`)
+		case "/private":
+			fmt.Fprint(w, `<meta name="robots" content="noindex"><img src="/img/private.png">`)
+		case "/many":
+			for i := 0; i < 1001; i++ {
+				fmt.Fprintf(w, `<img src="/img/%d.png">`, i)
+			}
+		default:
+			fmt.Fprint(w, `<img src="/logo.svg"><a href="/gallery">gallery</a><a href="/about">about</a>
+<a href="/private">private</a>`)
+		}
+	}))
+	defer httpTestServer.Close()
+
+	t.Run("Images", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatImageSitemap,
+		}
+		assert.NoError(t, c.Run())
+		assertGolden(t, "image_sitemap.golden", httpTestServer.URL, siteMapOutBuf.String())
+	})
+
+	t.Run("Max images per page", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL + "/many",
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatImageSitemap,
+		}
+		assert.NoError(t, c.Run())
+		assert.Equal(t, 1000, strings.Count(siteMapOutBuf.String(), "<image:loc>"))
+		assert.Contains(t, siteMapOutBuf.String(), "/img/999.png")
+		assert.NotContains(t, siteMapOutBuf.String(), "/img/1000.png")
+	})
+}
+
+func TestRunJSON(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	t.Run("Document", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       serverURL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatJSON,
+		}
+		before := time.Now()
+		assert.NoError(t, c.Run())
+
+		var siteMap crawler.JSONSiteMap
+		assert.NoError(t, json.Unmarshal(siteMapOutBuf.Bytes(), &siteMap))
+		assert.Equal(t, map[string]crawler.JSONPage{
+			serverURL:              {Status: http.StatusOK, Depth: 0, Title: "Main page", Inbound: 2, Links: []string{serverURL + "/about", serverURL + "/help", "https://twitter.com"}},
+			serverURL + "/about":   {Status: http.StatusOK, Depth: 1, Title: "About page", Inbound: 1, Links: []string{serverURL, serverURL + "/help", "https://fb.com", serverURL + "/careers"}},
+			serverURL + "/careers": {Status: http.StatusOK, Depth: 2, Title: "Careers page", Inbound: 1, Links: []string{serverURL, "https://golang.org", serverURL + "/help"}},
+		}, siteMap.Pages)
+		metadata := siteMap.Metadata
+		assert.Equal(t, []string{serverURL}, metadata.Seeds)
+		assert.Equal(t, 3, metadata.Pages)
+		assert.Equal(t, 10, metadata.Links)
+		assert.Equal(t, 1, metadata.PagesFailed)
+		assert.Empty(t, metadata.Truncated)
+		assert.False(t, metadata.Started.Before(before.Truncate(time.Second)))
+		assert.False(t, metadata.Finished.Before(metadata.Started))
+
+		// keys are sorted for deterministic diffs
+		output := siteMapOutBuf.String()
+		about := strings.Index(output, `"`+serverURL+`/about": {`)
+		careers := strings.Index(output, `"`+serverURL+`/careers": {`)
+		assert.True(t, about > 0 && careers > about)
+	})
+
+	t.Run("Too large", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       serverURL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatJSON,
+			MaxJSONPages:  2,
+		}
+		assert.Equal(t, crawler.ErrSiteMapTooLarge, c.Run())
+		assert.Empty(t, siteMapOutBuf.String())
+	})
+}
+
+// flushCounter is a buffered site map writer counting its flushes.
+type flushCounter struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (f *flushCounter) Flush() error {
+	f.flushes++
+	return nil
+}
+
+func TestRunNDJSON(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	siteMapOut := &flushCounter{}
+	c := crawler.Crawler{
+		SeedURL:       serverURL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: siteMapOut,
+		Format:        crawler.FormatNDJSON,
+	}
+	assert.NoError(t, c.Run())
+
+	records := map[string]crawler.PageRecord{}
+	lines := strings.SplitAfter(siteMapOut.String(), "\n")
+	assert.Equal(t, "", lines[len(lines)-1])
+	for _, line := range lines[:len(lines)-1] {
+		var record crawler.PageRecord
+		assert.NoError(t, json.Unmarshal([]byte(line), &record), line)
+		assert.True(t, record.LatencyMS >= 0)
+		assert.True(t, record.Bytes > 0 || record.Error != "")
+		record.LatencyMS, record.Bytes = 0, 0
+		records[record.URL] = record
+	}
+	assert.Len(t, records, 4)
+	// once per record and once when the site map ends
+	assert.Equal(t, 5, siteMapOut.flushes)
+	assert.Equal(t, map[string]crawler.PageRecord{
+		serverURL:              {URL: serverURL, Parents: []string{}, Status: http.StatusOK, Depth: 0, Title: "Main page", Links: []string{serverURL + "/about", serverURL + "/help", "https://twitter.com"}},
+		serverURL + "/about":   {URL: serverURL + "/about", Parents: []string{serverURL}, Status: http.StatusOK, Depth: 1, Title: "About page", Links: []string{serverURL, serverURL + "/help", "https://fb.com", serverURL + "/careers"}},
+		serverURL + "/careers": {URL: serverURL + "/careers", Parents: []string{serverURL + "/about"}, Status: http.StatusOK, Depth: 2, Title: "Careers page", Links: []string{serverURL, "https://golang.org", serverURL + "/help"}},
+		serverURL + "/help":    {URL: serverURL + "/help", Parents: []string{serverURL}, Status: http.StatusNotFound, Depth: 1, Links: []string{}, Error: "404 Not Found"},
+	}, records)
+}
+
+func TestRunCSV(t *testing.T) {
+	t.Run("Fixture site", func(t *testing.T) {
+		httpTestServer := newTestServer()
+		defer httpTestServer.Close()
+		siteMapOutBuf := &bytes.Buffer{}
+		pagesOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:        httpTestServer.URL,
+			IgnoreRobots:   true,
+			NumWorkers:     crawler.DefaultNumWorkers,
+			SiteMapWriter:  siteMapOutBuf,
+			Format:         crawler.FormatCSV,
+			CSVPagesWriter: pagesOutBuf,
+		}
+		assert.NoError(t, c.Run())
+		assertGolden(t, "csv.golden", httpTestServer.URL, siteMapOutBuf.String())
+
+		// the pages are written as soon as they are fetched
+		rows, err := csv.NewReader(pagesOutBuf).ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, crawler.CSVPagesHeader, rows[0])
+		pages := map[string][]string{}
+		for _, row := range rows[1:] {
+			pages[row[0]] = row[1:5]
+		}
+		assert.Equal(t, map[string][]string{
+			httpTestServer.URL:              {"200", "0", "Main page", "3"},
+			httpTestServer.URL + "/about":   {"200", "1", "About page", "4"},
+			httpTestServer.URL + "/careers": {"200", "2", "Careers page", "3"},
+		}, pages)
+	})
+
+	t.Run("Pages written once with several CSV site maps", func(t *testing.T) {
+		httpTestServer := newTestServer()
+		defer httpTestServer.Close()
+		pagesOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:        httpTestServer.URL,
+			IgnoreRobots:   true,
+			NumWorkers:     crawler.DefaultNumWorkers,
+			SiteMapWriter:  &bytes.Buffer{},
+			Format:         crawler.FormatCSV,
+			Outputs:        []crawler.OutputConfig{{Format: crawler.FormatCSV, Writer: &bytes.Buffer{}}},
+			CSVPagesWriter: pagesOutBuf,
+		}
+		assert.NoError(t, c.Run())
+		rows, err := csv.NewReader(pagesOutBuf).ReadAll()
+		assert.NoError(t, err)
+		// the header and the three pages
+		assert.Len(t, rows, 4)
+	})
+
+	t.Run("Quoting", func(t *testing.T) {
+		httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "" || r.URL.Path == "/" {
+				fmt.Fprint(w, `<a href="/a?x=1,2">Say "hi", world</a><img src="/logo.png">`)
+			}
+		}))
+		defer httpTestServer.Close()
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatCSV,
+			IncludeAssets: true,
+		}
+		assert.NoError(t, c.Run())
+		rows, err := csv.NewReader(siteMapOutBuf).ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, [][]string{
+			crawler.CSVHeader,
+			{httpTestServer.URL, httpTestServer.URL + "/a?x=1,2", "a", "200", `Say "hi", world`},
+			{httpTestServer.URL, httpTestServer.URL + "/logo.png", "img", "", ""},
+		}, rows)
+	})
+}
+
+func TestRunDOT(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+
+	t.Run("Fixture site", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:         httpTestServer.URL,
+			IgnoreRobots:    true,
+			NumWorkers:      crawler.DefaultNumWorkers,
+			SiteMapWriter:   siteMapOutBuf,
+			Format:          crawler.FormatDOT,
+			DOTStatusColors: true,
+		}
+		assert.NoError(t, c.Run())
+		assertGolden(t, "dot.golden", httpTestServer.URL, siteMapOutBuf.String())
+
+		dot, err := exec.LookPath("dot")
+		if err != nil {
+			t.Log("Graphviz dot not found: the output is not parsed")
+			return
+		}
+		cmd := exec.Command(dot, "-Tsvg", "-o", os.DevNull)
+		cmd.Stdin = siteMapOutBuf
+		output, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(output))
+	})
+
+	t.Run("Max depth", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatDOT,
+			DOTMaxDepth:   1,
+		}
+		assert.NoError(t, c.Run())
+		assertGolden(t, "dot_max_depth.golden", httpTestServer.URL, siteMapOutBuf.String())
+	})
+
+	t.Run("Escaping", func(t *testing.T) {
+		httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `<a href="https://example.com/?q=%22quoted%22&amp;p=a\b">example</a>`)
+		}))
+		defer httpTestServer.Close()
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatDOT,
+		}
+		assert.NoError(t, c.Run())
+		assert.Contains(t, siteMapOutBuf.String(), `"`+httpTestServer.URL+`" -> "https://example.com?q=%22quoted%22&p=a\\b";`)
+	})
+}
+
+// mermaidIDs matches the node IDs of FormatMermaid.
+var mermaidIDs = regexp.MustCompile(`\bn[0-9a-f]{16}\b`)
+
+// normalizeMermaidIDs replaces the node IDs, hashes of the URLs of the test
+// server, with their order of appearance.
+func normalizeMermaidIDs(output string) string {
+	ids := map[string]string{}
+	return mermaidIDs.ReplaceAllStringFunc(output, func(id string) string {
+		if _, ok := ids[id]; !ok {
+			ids[id] = fmt.Sprintf("node%d", len(ids)+1)
+		}
+		return ids[id]
+	})
+}
+
+func TestRunMermaid(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+
+	t.Run("Fixture site", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatMermaid,
+		}
+		assert.NoError(t, c.Run())
+		assertGolden(t, "mermaid.golden", httpTestServer.URL, normalizeMermaidIDs(siteMapOutBuf.String()))
+	})
+
+	t.Run("Max nodes", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:         httpTestServer.URL,
+			IgnoreRobots:    true,
+			NumWorkers:      crawler.DefaultNumWorkers,
+			SiteMapWriter:   siteMapOutBuf,
+			Format:          crawler.FormatMermaid,
+			MaxMermaidNodes: 3,
+		}
+		assert.NoError(t, c.Run())
+		assertGolden(t, "mermaid_max_nodes.golden", httpTestServer.URL, normalizeMermaidIDs(siteMapOutBuf.String()))
+	})
+
+	t.Run("Escaping", func(t *testing.T) {
+		httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `<a href="https://example.com?q=[&quot;x&quot;]&amp;tag=<b>">example</a>`)
+		}))
+		defer httpTestServer.Close()
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatMermaid,
+		}
+		assert.NoError(t, c.Run())
+		assert.Contains(t, siteMapOutBuf.String(), `(["https://example.com?q=#91;#quot;x#quot;#93;&tag=#lt;b#gt;"])`)
+	})
+}
+
+func newNestedTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<a href="/docs/install">install</a><a href="/docs/config">config</a>
+<a href="/blog/2024/hello">hello</a><a href="/about">about</a><a href="https://golang.org">go</a>`)
+		case "/about":
+			fmt.Fprint(w, `<a href="/">home</a><a href="/docs/install">install</a>`)
+		case "/docs/install":
+			fmt.Fprint(w, `<a href="/docs/config">config</a><a href="/">home</a>`)
+		case "/docs/config":
+			fmt.Fprint(w, `<a href="/docs/config/advanced">advanced</a>`)
+		case "/docs/config/advanced":
+			fmt.Fprint(w, `<a href="/docs/missing">missing</a>`)
+		case "/blog/2024/hello":
+			fmt.Fprint(w, `<a href="/blog?page=2">older</a>`)
+		case "/blog":
+			fmt.Fprint(w, `<a href="/blog/2024/hello">hello</a>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestRunTree(t *testing.T) {
+	httpTestServer := newNestedTestServer()
+	defer httpTestServer.Close()
+
+	siteMapOutBuf := &bytes.Buffer{}
+	c := crawler.Crawler{
+		SeedURL:       httpTestServer.URL,
+		IgnoreRobots:  true,
+		NumWorkers:    crawler.DefaultNumWorkers,
+		SiteMapWriter: siteMapOutBuf,
+		Format:        crawler.FormatTree,
+	}
+	assert.NoError(t, c.Run())
+	assertGolden(t, "tree.golden", httpTestServer.URL, siteMapOutBuf.String())
+}
+
+func TestRunHTML(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	t.Run("Report", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       serverURL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatHTML,
+		}
+		assert.NoError(t, c.Run())
+		report := siteMapOutBuf.String()
+		assert.Contains(t, report, "<dt>Pages</dt><dd>3</dd>")
+		assert.Contains(t, report, "<dt>Pages failed</dt><dd>1</dd>")
+		assert.Contains(t, report, `<th data-type="text">Title</th>`)
+		assert.Regexp(t, `<td><a href="`+serverURL+`/about">`+serverURL+`/about</a></td>
+<td class="number">200</td>
+<td class="number">1</td>
+<td>About page</td>
+<td class="number">1</td>
+<td class="number">4</td>
+<td class="number">\d*</td>`, report)
+		assert.Contains(t, report, `<tr class="failed"><td><a href="`+serverURL+`">`+serverURL+`</a></td><td>`+serverURL+`/help</td><td class="number">404</td></tr>`)
+		assert.Contains(t, report, `<tr><td>twitter.com</td><td class="number">1</td><td class="number">1</td></tr>`)
+		assert.Regexp(t, `<table id="slowest-pages">(?s:.*)<tr><td><a href="`+serverURL+`/careers">`+serverURL+`/careers</a></td><td class="number">200</td><td class="number">\d+</td><td class="number">\d+</td></tr>`, report)
+		assert.NotRegexp(t, `<(script|link)[^>]*(src|href)=`, report, "the report must be self-contained")
+	})
+
+	t.Run("Without titles", func(t *testing.T) {
+		httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `<a href="/about">about</a>`)
+		}))
+		defer httpTestServer.Close()
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Format:        crawler.FormatHTML,
+		}
+		assert.NoError(t, c.Run())
+		report := siteMapOutBuf.String()
+		assert.NotContains(t, report, "Title</th>")
+		assert.Contains(t, report, "<p>No broken links.</p>")
+		assert.Contains(t, report, "<p>No links to external domains.</p>")
+	})
+}
+
+// readGzip returns the decompressed content of the gzip file.
+func readGzip(t *testing.T, name string) string {
+	t.Helper()
+	f, err := os.Open(name)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	// reading up to the end checks the gzip trailer was written
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestRunCompressed(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+	dir, err := ioutil.TempDir("", "compressed")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("Inferred from the file name", func(t *testing.T) {
+		name := filepath.Join(dir, "sitemap.csv.gz")
+		c := crawler.Crawler{
+			SeedURL:           httpTestServer.URL,
+			IgnoreRobots:      true,
+			NumWorkers:        crawler.DefaultNumWorkers,
+			SiteMapOutputFile: name,
+			Format:            crawler.FormatCSV,
+		}
+		assert.NoError(t, c.Run())
+		assertGolden(t, "csv.golden", httpTestServer.URL, readGzip(t, name))
+	})
+
+	t.Run("Writer", func(t *testing.T) {
+		name := filepath.Join(dir, "sitemap.dot")
+		f, err := os.Create(name)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer f.Close()
+		c := crawler.Crawler{
+			SeedURL:         httpTestServer.URL,
+			IgnoreRobots:    true,
+			NumWorkers:      crawler.DefaultNumWorkers,
+			SiteMapWriter:   f,
+			Format:          crawler.FormatDOT,
+			DOTStatusColors: true,
+			Compress:        crawler.CompressGzip,
+		}
+		assert.NoError(t, c.Run())
+		assertGolden(t, "dot.golden", httpTestServer.URL, readGzip(t, name))
+	})
+
+	t.Run("Stopped", func(t *testing.T) {
+		name := filepath.Join(dir, "sitemap.ndjson.gz")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		c := crawler.Crawler{
+			SeedURL:           httpTestServer.URL,
+			IgnoreRobots:      true,
+			NumWorkers:        1,
+			SiteMapOutputFile: name,
+			Format:            crawler.FormatNDJSON,
+			ResponseHook: func(*http.Response) {
+				cancel()
+			},
+		}
+		assert.Equal(t, context.Canceled, c.RunContext(ctx))
+		assert.Contains(t, readGzip(t, name), `"url":"`+httpTestServer.URL+`"`)
+	})
+
+	t.Run("NDJSON compressed at once", func(t *testing.T) {
+		compressed := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: bufio.NewWriter(compressed),
+			Format:        crawler.FormatNDJSON,
+			Compress:      crawler.CompressGzip,
+		}
+		assert.NoError(t, c.Run())
+		r, err := gzip.NewReader(bytes.NewReader(compressed.Bytes()))
+		if !assert.NoError(t, err) {
+			return
+		}
+		lines, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Contains(t, string(lines), `"url":"`+httpTestServer.URL+`"`)
+		// flushing the gzip.Writer after every line would end a block per line
+		expected := &bytes.Buffer{}
+		gz := gzip.NewWriter(expected)
+		gz.Write(lines)
+		gz.Close()
+		assert.Equal(t, expected.Bytes(), compressed.Bytes())
+	})
+
+	t.Run("Split sitemap", func(t *testing.T) {
+		name := filepath.Join(dir, "sitemap.xml.gz")
+		c := crawler.Crawler{
+			SeedURL:           httpTestServer.URL,
+			IgnoreRobots:      true,
+			NumWorkers:        crawler.DefaultNumWorkers,
+			SiteMapOutputFile: name,
+			Format:            crawler.FormatXMLSitemap,
+			MaxSitemapURLs:    2,
+		}
+		assert.NoError(t, c.Run())
+		assert.Contains(t, readGzip(t, name), "/sitemap-1.xml.gz</loc>")
+		assert.Contains(t, readGzip(t, filepath.Join(dir, "sitemap-2.xml.gz")), "<urlset")
+	})
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// failAfterWriter fails the writes beyond its first n bytes.
+type failAfterWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *failAfterWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > w.n {
+		return 0, errors.New("disk full")
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestRunOutputs(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+
+	t.Run("Two sinks", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "outputs")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer os.RemoveAll(dir)
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Outputs: []crawler.OutputConfig{
+				{Format: crawler.FormatCSV, File: filepath.Join(dir, "sitemap.csv")},
+				{Format: crawler.FormatNDJSON, File: filepath.Join(dir, "sitemap.ndjson.gz")},
+			},
+		}
+		assert.NoError(t, c.Run())
+		assert.Contains(t, siteMapOutBuf.String(), httpTestServer.URL+" -> "+httpTestServer.URL+"/about\n")
+		output, err := ioutil.ReadFile(filepath.Join(dir, "sitemap.csv"))
+		assert.NoError(t, err)
+		assertGolden(t, "csv.golden", httpTestServer.URL, string(output))
+		lines := strings.Split(strings.TrimSpace(readGzip(t, filepath.Join(dir, "sitemap.ndjson.gz"))), "\n")
+		assert.Len(t, lines, 4)
+	})
+
+	t.Run("Failing sink", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Outputs:       []crawler.OutputConfig{{Format: crawler.FormatNDJSON, Writer: failingWriter{}}},
+		}
+		assert.EqualError(t, c.Run(), "disk full")
+		// the other sinks are still written
+		assert.Contains(t, siteMapOutBuf.String(), httpTestServer.URL+" -> "+httpTestServer.URL+"/about\n")
+	})
+
+	t.Run("Failing mid-crawl", func(t *testing.T) {
+		siteMapOut := &failAfterWriter{n: 100}
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOut,
+		}
+		assert.EqualError(t, c.Run(), "disk full")
+		assert.NotEmpty(t, siteMapOut.String())
+	})
+
+	t.Run("Buffered writer flushed", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		buffered := bufio.NewWriterSize(siteMapOutBuf, 64<<10)
+		c := crawler.Crawler{
+			SeedURL:       httpTestServer.URL,
+			IgnoreRobots:  true,
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: buffered,
+		}
+		assert.NoError(t, c.Run())
+		assert.Zero(t, buffered.Buffered())
+		assert.Contains(t, siteMapOutBuf.String(), httpTestServer.URL+" -> "+httpTestServer.URL+"/about\n")
+	})
+
+	t.Run("File failing when flushed", func(t *testing.T) {
+		if _, err := os.Stat("/dev/full"); err != nil {
+			t.Skip("no /dev/full")
+		}
+		// the site map fits in the buffer, so only the flush fails
+		c := crawler.Crawler{
+			SeedURL:           httpTestServer.URL,
+			IgnoreRobots:      true,
+			NumWorkers:        crawler.DefaultNumWorkers,
+			SiteMapOutputFile: "/dev/full",
+		}
+		err := c.Run()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "no space left on device")
+		}
+	})
+
+	t.Run("Ignored errors", func(t *testing.T) {
+		c := crawler.Crawler{
+			SeedURL:            httpTestServer.URL,
+			IgnoreRobots:       true,
+			NumWorkers:         crawler.DefaultNumWorkers,
+			SiteMapWriter:      ioutil.Discard,
+			Outputs:            []crawler.OutputConfig{{Format: crawler.FormatNDJSON, Writer: failingWriter{}}},
+			IgnoreOutputErrors: true,
+		}
+		assert.NoError(t, c.Run())
+	})
+}
+
+func TestRunDedupeEdges(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `<nav><a href="/docs#install">install</a></nav>
+<main><a href="/docs#config">config</a><a href="/docs">docs</a></main>
+<footer><a href="https://%s/docs">docs</a><a href="/about">about</a></footer>`, r.Host)
+		default:
+			fmt.Fprint(w, `no links`)
+		}
+	}))
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+	httpsURL := strings.Replace(serverURL, "http://", "https://", 1)
+
+	crawl := func(c *crawler.Crawler) []string {
+		siteMapOutBuf := &bytes.Buffer{}
+		c.SeedURL = serverURL
+		c.IgnoreRobots = true
+		c.NumWorkers = 1
+		c.SiteMapWriter = siteMapOutBuf
+		assert.NoError(t, c.Run())
+		return strings.Split(strings.TrimSpace(siteMapOutBuf.String()), "\n")
+	}
+
+	t.Run("Edge counts", func(t *testing.T) {
+		// the links differing only by fragment are the same URL
+		lines := crawl(&crawler.Crawler{EdgeCounts: true})
+		assert.Equal(t, []string{
+			serverURL + " -> " + serverURL + "/docs [3]",
+			serverURL + " -> " + httpsURL + "/docs [1]",
+			serverURL + " -> " + serverURL + "/about [1]",
+		}, lines)
+	})
+
+	t.Run("Deduped", func(t *testing.T) {
+		lines := crawl(&crawler.Crawler{DedupeEdges: true, EdgeCounts: true})
+		assert.Equal(t, []string{
+			serverURL + " -> " + serverURL + "/docs [4]",
+			serverURL + " -> " + serverURL + "/about [1]",
+		}, lines)
+	})
+
+	t.Run("Scheme sensitive", func(t *testing.T) {
+		lines := crawl(&crawler.Crawler{DedupeEdges: true, SchemeSensitive: true})
+		assert.Equal(t, []string{
+			serverURL + " -> " + serverURL + "/docs",
+			serverURL + " -> " + httpsURL + "/docs",
+			serverURL + " -> " + serverURL + "/about",
+		}, lines)
+	})
+}
@@ -0,0 +1,120 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RedirectChain is a page fetched after 2 or more redirects, each pointing
+// at a URL that redirects again, or a page whose redirects loop.
+type RedirectChain struct {
+	URL         string     // URL of the page
+	Redirects   []Redirect // redirects followed, in order
+	FinalURL    string     // URL the chain ends at or, for a loop, the URL redirected to again
+	FinalStatus int        // status code of FinalURL. Zero for a loop.
+	Loop        bool
+}
+
+// redirectChains holds the redirect chains recorded with RecordRedirects.
+// A nil *redirectChains records nothing.
+type redirectChains struct {
+	mu     sync.Mutex
+	chains []RedirectChain
+}
+
+func (r *redirectChains) add(chain RedirectChain) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.chains = append(r.chains, chain)
+}
+
+// recordRedirects counts the redirects followed to fetch the site, in
+// Stats, and records them if they are a chain.
+func (c *Crawler) recordRedirects(s webSite, response *FetchResult) {
+	switch len(response.Redirects) {
+	case 0:
+		return
+	case 1:
+		c.statsMu.Lock()
+		c.stats.SingleRedirects++
+		c.statsMu.Unlock()
+		return
+	}
+	c.statsMu.Lock()
+	c.stats.RedirectChains++
+	c.statsMu.Unlock()
+	c.redirectChains.add(RedirectChain{
+		URL:         s.URL.String(),
+		Redirects:   response.Redirects,
+		FinalURL:    response.URL.String(),
+		FinalStatus: response.StatusCode,
+	})
+}
+
+// recordRedirectLoop counts and records the redirect loop the fetch of the
+// site failed with, if it did.
+func (c *Crawler) recordRedirectLoop(s webSite, err error) {
+	var loopErr *RedirectLoopError
+	if !errors.As(err, &loopErr) {
+		return
+	}
+	c.statsMu.Lock()
+	c.stats.RedirectLoops++
+	c.statsMu.Unlock()
+	c.redirectChains.add(RedirectChain{
+		URL:       s.URL.String(),
+		Redirects: loopErr.Redirects,
+		FinalURL:  loopErr.URL,
+		Loop:      true,
+	})
+}
+
+// RedirectChains returns the pages fetched after 2 or more redirects and
+// the redirect loops, sorted by URL. They are only recorded if
+// RecordRedirects is set.
+func (c *Crawler) RedirectChains() []RedirectChain {
+	r := c.redirectChains
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	chains := make([]RedirectChain, len(r.chains))
+	for i, chain := range r.chains {
+		chain.Redirects = append([]Redirect(nil), chain.Redirects...)
+		chains[i] = chain
+	}
+	sort.Slice(chains, func(i, j int) bool {
+		return chains[i].URL < chains[j].URL
+	})
+	return chains
+}
+
+// WriteRedirectsReport writes the redirect chains (see RedirectChains) as
+// tab separated lines: "chain" or "loop", URL, number of redirects, final
+// status and the hops, e.g. "/old (301) -> /older (302) -> /new".
+func (c *Crawler) WriteRedirectsReport(w io.Writer) error {
+	for _, chain := range c.RedirectChains() {
+		kind := "chain"
+		if chain.Loop {
+			kind = "loop"
+		}
+		hops := make([]string, 0, len(chain.Redirects)+1)
+		for _, redirect := range chain.Redirects {
+			hops = append(hops, fmt.Sprintf("%s (%d)", redirect.URL, redirect.Status))
+		}
+		hops = append(hops, chain.FinalURL)
+		_, err := fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", kind, chain.URL, len(chain.Redirects), formatStatus(chain.FinalStatus), strings.Join(hops, " -> "))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package crawler_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/scanterog/crawler/crawler"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRedirectsTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<a href="/old">old</a><a href="/moved">moved</a><a href="/ping">ping</a>`)
+	})
+	// a two-hop chain
+	mux.Handle("/old", http.RedirectHandler("/older", http.StatusMovedPermanently))
+	mux.Handle("/older", http.RedirectHandler("/new", http.StatusFound))
+	mux.HandleFunc("/new", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><head><title>New page</title></head><body><a href="/">home</a></body></html>`)
+	})
+	// a single hop
+	mux.Handle("/moved", http.RedirectHandler("/new", http.StatusMovedPermanently))
+	// a loop
+	mux.Handle("/ping", http.RedirectHandler("/pong", http.StatusFound))
+	mux.Handle("/pong", http.RedirectHandler("/ping", http.StatusFound))
+	return httptest.NewServer(mux)
+}
+
+func TestRunRecordRedirects(t *testing.T) {
+	httpTestServer := newRedirectsTestServer()
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+
+	c := crawler.Crawler{
+		SeedURL:         serverURL,
+		IgnoreRobots:    true,
+		NumWorkers:      crawler.DefaultNumWorkers,
+		SiteMapWriter:   &bytes.Buffer{},
+		RecordRedirects: true,
+	}
+	assert.NoError(t, c.Run())
+	assert.Equal(t, []crawler.RedirectChain{{
+		URL: serverURL + "/old",
+		Redirects: []crawler.Redirect{
+			{URL: serverURL + "/old", Status: http.StatusMovedPermanently},
+			{URL: serverURL + "/older", Status: http.StatusFound},
+		},
+		FinalURL:    serverURL + "/new",
+		FinalStatus: http.StatusOK,
+	}, {
+		URL: serverURL + "/ping",
+		Redirects: []crawler.Redirect{
+			{URL: serverURL + "/ping", Status: http.StatusFound},
+			{URL: serverURL + "/pong", Status: http.StatusFound},
+		},
+		FinalURL: serverURL + "/ping",
+		Loop:     true,
+	}}, c.RedirectChains())
+
+	stats := c.Stats()
+	assert.Equal(t, 1, stats.SingleRedirects)
+	assert.Equal(t, 1, stats.RedirectChains)
+	assert.Equal(t, 1, stats.RedirectLoops)
+	assert.Contains(t, stats.String(), "single-hop redirects: 1\n")
+
+	report := &bytes.Buffer{}
+	assert.NoError(t, c.WriteRedirectsReport(report))
+	assert.Equal(t, fmt.Sprintf(`chain	%[1]s/old	2	200	%[1]s/old (301) -> %[1]s/older (302) -> %[1]s/new
+loop	%[1]s/ping	2		%[1]s/ping (302) -> %[1]s/pong (302) -> %[1]s/ping
+`, serverURL), report.String())
+}
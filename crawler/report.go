@@ -0,0 +1,127 @@
+package crawler
+
+import (
+	_ "embed" // for the template of the report
+	"html/template"
+	"io"
+	"sort"
+	"time"
+)
+
+//go:embed templates/report.html.tmpl
+var reportTemplateText string
+
+// reportTemplate renders FormatHTML. The CSS and JavaScript are embedded in
+// it, so the report is a single file without external dependencies.
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"status": formatStatus,
+	"ms": func(d time.Duration) int64 {
+		return int64(d / time.Millisecond)
+	},
+}).Parse(reportTemplateText))
+
+// reportPage is a row of the table of pages of FormatHTML.
+type reportPage struct {
+	URL      string
+	Status   int
+	Depth    int
+	Title    string
+	Inbound  int // pages linking to it
+	Outbound int // links of the page, without assets
+	Latency  time.Duration
+}
+
+// reportBrokenLink is a link to a page failed with a 4xx or 5xx status.
+type reportBrokenLink struct {
+	Source string
+	Target string
+	Status int
+}
+
+// reportExternalDomain is a row of the external domains of FormatHTML.
+type reportExternalDomain struct {
+	Domain string
+	ExternalLinks
+}
+
+// report is the data of reportTemplate.
+type report struct {
+	Seeds           []string
+	Started         time.Time
+	Finished        time.Time
+	Stats           Stats
+	Links           int
+	Pages           []reportPage // sorted by URL
+	BrokenLinks     []reportBrokenLink
+	ExternalDomains []reportExternalDomain // the most linked first
+	// HasTitles and HasLatencies report whether any page has a title or a
+	// latency, the columns being left out otherwise.
+	HasTitles    bool
+	HasLatencies bool
+}
+
+// htmlOutput keeps the pages and their links until the end of the crawl,
+// when the status of the targets is known and the report is written.
+type htmlOutput struct {
+	crawler *Crawler
+	w       io.Writer
+	pages   []reportPage
+	links   [][2]string // internal links, source and target, in the order found
+}
+
+func (o *htmlOutput) write(r PageResult) error {
+	source := r.URL
+	page := reportPage{
+		URL:     source,
+		Status:  r.StatusCode,
+		Depth:   r.Depth,
+		Title:   r.Metadata.Title,
+		Latency: r.Duration,
+	}
+	for _, edge := range r.Links {
+		if edge.Asset {
+			continue
+		}
+		page.Outbound++
+		if !edge.External {
+			o.links = append(o.links, [2]string{source, edge.URL})
+		}
+	}
+	o.pages = append(o.pages, page)
+	return nil
+}
+
+func (o *htmlOutput) close() error {
+	c := o.crawler
+	codes := c.StatusCodes()
+	inbound := c.InboundLinks()
+	stats := c.Stats()
+	data := report{
+		Seeds:    c.seedURLs(),
+		Started:  c.started,
+		Finished: time.Now(),
+		Stats:    stats,
+		Pages:    o.pages,
+	}
+	for i, page := range data.Pages {
+		data.Pages[i].Inbound = inbound[page.URL]
+		data.Links += page.Outbound
+		data.HasTitles = data.HasTitles || page.Title != ""
+		data.HasLatencies = data.HasLatencies || page.Latency > 0
+	}
+	sort.Slice(data.Pages, func(i, j int) bool {
+		return data.Pages[i].URL < data.Pages[j].URL
+	})
+	for _, link := range o.links {
+		if code := codes[link[1]]; code >= 400 {
+			data.BrokenLinks = append(data.BrokenLinks, reportBrokenLink{Source: link[0], Target: link[1], Status: code})
+		}
+	}
+	sort.SliceStable(data.BrokenLinks, func(i, j int) bool {
+		return data.BrokenLinks[i].Source < data.BrokenLinks[j].Source
+	})
+	for _, domain := range stats.externalDomainsByPages() {
+		data.ExternalDomains = append(data.ExternalDomains, reportExternalDomain{Domain: domain, ExternalLinks: stats.ExternalDomains[domain]})
+	}
+	return reportTemplate.Execute(o.w, data)
+}
@@ -0,0 +1,274 @@
+package crawler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRobotsSize is the max number of bytes of a robots.txt file parsed.
+// The rest of the file is ignored.
+const maxRobotsSize = 500 * 1024
+
+// maxDurationSeconds is the number of seconds of the longest Duration.
+const maxDurationSeconds = float64(math.MaxInt64) / float64(time.Second)
+
+// robotsRules holds the robots.txt rules applying to our user agent.
+type robotsRules struct {
+	rules      []robotsRule
+	crawlDelay time.Duration // from the Crawl-delay directive. Zero if missing.
+}
+
+type robotsRule struct {
+	pattern string
+	re      *regexp.Regexp
+	allow   bool
+}
+
+// robotsGroup is a set of rules shared by one or more user agents.
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// robotsAgent returns the product token of a User-Agent header value,
+// e.g. "crawlerbot" for "CrawlerBot/0.1", used to match robots.txt groups.
+func robotsAgent(userAgent string) string {
+	token := strings.SplitN(userAgent, "/", 2)[0]
+	return strings.ToLower(strings.TrimSpace(token))
+}
+
+// parseRobots parses a robots.txt file and returns the rules of the group
+// matching agent, falling back to the "*" group. Unknown directives and
+// malformed lines are ignored: comments, a missing colon between the
+// directive and its value, a BOM and CRLF line endings are tolerated.
+func parseRobots(r io.Reader, agent string) (*robotsRules, error) {
+	var groups []*robotsGroup
+	var group *robotsGroup
+	scanner := bufio.NewScanner(io.LimitReader(r, maxRobotsSize))
+	first := true
+	for scanner.Scan() {
+		line := scanner.Text()
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+		}
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		directive, value, ok := splitRobotsLine(line)
+		if !ok {
+			continue
+		}
+		switch directive {
+		case "user-agent":
+			// consecutive user-agent lines share the rules that follow them
+			if group == nil || len(group.rules) > 0 || group.crawlDelay > 0 {
+				group = &robotsGroup{}
+				groups = append(groups, group)
+			}
+			group.agents = append(group.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			if group == nil || value == "" {
+				// an empty disallow allows everything
+				continue
+			}
+			rule, err := newRobotsRule(value, directive == "allow")
+			if err != nil {
+				continue
+			}
+			group.rules = append(group.rules, rule)
+		case "crawl-delay":
+			if group == nil {
+				continue
+			}
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds < 0 {
+				log.Warnf("Ignoring invalid robots.txt Crawl-delay %q", value)
+				continue
+			}
+			// the delays overflowing a Duration are capped in seconds, before
+			// converting them, and clamped to MaxCrawlDelay by applyCrawlDelay
+			if seconds >= maxDurationSeconds {
+				group.crawlDelay = math.MaxInt64
+				continue
+			}
+			group.crawlDelay = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read robots.txt: %q", err.Error())
+	}
+	return matchingRules(groups, agent), nil
+}
+
+// splitRobotsLine splits a robots.txt line into its lower case directive
+// and its value. The colon is optional.
+func splitRobotsLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexAny(line, ": \t")
+	if i < 0 {
+		return "", "", false
+	}
+	directive := strings.ToLower(strings.TrimSpace(line[:i]))
+	value := strings.TrimSpace(line[i+1:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, ":"))
+	return directive, value, true
+}
+
+// matchingRules merges the groups naming agent or, if there are none, the
+// "*" groups. The longest Crawl-delay is kept.
+func matchingRules(groups []*robotsGroup, agent string) *robotsRules {
+	rules, wildcardRules := &robotsRules{}, &robotsRules{}
+	matched := false
+	for _, g := range groups {
+		for _, a := range g.agents {
+			switch a {
+			case agent:
+				rules.add(g)
+				matched = true
+			case "*":
+				wildcardRules.add(g)
+			}
+		}
+	}
+	if !matched {
+		return wildcardRules
+	}
+	return rules
+}
+
+func (r *robotsRules) add(g *robotsGroup) {
+	r.rules = append(r.rules, g.rules...)
+	if g.crawlDelay > r.crawlDelay {
+		r.crawlDelay = g.crawlDelay
+	}
+}
+
+// newRobotsRule compiles a path pattern where "*" matches any sequence of
+// characters and a trailing "$" anchors the end of the path.
+func newRobotsRule(pattern string, allow bool) (robotsRule, error) {
+	expr := strings.TrimSuffix(pattern, "$")
+	parts := strings.Split(expr, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	expr = "^" + strings.Join(parts, ".*")
+	if strings.HasSuffix(pattern, "$") {
+		expr += "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return robotsRule{}, err
+	}
+	return robotsRule{pattern: pattern, re: re, allow: allow}, nil
+}
+
+// allowed reports whether the URL can be crawled. The most specific
+// (longest) matching rule wins and, on a tie, allow rules win.
+func (r *robotsRules) allowed(u *url.URL) bool {
+	if r == nil {
+		return true
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	allowed := true
+	longest := -1
+	for _, rule := range r.rules {
+		if !rule.re.MatchString(path) {
+			continue
+		}
+		if len(rule.pattern) > longest || (len(rule.pattern) == longest && rule.allow) {
+			longest = len(rule.pattern)
+			allowed = rule.allow
+		}
+	}
+	return allowed
+}
+
+// hostRobots returns the robots.txt rules of the host of the given URL. They
+// are fetched and their Crawl-delay applied the first time the host is
+// seen, so the hosts only found during the crawl, e.g. the subdomains
+// admitted with IncludeSubdomains, are checked too. It's called by the
+// workers, never by the dispatcher, as the fetch may take long: the callers
+// asking for the rules of a host being fetched wait for them.
+func (c *Crawler) hostRobots(u *url.URL) *robotsRules {
+	c.robotsMu.Lock()
+	for {
+		if rules, ok := c.robots[u.Host]; ok {
+			c.robotsMu.Unlock()
+			return rules
+		}
+		fetching, ok := c.robotsFetching[u.Host]
+		if !ok {
+			break
+		}
+		c.robotsMu.Unlock()
+		<-fetching
+		c.robotsMu.Lock()
+	}
+	fetching := make(chan bool)
+	c.robotsFetching[u.Host] = fetching
+	c.robotsMu.Unlock()
+
+	rules := c.fetchRobots(u)
+	c.robotsMu.Lock()
+	c.robots[u.Host] = rules
+	delete(c.robotsFetching, u.Host)
+	c.robotsMu.Unlock()
+	c.applyCrawlDelay(u.Host)
+	c.recordDelay(u.Host, c.delay(u.Host))
+	// the waiting callers fetch the host with its Crawl-delay
+	close(fetching)
+	return rules
+}
+
+// cachedRobots returns the robots.txt rules of host if they were fetched,
+// nil otherwise.
+func (c *Crawler) cachedRobots(host string) *robotsRules {
+	c.robotsMu.RLock()
+	defer c.robotsMu.RUnlock()
+	return c.robots[host]
+}
+
+// fetchRobots fetches and parses the robots.txt file of the host of the
+// given URL. Missing or unreachable files allow everything.
+func (c *Crawler) fetchRobots(u *url.URL) *robotsRules {
+	robotsURL := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/robots.txt"}
+	response, err := c.fetch(robotsURL)
+	if err != nil {
+		log.Warnf("Can't fetch %q, allowing everything: %s", robotsURL, err.Error())
+		return nil
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode >= http.StatusInternalServerError:
+		log.Warnf("Can't fetch %q, allowing everything: %s", robotsURL, response.status())
+		return nil
+	case response.StatusCode >= http.StatusBadRequest:
+		log.Debugf("No robots.txt at %q (%s): allowing everything", robotsURL, response.status())
+		return nil
+	}
+	rules, err := parseRobots(response.Body, robotsAgent(DefaultCrawlerUserAgent))
+	if err != nil {
+		log.Warnf("Can't parse %q, allowing everything: %s", robotsURL, err.Error())
+		return nil
+	}
+	return rules
+}
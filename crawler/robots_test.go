@@ -0,0 +1,161 @@
+package crawler
+
+import (
+	"math"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRobotsAgent(t *testing.T) {
+	assert.Equal(t, "crawlerbot", robotsAgent("CrawlerBot/0.1"))
+	assert.Equal(t, "crawlerbot", robotsAgent("CrawlerBot"))
+}
+
+func TestParseRobots(t *testing.T) {
+	allowed := func(rules *robotsRules, path string) bool {
+		u, _ := url.Parse("https://example.com" + path)
+		return rules.allowed(u)
+	}
+
+	t.Run("Agent group takes precedence over the wildcard one", func(t *testing.T) {
+		rules, err := parseRobots(strings.NewReader(`
+User-agent: *
+Disallow: /
+
+User-agent: OtherBot
+User-agent: CrawlerBot
+Disallow: /private
+Allow: /private/public
+`), "crawlerbot")
+		assert.NoError(t, err)
+		assert.True(t, allowed(rules, "/"))
+		assert.False(t, allowed(rules, "/private"))
+		assert.False(t, allowed(rules, "/private/secret"))
+		assert.True(t, allowed(rules, "/private/public/page"))
+	})
+
+	t.Run("Wildcard group used by default", func(t *testing.T) {
+		rules, err := parseRobots(strings.NewReader("User-agent: OtherBot\nDisallow: /\n\nUser-agent: *\nDisallow: /admin\n"), "crawlerbot")
+		assert.NoError(t, err)
+		assert.True(t, allowed(rules, "/"))
+		assert.False(t, allowed(rules, "/admin/users"))
+	})
+
+	t.Run("No matching group allows everything", func(t *testing.T) {
+		rules, err := parseRobots(strings.NewReader("User-agent: OtherBot\nDisallow: /\n"), "crawlerbot")
+		assert.NoError(t, err)
+		assert.True(t, allowed(rules, "/"))
+	})
+
+	t.Run("Empty disallow allows everything", func(t *testing.T) {
+		rules, err := parseRobots(strings.NewReader("User-agent: *\nDisallow:\n"), "crawlerbot")
+		assert.NoError(t, err)
+		assert.True(t, allowed(rules, "/anything"))
+	})
+
+	t.Run("Wildcards and end anchors", func(t *testing.T) {
+		rules, err := parseRobots(strings.NewReader("User-agent: *\nDisallow: /*.pdf$\nDisallow: /*?session=\n"), "crawlerbot")
+		assert.NoError(t, err)
+		assert.False(t, allowed(rules, "/docs/manual.pdf"))
+		assert.True(t, allowed(rules, "/docs/manual.pdf.html"))
+		assert.False(t, allowed(rules, "/list?session=1"))
+		assert.True(t, allowed(rules, "/list?page=1"))
+	})
+
+	t.Run("Longest match wins and allow wins ties", func(t *testing.T) {
+		rules, err := parseRobots(strings.NewReader("User-agent: *\nAllow: /shop\nDisallow: /shop/cart\nDisallow: /blog\nAllow: /blog\n"), "crawlerbot")
+		assert.NoError(t, err)
+		assert.True(t, allowed(rules, "/shop/items"))
+		assert.False(t, allowed(rules, "/shop/cart"))
+		assert.True(t, allowed(rules, "/blog/post"))
+	})
+
+	t.Run("Messy syntax tolerated", func(t *testing.T) {
+		robots := "\ufeffUSER-AGENT: crawlerbot # our bot\r\n" +
+			"# a comment line\r\n" +
+			"Disallow /no-colon\r\n" +
+			"   disallow:/indented   \r\n" +
+			"Crawl-delay: 10\r\n" +
+			"garbage\r\n" +
+			"Sitemap: https://example.com/sitemap.xml\r\n"
+		rules, err := parseRobots(strings.NewReader(robots), "crawlerbot")
+		assert.NoError(t, err)
+		assert.False(t, allowed(rules, "/no-colon"))
+		assert.False(t, allowed(rules, "/indented"))
+		assert.True(t, allowed(rules, "/other"))
+	})
+
+	t.Run("Nil rules allow everything", func(t *testing.T) {
+		var rules *robotsRules
+		assert.True(t, allowed(rules, "/"))
+	})
+}
+
+func TestParseRobotsCrawlDelay(t *testing.T) {
+	t.Run("Crawl-delay of the matching group", func(t *testing.T) {
+		rules, err := parseRobots(strings.NewReader("User-agent: *\nCrawl-delay: 5\n\nUser-agent: CrawlerBot\nCrawl-delay: 0.5\nDisallow: /private\n"), "crawlerbot")
+		assert.NoError(t, err)
+		assert.Equal(t, 500*time.Millisecond, rules.crawlDelay)
+		assert.Len(t, rules.rules, 1)
+	})
+
+	t.Run("Invalid Crawl-delay ignored", func(t *testing.T) {
+		rules, err := parseRobots(strings.NewReader("User-agent: *\nCrawl-delay: soon\nCrawl-delay: -1\n"+
+			"Crawl-delay: NaN\nCrawl-delay: Inf\nCrawl-delay: -Inf\nCrawl-delay: 1e400\n"), "crawlerbot")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), rules.crawlDelay)
+	})
+
+	t.Run("Crawl-delay overflowing a Duration", func(t *testing.T) {
+		rules, err := parseRobots(strings.NewReader("User-agent: *\nCrawl-delay: 1e300\n"), "crawlerbot")
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(math.MaxInt64), rules.crawlDelay)
+	})
+}
+
+func TestApplyCrawlDelay(t *testing.T) {
+	newCrawler := func(delay, crawlDelay time.Duration) *Crawler {
+		return &Crawler{
+			Delay:         delay,
+			MaxCrawlDelay: DefaultMaxCrawlDelay,
+			robots:        map[string]*robotsRules{"example.com": {crawlDelay: crawlDelay}},
+			hostDelays:    map[string]time.Duration{},
+		}
+	}
+
+	t.Run("Longer Crawl-delay used", func(t *testing.T) {
+		c := newCrawler(time.Second, 2*time.Second)
+		c.applyCrawlDelay("example.com")
+		assert.Equal(t, 2*time.Second, c.delay("example.com"))
+		assert.Equal(t, time.Second, c.delay("other.example.com"))
+	})
+
+	t.Run("Shorter Crawl-delay ignored", func(t *testing.T) {
+		c := newCrawler(time.Second, 500*time.Millisecond)
+		c.applyCrawlDelay("example.com")
+		assert.Equal(t, time.Second, c.delay("example.com"))
+	})
+
+	t.Run("Crawl-delay overridden", func(t *testing.T) {
+		c := newCrawler(time.Second, 2*time.Second)
+		c.OverrideCrawlDelay = true
+		c.applyCrawlDelay("example.com")
+		assert.Equal(t, time.Second, c.delay("example.com"))
+	})
+
+	t.Run("Absurd Crawl-delay clamped", func(t *testing.T) {
+		c := newCrawler(0, 24*time.Hour)
+		c.applyCrawlDelay("example.com")
+		assert.Equal(t, DefaultMaxCrawlDelay, c.delay("example.com"))
+	})
+
+	t.Run("Crawl-delay overflowing a Duration clamped", func(t *testing.T) {
+		c := newCrawler(0, math.MaxInt64)
+		c.applyCrawlDelay("example.com")
+		assert.Equal(t, DefaultMaxCrawlDelay, c.delay("example.com"))
+	})
+}
@@ -0,0 +1,47 @@
+package crawler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxSeedLineSize is the max length of a line of a seeds file.
+const maxSeedLineSize = 1024 * 1024
+
+// ReadSeeds reads seed URLs, one per line, to be used as SeedURLs.
+// Blank lines and lines starting with "#" are ignored, as well as
+// duplicated URLs. Every invalid line is reported in the returned error.
+// Lines are streamed, so only the distinct seeds are kept in memory.
+func ReadSeeds(r io.Reader) ([]string, error) {
+	var seeds, invalid []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSeedLineSize)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := strToAbsoluteURL(line)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("line %d %q: %s", lineNum, line, err.Error()))
+			continue
+		}
+		if seen[u.String()] {
+			continue
+		}
+		seen[u.String()] = true
+		seeds = append(seeds, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read seeds: %q", err.Error())
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("invalid seed URLs:\n%s", strings.Join(invalid, "\n"))
+	}
+	return seeds, nil
+}
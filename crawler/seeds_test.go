@@ -0,0 +1,40 @@
+package crawler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSeeds(t *testing.T) {
+	t.Run("Valid and duplicated URLs", func(t *testing.T) {
+		seeds, err := ReadSeeds(strings.NewReader(`# sections
+https://example.com/docs
+
+  https://example.com/blog  
+https://example.com/docs
+https://example.com/blog#top
+`))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"https://example.com/docs", "https://example.com/blog"}, seeds)
+	})
+
+	t.Run("Every invalid line reported", func(t *testing.T) {
+		_, err := ReadSeeds(strings.NewReader(`https://example.com/docs
+/relative
+https://example.com/docs
+ftp://example.com/files
+`))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `line 2 "/relative"`)
+		assert.Contains(t, err.Error(), `line 4 "ftp://example.com/files"`)
+		assert.NotContains(t, err.Error(), "line 1")
+		assert.NotContains(t, err.Error(), "line 3")
+	})
+
+	t.Run("Too long line", func(t *testing.T) {
+		_, err := ReadSeeds(strings.NewReader("https://example.com/" + strings.Repeat("a", maxSeedLineSize)))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,41 @@
+package crawler
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// SameSite reports whether both hosts belong to the same registrable
+// domain (eTLD+1), according to the public suffix list. For example
+// "uk.wikipedia.org" and "wikipedia.org" are the same site while
+// "example.co.uk" and "another.co.uk", or "alice.github.io" and
+// "bob.github.io", are not. Ports are ignored. Hosts without a
+// registrable domain (IP addresses, localhost) must match exactly.
+func SameSite(hostA, hostB string) bool {
+	domainA, errA := RegistrableDomain(hostA)
+	domainB, errB := RegistrableDomain(hostB)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(stripPort(hostA), stripPort(hostB))
+	}
+	return domainA == domainB
+}
+
+// RegistrableDomain returns the registrable domain (eTLD+1) of the given
+// host, e.g. "example.co.uk" for "www.example.co.uk:8080".
+func RegistrableDomain(host string) (string, error) {
+	host = strings.ToLower(stripPort(host))
+	if net.ParseIP(host) != nil {
+		return "", ErrInvalidURL
+	}
+	return publicsuffix.EffectiveTLDPlusOne(host)
+}
+
+// stripPort removes the port, if any, from the given host.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
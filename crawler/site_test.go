@@ -0,0 +1,44 @@
+package crawler_test
+
+import (
+	"testing"
+
+	"github.com/scanterog/crawler/crawler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSameSite(t *testing.T) {
+	tests := []struct {
+		hostA, hostB string
+		same         bool
+	}{
+		{"example.com", "example.com", true},
+		{"www.example.com", "example.com", true},
+		{"uk.wikipedia.org", "en.wikipedia.org", true},
+		{"example.com:8080", "blog.example.com", true},
+		{"example.com", "example.org", false},
+		{"example.co.uk", "another.co.uk", false},
+		{"www.example.co.uk", "shop.example.co.uk", true},
+		{"alice.github.io", "bob.github.io", false},
+		{"alice.github.io", "docs.alice.github.io", true},
+		{"127.0.0.1:8080", "127.0.0.1:8080", true},
+		{"127.0.0.1:8080", "127.0.0.2:8080", false},
+		{"localhost", "localhost:80", true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.same, crawler.SameSite(test.hostA, test.hostB), "%s vs %s", test.hostA, test.hostB)
+	}
+}
+
+func TestRegistrableDomain(t *testing.T) {
+	domain, err := crawler.RegistrableDomain("www.Example.co.uk:443")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.co.uk", domain)
+
+	domain, err = crawler.RegistrableDomain("alice.github.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice.github.io", domain)
+
+	_, err = crawler.RegistrableDomain("127.0.0.1")
+	assert.Error(t, err)
+}
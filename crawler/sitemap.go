@@ -0,0 +1,162 @@
+package crawler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits applied when reading the sitemap.xml of a site to avoid abuse.
+const (
+	maxSitemapSize  = 50 * 1024 * 1024 // uncompressed bytes read from each sitemap file
+	maxSitemapDepth = 3                // nesting levels of sitemap index files followed
+	maxSitemapFiles = 100              // sitemap files fetched, including index files
+	maxSitemapURLs  = 50000            // page URLs taken from all the sitemap files
+)
+
+// sitemapFile holds either a sitemap (urlset) or a sitemap index.
+type sitemapFile struct {
+	XMLName  xml.Name
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// parseSitemap parses a sitemap or a sitemap index, which may be gzip
+// compressed.
+func parseSitemap(r io.Reader) (sitemapFile, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return sitemapFile{}, fmt.Errorf("invalid gzip sitemap: %q", err.Error())
+		}
+		defer gr.Close()
+		r = gr
+	} else {
+		r = br
+	}
+	var sitemap sitemapFile
+	if err := xml.NewDecoder(io.LimitReader(r, maxSitemapSize)).Decode(&sitemap); err != nil {
+		return sitemapFile{}, fmt.Errorf("invalid sitemap: %q", err.Error())
+	}
+	return sitemap, nil
+}
+
+// sitemapSites returns the pages listed in the /sitemap.xml of the seed
+// host, following sitemap index files. Pages on other sites are ignored.
+func (c *Crawler) sitemapSites(seedURL *url.URL) []webSite {
+	sitemapURL := &url.URL{Scheme: seedURL.Scheme, Host: seedURL.Host, Path: "/sitemap.xml"}
+	reader := &sitemapReader{crawler: c, seedURL: seedURL, fetched: map[string]bool{}}
+	reader.read(sitemapURL, 0)
+	log.Debugf("Found %d pages in %d sitemap files", len(reader.sites), len(reader.fetched))
+	return reader.sites
+}
+
+type sitemapReader struct {
+	crawler *Crawler
+	seedURL *url.URL
+	fetched map[string]bool // sitemap files already fetched
+	sites   []webSite
+}
+
+func (r *sitemapReader) read(sitemapURL *url.URL, depth int) {
+	if r.fetched[sitemapURL.String()] || len(r.fetched) >= maxSitemapFiles {
+		return
+	}
+	r.fetched[sitemapURL.String()] = true
+	sitemap, err := r.crawler.fetchSitemap(sitemapURL)
+	if err != nil {
+		log.Warnf("Can't read sitemap %q: %s", sitemapURL.String(), err.Error())
+		return
+	}
+	r.add(sitemapURL, sitemap, depth)
+}
+
+// add adds the pages of the sitemap, reading the sitemaps of an index.
+func (r *sitemapReader) add(sitemapURL *url.URL, sitemap sitemapFile, depth int) {
+	for _, entry := range sitemap.URLs {
+		if len(r.sites) >= maxSitemapURLs {
+			log.Warnf("Ignoring the pages of sitemap %q beyond %d", sitemapURL.String(), maxSitemapURLs)
+			break
+		}
+		u, err := r.crawler.normalizer.parseAbsolute(entry.Loc)
+		if err != nil || r.crawler.isExternal(webSite{URL: u, Parent: r.seedURL}) {
+			log.Debugf("Ignoring sitemap entry %q", entry.Loc)
+			continue
+		}
+		r.sites = append(r.sites, webSite{URL: u, sitemap: sitemapURL})
+	}
+	for _, entry := range sitemap.Sitemaps {
+		if depth >= maxSitemapDepth {
+			log.Warnf("Ignoring sitemap %q: index files nested too deep", entry.Loc)
+			continue
+		}
+		u, err := strToAbsoluteURL(entry.Loc)
+		if err != nil || u.Host != sitemapURL.Host {
+			log.Debugf("Ignoring sitemap %q", entry.Loc)
+			continue
+		}
+		r.read(u, depth+1)
+	}
+}
+
+// isSitemapResponse reports whether the response of a page may be a XML
+// sitemap rather than HTML, e.g. a sitemap.xml linked from a page or given
+// as seed: XML or gzip content or a .xml.gz file.
+func isSitemapResponse(response *FetchResult) bool {
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/xml", "text/xml", "application/gzip", "application/x-gzip":
+		return true
+	}
+	return strings.HasSuffix(strings.ToLower(response.URL.Path), ".xml.gz")
+}
+
+// sitemapResult returns the result of a sitemap crawled as a page, holding
+// the pages on its host as children. The sitemaps of an index are fetched
+// like the ones of UseSitemap. Other XML documents have no children.
+func (c *Crawler) sitemapResult(s webSite, body io.Reader) (PageResult, error) {
+	r := PageResult{site: s}
+	sitemap, err := parseSitemap(body)
+	if err != nil {
+		return PageResult{}, err
+	}
+	if sitemap.XMLName.Local != "urlset" && sitemap.XMLName.Local != "sitemapindex" {
+		log.Debugf("Ignoring XML document %q: not a sitemap", s.URL.String())
+		return r, nil
+	}
+	reader := &sitemapReader{crawler: c, seedURL: s.URL, fetched: map[string]bool{s.URL.String(): true}}
+	reader.add(s.URL, sitemap, 0)
+	seen := map[string]bool{}
+	for _, site := range reader.sites {
+		if !seen[site.URL.String()] {
+			seen[site.URL.String()] = true
+			r.children = append(r.children, &webSite{URL: site.URL, Parent: s.URL, Depth: s.Depth + 1})
+		}
+	}
+	return r, nil
+}
+
+func (c *Crawler) fetchSitemap(u *url.URL) (sitemapFile, error) {
+	response, err := c.fetch(u)
+	if err != nil {
+		return sitemapFile{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		return sitemapFile{}, fmt.Errorf("%v", response.status())
+	}
+	return parseSitemap(response.Body)
+}
@@ -0,0 +1,50 @@
+package crawler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSitemap(t *testing.T) {
+	urlset := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/</loc><lastmod>2020-01-01</lastmod></url>
+  <url><loc>https://example.com/orphan</loc></url>
+</urlset>`
+
+	t.Run("Sitemap", func(t *testing.T) {
+		sitemap, err := parseSitemap(strings.NewReader(urlset))
+		assert.NoError(t, err)
+		assert.Equal(t, []sitemapLoc{{Loc: "https://example.com/"}, {Loc: "https://example.com/orphan"}}, sitemap.URLs)
+		assert.Empty(t, sitemap.Sitemaps)
+	})
+
+	t.Run("Sitemap index", func(t *testing.T) {
+		sitemap, err := parseSitemap(strings.NewReader(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>https://example.com/sitemap1.xml</loc></sitemap>
+  <sitemap><loc>https://example.com/sitemap2.xml.gz</loc></sitemap>
+</sitemapindex>`))
+		assert.NoError(t, err)
+		assert.Empty(t, sitemap.URLs)
+		assert.Equal(t, []sitemapLoc{{Loc: "https://example.com/sitemap1.xml"}, {Loc: "https://example.com/sitemap2.xml.gz"}}, sitemap.Sitemaps)
+	})
+
+	t.Run("Gzip compressed sitemap", func(t *testing.T) {
+		compressed := &bytes.Buffer{}
+		w := gzip.NewWriter(compressed)
+		w.Write([]byte(urlset))
+		w.Close()
+		sitemap, err := parseSitemap(compressed)
+		assert.NoError(t, err)
+		assert.Len(t, sitemap.URLs, 2)
+	})
+
+	t.Run("Invalid sitemap", func(t *testing.T) {
+		_, err := parseSitemap(strings.NewReader("<html><body>Not found</body>"))
+		assert.Error(t, err)
+	})
+}
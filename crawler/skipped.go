@@ -0,0 +1,85 @@
+package crawler
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MaxSkippedParents is the max number of parents stored per skipped URL.
+const MaxSkippedParents = 10
+
+// SkippedURL is a discovered URL that was not crawled.
+type SkippedURL struct {
+	URL     string
+	Reason  SkipReason
+	Parents []string // pages linking to the URL, up to MaxSkippedParents
+}
+
+type skippedKey struct {
+	url    string
+	reason SkipReason
+}
+
+// skippedURLs holds the skipped URLs deduplicated by URL and reason.
+type skippedURLs struct {
+	mu   sync.Mutex
+	urls map[skippedKey]*SkippedURL
+}
+
+func newSkippedURLs() *skippedURLs {
+	return &skippedURLs{urls: make(map[skippedKey]*SkippedURL)}
+}
+
+func (s *skippedURLs) add(site webSite, reason SkipReason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := skippedKey{url: site.URL.String(), reason: reason}
+	skipped, ok := s.urls[key]
+	if !ok {
+		skipped = &SkippedURL{URL: key.url, Reason: reason}
+		s.urls[key] = skipped
+	}
+	if site.Parent != nil && len(skipped.Parents) < MaxSkippedParents {
+		skipped.Parents = append(skipped.Parents, site.Parent.String())
+	}
+}
+
+// SkippedURLs returns the URLs that were not crawled, sorted by URL and
+// reason. They are only recorded if RecordSkipped is set.
+func (c *Crawler) SkippedURLs() []SkippedURL {
+	if c.skipped == nil {
+		return nil
+	}
+	c.skipped.mu.Lock()
+	defer c.skipped.mu.Unlock()
+	skipped := make([]SkippedURL, 0, len(c.skipped.urls))
+	for _, s := range c.skipped.urls {
+		skipped = append(skipped, SkippedURL{
+			URL:     s.URL,
+			Reason:  s.Reason,
+			Parents: append([]string(nil), s.Parents...),
+		})
+	}
+	sort.Slice(skipped, func(i, j int) bool {
+		if skipped[i].URL != skipped[j].URL {
+			return skipped[i].URL < skipped[j].URL
+		}
+		return skipped[i].Reason < skipped[j].Reason
+	})
+	return skipped
+}
+
+// WriteSkippedReport writes the skipped URLs as tab separated lines:
+// URL, reason and the comma separated parents linking to it.
+func (c *Crawler) WriteSkippedReport(w io.Writer) error {
+	for _, s := range c.SkippedURLs() {
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\n", s.URL, s.Reason, strings.Join(s.Parents, ","))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package crawler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkippedURLsAdd(t *testing.T) {
+	s := newSkippedURLs()
+	u, _ := url.Parse("https://example.com/logout")
+	for i := 0; i < MaxSkippedParents+5; i++ {
+		parent, _ := url.Parse(fmt.Sprintf("https://example.com/%d", i))
+		s.add(webSite{URL: u, Parent: parent}, SkipDenylisted)
+	}
+	s.add(webSite{URL: u, Parent: nil}, SkipVisited)
+
+	c := Crawler{skipped: s}
+	skipped := c.SkippedURLs()
+	assert.Len(t, skipped, 2)
+	assert.Equal(t, SkipVisited, skipped[0].Reason)
+	assert.Empty(t, skipped[0].Parents)
+	assert.Equal(t, SkipDenylisted, skipped[1].Reason)
+	assert.Len(t, skipped[1].Parents, MaxSkippedParents)
+}
+
+func TestRunRecordSkipped(t *testing.T) {
+	httpTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`<a href="/about">about</a><a href="/logo.png">logo</a><a href="https://twitter.com">tw</a>`))
+		case "/about":
+			w.Write([]byte(`<a href="/">home</a><a href="https://twitter.com">tw</a>`))
+		}
+	}))
+	defer httpTestServer.Close()
+	root := httpTestServer.URL
+	about := httpTestServer.URL + "/about"
+
+	t.Run("Not recorded by default", func(t *testing.T) {
+		c := Crawler{
+			SeedURL:       root,
+			NumWorkers:    1,
+			SiteMapWriter: &bytes.Buffer{},
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		assert.Empty(t, c.SkippedURLs())
+		assert.Equal(t, 2, c.Stats().Skipped[SkipExternal])
+	})
+
+	t.Run("Recorded with reasons", func(t *testing.T) {
+		c := Crawler{
+			SeedURL:       root,
+			NumWorkers:    1,
+			SiteMapWriter: &bytes.Buffer{},
+			RecordSkipped: true,
+		}
+		err := c.Run()
+		assert.NoError(t, err)
+		skipped := c.SkippedURLs()
+		assert.Equal(t, []SkippedURL{
+			{URL: root, Reason: SkipVisited, Parents: []string{about}},
+			{URL: root + "/logo.png", Reason: "filtered by media", Parents: []string{root}},
+			{URL: "https://twitter.com", Reason: SkipExternal, Parents: []string{root, about}},
+		}, skipped)
+
+		report := &bytes.Buffer{}
+		assert.NoError(t, c.WriteSkippedReport(report))
+		assert.Contains(t, report.String(), fmt.Sprintf("https://twitter.com\texternal\t%s,%s\n", root, about))
+	})
+}
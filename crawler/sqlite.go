@@ -0,0 +1,193 @@
+package crawler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// SQLiteSchema is the schema of the SQLiteOutputFile database. Every crawl
+// adds a row to runs, and its pages and links are tagged with its id, so
+// crawls can be appended to the same database and compared. The pages are
+// committed with their links as soon as they are fetched, so a killed crawl
+// still leaves the pages fetched so far, with a NULL runs.finished.
+//
+//   - runs: a row per crawl, with the seeds separated by spaces, the start
+//     and end times in RFC 3339 and the reason it was truncated, if it was
+//     (see Stats)
+//   - pages: a row per page fetched, also when it failed. status is NULL if
+//     no response was received and error holds the reason it failed.
+//     latency_ms is the time taken to get the response.
+//   - links: a row per link written to the site map, with the link_type and
+//     anchor_text of CSVHeader. external is 1 for the links to external
+//     URLs.
+//   - inbound_links: a row per URL linked, with the number of pages linking
+//     to it (see InboundLinks), added at the end of the crawl
+const SQLiteSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id        INTEGER PRIMARY KEY,
+	seeds     TEXT NOT NULL,
+	started   TEXT NOT NULL,
+	finished  TEXT,
+	truncated TEXT
+);
+CREATE TABLE IF NOT EXISTS pages (
+	run_id     INTEGER NOT NULL REFERENCES runs (id),
+	url        TEXT NOT NULL,
+	status     INTEGER,
+	depth      INTEGER NOT NULL,
+	title      TEXT,
+	bytes      INTEGER,
+	latency_ms INTEGER,
+	error      TEXT
+);
+CREATE INDEX IF NOT EXISTS pages_url ON pages (url);
+CREATE INDEX IF NOT EXISTS pages_status ON pages (status);
+CREATE TABLE IF NOT EXISTS links (
+	run_id      INTEGER NOT NULL REFERENCES runs (id),
+	source      TEXT NOT NULL,
+	target      TEXT NOT NULL,
+	link_type   TEXT NOT NULL,
+	anchor_text TEXT,
+	external    INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS links_source ON links (source);
+CREATE INDEX IF NOT EXISTS links_target ON links (target);
+CREATE TABLE IF NOT EXISTS inbound_links (
+	run_id INTEGER NOT NULL REFERENCES runs (id),
+	url    TEXT NOT NULL,
+	pages  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS inbound_links_url ON inbound_links (url);
+`
+
+// sqliteOutput writes the pages to the SQLiteOutputFile database. A nil
+// *sqliteOutput writes nothing. It's safe for concurrent use.
+type sqliteOutput struct {
+	db    *sql.DB
+	runID int64
+}
+
+// openSQLiteOutput opens the database at path, creating it and its tables
+// if needed, and adds the run of the crawl.
+func openSQLiteOutput(path string, seeds []string, started time.Time) (*sqliteOutput, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open SQLite output file %q: %s", path, err.Error())
+	}
+	// SQLite allows a single writer at a time
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(SQLiteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't create the tables of SQLite output file %q: %s", path, err.Error())
+	}
+	res, err := db.Exec("INSERT INTO runs (seeds, started) VALUES (?, ?)", strings.Join(seeds, " "), started.Format(time.RFC3339))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't add the run to SQLite output file %q: %s", path, err.Error())
+	}
+	runID, err := res.LastInsertId()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't add the run to SQLite output file %q: %s", path, err.Error())
+	}
+	return &sqliteOutput{db: db, runID: runID}, nil
+}
+
+// write adds the page of the result with its links in a transaction.
+func (o *sqliteOutput) write(r PageResult) error {
+	if o == nil {
+		return nil
+	}
+	tx, err := o.db.Begin()
+	if err != nil {
+		return err
+	}
+	source := r.URL
+	_, err = tx.Exec("INSERT INTO pages (run_id, url, status, depth, title, bytes, latency_ms) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		o.runID, source, nullInt(r.StatusCode), r.Depth, r.Metadata.Title, r.Bytes, int64(r.Duration/time.Millisecond))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if r.site.sitemap != nil {
+		_, err = tx.Exec("INSERT INTO links (run_id, source, target, link_type, external) VALUES (?, ?, ?, 'sitemap', 0)",
+			o.runID, r.site.sitemap.String(), source)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, edge := range r.Links {
+		linkType := edge.Element
+		if linkType == "" {
+			linkType = "link"
+		}
+		_, err = tx.Exec("INSERT INTO links (run_id, source, target, link_type, anchor_text, external) VALUES (?, ?, ?, ?, ?, ?)",
+			o.runID, source, edge.URL, linkType, edge.Text, edge.External)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// writeFailed adds a page that failed, with its status code if it failed
+// with an HTTP error.
+func (o *sqliteOutput) writeFailed(s webSite, failure error) error {
+	if o == nil {
+		return nil
+	}
+	var status interface{}
+	var statusErr *statusError
+	if errors.As(failure, &statusErr) {
+		status = statusErr.code
+	}
+	_, err := o.db.Exec("INSERT INTO pages (run_id, url, status, depth, error) VALUES (?, ?, ?, ?, ?)",
+		o.runID, s.URL.String(), status, s.Depth, failure.Error())
+	return err
+}
+
+// close adds the inbound links counts, sets the end of the run and closes
+// the database.
+func (o *sqliteOutput) close(truncated string, inbound map[string]int) error {
+	if o == nil {
+		return nil
+	}
+	err := o.writeInboundLinks(inbound)
+	if err == nil {
+		_, err = o.db.Exec("UPDATE runs SET finished = ?, truncated = NULLIF(?, '') WHERE id = ?",
+			time.Now().Format(time.RFC3339), truncated, o.runID)
+	}
+	if closeErr := o.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (o *sqliteOutput) writeInboundLinks(inbound map[string]int) error {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return err
+	}
+	for u, pages := range inbound {
+		if _, err := tx.Exec("INSERT INTO inbound_links (run_id, url, pages) VALUES (?, ?, ?)", o.runID, u, pages); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// nullInt returns n, or nil, stored as NULL, if it's zero.
+func nullInt(n int) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
@@ -0,0 +1,99 @@
+package crawler_test
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/scanterog/crawler/crawler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunSQLiteOutput(t *testing.T) {
+	httpTestServer := newTestServer()
+	defer httpTestServer.Close()
+	serverURL := httpTestServer.URL
+	dir, err := ioutil.TempDir("", "sqlite")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "crawl.db")
+
+	crawl := func() {
+		c := crawler.Crawler{
+			SeedURL:          serverURL,
+			IgnoreRobots:     true,
+			NumWorkers:       crawler.DefaultNumWorkers,
+			SiteMapWriter:    ioutil.Discard,
+			SQLiteOutputFile: path,
+		}
+		assert.NoError(t, c.Run())
+	}
+	crawl()
+
+	db, err := sql.Open("sqlite", path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	t.Run("Pages", func(t *testing.T) {
+		var status, depth int
+		var title string
+		err := db.QueryRow("SELECT status, depth, title FROM pages WHERE url = ?", serverURL+"/careers").Scan(&status, &depth, &title)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, 2, depth)
+		assert.Equal(t, "Careers page", title)
+
+		var failed string
+		err = db.QueryRow("SELECT url FROM pages WHERE status = 404").Scan(&failed)
+		assert.NoError(t, err)
+		assert.Equal(t, serverURL+"/help", failed)
+	})
+
+	t.Run("Links", func(t *testing.T) {
+		var links, external int
+		err := db.QueryRow("SELECT COUNT(*), SUM(external) FROM links").Scan(&links, &external)
+		assert.NoError(t, err)
+		assert.Equal(t, 10, links)
+		assert.Equal(t, 3, external)
+
+		var anchorText string
+		err = db.QueryRow("SELECT anchor_text FROM links WHERE source = ? AND target = ?", serverURL+"/about", serverURL+"/careers").Scan(&anchorText)
+		assert.NoError(t, err)
+		assert.Equal(t, "careers", anchorText)
+	})
+
+	t.Run("Inbound links", func(t *testing.T) {
+		var pages int
+		err := db.QueryRow("SELECT pages FROM inbound_links WHERE url = ?", serverURL+"/help").Scan(&pages)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, pages)
+	})
+
+	t.Run("Appended runs", func(t *testing.T) {
+		crawl()
+		var runs, finished int
+		err := db.QueryRow("SELECT COUNT(*), COUNT(finished) FROM runs").Scan(&runs, &finished)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, runs)
+		assert.Equal(t, 2, finished)
+
+		rows, err := db.Query("SELECT run_id, COUNT(*) FROM pages GROUP BY run_id ORDER BY run_id")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer rows.Close()
+		counts := map[int]int{}
+		for rows.Next() {
+			var runID, pages int
+			assert.NoError(t, rows.Scan(&runID, &pages))
+			counts[runID] = pages
+		}
+		assert.Equal(t, map[int]int{1: 4, 2: 4}, counts)
+	})
+}
@@ -0,0 +1,601 @@
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SkipReason describes why a discovered URL was not crawled.
+type SkipReason string
+
+const (
+	SkipExternal           SkipReason = "external"
+	SkipVisited            SkipReason = "already visited"
+	SkipURLTooLong         SkipReason = "url too long"
+	SkipPathTooDeep        SkipReason = "path too deep"
+	SkipRepeatedSegments   SkipReason = "repeated path segments (probable trap)"
+	SkipBudgetExhausted    SkipReason = "pattern budget exhausted"
+	SkipDirBudgetExhausted SkipReason = "dir budget exhausted"
+	SkipNofollow           SkipReason = "nofollow"
+	SkipDenylisted         SkipReason = "denylisted"
+	SkipMaxDepth           SkipReason = "max depth exceeded"
+	SkipMaxPages           SkipReason = "max pages reached"
+	SkipStopped            SkipReason = "crawl stopped"
+	SkipRobots             SkipReason = "disallowed by robots.txt"
+)
+
+// Reasons for a crawl to stop before every discovered page is visited.
+const (
+	TruncatedMaxPages    = "max pages reached"
+	TruncatedMaxDuration = "max duration reached"
+	TruncatedCancelled   = "cancelled"
+	TruncatedStopped     = "stopped"
+)
+
+// Stats holds the counters collected while crawling.
+type Stats struct {
+	PagesFetched    int                // pages successfully fetched and parsed
+	PagesFailed     int                // pages that could not be fetched or parsed
+	PagesDeadline   int                // pages failed because PageDeadline or MaxParseTime was exceeded, included in PagesFailed
+	SeedsFailed     int                // seeds that could not be fetched or parsed, included in PagesFailed
+	BrokenInternal  int                // internal URLs linked from the pages or sitemaps that could not be fetched (see BrokenLinks). Only counted with RecordBrokenLinks.
+	BrokenExternal  int                // external URLs linked from the pages whose check failed (see CheckExternal). Only counted with RecordBrokenLinks.
+	PagesTruncated  int                // pages fetched with some links or attributes left out (see PageMetadata)
+	DeadEnds        []string           // HTML pages fetched without links to internal pages, sorted (see PageMetadata)
+	BothSchemes     int                // pages fetched over both http and https. Only counted with SchemeSensitive.
+	SingleRedirects int                // pages fetched after a single redirect
+	RedirectChains  int                // pages fetched after 2 or more redirects (see RedirectChains)
+	RedirectLoops   int                // pages failed with a redirect loop, included in PagesFailed
+	Skipped         map[SkipReason]int // discovered URLs that were not crawled, by reason
+	SkippedSchemes  map[string]int     // links with a non-web scheme (mailto, tel, javascript, data), by scheme
+	Filtered        map[string]int     // URLs rejected by each URLFilter, by filter name
+	// BudgetExhausted holds the URLs skipped per exhausted PatternBudget
+	// pattern. The site map is intentionally incomplete for those.
+	BudgetExhausted map[string]int
+	DirBudgets      map[string]DirBudgetUsage // usage of each DirBudgets prefix
+	// VisitedFillRatio holds the estimated fill ratio of a BloomVisitedStore
+	// (see BloomVisitedStore.FillRatio). Zero with other stores.
+	VisitedFillRatio float64
+	Delays           map[string]time.Duration // min time between two requests in force, by host. Only hosts with a delay.
+	Frontier         int                      // pages waiting to be crawled
+	PagesByDepth     map[int]int              // pages fetched by depth (see PageDepths)
+	PageStatuses     map[PageStatus]int       // pages by how they changed since the previous crawl. Only with IncrementalStateFile.
+	FrontierPeak     int                      // max number of pages waiting to be crawled at once
+	// Truncated holds the reason the crawl stopped before visiting every
+	// discovered page, e.g. TruncatedMaxPages. Empty if it completed.
+	Truncated string
+	// SlowestPages holds the pages taking the longest to respond, the
+	// slowest first, up to MaxSlowestPages.
+	SlowestPages []SlowPage
+	// MostLinked holds the URLs with the most pages linking to them, the
+	// most linked first, up to MaxMostLinked (see InboundLinks).
+	MostLinked []LinkedURL
+	// ExternalDomains holds the links of the pages written to the site map
+	// to external hosts, by host or, with GroupExternalDomains, by
+	// registrable domain.
+	ExternalDomains map[string]ExternalLinks
+}
+
+// ExternalLinks counts the links to an external domain.
+type ExternalLinks struct {
+	Pages int `json:"pages"` // pages linking to the domain
+	Links int `json:"links"` // distinct URLs of the domain linked, summed over the pages
+}
+
+// SlowPage is a page with the time taken to get its response.
+type SlowPage struct {
+	URL      string
+	Status   int
+	Bytes    int64 // size of the body, telling the pages slow because they're big
+	Duration time.Duration
+	Retried  bool // the Fetcher made several requests. Duration is the one of the last.
+}
+
+// LinkedURL is a URL with the number of pages linking to it.
+type LinkedURL struct {
+	URL     string
+	Inbound int
+}
+
+// MaxMostLinked is the number of URLs in Stats.MostLinked.
+const MaxMostLinked = 10
+
+// maxSummaryExternalDomains is the number of external domains listed by
+// Stats.String, the most linked ones.
+const maxSummaryExternalDomains = 10
+
+// maxSummaryDeadEnds is the number of dead-end pages listed by
+// Stats.String.
+const maxSummaryDeadEnds = 10
+
+// externalDomainsByPages returns the external domains sorted by the number
+// of pages linking to them, then by links and name.
+func (s Stats) externalDomainsByPages() []string {
+	domains := make([]string, 0, len(s.ExternalDomains))
+	for domain := range s.ExternalDomains {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		a, b := s.ExternalDomains[domains[i]], s.ExternalDomains[domains[j]]
+		if a.Pages != b.Pages {
+			return a.Pages > b.Pages
+		}
+		if a.Links != b.Links {
+			return a.Links > b.Links
+		}
+		return domains[i] < domains[j]
+	})
+	return domains
+}
+
+// String returns a human readable summary of the crawl.
+func (s Stats) String() string {
+	var b strings.Builder
+	if s.Truncated != "" {
+		fmt.Fprintf(&b, "crawl truncated: %s\n", s.Truncated)
+	}
+	fmt.Fprintf(&b, "pages fetched: %d\n", s.PagesFetched)
+	fmt.Fprintf(&b, "pages failed: %d\n", s.PagesFailed)
+	if s.PagesDeadline > 0 {
+		fmt.Fprintf(&b, "pages failed with deadline exceeded: %d\n", s.PagesDeadline)
+	}
+	if s.SeedsFailed > 0 {
+		fmt.Fprintf(&b, "seeds failed: %d\n", s.SeedsFailed)
+	}
+	if s.BrokenInternal > 0 {
+		fmt.Fprintf(&b, "broken internal links: %d\n", s.BrokenInternal)
+	}
+	if s.BrokenExternal > 0 {
+		fmt.Fprintf(&b, "broken external links: %d\n", s.BrokenExternal)
+	}
+	if s.PagesTruncated > 0 {
+		fmt.Fprintf(&b, "pages truncated: %d\n", s.PagesTruncated)
+	}
+	for i, u := range s.DeadEnds {
+		if i == maxSummaryDeadEnds {
+			fmt.Fprintf(&b, "%d more dead-end pages\n", len(s.DeadEnds)-i)
+			break
+		}
+		fmt.Fprintf(&b, "dead-end page: %s\n", u)
+	}
+	fmt.Fprintf(&b, "max pages waiting to be crawled: %d\n", s.FrontierPeak)
+	depths := make([]int, 0, len(s.PagesByDepth))
+	for depth := range s.PagesByDepth {
+		depths = append(depths, depth)
+	}
+	sort.Ints(depths)
+	for _, depth := range depths {
+		fmt.Fprintf(&b, "pages at depth %d: %d\n", depth, s.PagesByDepth[depth])
+	}
+	if s.SingleRedirects > 0 {
+		fmt.Fprintf(&b, "single-hop redirects: %d\n", s.SingleRedirects)
+	}
+	if s.RedirectChains > 0 {
+		fmt.Fprintf(&b, "redirect chains: %d\n", s.RedirectChains)
+	}
+	if s.RedirectLoops > 0 {
+		fmt.Fprintf(&b, "redirect loops: %d\n", s.RedirectLoops)
+	}
+	if s.BothSchemes > 0 {
+		fmt.Fprintf(&b, "pages reachable over both http and https: %d\n", s.BothSchemes)
+	}
+	reasons := make([]string, 0, len(s.Skipped))
+	for reason := range s.Skipped {
+		reasons = append(reasons, string(reason))
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(&b, "skipped (%s): %d\n", reason, s.Skipped[SkipReason(reason)])
+	}
+	schemes := make([]string, 0, len(s.SkippedSchemes))
+	for scheme := range s.SkippedSchemes {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	for _, scheme := range schemes {
+		fmt.Fprintf(&b, "%s links: %d\n", scheme, s.SkippedSchemes[scheme])
+	}
+	hosts := make([]string, 0, len(s.Delays))
+	for host := range s.Delays {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "delay between requests to %s: %v\n", host, s.Delays[host])
+	}
+	patterns := make([]string, 0, len(s.BudgetExhausted))
+	for pattern := range s.BudgetExhausted {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		fmt.Fprintf(&b, "budget exhausted for %q: %d skipped\n", pattern, s.BudgetExhausted[pattern])
+	}
+	statuses := make([]string, 0, len(s.PageStatuses))
+	for status := range s.PageStatuses {
+		statuses = append(statuses, string(status))
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "%s pages: %d\n", status, s.PageStatuses[PageStatus(status)])
+	}
+	if s.VisitedFillRatio > 0 {
+		fmt.Fprintf(&b, "visited set fill ratio: %.1f%%\n", s.VisitedFillRatio*100)
+	}
+	prefixes := make([]string, 0, len(s.DirBudgets))
+	for prefix := range s.DirBudgets {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		u := s.DirBudgets[prefix]
+		fmt.Fprintf(&b, "dir budget for %q: %d/%d pages fetched, %d skipped\n", prefix, u.Fetched, u.Max, u.Skipped)
+	}
+	for _, page := range s.SlowestPages {
+		retried := ""
+		if page.Retried {
+			retried = ", retried"
+		}
+		fmt.Fprintf(&b, "slow page: %s in %v (%s, %d bytes%s)\n", page.URL, page.Duration, formatStatus(page.Status), page.Bytes, retried)
+	}
+	for _, linked := range s.MostLinked {
+		fmt.Fprintf(&b, "most linked: %s from %d pages\n", linked.URL, linked.Inbound)
+	}
+	domains := s.externalDomainsByPages()
+	for i, domain := range domains {
+		if i == maxSummaryExternalDomains {
+			fmt.Fprintf(&b, "links to %d more external domains\n", len(domains)-i)
+			break
+		}
+		l := s.ExternalDomains[domain]
+		fmt.Fprintf(&b, "links to %s: %d from %d pages\n", domain, l.Links, l.Pages)
+	}
+	return b.String()
+}
+
+// Stats returns a snapshot of the counters collected so far.
+func (c *Crawler) Stats() Stats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	stats := c.stats
+	stats.DeadEnds = append([]string(nil), c.stats.DeadEnds...)
+	sort.Strings(stats.DeadEnds)
+	stats.Skipped = make(map[SkipReason]int, len(c.stats.Skipped))
+	for reason, n := range c.stats.Skipped {
+		stats.Skipped[reason] = n
+	}
+	stats.SkippedSchemes = make(map[string]int, len(c.stats.SkippedSchemes))
+	for scheme, n := range c.stats.SkippedSchemes {
+		stats.SkippedSchemes[scheme] = n
+	}
+	stats.Filtered = make(map[string]int, len(c.stats.Filtered))
+	for name, n := range c.stats.Filtered {
+		stats.Filtered[name] = n
+	}
+	stats.BudgetExhausted = make(map[string]int, len(c.stats.BudgetExhausted))
+	for pattern, n := range c.stats.BudgetExhausted {
+		stats.BudgetExhausted[pattern] = n
+	}
+	stats.DirBudgets = c.dirBudgets.snapshot()
+	stats.PageStatuses = c.incremental.counts()
+	stats.PagesByDepth = make(map[int]int, len(c.stats.PagesByDepth))
+	for depth, n := range c.stats.PagesByDepth {
+		stats.PagesByDepth[depth] = n
+	}
+	stats.Delays = make(map[string]time.Duration, len(c.stats.Delays))
+	for host, d := range c.stats.Delays {
+		stats.Delays[host] = d
+	}
+	stats.SlowestPages = append([]SlowPage(nil), c.slowestPages...)
+	stats.MostLinked = mostLinked(c.inboundLinks, MaxMostLinked)
+	stats.BrokenInternal, stats.BrokenExternal = c.brokenLinks.counts()
+	stats.ExternalDomains = make(map[string]ExternalLinks, len(c.stats.ExternalDomains))
+	for domain, l := range c.stats.ExternalDomains {
+		stats.ExternalDomains[domain] = l
+	}
+	return stats
+}
+
+// recordExternalLinks adds the links of a page to external domains, by
+// domain.
+func (c *Crawler) recordExternalLinks(links map[string]int) {
+	if len(links) == 0 {
+		return
+	}
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.stats.ExternalDomains == nil {
+		c.stats.ExternalDomains = make(map[string]ExternalLinks)
+	}
+	for domain, n := range links {
+		l := c.stats.ExternalDomains[domain]
+		l.Pages++
+		l.Links += n
+		c.stats.ExternalDomains[domain] = l
+	}
+}
+
+// externalDomain returns the domain the links to the external host are
+// counted under: the host or, with GroupExternalDomains, its registrable
+// domain.
+func (c *Crawler) externalDomain(host string) string {
+	host = strings.ToLower(host)
+	if c.GroupExternalDomains {
+		if domain, err := RegistrableDomain(host); err == nil {
+			return domain
+		}
+	}
+	return host
+}
+
+// WriteExternalDomainsReport writes the external domains linked from the
+// pages (see Stats.ExternalDomains) as tab separated lines: domain, pages
+// linking to it and links, the most linked first.
+func (c *Crawler) WriteExternalDomainsReport(w io.Writer) error {
+	stats := c.Stats()
+	for _, domain := range stats.externalDomainsByPages() {
+		l := stats.ExternalDomains[domain]
+		if _, err := fmt.Fprintf(w, "%s\t%d\t%d\n", domain, l.Pages, l.Links); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Crawler) recordSkipped(reason SkipReason) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.stats.Skipped == nil {
+		c.stats.Skipped = make(map[SkipReason]int)
+	}
+	c.stats.Skipped[reason]++
+}
+
+func (c *Crawler) recordFiltered(name string) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.stats.Filtered == nil {
+		c.stats.Filtered = make(map[string]int)
+	}
+	c.stats.Filtered[name]++
+}
+
+func (c *Crawler) recordBudgetExhausted(pattern string) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.stats.BudgetExhausted == nil {
+		c.stats.BudgetExhausted = make(map[string]int)
+	}
+	c.stats.BudgetExhausted[pattern]++
+}
+
+func (c *Crawler) recordPageFetched(u *url.URL) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.stats.PagesFetched++
+
+	if !c.SchemeSensitive {
+		return
+	}
+	both := schemeMask("http") | schemeMask("https")
+	key := schemelessKey(u)
+	seen := c.fetchedSchemes[key]
+	c.fetchedSchemes[key] = seen | schemeMask(u.Scheme)
+	if seen != both && c.fetchedSchemes[key] == both {
+		c.stats.BothSchemes++
+	}
+}
+
+func (c *Crawler) recordPageDepth(u *url.URL, depth int) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.stats.PagesByDepth == nil {
+		c.stats.PagesByDepth = make(map[int]int)
+	}
+	c.stats.PagesByDepth[depth]++
+	c.pageDepths[u.String()] = depth
+}
+
+// PageDepths returns the depth of every fetched page, by URL: the number of
+// links followed from the seed to the page. Since pages are fetched
+// concurrently, it's the depth of the first link found to the page, which
+// may not be the shortest path from the seed. The seeds are at depth 0.
+func (c *Crawler) PageDepths() map[string]int {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	depths := make(map[string]int, len(c.pageDepths))
+	for u, depth := range c.pageDepths {
+		depths[u] = depth
+	}
+	return depths
+}
+
+// WriteDepthReport writes the fetched pages as tab separated lines: depth
+// (see PageDepths) and URL, sorted by depth and URL.
+func (c *Crawler) WriteDepthReport(w io.Writer) error {
+	depths := c.PageDepths()
+	urls := make([]string, 0, len(depths))
+	for u := range depths {
+		urls = append(urls, u)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if depths[urls[i]] != depths[urls[j]] {
+			return depths[urls[i]] < depths[urls[j]]
+		}
+		return urls[i] < urls[j]
+	})
+	for _, u := range urls {
+		if _, err := fmt.Fprintf(w, "%d\t%s\n", depths[u], u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Crawler) recordSkippedSchemes(schemes map[string]int) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	for scheme, n := range schemes {
+		if c.stats.SkippedSchemes == nil {
+			c.stats.SkippedSchemes = make(map[string]int)
+		}
+		c.stats.SkippedSchemes[scheme] += n
+	}
+}
+
+func (c *Crawler) recordTruncated(reason string) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.stats.Truncated == "" {
+		c.stats.Truncated = reason
+	}
+}
+
+func (c *Crawler) recordDelay(host string, d time.Duration) {
+	if d == 0 {
+		return
+	}
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if c.stats.Delays == nil {
+		c.stats.Delays = make(map[string]time.Duration)
+	}
+	c.stats.Delays[host] = d
+}
+
+func (c *Crawler) recordVisitedFillRatio(ratio float64) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.stats.VisitedFillRatio = ratio
+}
+
+func (c *Crawler) recordFrontier(size int) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.stats.Frontier = size
+	if size > c.stats.FrontierPeak {
+		c.stats.FrontierPeak = size
+	}
+}
+
+func (c *Crawler) recordPageFailed(s webSite, err error) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.stats.PagesFailed++
+	if err == errPageDeadline || err == errParseTime {
+		c.stats.PagesDeadline++
+	}
+	if s.Parent == nil && s.sitemap == nil {
+		c.stats.SeedsFailed++
+		if c.seedErr == nil {
+			c.seedErr = &SeedFetchError{URL: s.URL.String(), Err: err}
+		}
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		c.statusCodes[s.URL.String()] = statusErr.code
+	}
+}
+
+// recordInboundLinks counts the page of the result as linking to each of
+// its links, once per URL. Only the counts are kept, not the sources.
+func (c *Crawler) recordInboundLinks(r PageResult) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	for _, link := range r.Links {
+		if !link.Asset {
+			c.inboundLinks[link.URL]++
+		}
+	}
+}
+
+// recordLatency keeps the page of the result if it's among the
+// MaxSlowestPages slowest, ties sorted by URL.
+func (c *Crawler) recordLatency(r PageResult) {
+	if r.resource || r.Duration == 0 {
+		return
+	}
+	page := SlowPage{URL: r.URL, Status: r.StatusCode, Bytes: r.Bytes, Duration: r.Duration, Retried: r.Attempts > 1}
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	slowest := c.slowestPages
+	i := sort.Search(len(slowest), func(i int) bool {
+		return slowest[i].Duration < page.Duration || (slowest[i].Duration == page.Duration && slowest[i].URL > page.URL)
+	})
+	if i == c.MaxSlowestPages {
+		return
+	}
+	if len(slowest) < c.MaxSlowestPages {
+		slowest = append(slowest, SlowPage{})
+	}
+	copy(slowest[i+1:], slowest[i:])
+	slowest[i] = page
+	c.slowestPages = slowest
+}
+
+// InboundLinks returns the number of pages linking to each URL linked from
+// the pages written to the site map, by URL. The assets are left out.
+func (c *Crawler) InboundLinks() map[string]int {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	inbound := make(map[string]int, len(c.inboundLinks))
+	for u, n := range c.inboundLinks {
+		inbound[u] = n
+	}
+	return inbound
+}
+
+// mostLinked returns the n URLs with the most inbound links, the most
+// linked first, then by URL.
+func mostLinked(inbound map[string]int, n int) []LinkedURL {
+	var top []LinkedURL
+	for u, count := range inbound {
+		linked := LinkedURL{URL: u, Inbound: count}
+		i := sort.Search(len(top), func(i int) bool {
+			return top[i].Inbound < count || (top[i].Inbound == count && top[i].URL > u)
+		})
+		if i == n {
+			continue
+		}
+		if len(top) < n {
+			top = append(top, LinkedURL{})
+		}
+		copy(top[i+1:], top[i:])
+		top[i] = linked
+	}
+	return top
+}
+
+func (c *Crawler) recordStatusCode(u *url.URL, code int) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.statusCodes[u.String()] = code
+}
+
+// StatusCodes returns the status code of the response of every fetched
+// page, also of the ones failed with a 4xx or 5xx status, by URL.
+func (c *Crawler) StatusCodes() map[string]int {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	codes := make(map[string]int, len(c.statusCodes))
+	for u, code := range c.statusCodes {
+		codes[u] = code
+	}
+	return codes
+}
+
+// schemeMask returns the bit used to track the scheme a page was fetched with.
+func schemeMask(scheme string) uint8 {
+	switch scheme {
+	case "http":
+		return 1
+	case "https":
+		return 2
+	}
+	return 0
+}
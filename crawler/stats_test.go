@@ -0,0 +1,41 @@
+package crawler
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordPageFetched(t *testing.T) {
+	mustParse := func(s string) *url.URL {
+		u, _ := url.Parse(s)
+		return u
+	}
+
+	t.Run("Both schemes counted when scheme sensitive", func(t *testing.T) {
+		c := Crawler{SchemeSensitive: true, fetchedSchemes: map[string]uint8{}}
+		c.recordPageFetched(mustParse("http://example.com/a"))
+		c.recordPageFetched(mustParse("https://example.com/a"))
+		c.recordPageFetched(mustParse("https://example.com/b"))
+		stats := c.Stats()
+		assert.Equal(t, 3, stats.PagesFetched)
+		assert.Equal(t, 1, stats.BothSchemes)
+		assert.True(t, strings.Contains(stats.String(), "both http and https: 1"))
+	})
+
+	t.Run("Both schemes not counted by default", func(t *testing.T) {
+		c := Crawler{fetchedSchemes: map[string]uint8{}}
+		c.recordPageFetched(mustParse("http://example.com/a"))
+		c.recordPageFetched(mustParse("https://example.com/a"))
+		assert.Equal(t, 0, c.Stats().BothSchemes)
+	})
+}
+
+func TestMostLinked(t *testing.T) {
+	inbound := map[string]int{"/a": 1, "/b": 3, "/c": 2, "/d": 3, "/e": 1}
+	assert.Equal(t, []LinkedURL{{URL: "/b", Inbound: 3}, {URL: "/d", Inbound: 3}, {URL: "/c", Inbound: 2}}, mostLinked(inbound, 3))
+	assert.Len(t, mostLinked(inbound, 10), 5)
+	assert.Empty(t, mostLinked(nil, 10))
+}
@@ -0,0 +1,73 @@
+package crawler
+
+import (
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxStylesheetSize is the max number of bytes of a stylesheet read by
+// FetchStylesheets.
+const maxStylesheetSize = 1 << 20
+
+// cssURLRegexp matches the url() tokens of CSS, with their argument quoted
+// with double or single quotes or unquoted.
+var cssURLRegexp = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)'"\s]*))\s*\)`)
+
+// cssURLs returns the URLs referenced by the url() tokens of the CSS, e.g.
+// background images and fonts. The inline data: URLs are skipped.
+func cssURLs(css string) []string {
+	var urls []string
+	for _, match := range cssURLRegexp.FindAllStringSubmatch(css, -1) {
+		u := strings.TrimSpace(match[1] + match[2] + match[3])
+		if u == "" {
+			continue
+		}
+		if _, ok := nonWebScheme(u); ok {
+			continue
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// isStylesheet reports whether the asset of the page is a stylesheet on
+// its host, which is fetched with FetchStylesheets.
+func (r *PageResult) isStylesheet(a asset) bool {
+	return a.Element == "link" && a.URL.Host == r.site.URL.Host &&
+		strings.HasSuffix(strings.ToLower(a.URL.Path), ".css")
+}
+
+// stylesheetResults fetches the stylesheets of the page not fetched yet
+// and returns a result per stylesheet holding the URLs it references as
+// assets, so they are written to the site map once.
+func (c *Crawler) stylesheetResults(r PageResult) []PageResult {
+	var results []PageResult
+	for _, a := range r.assets {
+		if !r.isStylesheet(a) || !c.firstResourceFetch(a.URL) {
+			continue
+		}
+		css, err := c.fetchResource(a.URL, maxStylesheetSize)
+		if err != nil {
+			log.Errorf("Failed to fetch stylesheet %q: %s", a.URL.String(), err.Error())
+			continue
+		}
+		sheet := webSite{URL: a.URL}
+		sheetResult := PageResult{site: sheet, resource: true}
+		seen := map[string]bool{}
+		for _, u := range cssURLs(string(css)) {
+			assetURL, err := sheet.resolve(u, c.normalizer)
+			if err != nil {
+				log.Debugf("Skipping asset %q. Error: %q", u, err.Error())
+				continue
+			}
+			if !seen[assetURL.String()] {
+				seen[assetURL.String()] = true
+				sheetResult.assets = append(sheetResult.assets, asset{URL: assetURL, Element: "style"})
+			}
+		}
+		results = append(results, sheetResult)
+	}
+	return results
+}
@@ -0,0 +1,29 @@
+package crawler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSSURLs(t *testing.T) {
+	tests := []struct {
+		name string
+		css  string
+		urls []string
+	}{
+		{"Double quotes", `body { background: url("/bg.png") }`, []string{"/bg.png"}},
+		{"Single quotes", `body { background: url('/bg.png') }`, []string{"/bg.png"}},
+		{"Unquoted", `body { background: url(/bg.png) no-repeat }`, []string{"/bg.png"}},
+		{"Spaces", `body { background: URL(  " /bg.png "  ) }`, []string{"/bg.png"}},
+		{"Data URL", `i { background: url(data:image/png;base64,AAAA) } b { background: url('data:image/svg+xml;utf8,<svg></svg>') }`, nil},
+		{"Several", `@font-face { src: url(/f.woff2) format("woff2"), url('/f.woff') format("woff") } h1 { background: url(https://cdn.example.com/h.jpg) }`,
+			[]string{"/f.woff2", "/f.woff", "https://cdn.example.com/h.jpg"}},
+		{"Empty", `a { background: url() }`, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.urls, cssURLs(tc.css))
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package crawler
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Scopes of the site map templates: what each line is written for.
+const (
+	TemplateScopeEdge = "edge" // a TemplateEdge per link
+	TemplateScopePage = "page" // a TemplatePage per page, also for the failed ones
+)
+
+// TemplateEdge is a link of a page, as passed to the site map template
+// with TemplateScopeEdge. The edges are written as soon as Parent is
+// fetched, so the status of URL is not known yet.
+type TemplateEdge struct {
+	Parent       string // URL of the page linking to URL, or of the sitemap listing it
+	ParentStatus int    // status code of the response of Parent. Zero for the sitemaps.
+	URL          string // URL linked
+	Element      string // element of the link, e.g. "a" or "img", or "sitemap"
+	Text         string // text of the link, if any
+	Asset        bool   // a resource referenced by the page (see IncludeAssets)
+	External     bool   // URL is on another host
+	Count        int    // number of links of Parent to URL, at least 1
+}
+
+// TemplatePage is a page, as passed to the site map template with
+// TemplateScopePage.
+type TemplatePage struct {
+	Parent   string        // page the URL was first found on, or the sitemap listing it. Empty for the seeds.
+	URL      string        // URL crawled
+	FinalURL string        // URL fetched, after any redirect. Empty for the failed pages.
+	Status   int           // status code of the response. Zero if none was received, or for the feeds and stylesheets.
+	Depth    int           // number of links followed from the seed to the page
+	Duration time.Duration // time taken to get the response
+	Bytes    int64         // size of the body
+	Title    string        // title of the page, if any
+	Links    int           // number of links written to the site map
+	Error    string        // why the page could not be fetched or parsed, if it failed, e.g. "404 Not Found"
+}
+
+// parseTemplate parses the template of the config and checks the fields it
+// references on the record of its scope, so unknown fields are reported
+// before the crawl. It's not executed, since functions like slice or index
+// fail on an empty record.
+func (o OutputConfig) parseTemplate() (*template.Template, error) {
+	tmpl, err := template.New("output").Parse(o.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %s", err.Error())
+	}
+	var record interface{} = TemplateEdge{}
+	if o.TemplateScope == TemplateScopePage {
+		record = TemplatePage{}
+	}
+	if tmpl.Tree != nil {
+		check := templateChecker{tree: tmpl.Tree, record: reflect.TypeOf(record)}
+		if err := check.node(tmpl.Tree.Root, true); err != nil {
+			return nil, fmt.Errorf("invalid template: %s", err.Error())
+		}
+	}
+	return tmpl, nil
+}
+
+// templateChecker checks the fields referenced by a template on its record.
+// Only the first field of each chain is checked, and only where dot is the
+// record: not in the bodies of range and with.
+type templateChecker struct {
+	tree   *parse.Tree
+	record reflect.Type
+}
+
+// node checks the fields of the node. record reports whether dot is the
+// record.
+func (c templateChecker) node(node parse.Node, record bool) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := c.node(child, record); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return c.node(n.Pipe, record)
+	case *parse.IfNode:
+		return c.branch(&n.BranchNode, record, record)
+	case *parse.RangeNode:
+		return c.branch(&n.BranchNode, record, false)
+	case *parse.WithNode:
+		return c.branch(&n.BranchNode, record, false)
+	case *parse.TemplateNode:
+		return c.node(n.Pipe, record)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			for _, arg := range cmd.Args {
+				if err := c.node(arg, record); err != nil {
+					return err
+				}
+			}
+		}
+	case *parse.ChainNode:
+		return c.node(n.Node, record)
+	case *parse.FieldNode:
+		if record {
+			return c.field(n, n.Ident[0])
+		}
+	case *parse.VariableNode:
+		// $ is the record everywhere
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			return c.field(n, n.Ident[1])
+		}
+	}
+	return nil
+}
+
+// branch checks the pipeline of the branch, evaluated with the outer dot,
+// and its lists. Dot is the record in the list if inner is true, and in
+// the else list if the outer dot is.
+func (c templateChecker) branch(n *parse.BranchNode, record, inner bool) error {
+	if err := c.node(n.Pipe, record); err != nil {
+		return err
+	}
+	if err := c.node(n.List, record && inner); err != nil {
+		return err
+	}
+	return c.node(n.ElseList, record)
+}
+
+// field returns an error if the record has no field or method called name.
+func (c templateChecker) field(node parse.Node, name string) error {
+	if _, ok := c.record.FieldByName(name); ok {
+		return nil
+	}
+	if _, ok := c.record.MethodByName(name); ok {
+		return nil
+	}
+	location, _ := c.tree.ErrorContext(node)
+	return fmt.Errorf("%s: can't evaluate field %s in type %s", location, name, c.record)
+}
+
+// templateOutput writes a line per edge or page, with the template of the
+// OutputConfig.
+type templateOutput struct {
+	crawler  *Crawler
+	w        io.Writer
+	template *template.Template
+	page     bool // TemplateScopePage
+}
+
+func (o templateOutput) write(r PageResult) error {
+	if o.page {
+		return o.execute(newTemplatePage(r))
+	}
+	if r.site.sitemap != nil {
+		// pages only found in the sitemap are linked from it
+		edge := TemplateEdge{Parent: r.site.sitemap.String(), URL: r.URL, Element: "sitemap", Count: 1}
+		if err := o.execute(edge); err != nil {
+			return err
+		}
+	}
+	for _, link := range r.Links {
+		edge := TemplateEdge{
+			Parent:       r.URL,
+			ParentStatus: r.StatusCode,
+			URL:          link.URL,
+			Element:      link.Element,
+			Text:         link.Text,
+			Asset:        link.Asset,
+			External:     link.External,
+			Count:        link.Count,
+		}
+		if err := o.execute(edge); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFailed writes the failed pages with TemplateScopePage. They have no
+// edges.
+func (o templateOutput) writeFailed(r PageResult) error {
+	if !o.page {
+		return nil
+	}
+	return o.execute(newTemplatePage(r))
+}
+
+// execute writes the record with the template, followed by a newline
+// unless the template ends with one.
+func (o templateOutput) execute(record interface{}) error {
+	var line strings.Builder
+	if err := o.template.Execute(&line, record); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(line.String(), "\n") {
+		line.WriteString("\n")
+	}
+	_, err := io.WriteString(o.w, line.String())
+	return err
+}
+
+func (o templateOutput) close() error {
+	return nil
+}
+
+func newTemplatePage(r PageResult) TemplatePage {
+	page := TemplatePage{
+		URL:      r.URL,
+		FinalURL: r.FinalURL,
+		Status:   r.StatusCode,
+		Depth:    r.Depth,
+		Duration: r.Duration,
+		Bytes:    r.Bytes,
+		Title:    r.Metadata.Title,
+		Links:    len(r.Links),
+	}
+	if r.site.Parent != nil {
+		page.Parent = r.site.Parent.String()
+	} else if r.site.sitemap != nil {
+		page.Parent = r.site.sitemap.String()
+	}
+	if r.Error != nil {
+		page.Error = r.Error.Error()
+	}
+	return page
+}
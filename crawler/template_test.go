@@ -0,0 +1,174 @@
+package crawler_test
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scanterog/crawler/crawler"
+	"github.com/stretchr/testify/assert"
+)
+
+// templateOfFields returns a template writing every exported field of the
+// record, so adding a field to it without a test fails.
+func templateOfFields(record interface{}) string {
+	var fields []string
+	recordType := reflect.TypeOf(record)
+	for i := 0; i < recordType.NumField(); i++ {
+		fields = append(fields, "{{."+recordType.Field(i).Name+"}}")
+	}
+	return strings.Join(fields, "|")
+}
+
+func newTemplateTestFetcher() *fakeFetcher {
+	return &fakeFetcher{pages: map[string]fakePage{
+		"http://example.test/robots.txt": {contentType: "text/plain", body: "User-agent: *\n"},
+		"http://example.test": {duration: 2 * time.Millisecond, body: `<title>Home</title><a href="/about">About us</a>
+<a href="/about">again</a><a href="/missing">missing</a><a href="https://golang.org">Go</a><img src="/logo.png">`},
+		"http://example.test/about":   {redirect: "http://example.test/about/", body: `<a href="/">home</a>`},
+		"http://example.test/missing": {status: http.StatusNotFound},
+		"http://example.test/sitemap.xml": {contentType: "application/xml", body: `<urlset>
+  <url><loc>http://example.test/orphan</loc></url>
+</urlset>`},
+		"http://example.test/orphan": {body: `orphan`},
+	}}
+}
+
+func TestRunTemplate(t *testing.T) {
+	t.Run("Edges", func(t *testing.T) {
+		assert.Equal(t, "{{.Parent}}|{{.ParentStatus}}|{{.URL}}|{{.Element}}|{{.Text}}|{{.Asset}}|{{.External}}|{{.Count}}",
+			templateOfFields(crawler.TemplateEdge{}))
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       "http://example.test",
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			UseSitemap:    true,
+			IncludeAssets: true,
+			Fetcher:       newTemplateTestFetcher(),
+			Template:      templateOfFields(crawler.TemplateEdge{}),
+		}
+		assert.NoError(t, c.Run())
+		assert.ElementsMatch(t, []string{
+			"http://example.test|200|http://example.test/about|a|About us|false|false|2\n",
+			"http://example.test|200|http://example.test/missing|a|missing|false|false|1\n",
+			"http://example.test|200|https://golang.org|a|Go|false|true|1\n",
+			"http://example.test|200|http://example.test/logo.png|img||true|false|1\n",
+			"http://example.test/about|200|http://example.test|a|home|false|false|1\n",
+			"http://example.test/sitemap.xml|0|http://example.test/orphan|sitemap||false|false|1\n",
+		}, siteMapLines(siteMapOutBuf))
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		assert.Equal(t, "{{.Parent}}|{{.URL}}|{{.FinalURL}}|{{.Status}}|{{.Depth}}|{{.Duration}}|{{.Bytes}}|{{.Title}}|{{.Links}}|{{.Error}}",
+			templateOfFields(crawler.TemplatePage{}))
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       "http://example.test",
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			UseSitemap:    true,
+			Fetcher:       newTemplateTestFetcher(),
+			Template:      templateOfFields(crawler.TemplatePage{}) + "\n",
+			TemplateScope: crawler.TemplateScopePage,
+		}
+		assert.NoError(t, c.Run())
+		assert.ElementsMatch(t, []string{
+			"|http://example.test|http://example.test|200|0|2ms|161|Home|3|\n",
+			"http://example.test|http://example.test/about|http://example.test/about/|200|1|1ms|20||1|\n",
+			"http://example.test|http://example.test/missing||404|1|0s|0||0|404 Not Found\n",
+			"http://example.test/sitemap.xml|http://example.test/orphan|http://example.test/orphan|200|0|1ms|6||0|\n",
+		}, siteMapLines(siteMapOutBuf))
+	})
+
+	t.Run("Coexists with the formats", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		ndjson := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       "http://example.test/orphan",
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Fetcher:       newTemplateTestFetcher(),
+			Template:      "{{.URL}} {{.Status}}",
+			TemplateScope: crawler.TemplateScopePage,
+			Outputs:       []crawler.OutputConfig{{Format: crawler.FormatNDJSON, Writer: ndjson}},
+		}
+		assert.NoError(t, c.Run())
+		assert.Equal(t, "http://example.test/orphan 200\n", siteMapOutBuf.String())
+		assert.Contains(t, ndjson.String(), `"url":"http://example.test/orphan"`)
+	})
+
+	t.Run("Functions failing on an empty record", func(t *testing.T) {
+		siteMapOutBuf := &bytes.Buffer{}
+		c := crawler.Crawler{
+			SeedURL:       "http://example.test/orphan",
+			NumWorkers:    crawler.DefaultNumWorkers,
+			SiteMapWriter: siteMapOutBuf,
+			Fetcher:       newTemplateTestFetcher(),
+			Template:      `{{slice .URL 0 4}} {{index .URL 4}} {{with .Title}}{{.Missing}}{{end}}{{printf "%.3f" .Duration.Seconds}}`,
+			TemplateScope: crawler.TemplateScopePage,
+		}
+		assert.NoError(t, c.Run())
+		assert.Equal(t, "http 58 0.001\n", siteMapOutBuf.String())
+	})
+}
+
+func TestRunInvalidTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		scope    string
+		err      string
+	}{
+		{
+			name:     "Parse error",
+			template: "{{.URL",
+			err:      `invalid template: template: output:1: unclosed action`,
+		},
+		{
+			name:     "Unknown field",
+			template: "{{.Title}}",
+			err:      `invalid template: output:1:2: can't evaluate field Title in type crawler.TemplateEdge`,
+		},
+		{
+			name:     "Unknown field in a branch",
+			template: "{{if .ParentStatus}}{{$.Title}}{{end}}",
+			err:      `invalid template: output:1:23: can't evaluate field Title in type crawler.TemplateEdge`,
+		},
+		{
+			name:     "Status of the edges",
+			template: "{{.Status}}",
+			err:      `invalid template: output:1:2: can't evaluate field Status in type crawler.TemplateEdge`,
+		},
+		{
+			name:     "Field of the other scope",
+			template: "{{.Element}}",
+			scope:    crawler.TemplateScopePage,
+			err:      `invalid template: output:1:2: can't evaluate field Element in type crawler.TemplatePage`,
+		},
+		{
+			name:     "Scope",
+			template: "{{.URL}}",
+			scope:    "link",
+			err:      crawler.ErrInvalidTemplateScope.Error(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fetcher := newTemplateTestFetcher()
+			c := crawler.Crawler{
+				SeedURL:       "http://example.test",
+				NumWorkers:    crawler.DefaultNumWorkers,
+				SiteMapWriter: &bytes.Buffer{},
+				Fetcher:       fetcher,
+				Template:      test.template,
+				TemplateScope: test.scope,
+			}
+			assert.EqualError(t, c.Run(), test.err)
+			assert.Empty(t, fetcher.fetched)
+		})
+	}
+}
@@ -5,15 +5,99 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/PuerkitoBio/goquery"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
+// urlNormalizer holds the crawler options applied to every
+// discovered URL once it has been made absolute.
+type urlNormalizer struct {
+	wwwHost       string   // if set, "www.host" and "host" are rewritten to this form
+	keepFragments bool     // if set, fragments are not removed
+	keepSlash     bool     // if set, trailing slashes are not removed
+	sessionParams []string // lower-cased names of the session ID parameters to remove
+}
+
+// normalizeHost rewrites the host of u to the seed's form when u
+// refers to the seed host with or without a leading "www.".
+func (n urlNormalizer) normalizeHost(u *url.URL) {
+	if n.wwwHost != "" && u.Host != n.wwwHost && stripWWW(u.Host) == stripWWW(n.wwwHost) {
+		u.Host = n.wwwHost
+	}
+}
+
+// normalizeRoot makes the root path of an absolute URL consistent:
+// it is always empty when trailing slashes are removed and always "/"
+// when they are kept.
+func (n urlNormalizer) normalizeRoot(u *url.URL) {
+	if u.Host == "" {
+		return
+	}
+	if n.keepSlash && u.Path == "" {
+		u.Path = "/"
+	}
+}
+
+// stripSessionIDs removes the session ID parameters from both the path
+// (e.g. ";jsessionid=ABC123") and the query string (e.g. "PHPSESSID=ABC123").
+func (n urlNormalizer) stripSessionIDs(u *url.URL) {
+	if len(n.sessionParams) == 0 {
+		return
+	}
+
+	if strings.Contains(u.Path, ";") {
+		segments := strings.Split(u.Path, "/")
+		for i, segment := range segments {
+			params := strings.Split(segment, ";")
+			kept := params[:1]
+			for _, param := range params[1:] {
+				if !n.isSessionParam(param) {
+					kept = append(kept, param)
+				}
+			}
+			segments[i] = strings.Join(kept, ";")
+		}
+		u.Path = strings.Join(segments, "/")
+		u.RawPath = ""
+	}
+
+	if u.RawQuery != "" {
+		var kept []string
+		for _, param := range strings.Split(u.RawQuery, "&") {
+			if !n.isSessionParam(param) {
+				kept = append(kept, param)
+			}
+		}
+		u.RawQuery = strings.Join(kept, "&")
+	}
+}
+
+// isSessionParam reports whether the "name=value" parameter is a
+// session ID.
+func (n urlNormalizer) isSessionParam(param string) bool {
+	name := strings.ToLower(strings.SplitN(param, "=", 2)[0])
+	for _, sessionParam := range n.sessionParams {
+		if name == sessionParam {
+			return true
+		}
+	}
+	return false
+}
+
 // strToURL parses a string and returns an url.URL object.
 // The URL might be absolute or relative.
 // Only http(s) schemes are considered valid.
-// Fragments are ignored and trailing slashes are removed.
+// Credentials and fragments are ignored and trailing slashes are removed.
 func strToURL(stringUrl string) (*url.URL, error) {
+	return urlNormalizer{}.parse(stringUrl)
+}
+
+// parse is like strToURL but honors the normalizer options.
+func (n urlNormalizer) parse(stringUrl string) (*url.URL, error) {
 	u, err := url.Parse(stringUrl)
 	if err != nil {
 		return nil, ErrInvalidURL
@@ -21,18 +105,33 @@ func strToURL(stringUrl string) (*url.URL, error) {
 	if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
 		return nil, ErrInvalidURLScheme
 	}
-	u.Fragment = ""
-	u.Path = strings.TrimSuffix(u.Path, "/")
+	if u.User != nil {
+		log.Debugf("Removing credentials from URL on host %q", u.Host)
+		u.User = nil
+	}
+	if !n.keepFragments {
+		u.Fragment = ""
+	}
+	n.stripSessionIDs(u)
+	if !n.keepSlash {
+		u.Path = strings.TrimSuffix(u.Path, "/")
+	}
 	if u.Path == "." {
 		u.Path = ""
 	}
+	n.normalizeRoot(u)
 	return u, nil
 }
 
 // strToAbsoluteURL parses a string and returns an url.URL object
 // only if it is an absolute URL (full URL).
 func strToAbsoluteURL(stringUrl string) (*url.URL, error) {
-	u, err := strToURL(stringUrl)
+	return urlNormalizer{}.parseAbsolute(stringUrl)
+}
+
+// parseAbsolute is like strToAbsoluteURL but honors the normalizer options.
+func (n urlNormalizer) parseAbsolute(stringUrl string) (*url.URL, error) {
+	u, err := n.parse(stringUrl)
 	if err != nil {
 		return nil, err
 	}
@@ -42,34 +141,462 @@ func strToAbsoluteURL(stringUrl string) (*url.URL, error) {
 	return u, nil
 }
 
-// getLinks parses the HTML document and returns a list
-// of URLs as a list of strings.
-func getLinks(siteContent io.Reader) ([]string, error) {
+// hasRel reports whether the link rel attribute contains any of the
+// given values.
+func (l Link) hasRel(values ...string) bool {
+	for _, token := range l.Rel {
+		for _, value := range values {
+			if token == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isNofollow reports whether the link asks crawlers not to follow it.
+func (l Link) isNofollow() bool {
+	return l.hasRel("nofollow", "ugc", "sponsored")
+}
+
+// assetSelector matches the elements referencing the resources of a page:
+// images, stylesheets and other link elements, scripts and frames. The
+// srcset image candidates, the media sources, the form actions and the url()
+// of the inline CSS are extracted apart (see parseSrcset, mediaSelector and
+// cssURLs).
+const assetSelector = "img[src], picture > source[src], link[href], script[src], iframe[src], frame[src]"
+
+// mediaSelector matches the video and audio elements, whose sources are in
+// their src attribute or in their source children. The media assets are
+// tagged with the name of the media element, also for the sources and the
+// video posters, so they are told apart from the images.
+const mediaSelector = "video, audio"
+
+// maxHeadingLength is the number of characters of the headings kept in the
+// page metadata.
+const maxHeadingLength = 200
+
+// robotsMetaNames holds the meta names whose content holds robots
+// directives for the crawler: the generic and the bot specific one.
+var robotsMetaNames = []string{"robots", strings.ToLower(strings.Split(DefaultCrawlerUserAgent, "/")[0])}
+
+// parseRobotsMeta applies the comma separated directives of a robots
+// meta tag to the page.
+func (p *PageData) parseRobotsMeta(content string) {
+	for _, directive := range strings.Split(content, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "noindex":
+			p.NoIndex = true
+		case "nofollow":
+			p.NoFollow = true
+		case "none":
+			p.NoIndex = true
+			p.NoFollow = true
+		}
+	}
+}
+
+// parsePage parses the HTML document and returns its links
+// and metadata.
+func parsePage(siteContent io.Reader) (PageData, error) {
+	return HTMLExtractor{}.parse(siteContent)
+}
+
+// parse parses the HTML document and returns its links and metadata, up to
+// the limits of the extractor.
+func (e HTMLExtractor) parse(siteContent io.Reader) (PageData, error) {
 	doc, err := goquery.NewDocumentFromReader(siteContent)
 	if err != nil {
-		return nil, err
+		return PageData{}, err
+	}
+
+	if !e.IncludeTemplates {
+		doc.Find("template").Remove()
+	}
+	if !e.SkipNoscript {
+		expandNoscript(doc)
+	}
+
+	var page PageData
+	// attr returns the value of the attribute, which is missing when
+	// it's longer than MaxAttributeLength
+	attr := func(element *goquery.Selection, name string) (string, bool) {
+		value, ok := element.Attr(name)
+		if ok && e.MaxAttributeLength > 0 && len(value) > e.MaxAttributeLength {
+			page.Truncated = true
+			return "", false
+		}
+		return value, ok
+	}
+	full := func(links []Link) bool {
+		if e.MaxLinks > 0 && len(links) >= e.MaxLinks {
+			page.Truncated = true
+			return true
+		}
+		return false
+	}
+	addAsset := func(asset Link) {
+		if !full(page.Assets) {
+			page.Assets = append(page.Assets, asset)
+		}
+	}
+	doc.Find("a[href], area[href]").EachWithBreak(func(index int, element *goquery.Selection) bool {
+		if full(page.Links) {
+			return false
+		}
+		href, ok := attr(element, "href")
+		if !ok {
+			return true
+		}
+		rel, _ := attr(element, "rel")
+		page.Links = append(page.Links, Link{Href: href, Rel: relTokens(rel), Element: goquery.NodeName(element), Text: linkText(element)})
+		return true
+	})
+	doc.Find(assetSelector).Each(func(index int, element *goquery.Selection) {
+		name := goquery.NodeName(element)
+		attrName := "src"
+		if name == "link" {
+			attrName = "href"
+		}
+		href, ok := attr(element, attrName)
+		if !ok {
+			return
+		}
+		rel, _ := attr(element, "rel")
+		asset := Link{Href: href, Rel: relTokens(rel), Element: name}
+		if name == "link" && asset.hasRel("canonical") {
+			return
+		}
+		if name == "link" && isAlternate(element) {
+			lang, _ := attr(element, "hreflang")
+			asset.Lang = strings.TrimSpace(lang)
+			if !full(page.Alternates) {
+				page.Alternates = append(page.Alternates, asset)
+			}
+			return
+		}
+		addAsset(asset)
+	})
+	// forms without action submit to the page itself
+	doc.Find("form[action]").Each(func(index int, element *goquery.Selection) {
+		action, _ := attr(element, "action")
+		method, _ := attr(element, "method")
+		method = strings.ToLower(strings.TrimSpace(method))
+		switch method {
+		case "post":
+		case "dialog":
+			// closes a dialog instead of submitting
+			return
+		default:
+			method = "get"
+		}
+		if strings.TrimSpace(action) != "" {
+			addAsset(Link{Href: action, Element: "form", Method: method})
+		}
+	})
+	doc.Find("[style]").Each(func(index int, element *goquery.Selection) {
+		style, _ := attr(element, "style")
+		for _, u := range cssURLs(style) {
+			addAsset(Link{Href: u, Element: "style"})
+		}
+	})
+	doc.Find("style").Each(func(index int, element *goquery.Selection) {
+		for _, u := range cssURLs(element.Text()) {
+			addAsset(Link{Href: u, Element: "style"})
+		}
+	})
+	doc.Find(mediaSelector).Each(func(index int, element *goquery.Selection) {
+		name := goquery.NodeName(element)
+		if src, ok := attr(element, "src"); ok {
+			addAsset(Link{Href: src, Element: name})
+		}
+		element.ChildrenFiltered("source[src]").Each(func(index int, source *goquery.Selection) {
+			if src, ok := attr(source, "src"); ok {
+				addAsset(Link{Href: src, Element: name})
+			}
+		})
+		if poster, ok := attr(element, "poster"); ok && name == "video" {
+			addAsset(Link{Href: poster, Element: name})
+		}
+	})
+	doc.Find("img[srcset], source[srcset]").Each(func(index int, element *goquery.Selection) {
+		srcset, _ := attr(element, "srcset")
+		for _, candidate := range parseSrcset(srcset) {
+			addAsset(Link{Href: candidate, Element: goquery.NodeName(element)})
+		}
+	})
+	lang, _ := attr(doc.Find("html").First(), "lang")
+	page.Metadata.Lang = parseLang(lang)
+	// the title elements of inline SVG images are not the page title
+	page.Metadata.Title = normalizeSpace(doc.Find("title").Not("svg title").First().Text())
+	h1 := doc.Find("h1")
+	page.Metadata.H1Count = h1.Length()
+	page.Metadata.H1 = truncateText(normalizeSpace(h1.First().Text()), maxHeadingLength)
+	doc.Find("link[rel][href][type]").Each(func(index int, element *goquery.Selection) {
+		rel, _ := attr(element, "rel")
+		href, ok := attr(element, "href")
+		feedType, _ := attr(element, "type")
+		if !ok || !(Link{Rel: relTokens(rel)}).hasRel("alternate") {
+			return
+		}
+		for _, t := range feedTypes {
+			if strings.EqualFold(strings.TrimSpace(feedType), t) {
+				page.Feeds = append(page.Feeds, href)
+			}
+		}
+	})
+	doc.Find("link[rel]").EachWithBreak(func(index int, element *goquery.Selection) bool {
+		rel, _ := attr(element, "rel")
+		href, exists := attr(element, "href")
+		if exists && (Link{Rel: relTokens(rel)}).hasRel("canonical") {
+			page.Canonical = href
+			return false
+		}
+		return true
+	})
+	var hasDescription, hasRobots bool
+	doc.Find("meta[name]").Each(func(index int, element *goquery.Selection) {
+		name, _ := attr(element, "name")
+		content, hasContent := attr(element, "content")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "description" && hasContent && !hasDescription {
+			hasDescription = true
+			page.Metadata.Description = normalizeSpace(content)
+		}
+		if name == "robots" && hasContent && !hasRobots {
+			hasRobots = true
+			page.Metadata.Robots = normalizeSpace(content)
+		}
+		for _, robotsName := range robotsMetaNames {
+			if strings.EqualFold(strings.TrimSpace(name), robotsName) {
+				page.parseRobotsMeta(content)
+			}
+		}
+	})
+	// OpenGraph properties are declared with the property attribute and
+	// Twitter cards with the name one, but both are mixed up in the wild
+	doc.Find("meta[property], meta[name]").Each(func(index int, element *goquery.Selection) {
+		content, ok := attr(element, "content")
+		if !ok {
+			return
+		}
+		property, ok := attr(element, "property")
+		if !ok {
+			property, _ = attr(element, "name")
+		}
+		page.Metadata.setSocialProperty(strings.ToLower(strings.TrimSpace(property)), content)
+	})
+
+	return page, nil
+}
+
+// expandNoscript replaces the content of the noscript elements, which the
+// parser keeps as text since it runs with scripting enabled, by its nodes,
+// so their links are extracted like the others.
+func expandNoscript(doc *goquery.Document) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	doc.Find("noscript").Each(func(index int, element *goquery.Selection) {
+		nodes, err := html.ParseFragment(strings.NewReader(element.Text()), body)
+		if err != nil {
+			return
+		}
+		noscript := element.Get(0)
+		for child := noscript.FirstChild; child != nil; child = noscript.FirstChild {
+			noscript.RemoveChild(child)
+		}
+		for _, node := range nodes {
+			noscript.AppendChild(node)
+		}
+	})
+}
+
+// parseSrcset returns the URLs of the image candidates of a srcset
+// attribute, e.g. "a.jpg 480w, b.jpg 2x". The URL runs until a whitespace
+// or a comma, since commas in the URLs must be percent-encoded (but for
+// the inline data: URLs, which can't be crawled anyway), and the
+// optional descriptors until the next comma outside parentheses. Malformed
+// descriptors are ignored, so the URLs of a malformed attribute are still
+// returned.
+func parseSrcset(srcset string) []string {
+	var urls []string
+	isSpace := func(c byte) bool {
+		return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+	}
+	i := 0
+	for i < len(srcset) {
+		for i < len(srcset) && (isSpace(srcset[i]) || srcset[i] == ',') {
+			i++
+		}
+		start := i
+		isData := strings.HasPrefix(strings.ToLower(srcset[start:]), "data:")
+		for i < len(srcset) && !isSpace(srcset[i]) && (isData || srcset[i] != ',') {
+			i++
+		}
+		candidate := srcset[start:i]
+		inParens := false
+		for ; i < len(srcset) && (inParens || srcset[i] != ','); i++ {
+			switch srcset[i] {
+			case '(':
+				inParens = true
+			case ')':
+				inParens = false
+			}
+		}
+		if candidate != "" {
+			urls = append(urls, candidate)
+		}
 	}
+	return urls
+}
 
-	var links []string
-	doc.Find("a").Each(func(index int, element *goquery.Selection) {
-		href, exists := element.Attr("href")
-		if exists {
-			links = append(links, href)
+// isAlternate reports whether the link element declares an alternate
+// version of the page, e.g. a translation: it has a hreflang or it's a
+// rel="alternate" link but for the feeds.
+func isAlternate(element *goquery.Selection) bool {
+	if _, ok := element.Attr("hreflang"); ok {
+		return true
+	}
+	rel, _ := element.Attr("rel")
+	if !(Link{Rel: relTokens(rel)}).hasRel("alternate") {
+		return false
+	}
+	linkType, _ := element.Attr("type")
+	for _, t := range feedTypes {
+		if strings.EqualFold(strings.TrimSpace(linkType), t) {
+			return false
 		}
+	}
+	return true
+}
+
+// linkText returns the whitespace-normalized text of the anchor or, if it
+// has none, e.g. an image link, the alt text of the area or of its first
+// image having one.
+func linkText(s *goquery.Selection) string {
+	text := normalizeSpace(s.Text())
+	if text != "" {
+		return text
+	}
+	if alt, ok := s.Attr("alt"); ok {
+		return normalizeSpace(alt)
+	}
+	s.Find("img[alt]").EachWithBreak(func(index int, img *goquery.Selection) bool {
+		alt, _ := img.Attr("alt")
+		text = normalizeSpace(alt)
+		return text == ""
 	})
+	return text
+}
+
+// normalizeSpace trims the text and collapses its runs of whitespace.
+func normalizeSpace(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// truncateText cuts the text to max characters.
+func truncateText(text string, max int) string {
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	return string([]rune(text)[:max])
+}
+
+// relTokens splits a rel attribute value into its lower-cased tokens.
+func relTokens(rel string) []string {
+	return strings.Fields(strings.ToLower(rel))
+}
 
-	return links, nil
+// getLinks parses the HTML document and returns the list
+// of anchors found.
+func getLinks(siteContent io.Reader) ([]Link, error) {
+	page, err := parsePage(siteContent)
+	if err != nil {
+		return nil, err
+	}
+	return page.Links, nil
+}
+
+// nonWebSchemes holds the link schemes that are classified and counted
+// rather than treated as invalid URLs.
+var nonWebSchemes = []string{"mailto", "tel", "javascript", "data"}
+
+// nonWebScheme returns the scheme of the link if it's one of the known
+// non-web schemes. It's checked before any URL parsing so these links
+// can't ever be mistaken for relative paths.
+func nonWebScheme(href string) (string, bool) {
+	href = strings.ToLower(strings.TrimSpace(href))
+	for _, scheme := range nonWebSchemes {
+		if strings.HasPrefix(href, scheme+":") {
+			return scheme, true
+		}
+	}
+	return "", false
 }
 
 func isExternalURL(s webSite) bool {
 	return s.Parent != nil && s.URL.Host != s.Parent.Host
 }
 
+// schemelessKey returns the string form of u without its scheme.
+func schemelessKey(u *url.URL) string {
+	return strings.TrimPrefix(u.String(), u.Scheme)
+}
+
+// stripWWW removes a leading "www." from the given host.
+func stripWWW(host string) string {
+	return strings.TrimPrefix(strings.ToLower(host), "www.")
+}
+
+// pathSegments returns the number of non-empty segments in the URL path.
+func pathSegments(u *url.URL) int {
+	n := 0
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// maxConsecutiveSegments returns the highest number of times a single
+// path segment is repeated back to back, e.g. 3 for "/docs/docs/docs/intro".
+func maxConsecutiveSegments(u *url.URL) int {
+	max, run := 0, 0
+	previous := ""
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "" {
+			continue
+		}
+		if segment == previous {
+			run++
+		} else {
+			run = 1
+			previous = segment
+		}
+		if run > max {
+			max = run
+		}
+	}
+	return max
+}
+
 func isRelativeURL(u *url.URL) bool {
 	return u.Scheme == "" || u.Host == ""
 }
 
+// mediaURLRegexp matches the paths of media files, which are never crawled.
+var mediaURLRegexp = regexp.MustCompile(`(?i)\.(jpg|jpeg|png|svg|gif|pdf|csv)$`)
+
 func isMediaURL(u *url.URL) bool {
-	r, _ := regexp.Compile(`\.(jpg|jpeg|png|svg|gif|pdf|csv)$`)
-	return r.MatchString(u.Path)
+	return mediaURLRegexp.MatchString(u.Path)
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter struct {
+	n int64
+}
+
+func (b *byteCounter) Write(p []byte) (int, error) {
+	b.n += int64(len(p))
+	return len(p), nil
 }
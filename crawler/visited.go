@@ -0,0 +1,124 @@
+package crawler
+
+import (
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// VisitedStore keeps the set of visited pages, identified by their dedup
+// key (see DedupKeyFunc). It's only used from the goroutine admitting the
+// discovered URLs, so implementations don't need to be safe for concurrent
+// use.
+type VisitedStore interface {
+	Seen(key string) bool // reports whether the key was added
+	Add(key string) error // adds the key to the set
+	Close() error         // releases the resources of the store
+}
+
+// mapVisitedStore is the default in-memory VisitedStore.
+type mapVisitedStore map[string]bool
+
+func (m mapVisitedStore) Seen(key string) bool {
+	return m[key]
+}
+
+func (m mapVisitedStore) Add(key string) error {
+	m[key] = true
+	return nil
+}
+
+func (m mapVisitedStore) Close() error {
+	return nil
+}
+
+// boltBatchSize is the number of keys written to the database per
+// transaction. Committing every key would fsync once per page.
+const boltBatchSize = 1000
+
+var boltVisitedBucket = []byte("visited")
+
+// BoltVisitedStore is a VisitedStore persisted in a BoltDB file, so its
+// size is not bound by memory and the pages visited by a crawl are not
+// fetched again by the next ones. It doesn't resume a crawl: keys are added
+// when the pages are admitted, before they are fetched, and the frontier is
+// not persisted, so the pages waiting or being fetched when a crawl stops
+// are never crawled by the next ones, nor the pages only linked from them.
+// Keys are committed in batches of boltBatchSize and on Close, so the last
+// ones added may be lost on a crash and crawled again.
+type BoltVisitedStore struct {
+	db      *bolt.DB
+	pending map[string]bool // added keys not committed yet
+}
+
+// NewBoltVisitedStore opens the BoltDB file at path, creating it if
+// needed. The keys added to it by previous crawls are reported as seen.
+func NewBoltVisitedStore(path string) (*BoltVisitedStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't open visited store %q: %s", path, err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltVisitedBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("can't open visited store %q: %s", path, err.Error())
+	}
+	return &BoltVisitedStore{db: db, pending: make(map[string]bool)}, nil
+}
+
+// Seen reports whether the key was added. Read errors are reported as not
+// seen, so the page is crawled again.
+func (s *BoltVisitedStore) Seen(key string) bool {
+	if s.pending[key] {
+		return true
+	}
+	seen := false
+	s.db.View(func(tx *bolt.Tx) error {
+		seen = tx.Bucket(boltVisitedBucket).Get([]byte(key)) != nil
+		return nil
+	})
+	return seen
+}
+
+// Add adds the key to the set, committing the pending keys once there are
+// boltBatchSize of them.
+func (s *BoltVisitedStore) Add(key string) error {
+	s.pending[key] = true
+	if len(s.pending) < boltBatchSize {
+		return nil
+	}
+	return s.flush()
+}
+
+// flush commits the pending keys.
+func (s *BoltVisitedStore) flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltVisitedBucket)
+		for key := range s.pending {
+			if err := b.Put([]byte(key), []byte{1}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("can't write visited store: %s", err.Error())
+	}
+	s.pending = make(map[string]bool)
+	return nil
+}
+
+// Close commits the pending keys and closes the database.
+func (s *BoltVisitedStore) Close() error {
+	err := s.flush()
+	if closeErr := s.db.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("can't close visited store: %s", closeErr.Error())
+	}
+	return err
+}
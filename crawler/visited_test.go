@@ -0,0 +1,80 @@
+package crawler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "visited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestBoltVisitedStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "visited.db")
+
+	s, err := NewBoltVisitedStore(path)
+	assert.NoError(t, err)
+	// more than a batch so both committed and pending keys are checked
+	for i := 0; i < boltBatchSize+10; i++ {
+		assert.NoError(t, s.Add(fmt.Sprintf("example.com/%d", i)))
+	}
+	assert.True(t, s.Seen("example.com/0"))
+	assert.True(t, s.Seen(fmt.Sprintf("example.com/%d", boltBatchSize+5)))
+	assert.False(t, s.Seen("example.com/other"))
+	assert.NoError(t, s.Close())
+
+	// the keys survive reopening the store, as after a restart
+	s, err = NewBoltVisitedStore(path)
+	assert.NoError(t, err)
+	defer s.Close()
+	for i := 0; i < boltBatchSize+10; i++ {
+		assert.True(t, s.Seen(fmt.Sprintf("example.com/%d", i)))
+	}
+	assert.False(t, s.Seen("example.com/other"))
+}
+
+func TestNewBoltVisitedStoreError(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	_, err := NewBoltVisitedStore(filepath.Join(dir, "missing", "visited.db"))
+	assert.Error(t, err)
+}
+
+func benchmarkVisitedStore(b *testing.B, s VisitedStore) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("example.com/page/%d", i)
+		if !s.Seen(key) {
+			s.Add(key)
+		}
+		// most discovered links point to already visited pages
+		s.Seen(fmt.Sprintf("example.com/page/%d", i/2))
+	}
+}
+
+func BenchmarkVisitedStore(b *testing.B) {
+	b.Run("Map", func(b *testing.B) {
+		benchmarkVisitedStore(b, mapVisitedStore{})
+	})
+	b.Run("Bolt", func(b *testing.B) {
+		dir := tempDir(b)
+		defer os.RemoveAll(dir)
+		s, err := NewBoltVisitedStore(filepath.Join(dir, "visited.db"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer s.Close()
+		benchmarkVisitedStore(b, s)
+	})
+}
@@ -1,9 +1,13 @@
 module github.com/scanterog/crawler
 
-go 1.12
+go 1.16
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	golang.org/x/time v0.3.0
+	modernc.org/sqlite v1.17.3
 )
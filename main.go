@@ -1,26 +1,212 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/scanterog/crawler/crawler"
 	log "github.com/sirupsen/logrus"
 )
 
+// exitCodeInterrupted is returned when the crawl is stopped by SIGINT or
+// SIGTERM, after writing the site map of the pages crawled so far.
+const exitCodeInterrupted = 130
+
+// Exit codes of the failed crawls, so they can check the links in CI.
+const (
+	exitCodeFailOn     = 2 // a -fail-on condition was met
+	exitCodeSeedFailed = 3 // a seed could not be crawled
+)
+
 var (
-	helpMsgNumWorkers        = "Number of concurrent workers crawling sites."
-	helpMsgHttpClientTimeout = "Time limit (in sec) for a HTTP request. A Timeout of zero means no timeout."
-	helpMsgSiteMapOutputFile = "File path where the site map will be written to."
-	helpMsgDebug             = "Enable debug mode."
+	helpMsgNumWorkers         = "Number of concurrent workers crawling sites."
+	helpMsgMaxConcurrent      = "Max number of concurrent requests to a single host. Zero means no limit other than -num-workers."
+	helpMsgHttpClientTimeout  = "Time limit (in sec) for a HTTP request. A Timeout of zero means no timeout."
+	helpMsgSiteMapOutputFile  = "File path where the site map will be written to."
+	helpMsgOutput             = "Additional site map written by the same crawl, as format=path, e.g. ndjson=crawl.ndjson. A path ending in .gz is compressed with gzip and - is the standard output. It can be repeated."
+	helpMsgIgnoreOutputErrors = "Log the errors writing a site map and keep writing it, instead of failing the crawl."
+	helpMsgCompress           = "Compression of the site map: none or gzip. Gzip by default when -output-file ends in .gz."
+	helpMsgFormat             = "Format of the site map: text (parent -> child lines) or xml-sitemap (sitemaps.org urlset of the indexable pages fetched, split into several files listed by a sitemap index beyond 50,000 URLs), image-sitemap (the same urlset with the images of every page on its host, leaving out the pages without any), json (a document with every page and its links, written at the end of the crawl), ndjson (a JSON record per page and line, written as soon as it's fetched or fails), csv (source,target,link_type,status,anchor_text rows, written at the end of the crawl), dot (Graphviz digraph of the links, written at the end of the crawl), mermaid (Mermaid flowchart of the links, written at the end of the crawl), tree (internal URLs indented by path with their status and inbound links, written at the end of the crawl) or html (self-contained report with the summary, a sortable table of pages, the broken links and the external domains, written at the end of the crawl)."
+	helpMsgMaxNodes           = "With -format mermaid, max number of nodes drawn, the nearest to the seed. The rest are counted in a single node."
+	helpMsgDOTMaxDepth        = "With -format dot, only draw the links of the pages less than this many links away from the seed. Zero means unlimited."
+	helpMsgDOTStatusColors    = "With -format dot, fill the nodes with a color by status code: green for 2xx, yellow for 3xx and red for 4xx and 5xx."
+	helpMsgTemplate           = "Go text/template written for every link or page of the site map instead of -format, e.g. '{{.Parent}} {{.URL}} {{.Text}}'. Links have the fields Parent, ParentStatus, URL, Element, Text, Asset, External and Count; pages have Parent, URL, FinalURL, Status, Depth, Duration, Bytes, Title, Links (count) and Error."
+	helpMsgTemplateScope      = "What -template is written for: edge (every link) or page (every page, also the failed ones)."
+	helpMsgCSVPages           = "With -format csv, file where a url,status,depth,title,links,bytes,latency_ms row per page will be written."
+	helpMsgMaxJSONPages       = "With -format json, max number of pages kept in memory. The crawl fails beyond it."
+	helpMsgEquateWWW          = "Treat www.<host> and <host> as the same site."
+	helpMsgSchemeSensitive    = "Treat http and https variants of a URL as different pages."
+	helpMsgDedupeEdges        = "Write each parent -> child edge of the site map once, comparing the URLs like the visited set (e.g. regardless of the scheme)."
+	helpMsgMaxDedupeEdges     = "With -dedupe-edges, max number of edges remembered. Beyond it, edges may be repeated."
+	helpMsgEdgeCounts         = "With -format text, annotate each edge with the number of links of the parent to the child, e.g. \"A -> B [3]\"."
+	helpMsgKeepFragments      = "Keep URL fragments (e.g. hash routes) instead of dropping them."
+	helpMsgKeepTrailingSlash  = "Keep trailing slashes so /docs and /docs/ are different pages."
+	helpMsgMaxURLLength       = "Discovered URLs longer than this are not crawled."
+	helpMsgMaxPathSegments    = "Discovered URLs with more path segments than this are not crawled. Zero means unlimited."
+	helpMsgMaxRepeatedSegs    = "Discovered URLs repeating a path segment consecutively more than this are not crawled."
+	helpMsgMaxDepth           = "Pages more links away from the seed than this are not crawled. Zero means unlimited."
+	helpMsgMaxPages           = "Stop crawling once this many pages have been fetched. Zero means unlimited."
+	helpMsgMaxDuration        = "Stop crawling once this much time has elapsed, e.g. 10m. Zero means unlimited."
+	helpMsgPageDeadline       = "Time limit to fetch, read and parse a page, e.g. 30s. Zero means no deadline."
+	helpMsgMaxParseTime       = "Time limit to parse a page, e.g. 5s. Zero means unlimited."
+	helpMsgMaxLinksPerPage    = "Max number of links, and of assets, taken from a page. The others are left out."
+	helpMsgMaxAttributeLength = "Attribute values of the pages longer than this (in bytes) are ignored."
+	helpMsgIncludeTemplates   = "Also crawl the links inside template elements, which are inert content."
+	helpMsgSkipNoscript       = "Don't crawl the links inside noscript elements."
+	helpMsgDelay              = "Min time between two requests to the same host, e.g. 500ms. A 20% random jitter is applied."
+	helpMsgOverrideCrawlDelay = "Use -delay even when the robots.txt Crawl-delay is longer."
+	helpMsgMaxCrawlDelay      = "robots.txt Crawl-delay values longer than this are clamped."
+	helpMsgOrder              = "Order the pages are crawled in: bfs (breadth-first) or dfs (depth-first)."
+	helpMsgRate               = "Max number of requests per second across the whole crawl. Zero means unlimited."
+	helpMsgPatternBudgets     = `Max number of crawled URLs per pattern as JSON, e.g. '[{"pattern": "\\?page=\\d+", "max": 50}]'.`
+	helpMsgDirBudgets         = `Max number of pages fetched under each path prefix as JSON, e.g. '{"/forum/": 200}'.`
+	helpMsgRespectNofollow    = `Don't crawl links marked as rel="nofollow", "ugc" or "sponsored".`
+	helpMsgRespectRobotsMeta  = "Honor the noindex and nofollow directives of the robots meta tags."
+	helpMsgOnlyLang           = "Only follow the links of the pages in this language or its variants, e.g. de, or with no language."
+	helpMsgSessionParams      = "Comma separated list of session ID parameters removed from URLs."
+	helpMsgIncludeSubdomains  = "Follow links to other subdomains of the seed's registrable domain."
+	helpMsgDenylistFile       = `File with URLs, path prefixes and "re:" regular expressions never crawled, one per line.`
+	helpMsgIgnoreRobots       = "Don't fetch robots.txt nor honor its rules. Only for crawling your own sites."
+	helpMsgUseSitemap         = "Also crawl the pages listed in the /sitemap.xml of the seed host."
+	helpMsgFollowSeedRedir    = "When the seed URL redirects to another host, crawl that host instead."
+	helpMsgInternalOnly       = "Omit the links to external URLs from the site map."
+	helpMsgExternalDomains    = "File where the external domains linked from the pages will be written, with the number of pages linking to them and of links."
+	helpMsgGroupExternal      = "Count the links to external hosts by registrable domain, e.g. google.com for maps.google.com."
+	helpMsgIncludeAssets      = "Also write the links to the images, video and audio, stylesheets, scripts, frames and form actions of the pages to the site map. They are never crawled."
+	helpMsgCrawlFrames        = "Crawl the iframes and frames on the host of the page like links instead of recording them as assets."
+	helpMsgFetchStylesheets   = "With -include-assets, also fetch the stylesheets on the host of the pages to write the links to the resources they reference."
+	helpMsgFollowFeeds        = "Fetch the RSS and Atom feeds on the host of the pages to crawl their items."
+	helpMsgFeedReport         = "File where the URLs of the RSS and Atom feeds advertised by the pages fetched will be written."
+	helpMsgMixedContentReport = "File where the http URLs referenced by the https pages fetched will be written, by page and element."
+	helpMsgDuplicatesReport   = "File where the clusters of pages fetched with the same content will be written, one per line."
+	helpMsgHashNormalizeSpace = "Collapse the whitespace of the pages before hashing them, so pages only differing in whitespace are duplicates."
+	helpMsgMaxDuplicatePages  = "With -duplicates-report, max number of pages checked for duplicates, the first ones fetched, to bound the memory used."
+	helpMsgFollowForms        = "Crawl the actions of the GET forms like links instead of recording them as assets. POST forms are never crawled."
+	helpMsgSkippedReport      = "File where the skipped URLs, with their reason and parents, will be written to."
+	helpMsgBrokenLinksReport  = "File where the URLs that could not be fetched, with their status or error and the pages linking to them, will be written to."
+	helpMsgExternalReport     = "File where the external URLs linked, with the number of pages linking to them and some of those pages, will be written to."
+	helpMsgMaxExternalSources = "With -external-links-report, max number of pages linking to each external URL written."
+	helpMsgMaxSlowestPages    = "Number of slowest pages listed in the summary and the html report, with their status and size."
+	helpMsgRedirectsReport    = "File where the pages fetched after 2 or more redirects and the redirect loops, with their hops and final status, will be written to."
+	helpMsgCheckExternal      = "Check that the external URLs linked resolve, with a HEAD request falling back to GET, without crawling them. The broken ones are written to -broken-links-report."
+	helpMsgExternalWorkers    = "With -check-external, max number of concurrent checks."
+	helpMsgExternalRate       = "With -check-external, max number of checks per second, across all hosts. Zero means unlimited."
+	helpMsgExternalDelay      = "With -check-external, min time between two checks to the same host."
+	helpMsgVisitedDB          = "BoltDB file where the visited pages are kept, so they are not crawled again by the next runs. It doesn't resume an interrupted crawl."
+	helpMsgBloomExpected      = "Keep the visited pages in a Bloom filter sized for this many URLs, using bounded memory at the cost of wrongly skipping a few pages. Zero means an exact set."
+	helpMsgBloomFPRate        = "False positive rate of the Bloom filter: the fraction of pages wrongly skipped."
+	helpMsgIncremental        = "File where the state of the crawl is kept, so the next crawl only downloads and parses the pages that changed."
+	helpMsgOutputSQLite       = "SQLite database file where the pages and links are written as soon as they are fetched. An existing database is appended to, each crawl with its own run_id."
+	helpMsgIncrementalReport  = "File where every page crawled will be written along with whether it was revalidated, refetched, new or removed."
+	helpMsgDepthReport        = "File where every page fetched will be written along with its depth: the number of links followed from the seed."
+	helpMsgTitleReport        = "File where every page fetched will be written along with its title."
+	helpMsgSeedsFile          = `File with seed URLs, one per line, crawled along with SEED_URL. Use "-" to read from stdin.`
+	helpMsgDryRun             = "Only fetch the seed pages and print whether each of their links would be crawled or why not."
+	helpMsgFailOn             = "Exit with 2 when the condition is met, e.g. broken-internal>0. The crawl always exits with 3 when a seed could not be crawled. The conditions compare broken-internal, broken-external (with -check-external), pages-failed or redirect-loops to a number with > or >=. Repeat it or separate them with commas."
+	helpMsgDebug              = "Enable debug mode."
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		diff(os.Args[2:])
+		return
+	}
 	numWorkers := flag.Int("num-workers", crawler.DefaultNumWorkers, helpMsgNumWorkers)
+	maxConcurrentPerHost := flag.Int("max-concurrent-per-host", 0, helpMsgMaxConcurrent)
 	httpClientTimeout := flag.Int("client-timeout", crawler.DefaultHTTPClientTimeoutSec, helpMsgHttpClientTimeout)
 	siteMapOutputFile := flag.String("output-file", os.Stdout.Name(), helpMsgSiteMapOutputFile)
+	compress := flag.String("compress", "", helpMsgCompress)
+	var outputs outputFlags
+	flag.Var(&outputs, "output", helpMsgOutput)
+	var failOn failOnFlags
+	flag.Var(&failOn, "fail-on", helpMsgFailOn)
+	ignoreOutputErrors := flag.Bool("ignore-output-errors", false, helpMsgIgnoreOutputErrors)
+	format := flag.String("format", crawler.FormatText, helpMsgFormat)
+	outputTemplate := flag.String("template", "", helpMsgTemplate)
+	templateScope := flag.String("template-scope", crawler.TemplateScopeEdge, helpMsgTemplateScope)
+	csvPages := flag.String("csv-pages", "", helpMsgCSVPages)
+	dotMaxDepth := flag.Int("dot-max-depth", 0, helpMsgDOTMaxDepth)
+	maxNodes := flag.Int("max-nodes", crawler.DefaultMaxMermaidNodes, helpMsgMaxNodes)
+	dotStatusColors := flag.Bool("dot-status-colors", false, helpMsgDOTStatusColors)
+	maxJSONPages := flag.Int("max-json-pages", crawler.DefaultMaxJSONPages, helpMsgMaxJSONPages)
+	equateWWW := flag.Bool("equate-www", false, helpMsgEquateWWW)
+	schemeSensitive := flag.Bool("scheme-sensitive", false, helpMsgSchemeSensitive)
+	keepFragments := flag.Bool("keep-fragments", false, helpMsgKeepFragments)
+	dedupeEdges := flag.Bool("dedupe-edges", false, helpMsgDedupeEdges)
+	maxDedupeEdges := flag.Int("max-dedupe-edges", crawler.DefaultMaxDedupeEdges, helpMsgMaxDedupeEdges)
+	edgeCounts := flag.Bool("edge-counts", false, helpMsgEdgeCounts)
+	keepTrailingSlash := flag.Bool("keep-trailing-slash", false, helpMsgKeepTrailingSlash)
+	maxURLLength := flag.Int("max-url-length", crawler.DefaultMaxURLLength, helpMsgMaxURLLength)
+	maxPathSegments := flag.Int("max-path-segments", 0, helpMsgMaxPathSegments)
+	maxRepeatedSegments := flag.Int("max-repeated-segments", crawler.DefaultMaxRepeatedSegments, helpMsgMaxRepeatedSegs)
+	maxDepth := flag.Int("max-depth", 0, helpMsgMaxDepth)
+	maxPages := flag.Int("max-pages", 0, helpMsgMaxPages)
+	maxDuration := flag.Duration("max-duration", 0, helpMsgMaxDuration)
+	pageDeadline := flag.Duration("page-deadline", 0, helpMsgPageDeadline)
+	maxParseTime := flag.Duration("max-parse-time", 0, helpMsgMaxParseTime)
+	maxLinksPerPage := flag.Int("max-links-per-page", crawler.DefaultMaxLinksPerPage, helpMsgMaxLinksPerPage)
+	maxAttributeLength := flag.Int("max-attribute-length", crawler.DefaultMaxAttributeLength, helpMsgMaxAttributeLength)
+	includeTemplates := flag.Bool("include-templates", false, helpMsgIncludeTemplates)
+	skipNoscript := flag.Bool("skip-noscript", false, helpMsgSkipNoscript)
+	delay := flag.Duration("delay", 0, helpMsgDelay)
+	overrideCrawlDelay := flag.Bool("override-crawl-delay", false, helpMsgOverrideCrawlDelay)
+	maxCrawlDelay := flag.Duration("max-crawl-delay", crawler.DefaultMaxCrawlDelay, helpMsgMaxCrawlDelay)
+	order := flag.String("order", crawler.OrderBFS, helpMsgOrder)
+	requestRate := flag.Float64("rate", 0, helpMsgRate)
+	patternBudgets := flag.String("pattern-budgets", "", helpMsgPatternBudgets)
+	dirBudgets := flag.String("dir-budgets", "", helpMsgDirBudgets)
+	respectNofollow := flag.Bool("respect-nofollow", false, helpMsgRespectNofollow)
+	respectRobotsMeta := flag.Bool("respect-robots-meta", false, helpMsgRespectRobotsMeta)
+	onlyLang := flag.String("only-lang", "", helpMsgOnlyLang)
+	sessionParams := flag.String("session-params", strings.Join(crawler.DefaultSessionParams, ","), helpMsgSessionParams)
+	includeSubdomains := flag.Bool("include-subdomains", false, helpMsgIncludeSubdomains)
+	denylistFile := flag.String("denylist-file", "", helpMsgDenylistFile)
+	ignoreRobots := flag.Bool("ignore-robots", false, helpMsgIgnoreRobots)
+	useSitemap := flag.Bool("use-sitemap", false, helpMsgUseSitemap)
+	followSeedRedirect := flag.Bool("follow-seed-redirect", false, helpMsgFollowSeedRedir)
+	internalOnly := flag.Bool("internal-only", false, helpMsgInternalOnly)
+	externalDomainsReport := flag.String("external-domains-report", "", helpMsgExternalDomains)
+	groupExternalDomains := flag.Bool("group-external-domains", false, helpMsgGroupExternal)
+	includeAssets := flag.Bool("include-assets", false, helpMsgIncludeAssets)
+	crawlFrames := flag.Bool("crawl-frames", false, helpMsgCrawlFrames)
+	followForms := flag.Bool("follow-forms", false, helpMsgFollowForms)
+	followFeeds := flag.Bool("follow-feeds", false, helpMsgFollowFeeds)
+	feedReport := flag.String("feed-report", "", helpMsgFeedReport)
+	mixedContentReport := flag.String("mixed-content-report", "", helpMsgMixedContentReport)
+	duplicatesReport := flag.String("duplicates-report", "", helpMsgDuplicatesReport)
+	hashNormalizeSpace := flag.Bool("hash-normalize-space", false, helpMsgHashNormalizeSpace)
+	maxDuplicatePages := flag.Int("max-duplicate-pages", crawler.DefaultMaxDuplicatePages, helpMsgMaxDuplicatePages)
+	fetchStylesheets := flag.Bool("fetch-stylesheets", false, helpMsgFetchStylesheets)
+	skippedReport := flag.String("skipped-report", "", helpMsgSkippedReport)
+	brokenLinksReport := flag.String("broken-links-report", "", helpMsgBrokenLinksReport)
+	externalLinksReport := flag.String("external-links-report", "", helpMsgExternalReport)
+	maxExternalSources := flag.Int("max-external-sources", crawler.DefaultMaxExternalSources, helpMsgMaxExternalSources)
+	maxSlowestPages := flag.Int("max-slowest-pages", crawler.DefaultMaxSlowestPages, helpMsgMaxSlowestPages)
+	redirectsReport := flag.String("redirects-report", "", helpMsgRedirectsReport)
+	checkExternal := flag.Bool("check-external", false, helpMsgCheckExternal)
+	externalWorkers := flag.Int("external-workers", crawler.DefaultExternalWorkers, helpMsgExternalWorkers)
+	externalRate := flag.Float64("external-rate", 0, helpMsgExternalRate)
+	externalDelay := flag.Duration("external-delay", crawler.DefaultExternalDelay, helpMsgExternalDelay)
+	visitedDB := flag.String("visited-db", "", helpMsgVisitedDB)
+	bloomExpected := flag.Int("bloom-expected-urls", 0, helpMsgBloomExpected)
+	bloomFPRate := flag.Float64("bloom-fp-rate", 0.001, helpMsgBloomFPRate)
+	incremental := flag.String("incremental", "", helpMsgIncremental)
+	outputSQLite := flag.String("output-sqlite", "", helpMsgOutputSQLite)
+	incrementalReport := flag.String("incremental-report", "", helpMsgIncrementalReport)
+	depthReport := flag.String("depth-report", "", helpMsgDepthReport)
+	titleReport := flag.String("title-report", "", helpMsgTitleReport)
+	seedsFile := flag.String("seeds-file", "", helpMsgSeedsFile)
+	dryRun := flag.Bool("dry-run", false, helpMsgDryRun)
 	debug := flag.Bool("debug", false, helpMsgDebug)
 	flag.Parse()
 
@@ -30,29 +216,415 @@ func main() {
 	}
 
 	args := flag.Args()
-	if len(args) != 1 {
+	if len(args) > 1 || (len(args) == 0 && *seedsFile == "") {
 		usage()
 	}
-	seedURL := args[0]
+	seedURL := ""
+	if len(args) == 1 {
+		seedURL = args[0]
+	}
+	var seedURLs []string
+	if *seedsFile != "" {
+		seedURLs = readSeeds(*seedsFile)
+	}
+
+	var budgets []crawler.PatternBudget
+	if *patternBudgets != "" {
+		if err := json.Unmarshal([]byte(*patternBudgets), &budgets); err != nil {
+			log.Fatalf("Invalid pattern budgets: %s", err.Error())
+		}
+	}
+
+	var dirBudgetsMap map[string]int
+	if *dirBudgets != "" {
+		if err := json.Unmarshal([]byte(*dirBudgets), &dirBudgetsMap); err != nil {
+			log.Fatalf("Invalid dir budgets: %s", err.Error())
+		}
+	}
 
 	c := crawler.Crawler{
 		SeedURL:              seedURL,
+		SeedURLs:             seedURLs,
 		NumWorkers:           *numWorkers,
+		MaxConcurrentPerHost: *maxConcurrentPerHost,
 		HTTPClientTimeoutSec: *httpClientTimeout,
 		SiteMapOutputFile:    *siteMapOutputFile,
+		Compress:             *compress,
+		Outputs:              outputs,
+		IgnoreOutputErrors:   *ignoreOutputErrors,
+		Format:               *format,
+		Template:             *outputTemplate,
+		TemplateScope:        *templateScope,
+		MaxJSONPages:         *maxJSONPages,
+		DOTMaxDepth:          *dotMaxDepth,
+		DOTStatusColors:      *dotStatusColors,
+		MaxMermaidNodes:      *maxNodes,
+		InternalOnly:         *internalOnly,
+		GroupExternalDomains: *groupExternalDomains,
+		IncludeAssets:        *includeAssets,
+		CrawlFrames:          *crawlFrames,
+		FollowForms:          *followForms,
+		FollowFeeds:          *followFeeds,
+		FetchStylesheets:     *fetchStylesheets,
+		RecordSkipped:        *skippedReport != "",
+		RecordBrokenLinks:    *brokenLinksReport != "" || len(failOn) > 0,
+		RecordRedirects:      *redirectsReport != "",
+		MaxSlowestPages:      *maxSlowestPages,
+		RecordExternalURLs:   *externalLinksReport != "",
+		MaxExternalSources:   *maxExternalSources,
+		CheckExternal:        *checkExternal,
+		ExternalWorkers:      *externalWorkers,
+		ExternalRate:         *externalRate,
+		ExternalDelay:        *externalDelay,
+		EquateWWW:            *equateWWW,
+		SchemeSensitive:      *schemeSensitive,
+		IncludeSubdomains:    *includeSubdomains,
+		FollowSeedRedirect:   *followSeedRedirect,
+		UseSitemap:           *useSitemap,
+		KeepFragments:        *keepFragments,
+		DedupeEdges:          *dedupeEdges,
+		MaxDedupeEdges:       *maxDedupeEdges,
+		EdgeCounts:           *edgeCounts,
+		KeepTrailingSlash:    *keepTrailingSlash,
+		MaxURLLength:         *maxURLLength,
+		MaxPathSegments:      *maxPathSegments,
+		MaxRepeatedSegments:  *maxRepeatedSegments,
+		MaxDepth:             *maxDepth,
+		MaxPages:             *maxPages,
+		MaxDuration:          *maxDuration,
+		PageDeadline:         *pageDeadline,
+		MaxParseTime:         *maxParseTime,
+		MaxLinksPerPage:      *maxLinksPerPage,
+		MaxAttributeLength:   *maxAttributeLength,
+		IncludeTemplates:     *includeTemplates,
+		SkipNoscript:         *skipNoscript,
+		HashNormalizeSpace:   *hashNormalizeSpace,
+		MaxDuplicatePages:    *maxDuplicatePages,
+		Delay:                *delay,
+		OverrideCrawlDelay:   *overrideCrawlDelay,
+		MaxCrawlDelay:        *maxCrawlDelay,
+		Order:                *order,
+		Rate:                 *requestRate,
+		PatternBudgets:       budgets,
+		DirBudgets:           dirBudgetsMap,
+		RespectNofollow:      *respectNofollow,
+		RespectRobotsMeta:    *respectRobotsMeta,
+		OnlyLang:             *onlyLang,
+		SessionParams:        splitList(*sessionParams),
+		DenylistFile:         *denylistFile,
+		IgnoreRobots:         *ignoreRobots,
+		IncrementalStateFile: *incremental,
+		SQLiteOutputFile:     *outputSQLite,
+	}
+
+	if *csvPages != "" {
+		f, err := os.Create(*csvPages)
+		if err != nil {
+			log.Fatalf("Can't create CSV pages file: %s", err.Error())
+		}
+		defer f.Close()
+		c.CSVPagesWriter = f
+	}
+	if *visitedDB != "" && *bloomExpected != 0 {
+		log.Fatal("-visited-db and -bloom-expected-urls can't be used together")
+	}
+	if *visitedDB != "" {
+		store, err := crawler.NewBoltVisitedStore(*visitedDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.VisitedStore = store
+	}
+	if *bloomExpected != 0 {
+		store, err := crawler.NewBloomVisitedStore(*bloomExpected, *bloomFPRate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.VisitedStore = store
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handleSignals(cancel)
+
+	if *dryRun {
+		report, err := c.DryRun(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := report.Write(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	start := time.Now()
-	err := c.Run()
-	if err != nil {
+	err := c.RunContext(ctx)
+	interrupted := err == context.Canceled
+	if c.VisitedStore != nil {
+		if closeErr := c.VisitedStore.Close(); closeErr != nil {
+			log.Error(closeErr)
+		}
+	}
+	if err != nil && !interrupted {
+		if errors.Is(err, crawler.ErrSeedFetchFailed) {
+			log.Error(err)
+			os.Exit(exitCodeSeedFailed)
+		}
 		log.Fatal(err)
 	}
 	log.Infof("Crawling took %v", time.Since(start))
+	log.Infof("Crawl summary:\n%s", c.Stats())
+
+	if *skippedReport != "" {
+		writeReport(*skippedReport, c.WriteSkippedReport)
+	}
+	if *brokenLinksReport != "" {
+		writeReport(*brokenLinksReport, c.WriteBrokenLinksReport)
+	}
+	if *externalLinksReport != "" {
+		writeReport(*externalLinksReport, c.WriteExternalLinksReport)
+	}
+	if *redirectsReport != "" {
+		writeReport(*redirectsReport, c.WriteRedirectsReport)
+	}
+	if *depthReport != "" {
+		writeReport(*depthReport, c.WriteDepthReport)
+	}
+	if *titleReport != "" {
+		writeReport(*titleReport, c.WriteTitleReport)
+	}
+	if *feedReport != "" {
+		writeReport(*feedReport, c.WriteFeedReport)
+	}
+	if *mixedContentReport != "" {
+		writeReport(*mixedContentReport, c.WriteMixedContentReport)
+	}
+	if *externalDomainsReport != "" {
+		writeReport(*externalDomainsReport, c.WriteExternalDomainsReport)
+	}
+	if *duplicatesReport != "" {
+		writeReport(*duplicatesReport, c.WriteDuplicatesReport)
+	}
+	if *incrementalReport != "" {
+		writeReport(*incrementalReport, c.WriteIncrementalReport)
+	}
+	if interrupted {
+		os.Exit(exitCodeInterrupted)
+	}
+	if code := failOn.exitCode(c.Stats()); code != 0 {
+		os.Exit(code)
+	}
+}
+
+// diff writes the differences between two crawls written with -format
+// ndjson: "diff [-format text|json] OLD NEW".
+func diff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	format := flags.String("format", "text", `Format of the differences: "text" or "json".`)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [flags] OLD_NDJSON NEW_NDJSON\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		flags.PrintDefaults()
+		os.Exit(1)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 || (*format != "text" && *format != "json") {
+		flags.Usage()
+	}
+	oldFile, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Can't open crawl: %s", err.Error())
+	}
+	defer oldFile.Close()
+	newFile, err := os.Open(flags.Arg(1))
+	if err != nil {
+		log.Fatalf("Can't open crawl: %s", err.Error())
+	}
+	defer newFile.Close()
+	d, err := crawler.DiffCrawls(oldFile, newFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(d)
+	} else {
+		err = d.WriteText(os.Stdout)
+	}
+	if err != nil {
+		log.Fatalf("Can't write diff: %s", err.Error())
+	}
+}
+
+// handleSignals cancels the crawl on the first SIGINT or SIGTERM so the
+// partial site map is written, and exits right away on the second one.
+func handleSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Warnf("Received %s: stopping crawl. Send it again to exit immediately.", sig)
+	cancel()
+	sig = <-signals
+	log.Warnf("Received %s again: exiting", sig)
+	os.Exit(exitCodeInterrupted)
+}
+
+// readSeeds reads the seed URLs from the given file, or stdin if it's "-".
+func readSeeds(path string) []string {
+	r := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Can't open seeds file: %s", err.Error())
+		}
+		defer f.Close()
+		r = f
+	}
+	seeds, err := crawler.ReadSeeds(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(seeds) == 0 {
+		log.Fatalf("No seed URLs in %q", path)
+	}
+	return seeds
+}
+
+// writeReport creates the given file and writes a report into it.
+func writeReport(path string, write func(io.Writer) error) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("Can't create report file: %s", err.Error())
+	}
+	defer f.Close()
+	if err := write(f); err != nil {
+		log.Fatalf("Can't write report file %q: %s", path, err.Error())
+	}
+}
+
+// outputFlags holds the repeated -output flags.
+type outputFlags []crawler.OutputConfig
+
+func (o *outputFlags) String() string {
+	var outputs []string
+	for _, output := range *o {
+		outputs = append(outputs, output.Format+"="+output.File)
+	}
+	return strings.Join(outputs, ",")
+}
+
+// Set adds a "format=path" output, writing to the standard output if the
+// path is "-".
+func (o *outputFlags) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("%q is not format=path", value)
+	}
+	output := crawler.OutputConfig{Format: value[:i], File: value[i+1:]}
+	if output.File == "-" {
+		output.Writer = os.Stdout
+	}
+	*o = append(*o, output)
+	return nil
+}
+
+// failOnFlags holds the conditions of the repeated -fail-on flags.
+type failOnFlags []failCondition
+
+// failCondition is met when the metric of the crawl is over the threshold.
+type failCondition struct {
+	metric    string
+	threshold int
+}
+
+func (f failCondition) String() string {
+	return fmt.Sprintf("%s>%d", f.metric, f.threshold)
+}
+
+// value returns the metric of the crawl.
+func (f failCondition) value(stats crawler.Stats) int {
+	switch f.metric {
+	case "broken-internal":
+		return stats.BrokenInternal
+	case "broken-external":
+		return stats.BrokenExternal
+	case "pages-failed":
+		return stats.PagesFailed
+	default:
+		return stats.RedirectLoops
+	}
+}
+
+func (f *failOnFlags) String() string {
+	var conditions []string
+	for _, condition := range *f {
+		conditions = append(conditions, condition.String())
+	}
+	return strings.Join(conditions, ",")
+}
+
+// Set adds the comma separated "metric>N" or "metric>=N" conditions.
+func (f *failOnFlags) Set(value string) error {
+	for _, item := range splitList(value) {
+		i := strings.Index(item, ">")
+		if i <= 0 {
+			return fmt.Errorf("%q is not metric>N or metric>=N", item)
+		}
+		condition := failCondition{metric: strings.TrimSpace(item[:i])}
+		switch condition.metric {
+		case "broken-internal", "broken-external", "pages-failed", "redirect-loops":
+		default:
+			return fmt.Errorf("unknown metric %q: it must be broken-internal, broken-external, pages-failed or redirect-loops", condition.metric)
+		}
+		number, orEqual := item[i+1:], false
+		if strings.HasPrefix(number, "=") {
+			number, orEqual = number[1:], true
+		}
+		threshold, err := strconv.Atoi(strings.TrimSpace(number))
+		if err != nil || threshold < 0 {
+			return fmt.Errorf("%q is not metric>N or metric>=N", item)
+		}
+		if orEqual {
+			threshold--
+		}
+		condition.threshold = threshold
+		*f = append(*f, condition)
+	}
+	return nil
+}
+
+// exitCode returns the exit code of the crawl: exitCodeSeedFailed if a seed
+// could not be crawled, exitCodeFailOn if a condition is met or zero.
+func (f failOnFlags) exitCode(stats crawler.Stats) int {
+	if stats.SeedsFailed > 0 {
+		log.Errorf("Failing: %d seeds could not be crawled", stats.SeedsFailed)
+		return exitCodeSeedFailed
+	}
+	for _, condition := range f {
+		if value := condition.value(stats); value > condition.threshold {
+			log.Errorf("Failing: %s is %d (-fail-on %s)", condition.metric, value, condition)
+			return exitCodeFailOn
+		}
+	}
+	return 0
+}
+
+// splitList splits a comma separated flag value, ignoring empty items.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func usage() {
-	const msg string = "Usage: %s [flags] SEED_URL\n"
-	fmt.Fprintf(os.Stderr, msg, os.Args[0])
+	const msg string = "Usage: %s [flags] SEED_URL\n       %s [flags] -seeds-file FILE [SEED_URL]\n       %s diff [flags] OLD_NDJSON NEW_NDJSON\n"
+	fmt.Fprintf(os.Stderr, msg, os.Args[0], os.Args[0], os.Args[0])
 	fmt.Fprintf(os.Stderr, "\nFlags:\n")
 	flag.PrintDefaults()
 	os.Exit(1)
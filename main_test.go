@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/scanterog/crawler/crawler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailOnFlagsSet(t *testing.T) {
+	var failOn failOnFlags
+	assert.NoError(t, failOn.Set("broken-internal>0"))
+	assert.NoError(t, failOn.Set("broken-external >= 3, pages-failed>10,redirect-loops>0"))
+	assert.Equal(t, failOnFlags{
+		{metric: "broken-internal", threshold: 0},
+		{metric: "broken-external", threshold: 2},
+		{metric: "pages-failed", threshold: 10},
+		{metric: "redirect-loops", threshold: 0},
+	}, failOn)
+	assert.Equal(t, "broken-internal>0,broken-external>2,pages-failed>10,redirect-loops>0", failOn.String())
+
+	for _, value := range []string{"broken-internal", ">0", "broken-internal>", "broken-internal>-1", "broken-internal<1", "broken>0"} {
+		assert.Error(t, (&failOnFlags{}).Set(value), value)
+	}
+}
+
+func TestFailOnFlagsExitCode(t *testing.T) {
+	failOn := failOnFlags{{metric: "broken-internal", threshold: 0}, {metric: "pages-failed", threshold: 5}}
+	tests := []struct {
+		name   string
+		failOn failOnFlags
+		stats  crawler.Stats
+		code   int
+	}{
+		{name: "Fine", failOn: failOn, stats: crawler.Stats{PagesFetched: 10, PagesFailed: 5}, code: 0},
+		{name: "Broken internal links", failOn: failOn, stats: crawler.Stats{BrokenInternal: 1, PagesFailed: 1}, code: exitCodeFailOn},
+		{name: "Threshold exceeded", failOn: failOn, stats: crawler.Stats{PagesFailed: 6}, code: exitCodeFailOn},
+		{name: "Metric not in the conditions", failOn: failOn, stats: crawler.Stats{BrokenExternal: 4, RedirectLoops: 2}, code: 0},
+		{name: "Seed failed", failOn: failOn, stats: crawler.Stats{SeedsFailed: 1, BrokenInternal: 1, PagesFailed: 2}, code: exitCodeSeedFailed},
+		{name: "Without conditions", stats: crawler.Stats{SeedsFailed: 1, BrokenInternal: 1}, code: exitCodeSeedFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.code, test.failOn.exitCode(test.stats))
+		})
+	}
+}